@@ -0,0 +1,207 @@
+// File batch.go contains code for the batch methods, which save, find, or
+// delete many models at once in chunks.
+
+package kvmodel
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// SaveMany saves all the given models, which must be a slice or array of
+// models of the registered type (or a pointer to one). Instead of using a
+// separate transaction for each model, SaveMany sends the models in chunks,
+// each of which is sent to Redis in a single transaction. The size of the
+// chunks is determined by the BatchSize property of the PoolOptions. Since
+// each chunk is a separate transaction, SaveMany is not atomic if there is
+// more than one chunk.
+//
+// SaveMany does not stop at the first error. If any of the models could not be
+// saved (e.g. because it was nil or the wrong type), it returns a BatchError
+// which maps the index of each of those models to its error. If an entire
+// chunk fails (e.g. because the connection was lost), the error is reported
+// for each model in that chunk.
+func (c *Collection) SaveMany(models interface{}) error {
+	modelsVal, err := c.batchModelsValue("SaveMany", models)
+	if err != nil {
+		return err
+	}
+	return c.execBatch("SaveMany", modelsVal.Len(), func(t *Transaction, i int) {
+		model, ok := modelsVal.Index(i).Interface().(Model)
+		if !ok || reflect.ValueOf(model).IsNil() {
+			t.setError(fmt.Errorf("zoom: error in SaveMany: model at index %d was nil", i))
+			return
+		}
+		t.Save(c, model)
+	})
+}
+
+// FindMany finds the models with the given ids and scans their values into
+// models, which must be a pointer to a slice of models of the registered type.
+// FindMany will grow or shrink models as needed so that models[i] is the model
+// with id ids[i], reusing any existing non-nil models in the slice. Like
+// SaveMany, FindMany sends the ids to Redis in chunks and does not stop at the
+// first error.
+//
+// If any of the models could not be found, models[i] will be nil for each
+// missing id and FindMany will return a BatchError which maps each of those
+// indexes to a ModelNotFoundError. The same is true for models which could not
+// be scanned for any other reason.
+func (c *Collection) FindMany(ids []string, models interface{}) error {
+	if err := c.checkModelsType(models); err != nil {
+		return fmt.Errorf("zoom: error in FindMany: %s", err.Error())
+	}
+	modelsVal := reflect.ValueOf(models).Elem()
+	if modelsVal.Kind() != reflect.Slice {
+		return fmt.Errorf("zoom: error in FindMany: models should be a pointer to a slice of models")
+	}
+	// Grow or shrink models to the same length as ids and allocate any models
+	// which are nil
+	if modelsVal.Len() != len(ids) {
+		resized := reflect.MakeSlice(modelsVal.Type(), len(ids), len(ids))
+		reflect.Copy(resized, modelsVal)
+		modelsVal.Set(resized)
+	}
+	for i := range ids {
+		if modelsVal.Index(i).IsNil() {
+			modelsVal.Index(i).Set(reflect.New(c.spec.typ.Elem()))
+		}
+	}
+	err := c.execBatch("FindMany", len(ids), func(t *Transaction, i int) {
+		t.Find(c, ids[i], modelsVal.Index(i).Interface().(Model))
+	})
+	if batchErr, ok := err.(BatchError); ok {
+		for i := range batchErr.Errors {
+			modelsVal.Index(i).Set(reflect.Zero(c.spec.typ))
+		}
+	}
+	return err
+}
+
+// DeleteMany deletes the models with the given ids and returns the number of
+// models that were deleted. Like Delete, it does not return an error for ids
+// which do not correspond to any model. Like SaveMany, DeleteMany sends the
+// ids to Redis in chunks and does not stop at the first error. If there was an
+// error for any of the ids, it returns a BatchError which maps the index of
+// each of those ids to its error.
+func (c *Collection) DeleteMany(ids []string) (int, error) {
+	deleted := make([]bool, len(ids))
+	err := c.execBatch("DeleteMany", len(ids), func(t *Transaction, i int) {
+		t.Delete(c, ids[i], &deleted[i])
+	})
+	count := 0
+	for _, wasDeleted := range deleted {
+		if wasDeleted {
+			count++
+		}
+	}
+	return count, err
+}
+
+// batchModelsValue returns the reflect.Value for models, which must be a slice
+// or array of models or a pointer to one.
+func (c *Collection) batchModelsValue(methodName string, models interface{}) (reflect.Value, error) {
+	if c == nil {
+		return reflect.Value{}, newNilCollectionError(methodName)
+	}
+	modelsVal := reflect.Indirect(reflect.ValueOf(models))
+	if !modelsVal.IsValid() || !typeIsSliceOrArray(modelsVal.Type()) || !modelsVal.Type().Elem().Implements(reflect.TypeOf((*Model)(nil)).Elem()) {
+		return reflect.Value{}, fmt.Errorf("zoom: error in %s: models should be a slice or array of models. Got: %T", methodName, models)
+	}
+	return modelsVal, nil
+}
+
+// execBatch calls add once for each of n items, splitting the items into
+// chunks of at most BatchSize items which are each executed in their own
+// transaction. add should add the actions for the item with the given index to
+// the transaction. Errors for each item are collected instead of stopping the
+// batch, and if there were any, execBatch returns a BatchError. Error replies
+// from Redis are attributed to the item whose action caused them, so the other
+// items in the same chunk are unaffected. Only errors which affect the entire
+// transaction (e.g. a lost connection) are reported for every item in the
+// chunk.
+func (c *Collection) execBatch(methodName string, n int, add func(t *Transaction, i int)) error {
+	if c == nil {
+		return newNilCollectionError(methodName)
+	}
+	errs := map[int]error{}
+	size := c.pool.options.BatchSize
+	if size <= 0 {
+		size = n
+	}
+	for start := 0; start < n; start += size {
+		stop := start + size
+		if stop > n {
+			stop = n
+		}
+		t := c.pool.NewTransactionWithOptions(DefaultTransactionOptions.WithCollectAllErrors(true))
+		// owners maps the index of each action in the transaction to the index
+		// of the item which added it
+		owners := []int{}
+		for i := start; i < stop; i++ {
+			t.addBatchItem(errs, i, func() {
+				add(t, i)
+			})
+			for len(owners) < len(t.actions) {
+				owners = append(owners, i)
+			}
+		}
+		err := t.Exec()
+		if txErrs, ok := err.(TransactionErrors); ok {
+			// The handlers never return errors, so each of these is an error
+			// reply for a single action
+			for _, txErr := range txErrs {
+				if i := owners[txErr.Index]; errs[i] == nil {
+					errs[i] = txErr.Err
+				}
+			}
+		} else if err != nil {
+			// The entire chunk failed
+			for i := start; i < stop; i++ {
+				if _, found := errs[i]; !found {
+					errs[i] = err
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return BatchError{
+			Method: methodName,
+			Errors: errs,
+		}
+	}
+	return nil
+}
+
+// addBatchItem calls add, which should add the actions for the item with the
+// given index to the transaction, and records any errors for the item in errs
+// instead of causing the entire transaction to fail. If add sets an error for
+// the transaction, the error is recorded and any actions it added are removed.
+// Otherwise the handlers of the new actions are wrapped so that the first
+// error returned by any of them is recorded and the handlers which follow it
+// are skipped.
+func (t *Transaction) addBatchItem(errs map[int]error, i int, add func()) {
+	numActions := len(t.actions)
+	add()
+	if t.err != nil {
+		errs[i] = t.err
+		t.err = nil
+		t.actions = t.actions[:numActions]
+		return
+	}
+	for _, a := range t.actions[numActions:] {
+		if a.handler == nil {
+			continue
+		}
+		handler := a.handler
+		a.handler = func(reply interface{}) error {
+			if _, found := errs[i]; found {
+				return nil
+			}
+			if err := handler(reply); err != nil {
+				errs[i] = err
+			}
+			return nil
+		}
+	}
+}
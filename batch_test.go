@@ -0,0 +1,146 @@
+// File batch_test.go tests the batch methods (batch.go)
+
+package kvmodel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withBatchSize sets the BatchSize option of testPool to size and returns a
+// function which restores the original value.
+func withBatchSize(size int) func() {
+	original := testPool.options.BatchSize
+	testPool.options.BatchSize = size
+	return func() {
+		testPool.options.BatchSize = original
+	}
+}
+
+func TestSaveManyFindManyDeleteMany(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	// Use a small batch size so that the models are split into several chunks
+	defer withBatchSize(3)()
+
+	models := createIndexedTestModels(10)
+	require.NoError(t, indexedTestModels.SaveMany(models))
+	count, err := indexedTestModels.Count()
+	require.NoError(t, err)
+	assert.Equal(t, len(models), count)
+	for _, model := range models {
+		expectModelExists(t, indexedTestModels, model)
+	}
+	// Pointers to slices and arrays should also work
+	array := [2]*indexedTestModel{models[0], models[1]}
+	require.NoError(t, indexedTestModels.SaveMany(&array))
+
+	// The models should be in the same order as the ids, even if there are
+	// already some models in the slice.
+	ids := []string{}
+	for i := len(models) - 1; i >= 0; i-- {
+		ids = append(ids, models[i].ModelID())
+	}
+	got := []*indexedTestModel{{}, nil}
+	require.NoError(t, indexedTestModels.FindMany(ids, &got))
+	require.Len(t, got, len(ids))
+	for i, model := range got {
+		assert.Equal(t, models[len(models)-1-i], model)
+	}
+
+	deleteIDs := []string{models[0].ModelID(), "invalid", models[1].ModelID()}
+	deleted, err := indexedTestModels.DeleteMany(deleteIDs)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	count, err = indexedTestModels.Count()
+	require.NoError(t, err)
+	assert.Equal(t, len(models)-2, count)
+	for _, model := range models[:2] {
+		expectModelDoesNotExist(t, indexedTestModels, model)
+	}
+}
+
+func TestFindManyMissing(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	defer withBatchSize(2)()
+
+	models, err := createAndSaveTestModels(3)
+	require.NoError(t, err)
+	ids := []string{models[0].ModelID(), "missing1", models[1].ModelID(), models[2].ModelID(), "missing2"}
+	got := []*testModel{}
+	err = testModels.FindMany(ids, &got)
+	require.IsType(t, BatchError{}, err)
+	batchErr := err.(BatchError)
+	assert.Len(t, batchErr.Errors, 2)
+	for _, i := range []int{1, 4} {
+		assert.IsType(t, ModelNotFoundError{}, batchErr.Errors[i])
+	}
+	assert.Equal(t, []*testModel{models[0], nil, models[1], models[2], nil}, got)
+}
+
+func TestSaveManyErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	defer withBatchSize(2)()
+
+	valid := createTestModels(2)
+	models := []Model{valid[0], nil, &indexedTestModel{}, valid[1], (*testModel)(nil)}
+	err := testModels.SaveMany(models)
+	require.IsType(t, BatchError{}, err)
+	batchErr := err.(BatchError)
+	assert.Len(t, batchErr.Errors, 3)
+	for _, i := range []int{1, 2, 4} {
+		assert.Error(t, batchErr.Errors[i], "Expected an error for the model at index %d", i)
+	}
+	// The valid models should be saved despite the errors
+	for _, model := range valid {
+		expectModelExists(t, testModels, model)
+	}
+
+	assert.Error(t, testModels.SaveMany(valid[0]), "Expected an error when models is not a slice")
+	assert.Error(t, testModels.FindMany([]string{"id"}, &[2]*testModel{}), "Expected an error when models is an array")
+}
+
+func TestBatchReplyErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	defer withBatchSize(3)()
+
+	models, err := createAndSaveTestModels(3)
+	require.NoError(t, err)
+	// Replace the hash for one of the models with a string so that any
+	// commands for it return an error reply
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, err = conn.Do("SET", testModels.ModelKey(models[1].ModelID()), "notAHash")
+	require.NoError(t, err)
+
+	// Only the model which caused the error reply should fail
+	ids := []string{models[0].ModelID(), models[1].ModelID(), models[2].ModelID()}
+	got := []*testModel{}
+	err = testModels.FindMany(ids, &got)
+	require.IsType(t, BatchError{}, err)
+	batchErr := err.(BatchError)
+	assert.Len(t, batchErr.Errors, 1)
+	assert.Error(t, batchErr.Errors[1])
+	require.Len(t, got, 3)
+	assert.Equal(t, models[0], got[0])
+	assert.Nil(t, got[1])
+	assert.Equal(t, models[2], got[2])
+
+	models[0].Int++
+	models[1].Int++
+	models[2].Int++
+	err = testModels.SaveMany(models)
+	require.IsType(t, BatchError{}, err)
+	batchErr = err.(BatchError)
+	assert.Len(t, batchErr.Errors, 1)
+	assert.Error(t, batchErr.Errors[1])
+	expectModelExists(t, testModels, models[0])
+	expectModelExists(t, testModels, models[2])
+}
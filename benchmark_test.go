@@ -303,25 +303,31 @@ func BenchmarkCount10000(b *testing.B) {
 // BenchmarkQueryFilterInt1From1 runs a query which selects 1
 // model out of 1 total, filtering by the Int field
 func BenchmarkQueryFilterInt1From1(b *testing.B) {
-	benchmarkQueryFilterInt(b, 1, 1)
+	benchmarkQueryFilterInt(b, 1, 1, false)
 }
 
 // BenchmarkQueryFilterInt1From10 runs a query which selects 1
 // model out of 10 total, filtering by the Int field
 func BenchmarkQueryFilterInt1From10(b *testing.B) {
-	benchmarkQueryFilterInt(b, 1, 10)
+	benchmarkQueryFilterInt(b, 1, 10, false)
 }
 
 // BenchmarkQueryFilterInt10From100 runs a query which selects 10
 // models out of 100 total, filtering by the Int field
 func BenchmarkQueryFilterInt10From100(b *testing.B) {
-	benchmarkQueryFilterInt(b, 10, 100)
+	benchmarkQueryFilterInt(b, 10, 100, false)
 }
 
 // BenchmarkQueryFilterInt100From1000 runs a query which selects 100
 // models out of 1000 total, filtering by the Int field
 func BenchmarkQueryFilterInt100From1000(b *testing.B) {
-	benchmarkQueryFilterInt(b, 100, 1000)
+	benchmarkQueryFilterInt(b, 100, 1000, false)
+}
+
+// BenchmarkQueryFilterInt100From1000SingleScript runs the same query as
+// BenchmarkQueryFilterInt100From1000 as a single Lua script.
+func BenchmarkQueryFilterInt100From1000SingleScript(b *testing.B) {
+	benchmarkQueryFilterInt(b, 100, 1000, true)
 }
 
 //	BenchmarkQueryFilterString1From1 runs a query which selects
@@ -418,6 +424,16 @@ func BenchmarkQueryOrderBool10000(b *testing.B) {
 // 100 should fit the query criteria, but the query limits the number of results
 // to 10.
 func BenchmarkComplexQuery(b *testing.B) {
+	benchmarkComplexQuery(b, false)
+}
+
+// BenchmarkComplexQuerySingleScript runs the same query as
+// BenchmarkComplexQuery as a single Lua script.
+func BenchmarkComplexQuerySingleScript(b *testing.B) {
+	benchmarkComplexQuery(b, true)
+}
+
+func benchmarkComplexQuery(b *testing.B, singleScript bool) {
 	testingSetUp()
 	defer testingTearDown()
 
@@ -451,6 +467,9 @@ func BenchmarkComplexQuery(b *testing.B) {
 
 	// Construct the query and benchmark it
 	q := indexedTestModels.NewQuery().Filter("Int =", 1).Filter("String =", "find me").Order("Bool").Include("Int", "Bool").Limit(10).Offset(10)
+	if singleScript {
+		q.SingleScript()
+	}
 	benchmarkQuery(b, q)
 }
 
@@ -463,7 +482,7 @@ func benchmarkQuery(b *testing.B, q *Query) {
 	}
 }
 
-func benchmarkQueryFilterInt(b *testing.B, selected int, total int) {
+func benchmarkQueryFilterInt(b *testing.B, selected int, total int, singleScript bool) {
 	testingSetUp()
 	defer testingTearDown()
 
@@ -480,7 +499,11 @@ func benchmarkQueryFilterInt(b *testing.B, selected int, total int) {
 	if err := t.Exec(); err != nil {
 		b.Fatal(err)
 	}
-	benchmarkQuery(b, indexedTestModels.NewQuery().Filter("Int =", 1))
+	q := indexedTestModels.NewQuery().Filter("Int =", 1)
+	if singleScript {
+		q.SingleScript()
+	}
+	benchmarkQuery(b, q)
 }
 
 func benchmarkQueryFilterString(b *testing.B, selected int, total int) {
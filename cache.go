@@ -0,0 +1,296 @@
+// File cache.go contains code related to the optional client-side cache for
+// collections, which serves Find and FindFields from memory.
+
+package kvmodel
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// CacheStats contains statistics about the client-side cache for a
+// collection. See CollectionOptions.CacheSize.
+type CacheStats struct {
+	// Hits is the number of calls to Find or FindFields which were served from
+	// the cache.
+	Hits uint64
+	// Misses is the number of calls to Find or FindFields which had to read
+	// the model from Redis.
+	Misses uint64
+	// Evictions is the number of models which were removed from the cache to
+	// make room for other models.
+	Evictions uint64
+	// Invalidations is the number of times a model was removed from the cache
+	// because it was changed (or the entire cache was cleared).
+	Invalidations uint64
+	// Size is the number of models which are currently in the cache.
+	Size int
+}
+
+// modelCache is a least recently used cache of the encoded field values of the
+// models in a collection, with an optional time to live.
+type modelCache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+	// version is incremented each time a model is invalidated or the cache is
+	// cleared. A value which was read from Redis is only added to the cache if
+	// the version did not change while it was being read, so that a value
+	// which was read before a change is never added after it.
+	version uint64
+	stats   CacheStats
+}
+
+// cacheEntry is an entry in a modelCache.
+type cacheEntry struct {
+	id        string
+	values    map[string][]byte
+	expiresAt time.Time
+}
+
+// newModelCache returns a new cache which holds up to size models for up to
+// ttl. If ttl is 0, models are only removed when they are evicted or
+// invalidated.
+func newModelCache(size int, ttl time.Duration) *modelCache {
+	return &modelCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// get returns the values for the model with the given id and true, or nil and
+// false if it is not in the cache (or it expired). It updates the statistics
+// accordingly.
+func (mc *modelCache) get(id string) (map[string][]byte, bool) {
+	mc.Lock()
+	defer mc.Unlock()
+	elem, found := mc.entries[id]
+	if found {
+		entry := elem.Value.(*cacheEntry)
+		if mc.ttl == 0 || time.Now().Before(entry.expiresAt) {
+			mc.lru.MoveToFront(elem)
+			mc.stats.Hits++
+			return entry.values, true
+		}
+		mc.remove(elem)
+	}
+	mc.stats.Misses++
+	return nil, false
+}
+
+// currentVersion returns the current version of the cache. It should be called
+// before a value is read from Redis and passed to add.
+func (mc *modelCache) currentVersion() uint64 {
+	mc.Lock()
+	defer mc.Unlock()
+	return mc.version
+}
+
+// add adds the values for the model with the given id to the cache, evicting
+// the least recently used model if the cache is full. It does nothing if the
+// cache was invalidated since version was returned by currentVersion.
+func (mc *modelCache) add(id string, values map[string][]byte, version uint64) {
+	mc.Lock()
+	defer mc.Unlock()
+	if mc.version != version {
+		return
+	}
+	entry := &cacheEntry{
+		id:        id,
+		values:    values,
+		expiresAt: time.Now().Add(mc.ttl),
+	}
+	if elem, found := mc.entries[id]; found {
+		elem.Value = entry
+		mc.lru.MoveToFront(elem)
+		return
+	}
+	mc.entries[id] = mc.lru.PushFront(entry)
+	for mc.lru.Len() > mc.size {
+		mc.remove(mc.lru.Back())
+		mc.stats.Evictions++
+	}
+}
+
+// invalidate removes the model with the given id from the cache.
+func (mc *modelCache) invalidate(id string) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.version++
+	if elem, found := mc.entries[id]; found {
+		mc.remove(elem)
+		mc.stats.Invalidations++
+	}
+}
+
+// clear removes all the models from the cache.
+func (mc *modelCache) clear() {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.version++
+	mc.stats.Invalidations += uint64(mc.lru.Len())
+	mc.entries = map[string]*list.Element{}
+	mc.lru.Init()
+}
+
+// remove removes elem from the cache. The caller must hold the lock.
+func (mc *modelCache) remove(elem *list.Element) {
+	delete(mc.entries, elem.Value.(*cacheEntry).id)
+	mc.lru.Remove(elem)
+}
+
+// CacheStats returns statistics about the client-side cache for the
+// collection. All the statistics are 0 if the cache is not enabled.
+func (c *Collection) CacheStats() CacheStats {
+	if c.cache == nil {
+		return CacheStats{}
+	}
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	stats := c.cache.stats
+	stats.Size = c.cache.lru.Len()
+	return stats
+}
+
+// ClearCache removes all the models from the client-side cache for the
+// collection, if it is enabled. Call it after changing the models in the
+// collection in a way that Zoom does not know about, e.g. with
+// Transaction.Command or Transaction.Script.
+func (c *Collection) ClearCache() {
+	if c.cache != nil {
+		c.cache.clear()
+	}
+}
+
+// SubscribeCacheInvalidation keeps the client-side cache for the collection
+// consistent with changes made by other processes. It subscribes to the
+// change events for the collection (see Collection.Subscribe) and removes each
+// model which was changed from the cache. The collection must have both the
+// CacheSize and the PublishChanges options set, in this process and in the
+// processes which change the models. Since events which are published while
+// the subscription is reconnecting are lost, the entire cache is cleared each
+// time it reconnects. Call Close on the returned subscription to stop it.
+//
+// Note that Redis 6 client tracking is not used, because the Redis driver
+// does not support RESP3.
+func (c *Collection) SubscribeCacheInvalidation() (*Subscription, error) {
+	if c == nil {
+		return nil, newNilCollectionError("SubscribeCacheInvalidation")
+	}
+	if c.cache == nil {
+		return nil, fmt.Errorf("zoom: error in SubscribeCacheInvalidation: the cache is not enabled for collection %s", c.Name())
+	}
+	return c.subscribe(func(ev ChangeEvent) {
+		c.cache.invalidate(ev.ID)
+	}, c.cache.clear)
+}
+
+// invalidateCache registers callbacks with the transaction which remove the
+// model with the given id from the client-side cache for c (if it is enabled)
+// after the transaction is executed. The model is removed even if the
+// transaction is rolled back, since a pipeline may have executed some of its
+// actions, and an unnecessary removal is harmless.
+func (t *Transaction) invalidateCache(c *Collection, id string) {
+	if c.cache == nil {
+		return
+	}
+	t.OnCommit(func() {
+		c.cache.invalidate(id)
+	})
+	t.OnRollback(func(error) {
+		c.cache.invalidate(id)
+	})
+}
+
+// clearCache is like invalidateCache, but removes all the models in c from the
+// cache.
+func (t *Transaction) clearCache(c *Collection) {
+	if c.cache == nil {
+		return
+	}
+	t.OnCommit(c.cache.clear)
+	t.OnRollback(func(error) {
+		c.cache.clear()
+	})
+}
+
+// findWithCache implements Collection.Find and Collection.FindFields for
+// collections with a client-side cache. If the model is in the cache, it is
+// scanned from the cached values. Otherwise all the fields of the model are
+// read from Redis and added to the cache, and only the given fields are
+// scanned into model. methodName is used in error messages.
+func (c *Collection) findWithCache(methodName string, id string, fieldNames []string, model Model) error {
+	if err := c.checkModelType(model); err != nil {
+		return fmt.Errorf("zoom: Error in %s or Transaction.%s: %s", methodName, methodName, err.Error())
+	}
+	for _, fieldName := range fieldNames {
+		if !stringSliceContains(c.spec.fieldNames(), fieldName) {
+			return fmt.Errorf("zoom: Error in %s or Transaction.%s: Collection %s does not have field named %s", methodName, methodName, c.Name(), fieldName)
+		}
+	}
+	model.SetModelID(id)
+	mr := &modelRef{
+		collection: c,
+		model:      model,
+		spec:       c.spec,
+	}
+	if values, found := c.cache.get(id); found {
+		return scanCachedValues(fieldNames, values, mr)
+	}
+	version := c.cache.currentVersion()
+	allFieldNames := c.spec.fieldNames()
+	t := c.pool.NewTransaction()
+	t.Command("EXISTS", redis.Args{mr.key()}, newModelExistsHandler(c, id))
+	args := redis.Args{mr.key()}
+	for _, redisName := range c.spec.fieldRedisNames() {
+		args = append(args, redisName)
+	}
+	t.Command("HMGET", args, func(reply interface{}) error {
+		fieldValues, err := redis.Values(reply, nil)
+		if err != nil {
+			if err == redis.ErrNil {
+				return newModelNotFoundError(mr)
+			}
+			return err
+		}
+		values := map[string][]byte{}
+		for i, fieldValue := range fieldValues {
+			if fieldValue == nil {
+				continue
+			}
+			value, err := redis.Bytes(fieldValue, nil)
+			if err != nil {
+				return err
+			}
+			values[allFieldNames[i]] = value
+		}
+		c.cache.add(id, values, version)
+		return scanCachedValues(fieldNames, values, mr)
+	})
+	return t.Exec()
+}
+
+// scanCachedValues scans the cached values for the given fields into the
+// model. The values are copied, so the model never shares memory with the
+// cache.
+func scanCachedValues(fieldNames []string, values map[string][]byte, mr *modelRef) error {
+	fieldValues := make([]interface{}, len(fieldNames))
+	for i, fieldName := range fieldNames {
+		if value, found := values[fieldName]; found {
+			fieldValues[i] = append([]byte{}, value...)
+		}
+	}
+	if len(fieldValues) == 0 {
+		// The model exists, but there are no fields to scan
+		return nil
+	}
+	return scanModel(fieldNames, fieldValues, mr)
+}
@@ -0,0 +1,230 @@
+// File cache_test.go tests the client-side cache for collections (cache.go)
+
+package kvmodel
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cacheTestModel is a model type that is used for testing the cache
+type cacheTestModel struct {
+	Int    int `zoom:"index"`
+	String string
+	Bytes  []byte
+	RandomID
+}
+
+var (
+	cacheTestModels     *Collection
+	cacheTestModelsOnce sync.Once
+)
+
+// getCacheTestModels returns a collection of cacheTestModels with a cache
+// that holds up to 2 models and the PublishChanges option set. The cache is
+// cleared and the statistics are reset.
+func getCacheTestModels(t *testing.T) *Collection {
+	cacheTestModelsOnce.Do(func() {
+		options := DefaultCollectionOptions.WithIndex(true).WithCacheSize(2).WithPublishChanges(true)
+		var err error
+		cacheTestModels, err = testPool.NewCollectionWithOptions(&cacheTestModel{}, options)
+		require.NoError(t, err)
+	})
+	cacheTestModels.cache = newModelCache(2, 0)
+	return cacheTestModels
+}
+
+func TestCacheFind(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	collection := getCacheTestModels(t)
+
+	model := &cacheTestModel{Int: 42, String: "foo", Bytes: []byte("bar")}
+	require.NoError(t, collection.Save(model))
+	for i := 0; i < 3; i++ {
+		got := &cacheTestModel{}
+		require.NoError(t, collection.Find(model.ID, got))
+		assert.Equal(t, model, got)
+		// Mutating the model should not affect the cache
+		got.Bytes[0] = 'x'
+	}
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1, Size: 1}, collection.CacheStats())
+
+	// FindFields should be served from the cache and only set the given fields
+	got := &cacheTestModel{}
+	require.NoError(t, collection.FindFields(model.ID, []string{"String"}, got))
+	assert.Equal(t, &cacheTestModel{String: "foo", RandomID: model.RandomID}, got)
+	assert.Equal(t, uint64(3), collection.CacheStats().Hits)
+	assert.Error(t, collection.FindFields(model.ID, []string{"Invalid"}, got))
+
+	// Models which do not exist should not be cached
+	assert.IsType(t, ModelNotFoundError{}, collection.Find("does-not-exist", &cacheTestModel{}))
+	assert.IsType(t, ModelNotFoundError{}, collection.Find("does-not-exist", &cacheTestModel{}))
+	assert.Equal(t, 1, collection.CacheStats().Size)
+
+	// Changes made without Zoom's knowledge are not seen until the cache is
+	// cleared
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, err := conn.Do("HSET", collection.ModelKey(model.ID), "String", "changed")
+	require.NoError(t, err)
+	require.NoError(t, collection.Find(model.ID, got))
+	assert.Equal(t, "foo", got.String)
+	collection.ClearCache()
+	require.NoError(t, collection.Find(model.ID, got))
+	assert.Equal(t, "changed", got.String)
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	collection := getCacheTestModels(t)
+
+	model := &cacheTestModel{Int: 1, String: "foo"}
+	require.NoError(t, collection.Save(model))
+	require.NoError(t, collection.Find(model.ID, &cacheTestModel{}))
+
+	// Save, SaveFields, and Delete should remove the model from the cache
+	model.String = "bar"
+	require.NoError(t, collection.Save(model))
+	got := &cacheTestModel{}
+	require.NoError(t, collection.Find(model.ID, got))
+	assert.Equal(t, "bar", got.String)
+	model.Int = 2
+	require.NoError(t, collection.SaveFields([]string{"Int"}, model))
+	require.NoError(t, collection.Find(model.ID, got))
+	assert.Equal(t, 2, got.Int)
+	_, err := collection.Delete(model.ID)
+	require.NoError(t, err)
+	assert.IsType(t, ModelNotFoundError{}, collection.Find(model.ID, got))
+
+	// Query.Update should clear the cache
+	require.NoError(t, collection.Save(model))
+	require.NoError(t, collection.Find(model.ID, got))
+	_, err = collection.NewQuery().Update(map[string]interface{}{"String": "updated"})
+	require.NoError(t, err)
+	require.NoError(t, collection.Find(model.ID, got))
+	assert.Equal(t, "updated", got.String)
+
+	// A change in a transaction which is rolled back should not change the
+	// cached model
+	tx := testPool.NewTransaction()
+	model.String = "rolled back"
+	tx.Save(collection, model)
+	tx.setError(assert.AnError)
+	require.Error(t, tx.Exec())
+	require.NoError(t, collection.Find(model.ID, got))
+	assert.Equal(t, "updated", got.String)
+
+	// DeleteAll should clear the cache
+	_, err = collection.DeleteAll()
+	require.NoError(t, err)
+	assert.Equal(t, 0, collection.CacheStats().Size)
+	assert.True(t, collection.CacheStats().Invalidations > 0)
+}
+
+func TestCacheEviction(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	collection := getCacheTestModels(t)
+
+	models := []*cacheTestModel{{Int: 1}, {Int: 2}, {Int: 3}}
+	for _, model := range models {
+		require.NoError(t, collection.Save(model))
+		require.NoError(t, collection.Find(model.ID, &cacheTestModel{}))
+	}
+	stats := collection.CacheStats()
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, 2, stats.Size)
+	// The least recently used model should have been evicted
+	require.NoError(t, collection.Find(models[0].ID, &cacheTestModel{}))
+	assert.Equal(t, stats.Misses+1, collection.CacheStats().Misses)
+
+	// Models should expire after the ttl
+	collection.cache = newModelCache(2, 10*time.Millisecond)
+	require.NoError(t, collection.Find(models[0].ID, &cacheTestModel{}))
+	require.NoError(t, collection.Find(models[0].ID, &cacheTestModel{}))
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, collection.Find(models[0].ID, &cacheTestModel{}))
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 2, Size: 1}, collection.CacheStats())
+}
+
+func TestSubscribeCacheInvalidation(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	collection := getCacheTestModels(t)
+
+	s, err := collection.SubscribeCacheInvalidation()
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+	model := &cacheTestModel{Int: 1, String: "foo"}
+	require.NoError(t, collection.Save(model))
+	require.NoError(t, collection.Find(model.ID, &cacheTestModel{}))
+	// Simulate a change by another process by publishing an event without
+	// invalidating the local cache
+	tx := testPool.NewTransaction()
+	tx.publishChangeEvent(collection, ChangeEvent{Collection: collection.Name(), ID: model.ID, Operation: ChangeSave})
+	require.NoError(t, tx.Exec())
+	deadline := time.Now().Add(time.Second)
+	for collection.CacheStats().Size != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Model was not removed from the cache")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Collections without a cache should return an error
+	_, err = testModels.SubscribeCacheInvalidation()
+	assert.Error(t, err)
+}
+
+func TestSubscribeCacheInvalidationQuery(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	collection := getCacheTestModels(t)
+
+	s, err := collection.SubscribeCacheInvalidation()
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+	models := []*cacheTestModel{{Int: 1}, {Int: 2}}
+	for _, model := range models {
+		require.NoError(t, collection.Save(model))
+	}
+	other := newOtherProcessCollection(t, &cacheTestModel{}, DefaultCollectionOptions.WithIndex(true).WithPublishChanges(true))
+	expectInvalidated := func() {
+		deadline := time.Now().Add(time.Second)
+		for collection.CacheStats().Size != 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("Model was not removed from the cache")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Query.Update in another process should remove the model from the cache
+	require.NoError(t, collection.Find(models[0].ID, &cacheTestModel{}))
+	_, err = other.NewQuery().Filter("Int =", 1).Update(map[string]interface{}{"String": "updated"})
+	require.NoError(t, err)
+	expectInvalidated()
+	got := &cacheTestModel{}
+	require.NoError(t, collection.Find(models[0].ID, got))
+	assert.Equal(t, "updated", got.String)
+
+	// Query.Delete in another process should remove the model from the cache
+	require.NoError(t, collection.Find(models[1].ID, &cacheTestModel{}))
+	collection.cache.invalidate(models[0].ID)
+	_, err = other.NewQuery().Filter("Int =", 2).Delete()
+	require.NoError(t, err)
+	expectInvalidated()
+	assert.IsType(t, ModelNotFoundError{}, collection.Find(models[1].ID, &cacheTestModel{}))
+}
@@ -0,0 +1,99 @@
+// File callbacks.go contains code related to callbacks, which are run after a
+// transaction is committed or rolled back, and to the save and delete hooks for
+// collections, which can register them.
+
+package kvmodel
+
+import "sync"
+
+// OnCommit registers a function which will be called by Exec after the
+// transaction has been committed, i.e. after Redis has executed the actions in
+// the transaction. This is the place for side effects which should only happen
+// if the transaction succeeded, such as busting a cache or enqueueing a job.
+//
+// Note that Redis does not roll back a transaction if one of the commands in it
+// fails at runtime, so a transaction is considered committed even if Exec
+// returns an error from one of the replies or handlers (e.g. a
+// ModelNotFoundError). Functions registered with OnCommit are called in the
+// order they were registered, after all the handlers have been called.
+func (t *Transaction) OnCommit(f func()) {
+	t.onCommit = append(t.onCommit, f)
+}
+
+// OnRollback registers a function which will be called by Exec if the
+// transaction was not committed, with the error that Exec returns. That
+// includes a WatchError if one of the watched keys was changed, a LockError if
+// a required lock is no longer held, problems with the connection, and any
+// error encountered while adding actions to the transaction. Functions
+// registered with OnRollback are called in the order they were registered.
+//
+// Neither the OnCommit nor the OnRollback functions are called when the
+// transaction is executed with the DryRun option.
+func (t *Transaction) OnRollback(f func(err error)) {
+	t.onRollback = append(t.onRollback, f)
+}
+
+// runCallbacks calls the OnCommit functions if committed is true, or the
+// OnRollback functions if err is not nil.
+func (t *Transaction) runCallbacks(committed bool, err error) {
+	if committed {
+		for _, f := range t.onCommit {
+			f()
+		}
+	} else if err != nil {
+		for _, f := range t.onRollback {
+			f(err)
+		}
+	}
+}
+
+// collectionHooks holds the save and delete hooks for a collection.
+type collectionHooks struct {
+	sync.RWMutex
+	save   []func(t *Transaction, model Model)
+	delete []func(t *Transaction, id string)
+}
+
+// OnSave registers a hook which is called each time Save or SaveFields adds the
+// actions for saving a model in the collection to a transaction, including
+// through Collection.Save and Collection.SaveFields. The hook receives the
+// transaction, so it can register callbacks with OnCommit or OnRollback, e.g.
+// to enqueue a job only once the model has actually been saved.
+func (c *Collection) OnSave(hook func(t *Transaction, model Model)) {
+	c.hooks.Lock()
+	c.hooks.save = append(c.hooks.save, hook)
+	c.hooks.Unlock()
+}
+
+// OnDelete registers a hook which is called each time Delete adds the actions
+// for deleting a model in the collection to a transaction, including through
+// Collection.Delete. See OnSave for more information. OnDelete hooks are not
+// called by DeleteAll or Query.Delete, since the ids of the deleted models are
+// not known until the transaction is executed.
+func (c *Collection) OnDelete(hook func(t *Transaction, id string)) {
+	c.hooks.Lock()
+	c.hooks.delete = append(c.hooks.delete, hook)
+	c.hooks.Unlock()
+}
+
+// runSaveHooks calls the save hooks for the collection c with the transaction
+// and the model.
+func (t *Transaction) runSaveHooks(c *Collection, model Model) {
+	c.hooks.RLock()
+	hooks := c.hooks.save
+	c.hooks.RUnlock()
+	for _, hook := range hooks {
+		hook(t, model)
+	}
+}
+
+// runDeleteHooks calls the delete hooks for the collection c with the
+// transaction and the id of the deleted model.
+func (t *Transaction) runDeleteHooks(c *Collection, id string) {
+	c.hooks.RLock()
+	hooks := c.hooks.delete
+	c.hooks.RUnlock()
+	for _, hook := range hooks {
+		hook(t, id)
+	}
+}
@@ -0,0 +1,158 @@
+// File callbacks_test.go tests the transaction callbacks and collection hooks
+// (callbacks.go)
+
+package kvmodel
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnCommit(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	calls := []string{}
+	model := createTestModels(1)[0]
+	tx := testPool.NewTransaction()
+	tx.Save(testModels, model)
+	tx.OnCommit(func() {
+		// The model should already have been saved when the callback is called
+		expectModelExists(t, testModels, model)
+		calls = append(calls, "commit1")
+	})
+	tx.OnCommit(func() {
+		calls = append(calls, "commit2")
+	})
+	tx.OnRollback(func(err error) {
+		calls = append(calls, "rollback")
+	})
+	require.NoError(t, tx.Exec())
+	assert.Equal(t, []string{"commit1", "commit2"}, calls)
+
+	// A transaction with an error from a handler is still committed
+	calls = []string{}
+	tx = testPool.NewTransaction()
+	tx.Find(testModels, "does-not-exist", &testModel{})
+	tx.OnCommit(func() {
+		calls = append(calls, "commit")
+	})
+	tx.OnRollback(func(err error) {
+		calls = append(calls, "rollback")
+	})
+	assert.IsType(t, ModelNotFoundError{}, tx.Exec())
+	assert.Equal(t, []string{"commit"}, calls)
+}
+
+func TestOnRollback(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Cause a WatchError by changing a watched model
+	model := createTestModels(1)[0]
+	require.NoError(t, testModels.Save(model))
+	tx := testPool.NewTransaction()
+	require.NoError(t, tx.Watch(model))
+	require.NoError(t, testModels.Save(model))
+	tx.Command("HSET", redis.Args{testModels.ModelKey(model.ID), "Int", 35}, nil)
+	committed := false
+	var rollbackErr error
+	tx.OnCommit(func() {
+		committed = true
+	})
+	tx.OnRollback(func(err error) {
+		rollbackErr = err
+	})
+	err := tx.Exec()
+	assert.IsType(t, WatchError{}, err)
+	assert.False(t, committed)
+	assert.Equal(t, err, rollbackErr)
+
+	// An error encountered while adding actions also causes a rollback
+	tx = testPool.NewTransaction()
+	tx.Save(nil, model)
+	rollbackErr = nil
+	tx.OnRollback(func(err error) {
+		rollbackErr = err
+	})
+	err = tx.Exec()
+	require.Error(t, err)
+	assert.Equal(t, err, rollbackErr)
+
+	// Neither callback is called in a dry run
+	tx = testPool.NewTransactionWithOptions(DefaultTransactionOptions.WithDryRun(true))
+	tx.Save(testModels, model)
+	tx.OnCommit(func() {
+		t.Error("OnCommit callback was called in a dry run")
+	})
+	tx.OnRollback(func(err error) {
+		t.Error("OnRollback callback was called in a dry run")
+	})
+	require.NoError(t, tx.Exec())
+}
+
+func TestPipelineCallbacks(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	committed := false
+	p := testPool.NewPipeline()
+	p.Save(testModels, createTestModels(1)[0])
+	p.Find(testModels, "does-not-exist", &testModel{})
+	p.OnCommit(func() {
+		committed = true
+	})
+	p.OnRollback(func(err error) {
+		t.Errorf("OnRollback callback was called: %s", err)
+	})
+	assert.IsType(t, BatchError{}, p.Exec())
+	assert.True(t, committed)
+}
+
+// hookTestModel is a model type that is used for testing collection hooks
+type hookTestModel struct {
+	Int int
+	RandomID
+}
+
+func TestCollectionHooks(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	options := DefaultCollectionOptions.WithIndex(true)
+	hookTestModels, err := testPool.NewCollectionWithOptions(&hookTestModel{}, options)
+	require.NoError(t, err)
+	saved := []string{}
+	deleted := []string{}
+	hookTestModels.OnSave(func(tx *Transaction, model Model) {
+		tx.OnCommit(func() {
+			saved = append(saved, model.ModelID())
+		})
+	})
+	hookTestModels.OnDelete(func(tx *Transaction, id string) {
+		tx.OnCommit(func() {
+			deleted = append(deleted, id)
+		})
+	})
+
+	models := []*hookTestModel{{Int: 1}, {Int: 2}}
+	require.NoError(t, hookTestModels.Save(models[0]))
+	require.NoError(t, hookTestModels.SaveFields([]string{"Int"}, models[1]))
+	assert.Equal(t, []string{models[0].ID, models[1].ID}, saved)
+	_, err = hookTestModels.Delete(models[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[0].ID}, deleted)
+
+	// The callbacks registered by the hooks should not be called if the
+	// transaction is rolled back
+	saved = []string{}
+	tx := testPool.NewTransaction()
+	tx.Save(hookTestModels, models[0])
+	tx.setError(errors.New("test error"))
+	require.Error(t, tx.Exec())
+	assert.Empty(t, saved)
+}
@@ -0,0 +1,400 @@
+// File changes.go contains code related to change data capture, in which
+// changes to models are added to a Redis stream as change events (or published
+// to subscribers) so that other services can react to them.
+
+package kvmodel
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ChangeOperation is the kind of change described by a ChangeEvent.
+type ChangeOperation string
+
+const (
+	// ChangeSave means that the model was saved with Save or SaveFields, or
+	// updated with Query.Update.
+	ChangeSave ChangeOperation = "save"
+	// ChangeDelete means that the model was deleted with Delete, DeleteAll, or
+	// Query.Delete.
+	ChangeDelete ChangeOperation = "delete"
+)
+
+// ChangeEvent describes a change to a single model.
+type ChangeEvent struct {
+	// StreamID is the id of the entry in the change stream, e.g.
+	// "1526919030474-0". It is empty for events received with a Subscription.
+	StreamID string
+	// Collection is the name of the collection that the model belongs to.
+	Collection string
+	// ID is the id of the model that was changed.
+	ID string
+	// Operation is the kind of change.
+	Operation ChangeOperation
+	// Fields are the names of the fields that were saved, as they appear in
+	// the struct definition. It is empty for deletes.
+	Fields []string
+	// Values maps the names of the fields that were saved to their new values,
+	// encoded the same way as in the main hash for the model. It is nil unless
+	// the ChangeStreamValues option was set for the collection.
+	Values     map[string][]byte
+	collection *Collection
+}
+
+// changeStreamOptions contains the options related to the change stream for a
+// collection.
+type changeStreamOptions struct {
+	enabled bool
+	publish bool
+	values  bool
+	maxLen  int
+}
+
+// ChangeStreamKey returns the key for the stream in Redis which holds the
+// change events for the collection. It is only used if the ChangeStream option
+// was set for the collection.
+func (c *Collection) ChangeStreamKey() string {
+	return c.Name() + ":changes"
+}
+
+// Decode scans the new values in the event into model, which must be a
+// pointer to a struct of the registered type corresponding to the collection
+// that the event came from. Only the fields in ev.Fields are set. It returns
+// an error if the event does not include any values, i.e. if it is a delete
+// event or the ChangeStreamValues option was not set for the collection.
+func (ev ChangeEvent) Decode(model Model) error {
+	if ev.collection == nil {
+		return fmt.Errorf("zoom: error in ChangeEvent.Decode: unknown collection %s", ev.Collection)
+	}
+	if err := ev.collection.checkModelType(model); err != nil {
+		return fmt.Errorf("zoom: error in ChangeEvent.Decode: %s", err.Error())
+	}
+	if ev.Values == nil {
+		return fmt.Errorf("zoom: error in ChangeEvent.Decode: %s event for model %s does not include values", ev.Operation, ev.ID)
+	}
+	fieldNames := []string{"-"}
+	fieldValues := []interface{}{[]byte(ev.ID)}
+	for _, fieldName := range ev.Fields {
+		if value, found := ev.Values[fieldName]; found {
+			fieldNames = append(fieldNames, fieldName)
+			fieldValues = append(fieldValues, value)
+		}
+	}
+	mr := &modelRef{
+		collection: ev.collection,
+		model:      model,
+		spec:       ev.collection.spec,
+	}
+	return scanModel(fieldNames, fieldValues, mr)
+}
+
+// changeEventArgs returns the args for an XADD command which adds a change
+// event for the model with the given id to the change stream for c. values
+// should alternate between field names and values.
+func (c *Collection) changeEventArgs(op ChangeOperation, id string, fieldNames []string, values redis.Args) redis.Args {
+	args := redis.Args{c.ChangeStreamKey()}
+	if c.changeStream.maxLen > 0 {
+		args = args.Add("MAXLEN", "~", c.changeStream.maxLen)
+	}
+	args = args.Add("*", "collection", c.Name(), "id", id, "op", string(op), "fields", strings.Join(fieldNames, ","))
+	return append(args, values...)
+}
+
+// addSaveEvent adds commands to the transaction which add a change event for
+// saving the given fields of the model to the change stream and/or publish it
+// to subscribers, according to the options for the collection.
+func (t *Transaction) addSaveEvent(mr *modelRef, fieldNames []string) {
+	c := mr.collection
+	if !c.changeStream.enabled && !c.changeStream.publish {
+		return
+	}
+	ev := ChangeEvent{
+		Collection: c.Name(),
+		ID:         mr.model.ModelID(),
+		Operation:  ChangeSave,
+		Fields:     fieldNames,
+	}
+	values := redis.Args{}
+	if c.changeStream.values {
+		hashArgs, err := mr.mainHashArgsForFields(fieldNames)
+		if err != nil {
+			t.setError(err)
+			return
+		}
+		// hashArgs consists of the key followed by pairs of redis names and
+		// values. The values in the event are identified by field names.
+		fieldNamesByRedisName := map[string]string{}
+		for _, fs := range c.spec.fields {
+			fieldNamesByRedisName[fs.redisName] = fs.name
+		}
+		ev.Values = map[string][]byte{}
+		for i := 1; i+1 < len(hashArgs); i += 2 {
+			fieldName := fieldNamesByRedisName[hashArgs[i].(string)]
+			values = append(values, "value:"+fieldName, hashArgs[i+1])
+			ev.Values[fieldName] = argBytes(hashArgs[i+1])
+		}
+	}
+	if c.changeStream.enabled {
+		t.Command("XADD", c.changeEventArgs(ChangeSave, ev.ID, fieldNames, values), nil)
+	}
+	if c.changeStream.publish {
+		t.publishChangeEvent(c, ev)
+	}
+}
+
+// addDeleteEvents adds a script to the transaction which adds a change event
+// to the change stream and/or publishes it to subscribers for each of the
+// models in the collection which are about to be deleted, according to the
+// options for the collection. The models are identified by the set, sorted set,
+// or list of ids stored at idsKey, or by ids if idsKey is empty. Events are
+// only added for models which exist.
+func (t *Transaction) addDeleteEvents(c *Collection, idsKey string, ids ...string) {
+	t.addChangeEvents(c, ChangeDelete, idsKey, nil, nil, ids...)
+}
+
+// addUpdateEvents adds a script to the transaction which adds a save event for
+// each of the models identified by idsKey, which are updated with fieldArgs by
+// Query.Update. fieldArgs is in the format expected by updateModelsByIDs.
+func (t *Transaction) addUpdateEvents(c *Collection, idsKey string, fieldArgs redis.Args) {
+	if !c.changeStream.enabled && !c.changeStream.publish {
+		return
+	}
+	fieldNamesByRedisName := map[string]string{}
+	for _, fs := range c.spec.fields {
+		fieldNamesByRedisName[fs.redisName] = fs.name
+	}
+	fieldNames := []string{}
+	var values map[string][]byte
+	if c.changeStream.values {
+		values = map[string][]byte{}
+	}
+	// fieldArgs consists of groups of 5 args for each field, starting with the
+	// redis name of the field and the value for the main hash.
+	for i := 0; i+4 < len(fieldArgs); i += 5 {
+		fieldName := fieldNamesByRedisName[fieldArgs[i].(string)]
+		fieldNames = append(fieldNames, fieldName)
+		if values != nil {
+			values[fieldName] = argBytes(fieldArgs[i+1])
+		}
+	}
+	t.addChangeEvents(c, ChangeSave, idsKey, fieldNames, values)
+}
+
+// addChangeEvents adds a script to the transaction which adds a change event
+// with the given operation, fields, and values to the change stream and/or
+// publishes it to subscribers for each of the models identified by idsKey or
+// ids which exist, according to the options for the collection.
+func (t *Transaction) addChangeEvents(c *Collection, op ChangeOperation, idsKey string, fieldNames []string, values map[string][]byte, ids ...string) {
+	if !c.changeStream.enabled && !c.changeStream.publish {
+		return
+	}
+	streamKey, channel, message := "", "", []byte{}
+	if c.changeStream.enabled {
+		streamKey = c.ChangeStreamKey()
+	}
+	if c.changeStream.publish {
+		channel = c.ChangesChannel()
+		var err error
+		message, err = json.Marshal(changeMessage{
+			Collection: c.Name(),
+			Operation:  op,
+			Fields:     fieldNames,
+			Values:     values,
+		})
+		if err != nil {
+			t.setError(fmt.Errorf("zoom: error publishing change event: %s", err.Error()))
+			return
+		}
+	}
+	entryArgs := redis.Args{"fields", strings.Join(fieldNames, ",")}
+	for _, fieldName := range fieldNames {
+		if value, found := values[fieldName]; found {
+			entryArgs = append(entryArgs, "value:"+fieldName, value)
+		}
+	}
+	args := redis.Args{streamKey, channel, c.Name(), c.changeStream.maxLen, string(op), message, idsKey, len(entryArgs)}
+	args = append(args, entryArgs...)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	t.Script(addChangeEventsScript, args, nil)
+}
+
+// argBytes returns arg encoded the same way that it would be when it is sent
+// to Redis as an argument to a command.
+func argBytes(arg interface{}) []byte {
+	switch arg := arg.(type) {
+	case string:
+		return []byte(arg)
+	case []byte:
+		return arg
+	case int:
+		return strconv.AppendInt(nil, int64(arg), 10)
+	case int64:
+		return strconv.AppendInt(nil, arg, 10)
+	case float64:
+		return strconv.AppendFloat(nil, arg, 'g', -1, 64)
+	case bool:
+		if arg {
+			return []byte("1")
+		}
+		return []byte("0")
+	case nil:
+		return []byte{}
+	case redis.Argument:
+		return argBytes(arg.RedisArg())
+	default:
+		return []byte(fmt.Sprint(arg))
+	}
+}
+
+// ChangeConsumer reads change events from the change stream for a collection
+// as a member of a consumer group. Each event in the stream is delivered to
+// only one of the consumers in a group, and remains pending until it is
+// acknowledged with Ack. Use Collection.NewChangeConsumer to create one.
+type ChangeConsumer struct {
+	collection *Collection
+	group      string
+	name       string
+}
+
+// NewChangeConsumer returns a consumer with the given name which reads the
+// change stream for the collection as a member of the given consumer group.
+// If the group does not exist, NewChangeConsumer creates it (and the stream,
+// if needed). A new group only receives events which are added after it was
+// created.
+func (c *Collection) NewChangeConsumer(group string, name string) (*ChangeConsumer, error) {
+	if c == nil {
+		return nil, newNilCollectionError("NewChangeConsumer")
+	}
+	conn := c.pool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	if _, err := conn.Do("XGROUP", "CREATE", c.ChangeStreamKey(), group, "$", "MKSTREAM"); err != nil {
+		if !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, err
+		}
+	}
+	return &ChangeConsumer{
+		collection: c,
+		group:      group,
+		name:       name,
+	}, nil
+}
+
+// Read reads up to count change events which have not been delivered to any
+// consumer in the group yet. If there are no such events, Read waits up to
+// block for one to be added before returning an empty slice. If block is 0,
+// Read returns immediately.
+func (cc *ChangeConsumer) Read(count int, block time.Duration) ([]ChangeEvent, error) {
+	conn := cc.collection.pool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	args := redis.Args{"GROUP", cc.group, cc.name, "COUNT", count}
+	if block > 0 {
+		args = args.Add("BLOCK", durationToMilliseconds(block))
+	}
+	args = args.Add("STREAMS", cc.collection.ChangeStreamKey(), ">")
+	streams, err := redis.Values(conn.Do("XREADGROUP", args...))
+	if err != nil {
+		if err == redis.ErrNil {
+			return []ChangeEvent{}, nil
+		}
+		return nil, err
+	}
+	events := []ChangeEvent{}
+	for _, stream := range streams {
+		streamValues, err := redis.Values(stream, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(streamValues) != 2 {
+			return nil, fmt.Errorf("zoom: error in ChangeConsumer.Read: unexpected reply: %v", stream)
+		}
+		entries, err := redis.Values(streamValues[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			ev, err := parseChangeEvent(entry)
+			if err != nil {
+				return nil, err
+			}
+			ev.collection = cc.collection
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+// Ack acknowledges the given events, which removes them from the list of
+// pending events for the group.
+func (cc *ChangeConsumer) Ack(events ...ChangeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	conn := cc.collection.pool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	args := redis.Args{cc.collection.ChangeStreamKey(), cc.group}
+	for _, ev := range events {
+		args = append(args, ev.StreamID)
+	}
+	_, err := conn.Do("XACK", args...)
+	return err
+}
+
+// parseChangeEvent converts an entry in a reply from XREADGROUP, which
+// consists of the stream id and a list of alternating keys and values, into a
+// ChangeEvent.
+func parseChangeEvent(entry interface{}) (ChangeEvent, error) {
+	entryValues, err := redis.Values(entry, nil)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+	if len(entryValues) != 2 {
+		return ChangeEvent{}, fmt.Errorf("zoom: error parsing change event: unexpected entry: %v", entry)
+	}
+	streamID, err := redis.String(entryValues[0], nil)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+	fields, err := redis.ByteSlices(entryValues[1], nil)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+	ev := ChangeEvent{
+		StreamID: streamID,
+		Fields:   []string{},
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		key, value := string(fields[i]), fields[i+1]
+		switch {
+		case key == "collection":
+			ev.Collection = string(value)
+		case key == "id":
+			ev.ID = string(value)
+		case key == "op":
+			ev.Operation = ChangeOperation(value)
+		case key == "fields":
+			if len(value) > 0 {
+				ev.Fields = strings.Split(string(value), ",")
+			}
+		case strings.HasPrefix(key, "value:"):
+			if ev.Values == nil {
+				ev.Values = map[string][]byte{}
+			}
+			ev.Values[strings.TrimPrefix(key, "value:")] = value
+		}
+	}
+	return ev, nil
+}
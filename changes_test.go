@@ -0,0 +1,179 @@
+// File changes_test.go tests the change data capture features (changes.go)
+
+package kvmodel
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// changeTestModel is a model type that is used for testing change streams
+type changeTestModel struct {
+	Int    int `zoom:"index"`
+	String string
+	Ptr    *string
+	RandomID
+}
+
+var (
+	changeTestModels     *Collection
+	changeTestModelsOnce sync.Once
+)
+
+// getChangeTestModels returns a collection of changeTestModels with the
+// ChangeStream and ChangeStreamValues options set.
+func getChangeTestModels(t *testing.T) *Collection {
+	changeTestModelsOnce.Do(func() {
+		options := DefaultCollectionOptions.WithIndex(true).WithChangeStream(true).WithChangeStreamValues(true).WithChangeStreamMaxLen(1000)
+		var err error
+		changeTestModels, err = testPool.NewCollectionWithOptions(&changeTestModel{}, options)
+		require.NoError(t, err)
+	})
+	return changeTestModels
+}
+
+func TestChangeStream(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	collection := getChangeTestModels(t)
+
+	consumer, err := collection.NewChangeConsumer("group", "consumer")
+	require.NoError(t, err)
+	// Creating a consumer for an existing group should also work
+	_, err = collection.NewChangeConsumer("group", "other")
+	require.NoError(t, err)
+
+	ptr := "ptr"
+	models := []*changeTestModel{
+		{Int: 1, String: "one", Ptr: &ptr},
+		{Int: 2, String: "two"},
+	}
+	require.NoError(t, collection.Save(models[0]))
+	models[1].Int = 3
+	require.NoError(t, collection.SaveFields([]string{"Int"}, models[1]))
+	_, err = collection.Delete(models[0].ID)
+	require.NoError(t, err)
+	// Deleting a model that does not exist should not add an event
+	_, err = collection.Delete("does-not-exist")
+	require.NoError(t, err)
+
+	events, err := consumer.Read(10, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	for _, ev := range events {
+		assert.Equal(t, collection.Name(), ev.Collection)
+		assert.NotEmpty(t, ev.StreamID)
+	}
+
+	assert.Equal(t, ChangeSave, events[0].Operation)
+	assert.Equal(t, models[0].ID, events[0].ID)
+	assert.Equal(t, []string{"Int", "String", "Ptr"}, events[0].Fields)
+	got := &changeTestModel{}
+	require.NoError(t, events[0].Decode(got))
+	assert.Equal(t, models[0], got)
+
+	assert.Equal(t, ChangeSave, events[1].Operation)
+	assert.Equal(t, []string{"Int"}, events[1].Fields)
+	got = &changeTestModel{}
+	require.NoError(t, events[1].Decode(got))
+	assert.Equal(t, &changeTestModel{Int: 3, RandomID: models[1].RandomID}, got)
+
+	assert.Equal(t, ChangeDelete, events[2].Operation)
+	assert.Equal(t, models[0].ID, events[2].ID)
+	assert.Empty(t, events[2].Fields)
+	assert.Error(t, events[2].Decode(&changeTestModel{}))
+
+	// All the events were delivered, so there should be no more
+	events, err = consumer.Read(10, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	// DeleteAll should add an event for each model
+	models[0].ID = ""
+	require.NoError(t, collection.Save(models[0]))
+	_, err = collection.DeleteAll()
+	require.NoError(t, err)
+	events, err = consumer.Read(10, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	deletedIDs := []string{events[1].ID, events[2].ID}
+	assert.Equal(t, ChangeDelete, events[1].Operation)
+	assert.Equal(t, ChangeDelete, events[2].Operation)
+	assert.ElementsMatch(t, []string{models[0].ID, models[1].ID}, deletedIDs)
+	require.NoError(t, consumer.Ack(events...))
+}
+
+func TestChangeStreamQuery(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	collection := getChangeTestModels(t)
+
+	models := []*changeTestModel{{Int: 1}, {Int: 2}, {Int: 3}}
+	for _, model := range models {
+		require.NoError(t, collection.Save(model))
+	}
+	consumer, err := collection.NewChangeConsumer("group", "consumer")
+	require.NoError(t, err)
+
+	// Query.Update should add a save event with the new values for each model
+	// that was updated
+	updated, err := collection.NewQuery().Filter("Int >", 1).Update(map[string]interface{}{
+		"String": "updated",
+		"Ptr":    nil,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, updated)
+	events, err := consumer.Read(10, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	ids := []string{}
+	for _, ev := range events {
+		ids = append(ids, ev.ID)
+		assert.Equal(t, ChangeSave, ev.Operation)
+		assert.Equal(t, []string{"String", "Ptr"}, ev.Fields)
+		got := &changeTestModel{}
+		require.NoError(t, ev.Decode(got))
+		assert.Equal(t, &changeTestModel{String: "updated", RandomID: RandomID{ID: ev.ID}}, got)
+	}
+	assert.ElementsMatch(t, []string{models[1].ID, models[2].ID}, ids)
+
+	// Query.Delete should add a delete event for each model that was deleted
+	deleted, err := collection.NewQuery().Filter("Int <", 3).Delete()
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+	events, err = consumer.Read(10, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	ids = []string{}
+	for _, ev := range events {
+		ids = append(ids, ev.ID)
+		assert.Equal(t, ChangeDelete, ev.Operation)
+		assert.Empty(t, ev.Fields)
+	}
+	assert.ElementsMatch(t, []string{models[0].ID, models[1].ID}, ids)
+}
+
+func TestChangeStreamTransaction(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	collection := getChangeTestModels(t)
+
+	consumer, err := collection.NewChangeConsumer("group", "consumer")
+	require.NoError(t, err)
+	// The event should not be added if the transaction fails
+	model := &changeTestModel{Int: 1}
+	tx := testPool.NewTransaction()
+	tx.Save(collection, model)
+	tx.Save(collection, &testModel{})
+	require.Error(t, tx.Exec())
+	events, err := consumer.Read(10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+	// Collections without the ChangeStream option should not add events
+	require.NoError(t, testModels.Save(createTestModels(1)[0]))
+	expectKeyDoesNotExist(t, testModels.ChangeStreamKey())
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -18,9 +20,14 @@ var collections = list.New()
 // for saving, finding, and deleting models of a specific type. Use the
 // NewCollection method to create a new collection.
 type Collection struct {
-	spec  *modelSpec
-	pool  *Pool
-	index bool
+	spec         *modelSpec
+	pool         *Pool
+	index        bool
+	views        map[string]*view
+	viewsMutex   sync.RWMutex
+	hooks        collectionHooks
+	changeStream changeStreamOptions
+	cache        *modelCache
 }
 
 // CollectionOptions contains various options for a pool.
@@ -46,6 +53,50 @@ type CollectionOptions struct {
 	// name corresponding to *models.User would be "User". If a custom name is
 	// provided, it cannot contain a colon.
 	Name string
+	// If ChangeStream is true, Save, SaveFields, Delete, DeleteAll,
+	// Query.Delete, and Query.Update add a change event to a stream in Redis
+	// for each model that is saved, updated, or deleted, inside of the same
+	// transaction. Query.Update adds a save event with the fields that were
+	// updated. The key for the stream is exposed via the ChangeStreamKey
+	// method. Other services can read the events with a ChangeConsumer.
+	// Changes made in other ways, e.g. with Transaction.Command, do not add
+	// any events.
+	ChangeStream bool
+	// If ChangeStreamValues is true, the change events for saves include the
+	// new values of the fields that were saved, so that the model can be
+	// decoded with ChangeEvent.Decode. It applies to the events in the change
+	// stream and to the events which are published because of the
+	// PublishChanges option, and has no effect unless one of them is true.
+	ChangeStreamValues bool
+	// If ChangeStreamMaxLen is greater than 0, the change stream is trimmed to
+	// approximately that many events each time an event is added, using XADD
+	// with MAXLEN ~. Otherwise the stream grows until it is trimmed manually.
+	ChangeStreamMaxLen int
+	// If PublishChanges is true, Save, SaveFields, Delete, DeleteAll,
+	// Query.Delete, and Query.Update publish a change event with PUBLISH for
+	// each model that is saved, updated, or deleted, inside of the same
+	// transaction, in the same way as for ChangeStream. The name of the
+	// channel is exposed via the ChangesChannel method. Use Subscribe to
+	// receive the events.
+	PublishChanges bool
+	// If CacheSize is greater than 0, Collection.Find and Collection.FindFields
+	// are served from an in-process cache which holds up to CacheSize models,
+	// evicting the least recently used model when it is full. Models are
+	// removed from the cache when they are changed by Save, SaveFields, or
+	// Delete (including inside of transactions) in this process, and the
+	// entire cache is cleared by DeleteAll, Query.Delete, and Query.Update.
+	// Changes made by other processes are only detected with
+	// SubscribeCacheInvalidation, which requires the PublishChanges option.
+	// Changes made in other ways, e.g. with Transaction.Command, are never
+	// detected, so call ClearCache after making them. Transaction.Find and
+	// queries do not use the cache. Use CacheStats to get the hit and miss
+	// statistics.
+	CacheSize int
+	// CacheTTL is the maximum amount of time that a model stays in the cache.
+	// If CacheTTL is 0, models stay in the cache until they are evicted or
+	// removed because they were changed. It has no effect unless CacheSize is
+	// greater than 0.
+	CacheTTL time.Duration
 }
 
 // DefaultCollectionOptions is the default set of options for a collection.
@@ -53,6 +104,12 @@ var DefaultCollectionOptions = CollectionOptions{
 	FallbackMarshalerUnmarshaler: GobMarshalerUnmarshaler,
 	Index:                        false,
 	Name:                         "",
+	ChangeStream:                 false,
+	ChangeStreamValues:           false,
+	ChangeStreamMaxLen:           0,
+	PublishChanges:               false,
+	CacheSize:                    0,
+	CacheTTL:                     0,
 }
 
 // WithFallbackMarshalerUnmarshaler returns a new copy of the options with the
@@ -77,6 +134,50 @@ func (options CollectionOptions) WithName(name string) CollectionOptions {
 	return options
 }
 
+// WithChangeStream returns a new copy of the options with the ChangeStream
+// property set to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithChangeStream(changeStream bool) CollectionOptions {
+	options.ChangeStream = changeStream
+	return options
+}
+
+// WithChangeStreamValues returns a new copy of the options with the
+// ChangeStreamValues property set to the given value. It does not mutate the
+// original options.
+func (options CollectionOptions) WithChangeStreamValues(values bool) CollectionOptions {
+	options.ChangeStreamValues = values
+	return options
+}
+
+// WithChangeStreamMaxLen returns a new copy of the options with the
+// ChangeStreamMaxLen property set to the given value. It does not mutate the
+// original options.
+func (options CollectionOptions) WithChangeStreamMaxLen(maxLen int) CollectionOptions {
+	options.ChangeStreamMaxLen = maxLen
+	return options
+}
+
+// WithPublishChanges returns a new copy of the options with the PublishChanges
+// property set to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithPublishChanges(publish bool) CollectionOptions {
+	options.PublishChanges = publish
+	return options
+}
+
+// WithCacheSize returns a new copy of the options with the CacheSize property
+// set to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithCacheSize(size int) CollectionOptions {
+	options.CacheSize = size
+	return options
+}
+
+// WithCacheTTL returns a new copy of the options with the CacheTTL property
+// set to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithCacheTTL(ttl time.Duration) CollectionOptions {
+	options.CacheTTL = ttl
+	return options
+}
+
 // NewCollection registers and returns a new collection of the given model type.
 // You must create a collection for each model type you want to save. The type
 // of model must be unique, i.e., not already registered, and must be a pointer
@@ -123,6 +224,15 @@ func (p *Pool) NewCollectionWithOptions(model Model, options CollectionOptions)
 		spec:  spec,
 		pool:  p,
 		index: options.Index,
+		changeStream: changeStreamOptions{
+			enabled: options.ChangeStream,
+			publish: options.PublishChanges,
+			values:  options.ChangeStreamValues,
+			maxLen:  options.ChangeStreamMaxLen,
+		},
+	}
+	if options.CacheSize > 0 {
+		collection.cache = newModelCache(options.CacheSize, options.CacheTTL)
 	}
 	addCollection(collection)
 	return collection, nil
@@ -284,6 +394,11 @@ func (t *Transaction) Save(c *Collection, model Model) {
 	if c.index {
 		t.Command("SADD", redis.Args{c.IndexKey(), model.ModelID()}, nil)
 	}
+	// Update any views which depend on the model fields
+	t.updateViewsForModel(c, c.spec.fieldNames(), model.ModelID())
+	t.addSaveEvent(mr, c.spec.fieldNames())
+	t.invalidateCache(c, model.ModelID())
+	t.runSaveHooks(c, model)
 }
 
 // saveFieldIndexes adds commands to the transaction for saving the indexes
@@ -309,37 +424,63 @@ func (t *Transaction) saveFieldIndexesForFields(fieldNames []string, mr *modelRe
 			t.saveBooleanIndex(mr, fs)
 		case stringIndex:
 			t.saveStringIndex(mr, fs)
+		case integerIndex:
+			t.saveIntegerIndex(mr, fs)
+		case geoIndex:
+			t.saveGeoIndex(mr, fs)
+		}
+		if fs.hasNullSet() {
+			t.saveNullSet(mr, fs)
 		}
 	}
 }
 
+// saveNullSet adds commands to the transaction for adding the model to the
+// null set for the given field if the field is nil, or removing it from the
+// null set otherwise.
+func (t *Transaction) saveNullSet(mr *modelRef, fs *fieldSpec) {
+	nullSetKey, err := mr.spec.fieldNullSetKey(fs.name)
+	if err != nil {
+		t.setError(err)
+	}
+	if mr.fieldValue(fs.name).IsNil() {
+		t.Command("SADD", redis.Args{nullSetKey, mr.model.ModelID()}, nil)
+	} else {
+		t.Command("SREM", redis.Args{nullSetKey, mr.model.ModelID()}, nil)
+	}
+}
+
 // saveNumericIndex adds commands to the transaction for saving a numeric
 // index on the given field.
 func (t *Transaction) saveNumericIndex(mr *modelRef, fs *fieldSpec) {
+	indexKey, err := mr.spec.fieldIndexKey(fs.name)
+	if err != nil {
+		t.setError(err)
+	}
 	fieldValue := mr.fieldValue(fs.name)
 	if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+		// Remove the old index (if any)
+		t.Command("ZREM", redis.Args{indexKey, mr.model.ModelID()}, nil)
 		return
 	}
 	score := numericScore(fieldValue)
-	indexKey, err := mr.spec.fieldIndexKey(fs.name)
-	if err != nil {
-		t.setError(err)
-	}
 	t.Command("ZADD", redis.Args{indexKey, score, mr.model.ModelID()}, nil)
 }
 
 // saveBooleanIndex adds commands to the transaction for saving a boolean
 // index on the given field.
 func (t *Transaction) saveBooleanIndex(mr *modelRef, fs *fieldSpec) {
+	indexKey, err := mr.spec.fieldIndexKey(fs.name)
+	if err != nil {
+		t.setError(err)
+	}
 	fieldValue := mr.fieldValue(fs.name)
 	if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+		// Remove the old index (if any)
+		t.Command("ZREM", redis.Args{indexKey, mr.model.ModelID()}, nil)
 		return
 	}
 	score := boolScore(fieldValue)
-	indexKey, err := mr.spec.fieldIndexKey(fs.name)
-	if err != nil {
-		t.setError(err)
-	}
 	t.Command("ZADD", redis.Args{indexKey, score, mr.model.ModelID()}, nil)
 }
 
@@ -429,6 +570,11 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 	if c.index {
 		t.Command("SADD", redis.Args{c.IndexKey(), model.ModelID()}, nil)
 	}
+	// Update any views which depend on the given fields
+	t.updateViewsForModel(c, fieldNames, model.ModelID())
+	t.addSaveEvent(mr, fieldNames)
+	t.invalidateCache(c, model.ModelID())
+	t.runSaveHooks(c, model)
 }
 
 // Find retrieves a model with the given id from redis and scans its values
@@ -436,8 +582,12 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 // corresponding to the Collection. Find will mutate the struct, filling in its
 // fields and overwriting any previous values. It returns an error if a model
 // with the given id does not exist, if the given model was the wrong type, or
-// if there was a problem connecting to the database.
+// if there was a problem connecting to the database. If the CacheSize option
+// was set for the collection, the model may be served from the cache.
 func (c *Collection) Find(id string, model Model) error {
+	if c.cache != nil {
+		return c.findWithCache("Find", id, c.spec.fieldNames(), model)
+	}
 	t := c.pool.NewTransaction()
 	t.Find(c, id, model)
 	if err := t.Exec(); err != nil {
@@ -482,6 +632,9 @@ func (t *Transaction) Find(c *Collection, id string, model Model) {
 // FindFields will return an error if any of the given fieldNames are not found
 // in the model type.
 func (c *Collection) FindFields(id string, fieldNames []string, model Model) error {
+	if c.cache != nil {
+		return c.findWithCache("FindFields", id, fieldNames, model)
+	}
 	t := c.pool.NewTransaction()
 	t.FindFields(c, id, fieldNames, model)
 	if err := t.Exec(); err != nil {
@@ -565,7 +718,7 @@ func (t *Transaction) FindAll(c *Collection, models interface{}) {
 		t.setError(fmt.Errorf("zoom: Error in FindAll or Transaction.FindAll: %s", err.Error()))
 		return
 	}
-	sortArgs := c.spec.sortArgs(c.spec.indexKey(), c.spec.fieldRedisNames(), 0, 0, false)
+	sortArgs := c.spec.sortArgs(c.spec.indexKey(), nil, c.spec.fieldRedisNames(), 0, 0, false)
 	fieldNames := append(c.spec.fieldNames(), "-")
 	t.Command("SORT", sortArgs, newScanModelsHandler(c.spec, fieldNames, models))
 }
@@ -649,6 +802,9 @@ func (t *Transaction) Delete(c *Collection, id string, deleted *bool) {
 		t.setError(newNilCollectionError("Delete"))
 		return
 	}
+	// Add a change event if needed. This must happen before the model is
+	// deleted, because the event is only added if the model exists.
+	t.addDeleteEvents(c, "", id)
 	// Delete any field indexes
 	// This must happen first, because it relies on reading the old field values
 	// from the hash for string indexes (if any)
@@ -663,20 +819,35 @@ func (t *Transaction) Delete(c *Collection, id string, deleted *bool) {
 	t.Command("DEL", redis.Args{c.Name() + ":" + id}, handler)
 	// Remvoe the id from the index of all models for the given type
 	t.Command("SREM", redis.Args{c.IndexKey(), id}, nil)
+	// Remove the id from any views
+	t.updateViews(c.Name(), c.viewFiltersKey(), "", "delete", "id", id, nil)
+	t.invalidateCache(c, id)
+	t.runDeleteHooks(c, id)
 }
 
 // deleteFieldIndexes adds commands to the transaction for deleting the field
-// indexes for all indexed fields of the given model type.
+// indexes and null sets for all indexed fields of the given model type.
 func (t *Transaction) deleteFieldIndexes(c *Collection, id string) {
 	for _, fs := range c.spec.fields {
 		switch fs.indexKind {
 		case noIndex:
 			continue
-		case numericIndex, booleanIndex:
+		case numericIndex, booleanIndex, geoIndex:
+			// Geo indexes are also sorted sets with the model id as the member
 			t.deleteNumericOrBooleanIndex(fs, c.spec, id)
 		case stringIndex:
 			// NOTE: this invokes a lua script which is defined in scripts/delete_string_index.lua
 			t.deleteStringIndex(c.Name(), id, fs.redisName)
+		case integerIndex:
+			// NOTE: this invokes a lua script which is defined in scripts/delete_integer_index.lua
+			t.deleteIntegerIndex(c.Name(), id, fs.redisName)
+		}
+		if fs.hasNullSet() {
+			nullSetKey, err := c.spec.fieldNullSetKey(fs.name)
+			if err != nil {
+				t.setError(err)
+			}
+			t.Command("SREM", redis.Args{nullSetKey, id}, nil)
 		}
 	}
 }
@@ -724,7 +895,11 @@ func (t *Transaction) DeleteAll(c *Collection, count *int) {
 	} else {
 		handler = NewScanIntHandler(count)
 	}
+	t.addDeleteEvents(c, c.IndexKey())
 	t.DeleteModelsBySetIDs(c.IndexKey(), c.Name(), handler)
+	t.clearCache(c)
+	// All the views are now empty
+	t.updateViews(c.Name(), c.viewFiltersKey(), "", "clear", "", "", nil)
 }
 
 // checkModelType returns an error iff model is not of the registered type that
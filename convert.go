@@ -128,3 +128,68 @@ func scanInconvertibleVal(marshalerUnmarshaler MarshalerUnmarshaler, src []byte,
 	}
 	return nil
 }
+
+// convertIndexValue converts a value read from the field index for fs into the
+// underlying type of the field (with any pointers dereferenced). For numeric
+// and boolean indexes, src should be a score. For string indexes, src should be
+// the string value, and for integer indexes it should be the encoded value.
+// Because the result is intended to be used as a map key, fields which are
+// slices or arrays of bytes are converted to strings.
+func convertIndexValue(fs *fieldSpec, src []byte) (interface{}, error) {
+	typ := fs.typ
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch fs.indexKind {
+	case numericIndex:
+		score, err := strconv.ParseFloat(string(src), 64)
+		if err != nil {
+			return nil, fmt.Errorf("zoom: could not convert score %s to float", string(src))
+		}
+		val := reflect.New(typ).Elem()
+		switch val.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			val.SetInt(int64(score))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			val.SetUint(uint64(score))
+		default:
+			val.SetFloat(score)
+		}
+		return val.Interface(), nil
+	case booleanIndex:
+		score, err := strconv.ParseFloat(string(src), 64)
+		if err != nil {
+			return nil, fmt.Errorf("zoom: could not convert score %s to bool", string(src))
+		}
+		return score != 0, nil
+	case integerIndex:
+		decoded, err := decodeIntegerString(string(src))
+		if err != nil {
+			return nil, err
+		}
+		val := reflect.New(typ).Elem()
+		switch val.Kind() {
+		case reflect.Int, reflect.Int64:
+			i, err := strconv.ParseInt(decoded, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			val.SetInt(i)
+		default:
+			u, err := strconv.ParseUint(decoded, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			val.SetUint(u)
+		}
+		return val.Interface(), nil
+	case stringIndex:
+		if typ.Kind() != reflect.String {
+			return string(src), nil
+		}
+		val := reflect.New(typ).Elem()
+		val.SetString(string(src))
+		return val.Interface(), nil
+	}
+	return nil, fmt.Errorf("zoom: field %s is not indexed", fs.name)
+}
@@ -0,0 +1,175 @@
+// File dry_run.go contains code related to dry runs, in which transactions
+// record the actions they would send to Redis instead of executing them.
+
+package kvmodel
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Recording is the ordered list of Redis commands and Lua scripts that a
+// transaction or pipeline would have sent to Redis. Recordings are created
+// instead of executing the transaction when the DryRun option is set for the
+// transaction or the pool.
+type Recording struct {
+	// Watched is the list of keys which would be watched with WATCH before the
+	// transaction is executed, including the keys for any locks that are
+	// required with Transaction.RequireLock.
+	Watched []string
+	// Steps is the list of commands and scripts in the order they would be
+	// sent, using the same format as Query.Explain.
+	Steps []ExplainStep
+	// Atomic is true iff the steps would be wrapped in MULTI/EXEC.
+	Atomic bool
+}
+
+// recordings holds all the recordings created by the transactions for a pool
+// which has the DryRun option set.
+type recordings struct {
+	sync.Mutex
+	list []Recording
+}
+
+// Recording returns the recording which was created when the transaction was
+// executed with the DryRun option, or nil if the transaction was not executed
+// or the DryRun option was not set.
+func (t *Transaction) Recording() *Recording {
+	return t.recording
+}
+
+// ExecDryRun records the actions in the transaction instead of sending them to
+// Redis, as if the transaction was created with the DryRun option, and returns
+// the recording. It returns an error without a recording if any of the methods
+// used to add actions to the transaction encountered an error. The recording
+// is also added to the pool's recordings and returned by Recording.
+func (t *Transaction) ExecDryRun() (*Recording, error) {
+	t.options.DryRun = true
+	if err := t.Exec(); err != nil {
+		return nil, err
+	}
+	return t.recording, nil
+}
+
+// ExecDryRun records the actions in the pipeline instead of sending them to
+// Redis, as if the pipeline was created with the DryRun option, and returns the
+// recording. See Transaction.ExecDryRun for more information.
+func (p *Pipeline) ExecDryRun() (*Recording, error) {
+	p.options.DryRun = true
+	if err := p.Exec(); err != nil {
+		return nil, err
+	}
+	return p.recording, nil
+}
+
+// Recordings returns the recordings for all the transactions and pipelines
+// which were executed for the pool since it was created or ClearRecordings was
+// last called, in the order they were executed. It is only useful if the
+// DryRun option was set for the pool.
+func (p *Pool) Recordings() []Recording {
+	p.recordings.Lock()
+	defer p.recordings.Unlock()
+	return append([]Recording{}, p.recordings.list...)
+}
+
+// ClearRecordings deletes all the recordings for the pool.
+func (p *Pool) ClearRecordings() {
+	p.recordings.Lock()
+	defer p.recordings.Unlock()
+	p.recordings.list = nil
+}
+
+// record creates a recording of the actions in the transaction and adds it to
+// the pool (if any) instead of executing them.
+func (t *Transaction) record(atomic bool) {
+	recording := &Recording{
+		Watched: append([]string{}, t.watching...),
+		Steps:   make([]ExplainStep, len(t.actions)),
+		Atomic:  atomic,
+	}
+	for _, lock := range t.locks {
+		recording.Watched = append(recording.Watched, lock.key)
+	}
+	if len(recording.Watched) > 0 {
+		recording.Atomic = true
+	}
+	for i, a := range t.actions {
+		recording.Steps[i] = newExplainStep(a)
+	}
+	t.recording = recording
+	if t.pool != nil {
+		t.pool.recordings.Lock()
+		t.pool.recordings.list = append(t.pool.recordings.list, *recording)
+		t.pool.recordings.Unlock()
+	}
+}
+
+// RedisCLI renders the recording as a script which can be piped into
+// redis-cli, with one command on each line. Lua scripts are rendered as EVAL
+// commands with the full source of the script if it is known (which is the
+// case for all the scripts used by Zoom and all the scripts registered with
+// Pool.RegisterScript), or EVALSHA commands otherwise. Arguments which contain
+// spaces, quotes, or non-printable characters are quoted in the format that
+// redis-cli expects.
+func (r Recording) RedisCLI() string {
+	lines := []string{}
+	for _, key := range r.Watched {
+		lines = append(lines, "WATCH "+redisCLIQuote(key))
+	}
+	if r.Atomic {
+		lines = append(lines, "MULTI")
+	}
+	for _, step := range r.Steps {
+		parts := []string{}
+		if step.ScriptHash == "" {
+			parts = append(parts, step.Name)
+		} else if info, found := getScriptInfo(step.ScriptHash); found {
+			parts = append(parts, "EVAL", redisCLIQuote(info.src))
+			if info.keyCount >= 0 {
+				parts = append(parts, fmt.Sprint(info.keyCount))
+			}
+		} else {
+			parts = append(parts, "EVALSHA", step.ScriptHash, "0")
+		}
+		for _, arg := range step.Args {
+			parts = append(parts, redisCLIQuote(arg))
+		}
+		lines = append(lines, strings.Join(parts, " "))
+	}
+	if r.Atomic {
+		lines = append(lines, "EXEC")
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// redisCLIQuote returns arg surrounded by double quotes, using the escape
+// sequences that redis-cli understands, if it contains spaces, quotes, or
+// non-printable characters. Otherwise it returns arg unchanged.
+func redisCLIQuote(arg string) string {
+	if quoteArg(arg) == arg {
+		return arg
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
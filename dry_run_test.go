@@ -0,0 +1,168 @@
+// File dry_run_test.go tests dry runs (dry_run.go)
+
+package kvmodel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expectEmptyDatabase checks that there are no keys in the database.
+func expectEmptyDatabase(t *testing.T) {
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	n, err := redis.Int(conn.Do("DBSIZE"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "Expected the database to be empty")
+}
+
+func TestTransactionDryRun(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := createIndexedTestModels(1)[0]
+	model.String = "with space\x00"
+	tx := testPool.NewTransactionWithOptions(DefaultTransactionOptions.WithDryRun(true))
+	assert.Nil(t, tx.Recording())
+	tx.Save(indexedTestModels, model)
+	tx.Delete(indexedTestModels, "deleted", nil)
+	models := []*indexedTestModel{}
+	tx.Query(indexedTestModels).Filter("Int >", 0).Run(&models)
+	require.NoError(t, tx.Exec())
+	expectEmptyDatabase(t)
+
+	recording := tx.Recording()
+	require.NotNil(t, recording)
+	assert.True(t, recording.Atomic)
+	assert.Empty(t, recording.Watched)
+	names := []string{}
+	for _, step := range recording.Steps {
+		names = append(names, step.Name)
+	}
+	assert.Contains(t, names, "HMSET")
+	assert.Contains(t, names, "SADD")
+	assert.Contains(t, names, "DEL")
+	assert.Contains(t, names, "EVALSHA")
+
+	script := recording.RedisCLI()
+	lines := strings.Split(strings.TrimSuffix(script, "\n"), "\n")
+	require.Len(t, lines, len(recording.Steps)+2)
+	assert.Equal(t, "MULTI", lines[0])
+	assert.Equal(t, "EXEC", lines[len(lines)-1])
+	assert.Contains(t, script, `"with space\x00"`)
+	// Scripts are rendered with their full source
+	assert.Contains(t, script, "EVAL \"-- Copyright 2015 Alex Browne.")
+	assert.NotContains(t, script, "EVALSHA")
+}
+
+func TestTransactionDryRunWatch(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	tx := testPool.NewTransactionWithOptions(DefaultTransactionOptions.WithDryRun(true))
+	require.NoError(t, tx.WatchKey("watched"))
+	tx.Command("SET", redis.Args{"key", "some value"}, nil)
+	require.NoError(t, tx.Exec())
+	expectEmptyDatabase(t)
+	assert.Equal(t, "WATCH watched\nMULTI\nSET key \"some value\"\nEXEC\n", tx.Recording().RedisCLI())
+
+	// A single action without any watched keys is not atomic
+	tx = testPool.NewTransactionWithOptions(DefaultTransactionOptions.WithDryRun(true))
+	tx.Command("GET", redis.Args{"quote\"d"}, nil)
+	require.NoError(t, tx.Exec())
+	assert.Equal(t, "GET \"quote\\\"d\"\n", tx.Recording().RedisCLI())
+}
+
+func TestPoolDryRun(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	pool := NewPoolWithOptions(testPool.options.WithDryRun(true))
+	defer func() {
+		_ = pool.Close()
+	}()
+	collection, err := pool.NewCollectionWithOptions(&testModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+	model := createTestModels(1)[0]
+	require.NoError(t, collection.Save(model))
+	require.NoError(t, collection.SaveFields([]string{"Int"}, model))
+	_, err = collection.Delete(model.ModelID())
+	require.NoError(t, err)
+	p := pool.NewPipeline()
+	p.Command("SET", redis.Args{"key", "value"}, nil)
+	require.NoError(t, p.Exec())
+	expectEmptyDatabase(t)
+
+	recordings := pool.Recordings()
+	require.Len(t, recordings, 4)
+	assert.Equal(t, "HMSET", recordings[0].Steps[0].Name)
+	assert.False(t, recordings[3].Atomic)
+	pool.ClearRecordings()
+	assert.Empty(t, pool.Recordings())
+
+	_, err = collection.NewQuery().ExplainAnalyze()
+	assert.Error(t, err)
+}
+
+func TestPoolDryRunDoesNotConnect(t *testing.T) {
+	// Nothing is listening on this address, so any command which is sent to
+	// Redis would fail.
+	pool := NewPoolWithOptions(testPool.options.WithAddress("localhost:1").WithDryRun(true))
+	defer func() {
+		_ = pool.Close()
+	}()
+	collection, err := pool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, err)
+	model := createIndexedTestModels(1)[0]
+	require.NoError(t, collection.Save(model))
+	require.NoError(t, collection.SaveFields([]string{"Int"}, model))
+	_, err = collection.Delete(model.ModelID())
+	require.NoError(t, err)
+	_, err = collection.DeleteAll()
+	require.NoError(t, err)
+	_, err = collection.NewQuery().Filter("Int >", 0).Update(map[string]interface{}{"String": "updated"})
+	require.NoError(t, err)
+	_, err = collection.NewQuery().Filter("Int >", 0).Delete()
+	require.NoError(t, err)
+	assert.Len(t, pool.Recordings(), 6)
+}
+
+func TestExecDryRun(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// ExecDryRun should record the actions even though the DryRun option was
+	// not set
+	tx := testPool.NewTransaction()
+	tx.Command("SET", redis.Args{"key", "value"}, nil)
+	tx.Command("INCR", redis.Args{"counter"}, nil)
+	recording, err := tx.ExecDryRun()
+	require.NoError(t, err)
+	expectEmptyDatabase(t)
+	require.NotNil(t, recording)
+	assert.Equal(t, tx.Recording(), recording)
+	assert.Equal(t, "MULTI\nSET key value\nINCR counter\nEXEC\n", recording.RedisCLI())
+
+	p := testPool.NewPipeline()
+	p.Command("SET", redis.Args{"key", "value"}, nil)
+	p.Command("INCR", redis.Args{"counter"}, nil)
+	recording, err = p.ExecDryRun()
+	require.NoError(t, err)
+	expectEmptyDatabase(t)
+	require.NotNil(t, recording)
+	assert.False(t, recording.Atomic)
+	assert.Len(t, recording.Steps, 2)
+
+	// Errors encountered while adding actions should be returned
+	tx = testPool.NewTransaction()
+	tx.RunScript("invalid", nil, nil)
+	recording, err = tx.ExecDryRun()
+	assert.Error(t, err)
+	assert.Nil(t, recording)
+}
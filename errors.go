@@ -39,3 +39,137 @@ type WatchError struct {
 func (e WatchError) Error() string {
 	return fmt.Sprintf("zoom: watch error: at least one of the following keys has changed: %v", e.keys)
 }
+
+// LockError is returned by Collection.Lock and the methods of Lock if a lock
+// could not be acquired, released, or extended, and by Transaction.Exec if a
+// lock which was required with Transaction.RequireLock is no longer held.
+type LockError struct {
+	Collection *Collection
+	ID         string
+	Msg        string
+}
+
+func (e LockError) Error() string {
+	return fmt.Sprintf("zoom: LockError for %s with id = %s: %s", e.Collection.Name(), e.ID, e.Msg)
+}
+
+func newLockError(collection *Collection, id string, msg string) error {
+	return LockError{
+		Collection: collection,
+		ID:         id,
+		Msg:        msg,
+	}
+}
+
+// ParseError is returned by Collection.ParseQuery if the query string is
+// invalid. Pos is the position in the query string (in bytes, starting from 0)
+// where the error occurred.
+type ParseError struct {
+	Query string
+	Pos   int
+	Msg   string
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("zoom: error parsing query at position %d: %s", e.Pos, e.Msg)
+}
+
+func newParseError(query string, pos int, msg string) error {
+	return ParseError{
+		Query: query,
+		Pos:   pos,
+		Msg:   msg,
+	}
+}
+
+// BatchError is returned by the batch methods (e.g. Collection.SaveMany) and
+// Pipeline.Exec if there was an error for one or more items. Errors maps the
+// index of each item (or each action for Pipeline.Exec) that failed to the
+// corresponding error. The other items were processed successfully.
+type BatchError struct {
+	Method string
+	Errors map[int]error
+}
+
+func (e BatchError) Error() string {
+	first := -1
+	for i := range e.Errors {
+		if first == -1 || i < first {
+			first = i
+		}
+	}
+	return fmt.Sprintf("zoom: error in %s: %d item(s) failed. First error (at index %d): %s", e.Method, len(e.Errors), first, e.Errors[first].Error())
+}
+
+// TransactionError is returned by Transaction.Exec if the transaction was
+// created with the DetailedErrors or CollectAllErrors option and the reply or
+// handler for one of its actions returned an error. It identifies the action
+// which failed.
+type TransactionError struct {
+	// Index is the index of the action, in the order the actions were added to
+	// the transaction.
+	Index int
+	// Name is the name of the command (e.g. "HMSET") or the name of the Lua
+	// script (e.g. "delete_models_by_ids"). Scripts which are not part of Zoom
+	// and were not registered with Pool.RegisterScript are named "script".
+	Name string
+	// IsScript is true iff the action was a Lua script.
+	IsScript bool
+	// Collection is the name of the collection that the action operates on, or
+	// an empty string if it could not be determined.
+	Collection string
+	// Err is the error returned by the reply or handler.
+	Err error
+}
+
+func (e TransactionError) Error() string {
+	kind := "command"
+	if e.IsScript {
+		kind = "script"
+	}
+	collection := ""
+	if e.Collection != "" {
+		collection = " on collection " + e.Collection
+	}
+	return fmt.Sprintf("zoom: error in transaction action %d (%s %s%s): %s", e.Index, kind, e.Name, collection, e.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (e TransactionError) Unwrap() error {
+	return e.Err
+}
+
+func newTransactionError(index int, a *Action, err error) TransactionError {
+	txErr := TransactionError{
+		Index:      index,
+		Name:       a.name,
+		Collection: a.collectionName(),
+		Err:        err,
+	}
+	if a.kind == scriptAction {
+		txErr.IsScript = true
+		if a.name == "" {
+			txErr.Name = scriptName(a.script)
+		}
+	}
+	return txErr
+}
+
+// TransactionErrors is returned by Transaction.Exec if the transaction was
+// created with the CollectAllErrors option and the replies or handlers for one
+// or more actions returned an error. It contains a TransactionError for each
+// of them, in the order the actions were added.
+type TransactionErrors []TransactionError
+
+func (e TransactionErrors) Error() string {
+	return fmt.Sprintf("zoom: %d action(s) in the transaction failed. First error: %s", len(e), e[0].Error())
+}
+
+// Unwrap returns all the underlying errors.
+func (e TransactionErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, txErr := range e {
+		errs[i] = txErr
+	}
+	return errs
+}
@@ -0,0 +1,195 @@
+// File explain.go contains code for inspecting the Redis commands and
+// scripts that are generated for a query.
+
+package kvmodel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ExplainStep is a single Redis command or Lua script that is part of the
+// execution plan for a query. ExplainSteps are returned by Query.Explain and
+// Query.ExplainAnalyze.
+type ExplainStep struct {
+	// Name is the name of the Redis command (e.g. "ZINTERSTORE" or "SORT"). For
+	// Lua scripts, Name is "EVALSHA".
+	Name string
+	// ScriptHash is the SHA1 hash of the source of the Lua script. It is empty
+	// if the step is a command.
+	ScriptHash string
+	// Args are the arguments for the command or script, converted to strings.
+	// For scripts, Args does not include the hash or the number of keys.
+	Args []string
+	// Cardinality is the number of ids returned or stored by the step. It is
+	// only set by ExplainAnalyze. For commands which return an integer (e.g.
+	// ZINTERSTORE or SORT with the STORE option), Cardinality is the integer.
+	// For commands which return an array, it is the number of elements in the
+	// array, except for SORT with GET options, where it is the number of ids.
+	Cardinality int
+	// Duration is the amount of time it took to run the step, including the
+	// network round trip. It is only set by ExplainAnalyze.
+	Duration time.Duration
+}
+
+// String satisfies fmt.Stringer and prints out the step in a format that
+// resembles the input to redis-cli. Arguments which contain spaces, quotes, or
+// non-printable characters (such as the NULL character used in string indexes)
+// are quoted.
+func (step ExplainStep) String() string {
+	parts := []string{step.Name}
+	if step.ScriptHash != "" {
+		parts = append(parts, step.ScriptHash, "0")
+	}
+	for _, arg := range step.Args {
+		parts = append(parts, quoteArg(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteArg returns arg surrounded by quotes if it contains spaces, quotes, or
+// non-printable characters. Otherwise it returns arg unchanged.
+func quoteArg(arg string) string {
+	if arg == "" {
+		return `""`
+	}
+	for _, r := range arg {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) || r == '"' || r == '\'' || r == '\\' {
+			return strconv.Quote(arg)
+		}
+	}
+	return arg
+}
+
+// Explain returns the ordered list of Redis commands and Lua scripts that would
+// be sent to the database if the query were run with Query.Run. This includes
+// the commands for creating and deleting any temporary keys. Explain does not
+// touch the database, and the names of the temporary keys are randomly
+// generated each time. Explain will return the first error that occurred during
+// the lifetime of the query (if any).
+func (q *Query) Explain() ([]ExplainStep, error) {
+	// The transaction is never executed, so it doesn't need a connection.
+	tx := &Transaction{}
+	q.explainRun(tx)
+	if tx.err != nil {
+		return nil, tx.err
+	}
+	steps := make([]ExplainStep, len(tx.actions))
+	for i, a := range tx.actions {
+		steps[i] = newExplainStep(a)
+	}
+	return steps, nil
+}
+
+// ExplainAnalyze works like Explain, but actually runs each step and records
+// its cardinality and the amount of time it took. Unlike Query.Run, the steps
+// are sent one at a time rather than in a single MULTI/EXEC transaction, so
+// the query is not atomic and the results are not scanned into any models.
+// Temporary keys are deleted as usual. If a step fails, ExplainAnalyze returns
+// the steps that were run up to that point along with the error.
+// ExplainAnalyze returns an error if the DryRun option is set for the pool.
+func (q *Query) ExplainAnalyze() ([]ExplainStep, error) {
+	if q.pool.options.DryRun {
+		return nil, fmt.Errorf("zoom: error in ExplainAnalyze: cannot run the steps because the DryRun option is set for the pool")
+	}
+	tx := q.pool.NewTransaction()
+	defer func() {
+		_ = tx.conn.Close()
+	}()
+	q.explainRun(tx)
+	if tx.err != nil {
+		return nil, tx.err
+	}
+	steps := []ExplainStep{}
+	for i, a := range tx.actions {
+		step := newExplainStep(a)
+		start := time.Now()
+		reply, err := tx.doAction(a)
+		step.Duration = time.Since(start)
+		if err != nil {
+			// Make sure the temporary keys are still deleted
+			deleteTmpKeys(tx, tx.actions[i+1:])
+			return steps, err
+		}
+		step.Cardinality = replyCardinality(step, reply)
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// deleteTmpKeys runs each of the DEL commands in actions, which are the
+// remaining actions for a query whose steps failed. The only keys that the
+// actions for a query delete are temporary keys. Errors are ignored, since
+// the keys would expire anyway if the TemporaryKeyTTL option is set.
+func deleteTmpKeys(tx *Transaction, actions []*Action) {
+	for _, a := range actions {
+		if a.kind == commandAction && a.name == "DEL" {
+			_, _ = tx.doAction(a)
+		}
+	}
+}
+
+// explainRun adds the actions for running the query to tx, using a new slice
+// of models of the correct type.
+func (q *Query) explainRun(tx *Transaction) {
+	models := q.collection.spec.newModelsSlice()
+	newTransactionQuery(q.query, tx).Run(models)
+}
+
+// newExplainStep converts a to an ExplainStep.
+func newExplainStep(a *Action) ExplainStep {
+	step := ExplainStep{
+		Name: a.name,
+		Args: make([]string, len(a.args)),
+	}
+	if a.kind == scriptAction {
+		step.Name = "EVALSHA"
+		step.ScriptHash = a.script.Hash()
+	}
+	for i, arg := range a.args {
+		step.Args[i] = argString(arg)
+	}
+	return step
+}
+
+// argString converts a single argument for a command or script to a string.
+func argString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	default:
+		return fmt.Sprint(arg)
+	}
+}
+
+// replyCardinality returns the cardinality of reply, which should be the reply
+// for step. See the documentation for ExplainStep.Cardinality.
+func replyCardinality(step ExplainStep, reply interface{}) int {
+	switch reply := reply.(type) {
+	case int64:
+		return int(reply)
+	case []interface{}:
+		if step.Name == "SORT" {
+			numGets := 0
+			for _, arg := range step.Args {
+				if arg == "GET" {
+					numGets++
+				}
+			}
+			if numGets > 0 {
+				return len(reply) / numGets
+			}
+		}
+		return len(reply)
+	}
+	// Ignore the error here. Any other kind of reply is not a cardinality.
+	n, _ := redis.Int(reply, nil)
+	return n
+}
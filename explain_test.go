@@ -0,0 +1,92 @@
+// File explain_test.go tests the Explain and ExplainAnalyze methods for
+// queries (explain.go)
+
+package kvmodel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryExplain(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	q := indexedTestModels.NewQuery().Filter("Int >", 3).Order("-String").Limit(2)
+	steps, err := q.Explain()
+	require.NoError(t, err)
+	names := []string{}
+	for _, step := range steps {
+		names = append(names, step.Name)
+	}
+	// The order on a string field requires a script to extract the ids, the
+	// filter requires a script and a ZINTERSTORE, then the results are read
+	// with SORT and all the temporary keys are deleted. Each temporary key is
+	// given an expiration as soon as it is written.
+	expectedNames := []string{"EVALSHA", "PEXPIRE", "EVALSHA", "PEXPIRE", "ZINTERSTORE", "DEL", "PEXPIRE", "SORT", "DEL"}
+	assert.Equal(t, expectedNames, names)
+	assert.Equal(t, extractIdsFromStringIndexScript.Hash(), steps[0].ScriptHash)
+	sortStep := steps[7]
+	assert.True(t, strings.HasPrefix(sortStep.String(), "SORT tmp:indexedTestModel:filter:all:"), "Unexpected SORT step: %s", sortStep)
+	assert.Contains(t, sortStep.Args, "DESC")
+
+	// Explain should not touch the database.
+	checkForLeakedTmpKeys(t, q.query)
+
+	// Errors in the query should be returned.
+	_, err = indexedTestModels.NewQuery().Order("Foo").Explain()
+	assert.Error(t, err)
+}
+
+func TestQueryExplainAnalyze(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	tx := testPool.NewTransaction()
+	for i := 0; i < 10; i++ {
+		tx.Save(indexedTestModels, &indexedTestModel{Int: i})
+	}
+	require.NoError(t, tx.Exec())
+
+	q := indexedTestModels.NewQuery().Filter("Int >=", 4).Order("Int")
+	steps, err := q.ExplainAnalyze()
+	require.NoError(t, err)
+	require.Len(t, steps, 7)
+	// The script extracts the ids matching the filter.
+	assert.Equal(t, "EVALSHA", steps[0].Name)
+	assert.Equal(t, 6, steps[0].Cardinality)
+	// ZINTERSTORE intersects them with the ordered ids.
+	assert.Equal(t, "ZINTERSTORE", steps[2].Name)
+	assert.Equal(t, 6, steps[2].Cardinality)
+	// SORT returns the final results.
+	assert.Equal(t, "SORT", steps[5].Name)
+	assert.Equal(t, 6, steps[5].Cardinality)
+	checkForLeakedTmpKeys(t, q.query)
+}
+
+func TestQueryExplainAnalyzeErrorDeletesTmpKeys(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	tx := testPool.NewTransaction()
+	for i := 0; i < 10; i++ {
+		model := createIndexedPrimativesModel()
+		model.Int64 = int64(i)
+		tx.Save(indexedPrimativesModels, model)
+	}
+	tx.Command("SET", redis.Args{"notASet", "foo"}, nil)
+	require.NoError(t, tx.Exec())
+
+	// Ordering by an integer index extracts the ordered ids into a temporary
+	// key first, so restricting the ids to a key of the wrong type causes one
+	// of the later steps to fail after some temporary keys have been created
+	q := indexedPrimativesModels.NewQuery().Filter("Int64 >=", int64(4)).Order("Int64").Within("notASet")
+	steps, err := q.ExplainAnalyze()
+	require.Error(t, err)
+	assert.NotEmpty(t, steps)
+	checkForLeakedTmpKeys(t, q.query)
+}
@@ -0,0 +1,199 @@
+// File geo.go contains code related to geo indexes and geospatial queries.
+
+package kvmodel
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// GeoPoint is a location on the surface of the earth, expressed as a latitude
+// and longitude in degrees. A field of type GeoPoint or *GeoPoint which has the
+// `zoom:"index"` struct tag will be stored in a geo index, which allows you to
+// use the Near and WithinBox query modifiers. Each model type may have at most
+// one geo index. As with all other indexes, a field of type *GeoPoint which is
+// nil will not be indexed. Redis only accepts latitudes between -85.05112878
+// and 85.05112878 and longitudes between -180 and 180, so saving a GeoPoint
+// outside of that range in a geo index is an error.
+type GeoPoint struct {
+	Lat float64
+	Lon float64
+}
+
+const (
+	// maxGeoLat and maxGeoLon are the maximum absolute values for the latitude
+	// and longitude of a location in a geo index.
+	maxGeoLat = 85.05112878
+	maxGeoLon = 180
+)
+
+// validate returns an error if p cannot be stored in a geo index.
+func (p GeoPoint) validate() error {
+	// The comparisons are written so that NaN is also invalid
+	if !(p.Lat >= -maxGeoLat && p.Lat <= maxGeoLat) || !(p.Lon >= -maxGeoLon && p.Lon <= maxGeoLon) {
+		return fmt.Errorf("invalid GeoPoint (Lat: %v, Lon: %v): the latitude must be between -%v and %v and the longitude must be between -%v and %v", p.Lat, p.Lon, maxGeoLat, maxGeoLat, maxGeoLon, maxGeoLon)
+	}
+	return nil
+}
+
+var (
+	geoPointType    = reflect.TypeOf(GeoPoint{})
+	geoPointPtrType = reflect.TypeOf(&GeoPoint{})
+)
+
+// geoUnits is the set of units which are accepted by Near and WithinBox. They
+// are the same units that are accepted by Redis.
+var geoUnits = map[string]bool{
+	"m":  true,
+	"km": true,
+	"mi": true,
+	"ft": true,
+}
+
+// typeIsGeoPoint returns true iff typ is GeoPoint or *GeoPoint.
+func typeIsGeoPoint(typ reflect.Type) bool {
+	return typ == geoPointType || typ == geoPointPtrType
+}
+
+// geoFieldSpec returns the fieldSpec for the geo indexed field of ms, or nil
+// if ms does not have a geo indexed field.
+func (ms *modelSpec) geoFieldSpec() *fieldSpec {
+	for _, fs := range ms.fields {
+		if fs.indexKind == geoIndex {
+			return fs
+		}
+	}
+	return nil
+}
+
+// geoShape is the shape of the area used in a geospatial query, and is either
+// radiusShape or boxShape.
+type geoShape int
+
+const (
+	radiusShape geoShape = iota
+	boxShape
+)
+
+// geoSearch represents a Near or WithinBox query modifier.
+type geoSearch struct {
+	fieldSpec *fieldSpec
+	shape     geoShape
+	lat       float64
+	lon       float64
+	radius    float64
+	width     float64
+	height    float64
+	unit      string
+}
+
+func (gs geoSearch) String() string {
+	if gs.shape == radiusShape {
+		return fmt.Sprintf(`Near(%v, %v, %v, "%s")`, gs.lat, gs.lon, gs.radius, gs.unit)
+	}
+	return fmt.Sprintf(`WithinBox(%v, %v, %v, %v, "%s")`, gs.lat, gs.lon, gs.width, gs.height, gs.unit)
+}
+
+// shapeArgs returns the arguments for the GEOSEARCH command which describe the
+// shape of the search area.
+func (gs geoSearch) shapeArgs() redis.Args {
+	if gs.shape == radiusShape {
+		return redis.Args{"BYRADIUS", gs.radius, gs.unit}
+	}
+	return redis.Args{"BYBOX", gs.width, gs.height, gs.unit}
+}
+
+// Near restricts the query to models within radius of the given location. See
+// the documentation for Query.Near for more information.
+func (q *query) Near(lat, lon, radius float64, unit string) {
+	if radius < 0 {
+		q.setError(errors.New("zoom: error in Query.Near: radius cannot be negative"))
+		return
+	}
+	q.setGeoSearch("Near", geoSearch{
+		shape:  radiusShape,
+		lat:    lat,
+		lon:    lon,
+		radius: radius,
+		unit:   unit,
+	})
+}
+
+// WithinBox restricts the query to models within a box centered on the given
+// location. See the documentation for Query.WithinBox for more information.
+func (q *query) WithinBox(lat, lon, width, height float64, unit string) {
+	if width < 0 || height < 0 {
+		q.setError(errors.New("zoom: error in Query.WithinBox: width and height cannot be negative"))
+		return
+	}
+	q.setGeoSearch("WithinBox", geoSearch{
+		shape:  boxShape,
+		lat:    lat,
+		lon:    lon,
+		width:  width,
+		height: height,
+		unit:   unit,
+	})
+}
+
+// setGeoSearch validates gs and sets the geoSearch property of q. methodName
+// is used to make error messages more helpful.
+func (q *query) setGeoSearch(methodName string, gs geoSearch) {
+	if q.hasGeoSearch() {
+		q.setError(fmt.Errorf("zoom: error in Query.%s: previous Near or WithinBox already specified (only one per query is allowed)", methodName))
+		return
+	}
+	if !geoUnits[gs.unit] {
+		q.setError(fmt.Errorf("zoom: error in Query.%s: invalid unit %q (should be one of m, km, mi, or ft)", methodName, gs.unit))
+		return
+	}
+	gs.fieldSpec = q.collection.spec.geoFieldSpec()
+	if gs.fieldSpec == nil {
+		q.setError(fmt.Errorf("zoom: error in Query.%s: type %s does not have a geo indexed field (try adding the `zoom:\"index\"` struct tag to a field of type GeoPoint)", methodName, q.collection.spec.typ.String()))
+		return
+	}
+	q.geoSearch = &gs
+}
+
+// hasGeoSearch returns true iff Near or WithinBox was used on the query.
+func (q *query) hasGeoSearch() bool {
+	return q.geoSearch != nil
+}
+
+// saveGeoIndex adds commands to the transaction for saving a geo index on the
+// given field. If the field is a nil pointer, the model is removed from the
+// index instead. If the location is invalid, it adds an error to the
+// transaction, so that none of the commands for saving the model are executed.
+func (t *Transaction) saveGeoIndex(mr *modelRef, fs *fieldSpec) {
+	indexKey, err := mr.spec.fieldIndexKey(fs.name)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	fieldValue := mr.fieldValue(fs.name)
+	if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+		t.Command("ZREM", redis.Args{indexKey, mr.model.ModelID()}, nil)
+		return
+	}
+	point := reflect.Indirect(fieldValue).Interface().(GeoPoint)
+	if err := point.validate(); err != nil {
+		t.setError(fmt.Errorf("zoom: error saving field %s of model %s: %s", fs.name, mr.model.ModelID(), err.Error()))
+		return
+	}
+	t.Command("GEOADD", redis.Args{indexKey, point.Lon, point.Lat, mr.model.ModelID()}, nil)
+}
+
+// geoIndexValue returns the value for a geo index expected by the
+// update_models_by_ids script, i.e. the longitude and latitude separated by a
+// space. It returns an error if the location cannot be stored in a geo index.
+func geoIndexValue(fieldValue reflect.Value) (string, error) {
+	point := reflect.Indirect(fieldValue).Interface().(GeoPoint)
+	if err := point.validate(); err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(point.Lon, 'f', -1, 64) + " " + strconv.FormatFloat(point.Lat, 'f', -1, 64), nil
+}
@@ -0,0 +1,235 @@
+// File geo_test.go tests geo indexes and the Near and WithinBox query
+// modifiers (geo.go)
+
+package kvmodel
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createAndSaveGeoTestModels saves a geoTestModel for each of a few cities in
+// California and returns them in order of their distance from San Francisco.
+func createAndSaveGeoTestModels(t *testing.T) []*geoTestModel {
+	models := []*geoTestModel{
+		{Name: "San Francisco", Location: &GeoPoint{Lat: 37.7749, Lon: -122.4194}},
+		{Name: "Oakland", Location: &GeoPoint{Lat: 37.8044, Lon: -122.2712}},
+		{Name: "San Jose", Location: &GeoPoint{Lat: 37.3382, Lon: -121.8863}},
+		{Name: "Los Angeles", Location: &GeoPoint{Lat: 34.0522, Lon: -118.2437}},
+		{Name: "Nowhere"},
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(geoTestModels, model)
+	}
+	require.NoError(t, tx.Exec())
+	return models
+}
+
+// geoIndexContains returns true iff the geo index for geoTestModels contains
+// the given id.
+func geoIndexContains(t *testing.T, id string) bool {
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	indexKey, err := geoTestModels.FieldIndexKey("Location")
+	require.NoError(t, err)
+	reply, err := conn.Do("ZSCORE", indexKey, id)
+	require.NoError(t, err)
+	return reply != nil
+}
+
+func TestGeoIndex(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createAndSaveGeoTestModels(t)
+	for _, model := range models[:4] {
+		assert.True(t, geoIndexContains(t, model.ModelID()), "Expected %s to be in the geo index", model.Name)
+	}
+	// Models with a nil location should not be indexed.
+	assert.False(t, geoIndexContains(t, models[4].ModelID()))
+
+	// The location should be saved in the main hash and found again.
+	found := &geoTestModel{}
+	require.NoError(t, geoTestModels.Find(models[0].ModelID(), found))
+	assert.Equal(t, models[0], found)
+
+	// Setting the location to nil should remove the model from the index.
+	models[1].Location = nil
+	require.NoError(t, geoTestModels.Save(models[1]))
+	assert.False(t, geoIndexContains(t, models[1].ModelID()))
+
+	// Deleting the model should remove it from the index.
+	_, err := geoTestModels.Delete(models[2].ModelID())
+	require.NoError(t, err)
+	assert.False(t, geoIndexContains(t, models[2].ModelID()))
+
+	// Only one geo index is allowed per model type.
+	type twoGeoIndexesModel struct {
+		Home *GeoPoint `zoom:"index"`
+		Work *GeoPoint `zoom:"index"`
+		RandomID
+	}
+	_, err = compileModelSpec(reflect.TypeOf(&twoGeoIndexesModel{}))
+	assert.Error(t, err)
+}
+
+func TestGeoIndexInvalidLocation(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createAndSaveGeoTestModels(t)
+	invalid := []GeoPoint{
+		{Lat: 90, Lon: 0},
+		{Lat: -85.1, Lon: 0},
+		{Lat: 0, Lon: 180.5},
+		{Lat: math.NaN(), Lon: 0},
+	}
+	for _, point := range invalid {
+		// Nothing should be saved, including the main hash and the other
+		// indexes
+		model := &geoTestModel{Name: "Invalid", Location: &point}
+		assert.Error(t, geoTestModels.Save(model), "Expected an error for %v", point)
+		expectKeyDoesNotExist(t, geoTestModels.ModelKey(model.ModelID()))
+		assert.False(t, geoIndexContains(t, model.ModelID()))
+
+		// Query.Update should not update any models
+		_, err := geoTestModels.NewQuery().Filter("Name =", "Oakland").Update(map[string]interface{}{
+			"Location": point,
+		})
+		assert.Error(t, err, "Expected an error for %v", point)
+	}
+	found := &geoTestModel{}
+	require.NoError(t, geoTestModels.Find(models[1].ModelID(), found))
+	assert.Equal(t, models[1], found)
+
+	// The bounds themselves are valid
+	model := &geoTestModel{Name: "Edge", Location: &GeoPoint{Lat: -maxGeoLat, Lon: maxGeoLon}}
+	require.NoError(t, geoTestModels.Save(model))
+	assert.True(t, geoIndexContains(t, model.ModelID()))
+}
+
+func TestQueryNear(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createAndSaveGeoTestModels(t)
+	sf := models[0].Location
+
+	// Near without an order.
+	got := []*geoTestModel{}
+	q := geoTestModels.NewQuery().Near(sf.Lat, sf.Lon, 20, "km")
+	require.NoError(t, q.Run(&got))
+	assert.ElementsMatch(t, models[:2], got)
+	checkForLeakedTmpKeys(t, q.query)
+
+	// Ordered by distance.
+	q = geoTestModels.NewQuery().Near(sf.Lat, sf.Lon, 100, "km").Order("Location")
+	require.NoError(t, q.Run(&got))
+	assert.Equal(t, models[:3], got)
+	q = geoTestModels.NewQuery().Near(sf.Lat, sf.Lon, 1000, "km").Order("-Location").Limit(2)
+	require.NoError(t, q.Run(&got))
+	assert.Equal(t, []*geoTestModel{models[3], models[2]}, got)
+
+	// Combined with a filter and an order on another field.
+	q = geoTestModels.NewQuery().Near(sf.Lat, sf.Lon, 1000, "km").Filter("Name !=", "Oakland").Order("Name")
+	require.NoError(t, q.Run(&got))
+	assert.Equal(t, []*geoTestModel{models[3], models[0], models[2]}, got)
+	checkForLeakedTmpKeys(t, q.query)
+
+	// Other finishers.
+	count, err := geoTestModels.NewQuery().Near(sf.Lat, sf.Lon, 100, "km").Count()
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	ids, err := geoTestModels.NewQuery().Near(sf.Lat, sf.Lon, 100, "km").Order("Location").IDs()
+	require.NoError(t, err)
+	assert.Equal(t, modelIDs(Models(models[:3])), ids)
+}
+
+func TestQueryWithinBox(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createAndSaveGeoTestModels(t)
+	sf := models[0].Location
+
+	// San Jose is about 47 km east of San Francisco, so a box that is only 40 km
+	// wide should exclude it, no matter how tall it is.
+	got := []*geoTestModel{}
+	q := geoTestModels.NewQuery().WithinBox(sf.Lat, sf.Lon, 40, 200, "km").Order("Location")
+	require.NoError(t, q.Run(&got))
+	assert.Equal(t, models[:2], got)
+	q = geoTestModels.NewQuery().WithinBox(sf.Lat, sf.Lon, 150, 150, "km").Order("Location")
+	require.NoError(t, q.Run(&got))
+	assert.Equal(t, models[:3], got)
+	checkForLeakedTmpKeys(t, q.query)
+}
+
+func TestQueryNearUpdate(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createAndSaveGeoTestModels(t)
+	sf := models[0].Location
+
+	// Move Los Angeles to San Francisco.
+	_, err := geoTestModels.NewQuery().Filter("Name =", "Los Angeles").Update(map[string]interface{}{
+		"Location": *sf,
+	})
+	require.NoError(t, err)
+	ids, err := geoTestModels.NewQuery().Near(sf.Lat, sf.Lon, 1, "km").IDs()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{models[0].ModelID(), models[3].ModelID()}, ids)
+
+	// Setting the location to nil should remove it from the index.
+	_, err = geoTestModels.NewQuery().Filter("Name =", "Los Angeles").Update(map[string]interface{}{
+		"Location": nil,
+	})
+	require.NoError(t, err)
+	assert.False(t, geoIndexContains(t, models[3].ModelID()))
+
+	// Bulk delete should remove the models from the index.
+	_, err = geoTestModels.NewQuery().Near(sf.Lat, sf.Lon, 1, "km").Delete()
+	require.NoError(t, err)
+	assert.False(t, geoIndexContains(t, models[0].ModelID()))
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	indexKey, err := geoTestModels.FieldIndexKey("Location")
+	require.NoError(t, err)
+	n, err := redis.Int(conn.Do("ZCARD", indexKey))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestQueryNearErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	testCases := []struct {
+		name  string
+		query *Query
+	}{
+		{"invalid unit", geoTestModels.NewQuery().Near(0, 0, 1, "lightyears")},
+		{"negative radius", geoTestModels.NewQuery().Near(0, 0, -1, "km")},
+		{"negative width", geoTestModels.NewQuery().WithinBox(0, 0, -1, 1, "km")},
+		{"two searches", geoTestModels.NewQuery().Near(0, 0, 1, "km").WithinBox(0, 0, 1, 1, "km")},
+		{"no geo index", indexedTestModels.NewQuery().Near(0, 0, 1, "km")},
+		{"order without search", geoTestModels.NewQuery().Order("Location")},
+		{"filter on geo field", geoTestModels.NewQuery().Filter("Location =", GeoPoint{})},
+	}
+	for _, tc := range testCases {
+		_, err := tc.query.IDs()
+		assert.Error(t, err, "Expected an error for %s", tc.name)
+	}
+	_, err := geoTestModels.NewQuery().GroupCount("Location")
+	assert.Error(t, err)
+}
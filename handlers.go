@@ -53,6 +53,21 @@ func NewScanIntHandler(i *int) ReplyHandler {
 	}
 }
 
+// NewScanInt64Handler returns a ReplyHandler which will convert the reply to a
+// 64-bit integer and set the value of i to the converted integer. The
+// ReplyHandler will return an error if there was a problem converting the
+// reply.
+func NewScanInt64Handler(i *int64) ReplyHandler {
+	return func(reply interface{}) error {
+		var err error
+		(*i), err = redis.Int64(reply, nil)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
 // NewScanBoolHandler returns a ReplyHandler which will convert the reply to a
 // bool and set the value of i to the converted bool. The ReplyHandler
 // will return an error if there was a problem converting the reply.
@@ -110,6 +125,22 @@ func NewScanStringsHandler(strings *[]string) ReplyHandler {
 	}
 }
 
+// NewScanStringMapHandler returns a ReplyHandler which will convert the reply,
+// which should be an array of alternating keys and values (e.g. the reply from
+// HGETALL), to a map of strings and set the value of m to the converted value.
+// The ReplyHandler will return an error if there was a problem converting the
+// reply.
+func NewScanStringMapHandler(m *map[string]string) ReplyHandler {
+	return func(reply interface{}) error {
+		var err error
+		(*m), err = redis.StringMap(reply, nil)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
 // newScanModelRefHandler works exactly like the exported NewScanModelHandler,
 // but it expects a *modelRef as the final argument instead of a Model. See
 // the documentation for NewScanModelHandler for more information.
@@ -290,3 +321,35 @@ func newScanOneModelHandler(q *query, spec *modelSpec, fieldNames []string, mode
 		return nil
 	}
 }
+
+// newScanGroupCountsHandler returns a ReplyHandler which will scan the reply
+// from the group_count script into counts. It expects a reply which is an array
+// of alternating values and counts. Each value is converted to the underlying
+// type of the field identified by fs, so that it can be used as a key in
+// counts.
+func newScanGroupCountsHandler(fs *fieldSpec, counts *map[interface{}]int) ReplyHandler {
+	return func(reply interface{}) error {
+		valuesAndCounts, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		results := make(map[interface{}]int, len(valuesAndCounts)/2)
+		for i := 0; i+1 < len(valuesAndCounts); i += 2 {
+			valueBytes, err := redis.Bytes(valuesAndCounts[i], nil)
+			if err != nil {
+				return err
+			}
+			value, err := convertIndexValue(fs, valueBytes)
+			if err != nil {
+				return err
+			}
+			count, err := redis.Int(valuesAndCounts[i+1], nil)
+			if err != nil {
+				return err
+			}
+			results[value] += count
+		}
+		(*counts) = results
+		return nil
+	}
+}
@@ -0,0 +1,186 @@
+// File integer_index.go contains code related to integer indexes, which are
+// used for 64-bit integer fields.
+
+package kvmodel
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// typeIsLargeInteger returns true iff typ is int64 or uint64. Fields of these
+// types are stored in integer indexes instead of numeric indexes, because the
+// scores of a sorted set are float64s and integers above 2^53 would lose
+// precision. Fields of type int and uint are still stored in numeric indexes,
+// so that existing indexes for them remain valid.
+func typeIsLargeInteger(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Int64, reflect.Uint64:
+		return true
+	default:
+		return false
+	}
+}
+
+// encodeInteger returns the encoded form of val, which should be an integer or
+// a pointer to an integer, as it is stored in an integer index. See
+// encodeIntegerString for a description of the encoding.
+func encodeInteger(val reflect.Value) string {
+	for val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return encodeIntegerString(strconv.FormatInt(val.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return encodeIntegerString(strconv.FormatUint(val.Uint(), 10))
+	}
+	msg := fmt.Sprintf("zoom: attempt to call encodeInteger on non-integer type %s", val.Type().String())
+	panic(msg)
+}
+
+// encodeIntegerString converts the decimal representation of an integer into
+// a string which sorts lexicographically in the same order as the integers
+// themselves. Non-negative integers are encoded as "p", followed by the number
+// of digits as two digits, followed by the digits. Negative integers are
+// encoded as "n", followed by 99 minus the number of digits as two digits,
+// followed by the nines' complement of the digits, so that integers with a
+// larger absolute value come first. The same encoding is implemented in Lua by
+// the scripts which maintain integer indexes.
+func encodeIntegerString(s string) string {
+	if strings.HasPrefix(s, "-") {
+		digits := []byte(s[1:])
+		for i, digit := range digits {
+			digits[i] = '9' - (digit - '0')
+		}
+		return fmt.Sprintf("n%02d%s", 99-len(digits), digits)
+	}
+	return fmt.Sprintf("p%02d%s", len(s), s)
+}
+
+// decodeIntegerString converts an encoded integer from an integer index back
+// into its decimal representation. It is the inverse of encodeIntegerString.
+func decodeIntegerString(encoded string) (string, error) {
+	if len(encoded) < 4 || (encoded[0] != 'p' && encoded[0] != 'n') {
+		return "", fmt.Errorf("zoom: could not decode integer from index value %q", encoded)
+	}
+	if encoded[0] == 'p' {
+		return encoded[3:], nil
+	}
+	digits := []byte(encoded[3:])
+	for i, digit := range digits {
+		digits[i] = '9' - (digit - '0')
+	}
+	return "-" + string(digits), nil
+}
+
+// saveIntegerIndex adds commands to the transaction for saving an integer
+// index on the given field. This includes removing the old index (if any).
+func (t *Transaction) saveIntegerIndex(mr *modelRef, fs *fieldSpec) {
+	// Remove the old index (if any)
+	t.deleteIntegerIndex(mr.spec.name, mr.model.ModelID(), fs.redisName)
+	fieldValue := mr.fieldValue(fs.name)
+	if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+		return
+	}
+	member := encodeInteger(fieldValue) + nullString + mr.model.ModelID()
+	indexKey, err := mr.spec.fieldIndexKey(fs.name)
+	if err != nil {
+		t.setError(err)
+	}
+	t.Command("ZADD", redis.Args{indexKey, 0, member}, nil)
+}
+
+// RebuildIndex deletes the field index for the given field and builds it again
+// from the values stored in the main hash of each model in the collection. It
+// is needed after upgrading from a version of Zoom which stored fields of type
+// int64 or uint64 in numeric indexes, because those indexes are not valid
+// integer indexes. It can also be used to repair any other field index. The
+// collection must have been created with the Index option, since
+// RebuildIndex uses the set of all ids to find the models. The models are
+// read and indexed in chunks whose size is determined by the BatchSize
+// property of the PoolOptions, so RebuildIndex is not atomic and should be run
+// while no other process is saving or deleting models in the collection.
+// Queries which use the field may return incomplete results while it is
+// running.
+func (c *Collection) RebuildIndex(fieldName string) error {
+	if c == nil {
+		return newNilCollectionError("RebuildIndex")
+	}
+	if !c.index {
+		return fmt.Errorf("zoom: error in RebuildIndex: collection %s was not created with the Index option", c.Name())
+	}
+	fs, found := c.spec.fieldsByName[fieldName]
+	if !found {
+		return fmt.Errorf("zoom: error in RebuildIndex: could not find field %s in type %s", fieldName, c.spec.typ.String())
+	}
+	if fs.indexKind == noIndex {
+		return fmt.Errorf("zoom: error in RebuildIndex: field %s in type %s is not indexed", fieldName, c.spec.typ.String())
+	}
+	indexKey, err := c.spec.fieldIndexKey(fieldName)
+	if err != nil {
+		return err
+	}
+	keys := redis.Args{indexKey}
+	if fs.hasNullSet() {
+		nullSetKey, err := c.spec.fieldNullSetKey(fieldName)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, nullSetKey)
+	}
+	conn := c.pool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	ids, err := redis.Strings(conn.Do("SMEMBERS", c.IndexKey()))
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Do("DEL", keys...); err != nil {
+		return err
+	}
+	chunkSize := c.pool.options.BatchSize
+	if chunkSize <= 0 {
+		chunkSize = len(ids)
+	}
+	for start := 0; start < len(ids); start += chunkSize {
+		stop := start + chunkSize
+		if stop > len(ids) {
+			stop = len(ids)
+		}
+		models := reflect.New(reflect.SliceOf(c.spec.typ))
+		if err := c.FindMany(ids[start:stop], models.Interface()); err != nil {
+			// Models which were deleted in the meantime do not need an index
+			batchErr, ok := err.(BatchError)
+			if !ok {
+				return err
+			}
+			for _, err := range batchErr.Errors {
+				if _, notFound := err.(ModelNotFoundError); !notFound {
+					return batchErr
+				}
+			}
+		}
+		modelsVal := models.Elem()
+		err := c.execBatch("RebuildIndex", modelsVal.Len(), func(t *Transaction, i int) {
+			if modelsVal.Index(i).IsNil() {
+				return
+			}
+			mr := &modelRef{
+				collection: c,
+				model:      modelsVal.Index(i).Interface().(Model),
+				spec:       c.spec,
+			}
+			t.saveFieldIndexesForFields([]string{fieldName}, mr)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+// File integer_index_test.go tests integer indexes, which are used for 64-bit
+// integer fields (integer_index.go)
+
+package kvmodel
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeInteger(t *testing.T) {
+	ints := []int64{math.MinInt64, -1 << 53, -1001, -1000, -999, -10, -9, -1, 0, 1, 9, 10, 999, 1000, 1 << 53, (1 << 53) + 1, math.MaxInt64}
+	encoded := []string{}
+	for _, i := range ints {
+		e := encodeInteger(reflect.ValueOf(i))
+		decoded, err := decodeIntegerString(e)
+		require.NoError(t, err)
+		assert.Equal(t, strconv.FormatInt(i, 10), decoded)
+		encoded = append(encoded, e)
+	}
+	// The encoded strings should sort in the same order as the integers.
+	assert.True(t, sort.StringsAreSorted(encoded), "Encoded integers were not sorted: %v", encoded)
+
+	uints := []uint64{0, 1, 1 << 53, (1 << 53) + 1, math.MaxUint64}
+	encoded = []string{}
+	for _, u := range uints {
+		e := encodeInteger(reflect.ValueOf(&u))
+		decoded, err := decodeIntegerString(e)
+		require.NoError(t, err)
+		assert.Equal(t, strconv.FormatUint(u, 10), decoded)
+		encoded = append(encoded, e)
+	}
+	assert.True(t, sort.StringsAreSorted(encoded), "Encoded integers were not sorted: %v", encoded)
+
+	_, err := decodeIntegerString("x01")
+	assert.Error(t, err)
+}
+
+// createAndSaveLargeIntegerModels saves an indexedPrimativesModel for each of a
+// few integers which are too large to be represented exactly by a float64 and
+// returns them in ascending order.
+func createAndSaveLargeIntegerModels(t *testing.T) []*indexedPrimativesModel {
+	models := []*indexedPrimativesModel{}
+	tx := testPool.NewTransaction()
+	for i := 0; i < 5; i++ {
+		model := createIndexedPrimativesModel()
+		model.Int64 = math.MaxInt64 - 4 + int64(i)
+		model.Uint64 = (1 << 60) + uint64(i)
+		models = append(models, model)
+		tx.Save(indexedPrimativesModels, model)
+	}
+	require.NoError(t, tx.Exec())
+	return models
+}
+
+func TestIntegerIndexFilters(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createAndSaveLargeIntegerModels(t)
+	for _, q := range []*Query{
+		indexedPrimativesModels.NewQuery(),
+		indexedPrimativesModels.NewQuery().SingleScript(),
+	} {
+		ids, err := q.Filter("Int64 =", models[2].Int64).IDs()
+		require.NoError(t, err)
+		assert.Equal(t, []string{models[2].ModelID()}, ids)
+	}
+	testCases := []struct {
+		query    *Query
+		expected []*indexedPrimativesModel
+	}{
+		{
+			query:    indexedPrimativesModels.NewQuery().Filter("Uint64 =", uint64((1<<60)+3)),
+			expected: models[3:4],
+		},
+		{
+			query:    indexedPrimativesModels.NewQuery().Filter("Int64 >", models[1].Int64).Order("Int64"),
+			expected: models[2:],
+		},
+		{
+			query:    indexedPrimativesModels.NewQuery().Filter("Uint64 <=", models[1].Uint64).Order("-Uint64"),
+			expected: []*indexedPrimativesModel{models[1], models[0]},
+		},
+		{
+			query:    indexedPrimativesModels.NewQuery().Filter("Int64 !=", models[2].Int64).Order("Int64"),
+			expected: []*indexedPrimativesModel{models[0], models[1], models[3], models[4]},
+		},
+		{
+			query:    indexedPrimativesModels.NewQuery().Filter("Int64 in", []int64{models[0].Int64, models[4].Int64}).Order("-Int64"),
+			expected: []*indexedPrimativesModel{models[4], models[0]},
+		},
+	}
+	for _, tc := range testCases {
+		got := []*indexedPrimativesModel{}
+		require.NoError(t, tc.query.Run(&got))
+		assert.Equal(t, tc.expected, got, "Wrong results for query %s", tc.query)
+		expectSameResults(t, tc.query, true)
+		checkForLeakedTmpKeys(t, tc.query.query)
+	}
+}
+
+func TestIntegerIndexNegative(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	values := []int64{-1000, -999, -10, -1, 0, 1, 10}
+	tx := testPool.NewTransaction()
+	for _, i := range rand.Perm(len(values)) {
+		model := createIndexedPrimativesModel()
+		model.Int64 = values[i]
+		tx.Save(indexedPrimativesModels, model)
+	}
+	require.NoError(t, tx.Exec())
+	got := []*indexedPrimativesModel{}
+	require.NoError(t, indexedPrimativesModels.NewQuery().Filter("Int64 >=", int64(-999)).Order("Int64").Run(&got))
+	gotValues := []int64{}
+	for _, model := range got {
+		gotValues = append(gotValues, model.Int64)
+	}
+	assert.Equal(t, values[1:], gotValues)
+}
+
+func TestIntegerIndexMaintenance(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createAndSaveLargeIntegerModels(t)
+	for _, model := range models {
+		expectIndexExists(t, indexedPrimativesModels, model, "Int64")
+		expectIndexExists(t, indexedPrimativesModels, model, "Uint64")
+	}
+
+	// Saving a new value should replace the old entry in the index.
+	models[0].Int64 = -5
+	require.NoError(t, indexedPrimativesModels.Save(models[0]))
+	expectIndexExists(t, indexedPrimativesModels, models[0], "Int64")
+	indexKey, err := indexedPrimativesModels.FieldIndexKey("Int64")
+	require.NoError(t, err)
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	count, err := redis.Int(conn.Do("ZCARD", indexKey))
+	require.NoError(t, err)
+	assert.Equal(t, len(models), count)
+
+	// Query.Update should also replace the old entry.
+	_, err = indexedPrimativesModels.NewQuery().Filter("Int64 =", int64(-5)).Update(map[string]interface{}{
+		"Int64": int64(math.MinInt64),
+	})
+	require.NoError(t, err)
+	ids, err := indexedPrimativesModels.NewQuery().Filter("Int64 <", int64(0)).IDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[0].ModelID()}, ids)
+	count, err = redis.Int(conn.Do("ZCARD", indexKey))
+	require.NoError(t, err)
+	assert.Equal(t, len(models), count)
+
+	// GroupCount should return the exact values.
+	counts, err := indexedPrimativesModels.NewQuery().GroupCount("Uint64")
+	require.NoError(t, err)
+	expectedCounts := map[interface{}]int{}
+	for _, model := range models {
+		expectedCounts[model.Uint64] = 1
+	}
+	assert.Equal(t, expectedCounts, counts)
+
+	// Deleting models should remove them from the index, whether they are
+	// deleted one at a time or with Query.Delete.
+	_, err = indexedPrimativesModels.Delete(models[1].ModelID())
+	require.NoError(t, err)
+	expectIndexDoesNotExist(t, indexedPrimativesModels, models[1], "Int64")
+	_, err = indexedPrimativesModels.NewQuery().Filter("Uint64 >", models[2].Uint64).Delete()
+	require.NoError(t, err)
+	count, err = redis.Int(conn.Do("ZCARD", indexKey))
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestIntegerIndexNullPointers(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*indexedPointersModel{}
+	tx := testPool.NewTransaction()
+	for i := 0; i < 4; i++ {
+		model := createIndexedPointersModel()
+		if i%2 == 0 {
+			model.Int64 = nil
+		} else {
+			value := int64(math.MaxInt64 - i)
+			model.Int64 = &value
+		}
+		models = append(models, model)
+		tx.Save(indexedPointersModels, model)
+	}
+	require.NoError(t, tx.Exec())
+	ids, err := indexedPointersModels.NewQuery().IsNotNull("Int64").Order("Int64").IDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[3].ModelID(), models[1].ModelID()}, ids)
+
+	// Setting a value to nil should remove it from the index.
+	models[1].Int64 = nil
+	require.NoError(t, indexedPointersModels.Save(models[1]))
+	ids, err = indexedPointersModels.NewQuery().IsNotNull("Int64").IDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[3].ModelID()}, ids)
+	count, err := indexedPointersModels.NewQuery().IsNull("Int64").Count()
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestRebuildIndex(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	defer withBatchSize(2)()
+
+	models := createAndSaveLargeIntegerModels(t)
+	// Replace the integer index with a numeric index, as if it was created by
+	// an older version
+	indexKey, err := indexedPrimativesModels.FieldIndexKey("Int64")
+	require.NoError(t, err)
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, err = conn.Do("DEL", indexKey)
+	require.NoError(t, err)
+	for _, model := range models {
+		_, err = conn.Do("ZADD", indexKey, float64(model.Int64), model.ModelID())
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, indexedPrimativesModels.RebuildIndex("Int64"))
+	for _, model := range models {
+		expectIndexExists(t, indexedPrimativesModels, model, "Int64")
+	}
+	count, err := redis.Int(conn.Do("ZCARD", indexKey))
+	require.NoError(t, err)
+	assert.Equal(t, len(models), count)
+	ids, err := indexedPrimativesModels.NewQuery().Filter("Int64 =", models[2].Int64).IDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[2].ModelID()}, ids)
+
+	// Other kinds of indexes can be rebuilt too
+	require.NoError(t, indexedPrimativesModels.RebuildIndex("String"))
+	for _, model := range models {
+		expectIndexExists(t, indexedPrimativesModels, model, "String")
+	}
+
+	assert.Error(t, indexedPrimativesModels.RebuildIndex("Invalid"))
+	assert.Error(t, testModels.RebuildIndex("Int"), "Expected an error for a field which is not indexed")
+	other := newOtherProcessCollection(t, &indexedTestModel{}, DefaultCollectionOptions)
+	assert.Error(t, other.RebuildIndex("Int"), "Expected an error for a collection without the Index option")
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -16,15 +17,21 @@ import (
 // (e.g. Filter or Order) and may be executed with a query finisher
 // (e.g. Run or IDs).
 type query struct {
-	collection *Collection
-	pool       *Pool
-	includes   []string
-	excludes   []string
-	order      order
-	limit      uint
-	offset     uint
-	filters    []filter
-	err        error
+	collection   *Collection
+	pool         *Pool
+	includes     []string
+	excludes     []string
+	order        order
+	limit        uint
+	offset       uint
+	filters      []filter
+	allowScan    bool
+	geoSearch    *geoSearch
+	view         *view
+	withinKeys   []string
+	excludedKeys []string
+	singleScript bool
+	err          error
 }
 
 // newQuery creates and returns a new query with the given collection. It will
@@ -47,9 +54,21 @@ func newQuery(collection *Collection) *query {
 // matches the go code used to declare it.
 func (q *query) String() string {
 	result := fmt.Sprintf("%s.NewQuery()", q.collection.Name())
+	if q.view != nil {
+		result = fmt.Sprintf("%s.View(%q)", q.collection.Name(), q.view.name)
+	}
 	for _, filter := range q.filters {
 		result += fmt.Sprintf(".%s", filter)
 	}
+	if q.hasGeoSearch() {
+		result += fmt.Sprintf(".%s", q.geoSearch)
+	}
+	for _, setKey := range q.withinKeys {
+		result += fmt.Sprintf(".Within(%q)", setKey)
+	}
+	for _, setKey := range q.excludedKeys {
+		result += fmt.Sprintf(".Excluding(%q)", setKey)
+	}
 	if q.hasOrder() {
 		result += fmt.Sprintf(".%s", q.order)
 	}
@@ -64,6 +83,12 @@ func (q *query) String() string {
 	} else if q.hasExcludes() {
 		result += fmt.Sprintf(`.Exclude("%s")`, strings.Join(q.excludes, `", "`))
 	}
+	if q.allowScan {
+		result += ".AllowScan()"
+	}
+	if q.singleScript {
+		result += ".SingleScript()"
+	}
 	return result
 }
 
@@ -104,6 +129,14 @@ type filter struct {
 }
 
 func (f filter) String() string {
+	switch f.op {
+	case isNullOp:
+		return fmt.Sprintf(`IsNull("%s")`, f.fieldSpec.name)
+	case isNotNullOp:
+		return fmt.Sprintf(`IsNotNull("%s")`, f.fieldSpec.name)
+	case inOp:
+		return fmt.Sprintf(`Filter("%s %s", %#v)`, f.fieldSpec.name, f.op, f.value.Interface())
+	}
 	if f.value.Kind() == reflect.String {
 		return fmt.Sprintf(`Filter("%s %s", "%s")`, f.fieldSpec.name, f.op, f.value.String())
 	}
@@ -119,6 +152,9 @@ const (
 	lessOp
 	greaterOrEqualOp
 	lessOrEqualOp
+	isNullOp
+	isNotNullOp
+	inOp
 )
 
 func (fk filterOp) String() string {
@@ -135,6 +171,12 @@ func (fk filterOp) String() string {
 		return ">="
 	case lessOrEqualOp:
 		return "<="
+	case isNullOp:
+		return "is"
+	case isNotNullOp:
+		return "is not"
+	case inOp:
+		return "in"
 	}
 	return ""
 }
@@ -148,6 +190,29 @@ var filterOps = map[string]filterOp{
 	"<=": lessOrEqualOp,
 }
 
+type aggregateKind int
+
+const (
+	sumAggregate aggregateKind = iota
+	avgAggregate
+	minAggregate
+	maxAggregate
+)
+
+func (ak aggregateKind) String() string {
+	switch ak {
+	case sumAggregate:
+		return "sum"
+	case avgAggregate:
+		return "avg"
+	case minAggregate:
+		return "min"
+	case maxAggregate:
+		return "max"
+	}
+	return ""
+}
+
 // setError sets the err property of q only if it has not already been set
 func (q *query) setError(e error) {
 	if !q.hasError() {
@@ -157,18 +222,19 @@ func (q *query) setError(e error) {
 
 // Order specifies a field by which to sort the models. fieldName should be
 // a field in the struct type corresponding to the Collection used in the query
-// constructor. By default, the records are sorted by ascending order by the given
-// field. To sort by descending order, put a negative sign before the field name.
-// Zoom can only sort by fields which have been indexed, i.e. those which have the
-// `zoom:"index"` struct tag. However, in the future this may change. Only one
-// order may be specified per query. However in the future, secondary orders may be
-// allowed, and will take effect when two or more models have the same value for the
-// primary order field. Order will set an error on the query if the fieldName is invalid,
-// if another order has already been applied to the query, or if the fieldName specified
-// does not correspond to an indexed field. The error, same as any other error
-// that occurs during the lifetime of the query, is not returned until the query
-// is executed. When the query is executed the first error that occurred during
-// the lifetime of the query object (if any) will be returned.
+// constructor. By default, the records are sorted by ascending order by the
+// given field. To sort by descending order, put a negative sign before the
+// field name. Fields which have not been indexed are sorted with the SORT
+// command, which reads the value from the main hash of each model. Only one
+// order may be specified per query. However in the future, secondary orders
+// may be allowed, and will take effect when two or more models have the same
+// value for the primary order field. Order will set an error on the query if
+// the fieldName is invalid, if another order has already been applied to the
+// query, or if the fieldName specified corresponds to an unindexed field which
+// does not have a string, bool, or numeric type. The error, same as any other
+// error that occurs during the lifetime of the query, is not returned until the
+// query is executed. When the query is executed the first error that occurred
+// during the lifetime of the query object (if any) will be returned.
 func (q *query) Order(fieldName string) {
 	if q.hasOrder() {
 		// TODO: allow secondary sort orders?
@@ -191,6 +257,11 @@ func (q *query) Order(fieldName string) {
 		q.setError(err)
 		return
 	}
+	if fs.indexKind == noIndex && !fs.canSortBy() {
+		err := fmt.Errorf("zoom: error in Query.Order: cannot order by %s.%s, since it is not indexed and does not have a string, bool, or numeric type", q.collection.spec.typ.String(), fieldName)
+		q.setError(err)
+		return
+	}
 	q.order = order{
 		fieldName: fs.name,
 		redisName: fs.redisName,
@@ -243,13 +314,45 @@ func (q *query) Exclude(fields ...string) {
 	q.excludes = append(q.excludes, fields...)
 }
 
+// AllowScan allows filters on fields which are not indexed. See the
+// documentation for Query.AllowScan for more information.
+func (q *query) AllowScan() {
+	q.allowScan = true
+}
+
+// Within restricts the query to the ids in the set or sorted set identified by
+// setKey. See the documentation for Query.Within for more information.
+func (q *query) Within(setKey string) {
+	if setKey == "" {
+		q.setError(errors.New("zoom: error in Query.Within: setKey cannot be empty"))
+		return
+	}
+	q.withinKeys = append(q.withinKeys, setKey)
+}
+
+// Excluding excludes the ids in the set or sorted set identified by setKey
+// from the query. See the documentation for Query.Excluding for more
+// information.
+func (q *query) Excluding(setKey string) {
+	if setKey == "" {
+		q.setError(errors.New("zoom: error in Query.Excluding: setKey cannot be empty"))
+		return
+	}
+	q.excludedKeys = append(q.excludedKeys, setKey)
+}
+
 // Filter applies a filter to the query, which will cause the query to only
 // return models with attributes matching the expression. filterString should be
 // an expression which includes a fieldName, a space, and an operator in that
-// order. Operators must be one of "=", "!=", ">", "<", ">=", or "<=". You can
-// only use Filter on fields which are indexed, i.e. those which have the
-// `zoom:"index"` struct tag. If multiple filters are applied to the same query,
-// the query will only return models which have matches for ALL of the filters.
+// order. Operators must be one of "=", "!=", ">", "<", ">=", "<=", or "in".
+// For the "in" operator, value should be a slice or array and the filter
+// matches models whose field value equals any of its elements. If value
+// is nil, the operator must be one of "is", "=", "is not", or "!=", and the
+// filter works like IsNull or IsNotNull. You can only use Filter on fields
+// which are indexed, i.e. those which have the `zoom:"index"` struct tag,
+// unless AllowScan is used, in which case Filter may also be used on unindexed
+// primitive fields. If multiple filters are applied to the same query, the
+// query will only return models which have matches for ALL of the filters.
 // I.e. applying multiple filters is logically equivalent to combining them with
 // a AND or INTERSECT operator. Filter will set an error on the query if the
 // arguments are improperly formated, if the field you are attempting to filter
@@ -264,10 +367,27 @@ func (q *query) Filter(filterString string, value interface{}) {
 		q.setError(err)
 		return
 	}
+	// Check for the special case of a nil value
+	if value == nil {
+		switch operator {
+		case "is", "=":
+			q.nullFilter("Filter", fieldName, isNullOp)
+		case "is not", "!=":
+			q.nullFilter("Filter", fieldName, isNotNullOp)
+		default:
+			q.setError(errors.New("zoom: invalid Filter operator in fieldStr for nil value (should be one of is, =, is not, or !=)"))
+		}
+		return
+	}
 	// Parse the filter operator
 	fOp, found := filterOps[operator]
+	if operator == "in" {
+		// The in operator is handled separately because it expects a slice or
+		// array instead of a single value.
+		fOp, found = inOp, true
+	}
 	if !found {
-		q.setError(errors.New("zoom: invalid Filter operator in fieldStr (should be one of =, !=, >, <, >=, or <=)"))
+		q.setError(errors.New("zoom: invalid Filter operator in fieldStr (should be one of =, !=, >, <, >=, <=, or in)"))
 		return
 	}
 	// Get the fieldSpec for the given fieldName
@@ -277,9 +397,21 @@ func (q *query) Filter(filterString string, value interface{}) {
 		q.setError(err)
 		return
 	}
-	// Make sure the field is an indexed field
-	if fieldSpec.indexKind == noIndex {
-		err := fmt.Errorf("zoom: filters are only allowed on indexed fields and %s.%s is not indexed (try adding the `zoom:\"index\"` struct tag)", q.collection.spec.typ.String(), fieldName)
+	// Make sure the field is either an indexed field or a primitive field which
+	// could be scanned. Whether or not scanning is allowed is checked when the
+	// query is executed, since AllowScan may be called after Filter.
+	if fieldSpec.indexKind == geoIndex {
+		err := fmt.Errorf("zoom: filters are not allowed on geo indexed fields such as %s.%s (use Query.Near or Query.WithinBox instead)", q.collection.spec.typ.String(), fieldName)
+		q.setError(err)
+		return
+	}
+	if fOp == inOp && fieldSpec.indexKind == noIndex {
+		err := fmt.Errorf("zoom: the in operator is only allowed on indexed fields and %s.%s is not indexed (try adding the `zoom:\"index\"` struct tag)", q.collection.spec.typ.String(), fieldName)
+		q.setError(err)
+		return
+	}
+	if fieldSpec.indexKind == noIndex && fieldSpec.kind == inconvertibleField {
+		err := fmt.Errorf("zoom: filters are only allowed on indexed fields or primitive fields and %s.%s is neither", q.collection.spec.typ.String(), fieldName)
 		q.setError(err)
 		return
 	}
@@ -297,8 +429,48 @@ func (q *query) Filter(filterString string, value interface{}) {
 	return
 }
 
+// IsNull applies a filter to the query, which will cause the query to only
+// return models for which the value of the given field is nil. See the
+// documentation for Query.IsNull for more information.
+func (q *query) IsNull(fieldName string) {
+	q.nullFilter("IsNull", fieldName, isNullOp)
+}
+
+// IsNotNull applies a filter to the query, which will cause the query to only
+// return models for which the value of the given field is not nil. See the
+// documentation for Query.IsNotNull for more information.
+func (q *query) IsNotNull(fieldName string) {
+	q.nullFilter("IsNotNull", fieldName, isNotNullOp)
+}
+
+// nullFilter adds a filter with the given op, which should be either isNullOp
+// or isNotNullOp, on the field identified by fieldName. It sets an error on the
+// query if the field is not an indexed pointer field. methodName is used to
+// make the error message more helpful.
+func (q *query) nullFilter(methodName string, fieldName string, op filterOp) {
+	fs, found := q.collection.spec.fieldsByName[fieldName]
+	if !found {
+		err := fmt.Errorf("zoom: error in Query.%s: could not find field %s in type %s", methodName, fieldName, q.collection.spec.typ.String())
+		q.setError(err)
+		return
+	}
+	if !fs.hasNullSet() {
+		err := fmt.Errorf("zoom: error in Query.%s: null filters are only allowed on indexed pointer fields and %s.%s is not one (try adding the `zoom:\"index\"` struct tag)", methodName, q.collection.spec.typ.String(), fieldName)
+		q.setError(err)
+		return
+	}
+	q.filters = append(q.filters, filter{
+		fieldSpec: fs,
+		op:        op,
+	})
+}
+
 func splitFilterString(filterString string) (fieldName string, operator string, err error) {
 	tokens := strings.Split(filterString, " ")
+	if len(tokens) == 3 && tokens[1] == "is" && tokens[2] == "not" {
+		// Special case for the "is not" operator, which contains a space
+		return tokens[0], "is not", nil
+	}
 	if len(tokens) != 2 {
 		return "", "", errors.New("zoom: too many spaces in fieldStr argument (should be a field name, a space, and an operator)")
 	}
@@ -308,6 +480,9 @@ func splitFilterString(filterString string) (fieldName string, operator string,
 // checkValType returns an error if the type of value does not correspond to
 // filter.fieldSpec.
 func (f filter) checkValType(value interface{}) error {
+	if f.op == inOp {
+		return f.checkInValType(value)
+	}
 	// Here we iterate through pointer indirections. This is so you can
 	// just pass in a primitive instead of a pointer to a primitive for
 	// filtering on fields which have pointer values.
@@ -331,36 +506,265 @@ func (f filter) checkValType(value interface{}) error {
 	return nil
 }
 
+// checkInValType returns an error if value is not a slice or array whose
+// elements have the type of filter.fieldSpec. As with checkValType, pointer
+// fields are dereferenced.
+func (f filter) checkInValType(value interface{}) error {
+	fieldType := f.fieldSpec.typ
+	for fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	valueType := reflect.TypeOf(value)
+	if k := valueType.Kind(); (k != reflect.Slice && k != reflect.Array) || valueType.Elem() != fieldType {
+		return fmt.Errorf("zoom: invalid value for Filter on %s with the in operator: type of value (%T) should be a slice or array of %s", f.fieldSpec.name, value, fieldType.String())
+	}
+	return nil
+}
+
+// aggregateFieldSpec returns the fieldSpec for the field identified by
+// fieldName. It returns an error if the field does not exist or if it is not a
+// numeric field (or a pointer to a numeric field). methodName is used to make
+// the error message more helpful.
+func (q *query) aggregateFieldSpec(methodName string, fieldName string) (*fieldSpec, error) {
+	fs, found := q.collection.spec.fieldsByName[fieldName]
+	if !found {
+		return nil, fmt.Errorf("zoom: error in Query.%s: could not find field %s in type %s", methodName, fieldName, q.collection.spec.typ.String())
+	}
+	fieldType := fs.typ
+	if fs.kind == pointerField {
+		fieldType = fieldType.Elem()
+	}
+	if fs.kind == inconvertibleField || !typeIsNumeric(fieldType) {
+		return nil, fmt.Errorf("zoom: error in Query.%s: %s.%s is not a numeric field", methodName, q.collection.spec.typ.String(), fieldName)
+	}
+	return fs, nil
+}
+
+// groupFieldSpec returns the fieldSpec for the field identified by fieldName.
+// It returns an error if the field does not exist or if it is not indexed.
+// methodName is used to make the error message more helpful.
+func (q *query) groupFieldSpec(methodName string, fieldName string) (*fieldSpec, error) {
+	fs, found := q.collection.spec.fieldsByName[fieldName]
+	if !found {
+		return nil, fmt.Errorf("zoom: error in Query.%s: could not find field %s in type %s", methodName, fieldName, q.collection.spec.typ.String())
+	}
+	if fs.indexKind == noIndex {
+		return nil, fmt.Errorf("zoom: Query.%s is only allowed on indexed fields and %s.%s is not indexed (try adding the `zoom:\"index\"` struct tag)", methodName, q.collection.spec.typ.String(), fieldName)
+	}
+	if fs.indexKind == geoIndex {
+		return nil, fmt.Errorf("zoom: Query.%s is not allowed on geo indexed fields such as %s.%s", methodName, q.collection.spec.typ.String(), fieldName)
+	}
+	return fs, nil
+}
+
+// updateArgs converts values, a map of field names to new values, into the
+// arguments expected by the update_models_by_ids script. The values are
+// encoded the same way as they would be by Save. It returns an error if any of
+// the field names are invalid or if the type of any value does not match the
+// type of the corresponding field.
+func (q *query) updateArgs(values map[string]interface{}) (redis.Args, error) {
+	spec := q.collection.spec
+	for fieldName := range values {
+		if _, found := spec.fieldsByName[fieldName]; !found {
+			return nil, fmt.Errorf("zoom: error in Query.Update: could not find field %s in type %s", fieldName, spec.typ.String())
+		}
+	}
+	// Set the values on a new model so we can reuse the same code that Save
+	// uses to encode them.
+	mr := &modelRef{
+		collection: q.collection,
+		model:      reflect.New(spec.typ.Elem()).Interface().(Model),
+		spec:       spec,
+	}
+	fieldSpecs := []*fieldSpec{}
+	fieldNames := []string{}
+	for _, fs := range spec.fields {
+		value, found := values[fs.name]
+		if !found {
+			continue
+		}
+		if err := setFieldValue(fs, mr.fieldValue(fs.name), value); err != nil {
+			return nil, err
+		}
+		fieldSpecs = append(fieldSpecs, fs)
+		fieldNames = append(fieldNames, fs.name)
+	}
+	hashArgs, err := mr.mainHashArgsForFields(fieldNames)
+	if err != nil {
+		return nil, err
+	}
+	args := redis.Args{}
+	for i, fs := range fieldSpecs {
+		// The first element in hashArgs is the model key, followed by pairs of
+		// field names and values in the same order as fieldSpecs.
+		hashValue := hashArgs[2+2*i]
+		fieldVal := mr.fieldValue(fs.name)
+		isNull := fieldVal.Kind() == reflect.Ptr && fieldVal.IsNil()
+		var indexKind string
+		var indexValue interface{} = ""
+		switch fs.indexKind {
+		case numericIndex:
+			indexKind = "score"
+			if !isNull {
+				indexValue = numericScore(fieldVal)
+			}
+		case booleanIndex:
+			indexKind = "score"
+			if !isNull {
+				indexValue = boolScore(fieldVal)
+			}
+		case stringIndex:
+			indexKind = "string"
+			if !isNull {
+				indexValue = reflect.Indirect(fieldVal).String()
+			}
+		case integerIndex:
+			indexKind = "integer"
+			if !isNull {
+				indexValue = encodeInteger(fieldVal)
+			}
+		case geoIndex:
+			indexKind = "geo"
+			if !isNull {
+				value, err := geoIndexValue(fieldVal)
+				if err != nil {
+					return nil, fmt.Errorf("zoom: error in Query.Update: %s", err.Error())
+				}
+				indexValue = value
+			}
+		}
+		args = args.Add(fs.redisName, hashValue, indexKind, indexValue, convertBoolToInt(isNull))
+	}
+	return args, nil
+}
+
+// setFieldValue sets dest, the value of the field identified by fs, to value.
+// As with Filter, value may be a primitive if the field is a pointer to a
+// primitive. If value is nil, dest is set to its zero value, which is only
+// allowed for nilable fields. It returns an error if the type of value does not
+// match the type of the field.
+func setFieldValue(fs *fieldSpec, dest reflect.Value, value interface{}) error {
+	if value == nil {
+		switch dest.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+			dest.Set(reflect.Zero(dest.Type()))
+			return nil
+		}
+		return fmt.Errorf("zoom: invalid value for %s: nil is only allowed for pointer, slice, map, or interface fields", fs.name)
+	}
+	val := reflect.ValueOf(value)
+	switch {
+	case val.Type() == dest.Type():
+		dest.Set(val)
+	case dest.Kind() == reflect.Ptr && val.Type() == dest.Type().Elem():
+		ptr := reflect.New(val.Type())
+		ptr.Elem().Set(val)
+		dest.Set(ptr)
+	default:
+		return fmt.Errorf("zoom: invalid value for %s: type of value (%T) does not match type of field (%s)", fs.name, value, fs.typ.String())
+	}
+	return nil
+}
+
 // generateIDsSet will return the key of a set or sorted set that contains all the ids
 // which match the query criteria. It may also return some temporary keys which were created
 // during the process of creating the set of ids. Note that tmpKeys may contain idsKey itself,
 // so the temporary keys should not be deleted until after the ids have been read from idsKey.
 func generateIDsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interface{}, err error) {
+	indexedFilters, scanFilters := q.splitFilters()
+	if err := q.checkScanFilters(scanFilters); err != nil {
+		return "", nil, err
+	}
 	idsKey = q.collection.spec.indexKey()
 	tmpKeys = []interface{}{}
-	if q.hasOrder() {
+	geoIDsKey := ""
+	if q.hasGeoSearch() {
+		// Extract the ids within the search area into a temporary sorted set,
+		// where the score of each id is its distance from the center.
+		gs := q.geoSearch
+		geoIndexKey, err := q.collection.spec.fieldIndexKey(gs.fieldSpec.name)
+		if err != nil {
+			return "", nil, err
+		}
+		geoIDsKey = q.tmpKey("geo:" + gs.fieldSpec.redisName)
+		tmpKeys = append(tmpKeys, geoIDsKey)
+		tx.extractIDsFromGeoIndex(geoIndexKey, geoIDsKey, gs.lon, gs.lat, gs.shapeArgs())
+		q.expireTmpKey(tx, geoIDsKey)
+		idsKey = geoIDsKey
+	}
+	if q.view != nil {
+		if q.hasGeoSearch() {
+			// Only keep the ids in the search area which are also in the view,
+			// keeping the distances as scores.
+			tx.Command("ZINTERSTORE", redis.Args{geoIDsKey, 2, geoIDsKey, q.view.key, "WEIGHTS", 1, 0}, nil)
+			q.expireTmpKey(tx, geoIDsKey)
+		} else {
+			idsKey = q.view.key
+		}
+	}
+	if q.hasOrder() && q.sortByField() == nil {
 		fieldIndexKey, err := q.collection.spec.fieldIndexKey(q.order.fieldName)
 		if err != nil {
 			return "", nil, err
 		}
 		fieldSpec := q.collection.spec.fieldsByName[q.order.fieldName]
-		if fieldSpec.indexKind == stringIndex {
-			// If the order is a string field, we need to extract the ids before
+		if fieldSpec.indexKind == geoIndex {
+			// Ordering by a geo indexed field means ordering by the distance from
+			// the center of the search area, which is already the score for each
+			// id in geoIDsKey.
+			if !q.hasGeoSearch() {
+				return "", nil, fmt.Errorf("zoom: error in Query.Order: ordering by the geo indexed field %s requires Query.Near or Query.WithinBox", q.order.fieldName)
+			}
+		} else if fieldSpec.hasLexIndex() {
+			// If the order is a string or integer field, we need to extract the ids before
 			// we use ZRANGE. Create a temporary set to store the ordered ids
-			orderedIDsKey := generateRandomKey("tmp:order:" + q.order.fieldName)
+			orderedIDsKey := q.tmpKey("order:" + q.order.redisName)
 			tmpKeys = append(tmpKeys, orderedIDsKey)
 			idsKey = orderedIDsKey
 			// TODO: as an optimization, if there is a filter on the same field,
 			// pass the start and stop parameters to the script.
 			tx.ExtractIDsFromStringIndex(fieldIndexKey, orderedIDsKey, "-", "+")
+			q.expireTmpKey(tx, orderedIDsKey)
 		} else {
 			idsKey = fieldIndexKey
 		}
+		if q.hasGeoSearch() && fieldSpec.indexKind != geoIndex {
+			// Intersect the ordered ids with the ids in the search area, keeping
+			// the order.
+			tx.Command("ZINTERSTORE", redis.Args{geoIDsKey, 2, idsKey, geoIDsKey, "WEIGHTS", 1, 0}, nil)
+			q.expireTmpKey(tx, geoIDsKey)
+			idsKey = geoIDsKey
+		} else if q.view != nil {
+			// Intersect the ordered ids with the ids in the view, keeping the
+			// order.
+			viewIDsKey := q.tmpKey("view:" + q.view.name)
+			tmpKeys = append(tmpKeys, viewIDsKey)
+			tx.Command("ZINTERSTORE", redis.Args{viewIDsKey, 2, idsKey, q.view.key, "WEIGHTS", 1, 0}, nil)
+			q.expireTmpKey(tx, viewIDsKey)
+			idsKey = viewIDsKey
+		}
+	}
+	if q.hasSetRestrictions() {
+		// Intersect with the sets from Within and subtract the sets from
+		// Excluding, keeping the scores (and therefore the order) of idsKey.
+		restrictedIDsKey := q.tmpKey("within")
+		tmpKeys = append(tmpKeys, restrictedIDsKey)
+		for _, setKey := range q.withinKeys {
+			tx.Command("ZINTERSTORE", redis.Args{restrictedIDsKey, 2, idsKey, setKey, "WEIGHTS", 1, 0}, nil)
+			idsKey = restrictedIDsKey
+		}
+		for _, setKey := range q.excludedKeys {
+			tx.Command("ZDIFFSTORE", redis.Args{restrictedIDsKey, 2, idsKey, setKey}, nil)
+			idsKey = restrictedIDsKey
+		}
+		q.expireTmpKey(tx, restrictedIDsKey)
 	}
 	if q.hasFilters() {
-		filteredIDsKey := generateRandomKey("tmp:filter:all")
+		filteredIDsKey := q.tmpKey("filter:all")
 		tmpKeys = append(tmpKeys, filteredIDsKey)
-		for i, filter := range q.filters {
+		// Apply the indexed filters first, since they are fast and may
+		// significantly reduce the number of models that need to be scanned.
+		for i, filter := range indexedFilters {
 			if i == 0 {
 				// The first time, we should intersect with the ids key from above
 				if err := intersectFilter(q, tx, filter, idsKey, filteredIDsKey); err != nil {
@@ -372,99 +776,228 @@ func generateIDsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interfa
 					return "", tmpKeys, err
 				}
 			}
+			// ZINTERSTORE overwrites the key, including the expiration
+			q.expireTmpKey(tx, filteredIDsKey)
+		}
+		if len(scanFilters) > 0 {
+			origKey := idsKey
+			if len(indexedFilters) > 0 {
+				origKey = filteredIDsKey
+			}
+			tx.filterIDsByFieldValues(origKey, filteredIDsKey, q.collection.Name(), scanFilterArgs(scanFilters))
+			q.expireTmpKey(tx, filteredIDsKey)
 		}
 		idsKey = filteredIDsKey
 	}
 	return idsKey, tmpKeys, nil
 }
 
+// splitFilters splits the filters for the query into filters on indexed fields
+// and filters on unindexed fields, which can only be applied by scanning.
+func (q *query) splitFilters() (indexedFilters []filter, scanFilters []filter) {
+	for _, filter := range q.filters {
+		if filter.fieldSpec.indexKind == noIndex {
+			scanFilters = append(scanFilters, filter)
+		} else {
+			indexedFilters = append(indexedFilters, filter)
+		}
+	}
+	return indexedFilters, scanFilters
+}
+
+// checkScanFilters returns an error if there are any scanFilters (i.e. filters
+// on unindexed fields) and AllowScan was not used.
+func (q *query) checkScanFilters(scanFilters []filter) error {
+	if len(scanFilters) > 0 && !q.allowScan {
+		fieldName := scanFilters[0].fieldSpec.name
+		return fmt.Errorf("zoom: filters are only allowed on indexed fields and %s.%s is not indexed (try adding the `zoom:\"index\"` struct tag or using Query.AllowScan)", q.collection.spec.typ.String(), fieldName)
+	}
+	return nil
+}
+
+// scanFilterArgs converts filters into the arguments expected by the
+// filter_ids_by_field_values script.
+func scanFilterArgs(filters []filter) redis.Args {
+	args := redis.Args{}
+	for _, filter := range filters {
+		value := reflect.Indirect(filter.value)
+		kind := "number"
+		var compareValue interface{}
+		switch {
+		case value.Kind() == reflect.Bool:
+			// Booleans are stored as 1 or 0
+			compareValue = convertBoolToInt(value.Bool())
+		case typeIsNumeric(value.Type()):
+			compareValue = numericScore(value)
+		default:
+			// String or slice or array of bytes
+			kind = "string"
+			compareValue = stringValue(value)
+		}
+		isPointer := filter.fieldSpec.kind == pointerField
+		args = args.Add(filter.fieldSpec.redisName, filter.op.String(), kind, compareValue, convertBoolToInt(isPointer))
+	}
+	return args
+}
+
 // intersectFilter adds commands to the query transaction which, when run, will create a
 // temporary set which contains all the ids that fit the given filter criteria. Then it will
 // intersect them with origKey and stores the result in destKey. The function will automatically
 // delete any temporary sets created since, in this case, they are guaranteed to not be needed
 // by any other transaction commands.
 func intersectFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
-	switch filter.fieldSpec.indexKind {
-	case numericIndex:
-		return intersectNumericFilter(q, tx, filter, origKey, destKey)
-	case booleanIndex:
-		return intersectBoolFilter(q, tx, filter, origKey, destKey)
-	case stringIndex:
-		return intersectStringFilter(q, tx, filter, origKey, destKey)
+	if filter.op == isNullOp || filter.op == isNotNullOp {
+		return intersectNullFilter(q, tx, filter, origKey, destKey)
+	}
+	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
+	if err != nil {
+		return err
 	}
+	// Get all the ids that fit the filter criteria and store them in a temporary
+	// key called filterKey. Some filters (e.g. != or in) require more than one
+	// range, in which case the ids for each range are added to the same key.
+	filterKey := q.tmpKey("filter:" + filter.fieldSpec.redisName)
+	for _, r := range filter.indexRanges() {
+		if filter.fieldSpec.hasLexIndex() {
+			tx.ExtractIDsFromStringIndex(fieldIndexKey, filterKey, r.min.(string), r.max.(string))
+		} else {
+			tx.ExtractIDsFromFieldIndex(fieldIndexKey, filterKey, r.min, r.max)
+		}
+	}
+	q.expireTmpKey(tx, filterKey)
+	// Intersect filterKey with origKey and store result in destKey
+	tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
+	// Delete the temporary key
+	tx.Command("DEL", redis.Args{filterKey}, nil)
 	return nil
 }
 
-// intersectNumericFilter adds commands to the query transaction which, when run, will
-// create a temporary set which contains all the ids of models which match the given
-// numeric filter criteria, then intersect those ids with origKey and store the result
-// in destKey.
-func intersectNumericFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
+// intersectNullFilter adds commands to the query transaction which, when run,
+// will intersect origKey with the ids of the models for which the field is nil
+// (for isNullOp) or not nil (for isNotNullOp) and store the result in destKey.
+func intersectNullFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
+	if filter.op == isNullOp {
+		nullSetKey, err := q.collection.spec.fieldNullSetKey(filter.fieldSpec.name)
+		if err != nil {
+			return err
+		}
+		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, nullSetKey, "WEIGHTS", 1, 0}, nil)
+		return nil
+	}
+	// The models for which the field is not nil are exactly the models in the
+	// field index.
 	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
 	if err != nil {
 		return err
 	}
-	if filter.op == notEqualOp {
-		// Special case for not equal. We need to use two separate commands
-		valueExclusive := fmt.Sprintf("(%v", filter.value.Interface())
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-		// ZADD all ids greater than filter.value
-		tx.ExtractIDsFromFieldIndex(fieldIndexKey, filterKey, valueExclusive, "+inf")
-		// ZADD all ids less than filter.value
-		tx.ExtractIDsFromFieldIndex(fieldIndexKey, filterKey, "-inf", valueExclusive)
-		// Intersect filterKey with origKey and store result in destKey
+	if filter.fieldSpec.hasLexIndex() {
+		// The members of a string or integer index are not ids, so we need to extract them
+		// first.
+		filterKey := q.tmpKey("filter:" + filter.fieldSpec.redisName)
+		tx.ExtractIDsFromStringIndex(fieldIndexKey, filterKey, "-", "+")
+		q.expireTmpKey(tx, filterKey)
 		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
 		tx.Command("DEL", redis.Args{filterKey}, nil)
 	} else {
-		var min, max interface{}
-		switch filter.op {
-		case equalOp:
-			min, max = filter.value.Interface(), filter.value.Interface()
-		case lessOp:
-			min = "-inf"
-			// use "(" for exclusive
-			max = fmt.Sprintf("(%v", filter.value.Interface())
-		case greaterOp:
-			min = fmt.Sprintf("(%v", filter.value.Interface())
-			max = "+inf"
-		case lessOrEqualOp:
-			min = "-inf"
-			max = filter.value.Interface()
-		case greaterOrEqualOp:
-			min = filter.value.Interface()
-			max = "+inf"
+		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, fieldIndexKey, "WEIGHTS", 1, 0}, nil)
+	}
+	return nil
+}
+
+// indexRange is a range of values in a field index. min and max are the
+// arguments for ZRANGEBYSCORE (for numeric and boolean indexes) or ZRANGEBYLEX
+// (for string indexes).
+type indexRange struct {
+	min interface{}
+	max interface{}
+}
+
+// indexRanges returns the ranges in the field index which together contain
+// exactly the ids of the models that match the filter. It should not be used
+// for filters with isNullOp, since models for which the field is nil are not
+// in the field index at all.
+func (f filter) indexRanges() []indexRange {
+	switch f.op {
+	case isNotNullOp:
+		if f.fieldSpec.hasLexIndex() {
+			return []indexRange{{"-", "+"}}
 		}
-		// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-		tx.ExtractIDsFromFieldIndex(fieldIndexKey, filterKey, min, max)
-		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
+		return []indexRange{{"-inf", "+inf"}}
+	case inOp:
+		// Use one range for each element, as if it were an equal filter
+		ranges := []indexRange{}
+		for i := 0; i < f.value.Len(); i++ {
+			elemFilter := filter{
+				fieldSpec: f.fieldSpec,
+				op:        equalOp,
+				value:     reflect.Indirect(f.value.Index(i)),
+			}
+			ranges = append(ranges, elemFilter.indexRanges()...)
+		}
+		return ranges
+	}
+	switch f.fieldSpec.indexKind {
+	case numericIndex:
+		return f.numericIndexRanges()
+	case booleanIndex:
+		return f.boolIndexRanges()
+	case stringIndex:
+		return lexIndexRanges(f.op, stringValue(f.value))
+	case integerIndex:
+		return lexIndexRanges(f.op, encodeInteger(f.value))
 	}
 	return nil
 }
 
-// intersectBoolFilter adds commands to the query transaction which, when run, will
-// create a temporary set which contains all the ids of models which match the given
-// bool filter criteria, then intersect those ids with origKey and store the result
-// in destKey.
-func intersectBoolFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
-	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
-	if err != nil {
-		return err
+// stringValue returns the value of val, which should be a string or a slice or
+// array of bytes, as a string.
+func stringValue(val reflect.Value) string {
+	if val.Kind() == reflect.String {
+		return val.String()
 	}
+	valBytes := make([]byte, val.Len())
+	reflect.Copy(reflect.ValueOf(valBytes), val)
+	return string(valBytes)
+}
+
+// numericIndexRanges returns the ranges in a numeric index which contain
+// exactly the ids of the models that match the filter.
+func (f filter) numericIndexRanges() []indexRange {
+	value := f.value.Interface()
+	// use "(" for exclusive
+	valueExclusive := fmt.Sprintf("(%v", value)
+	switch f.op {
+	case equalOp:
+		return []indexRange{{value, value}}
+	case notEqualOp:
+		// Special case for not equal. We need to use two separate ranges, one for
+		// all ids greater than the value and one for all ids less than the value.
+		return []indexRange{{valueExclusive, "+inf"}, {"-inf", valueExclusive}}
+	case lessOp:
+		return []indexRange{{"-inf", valueExclusive}}
+	case greaterOp:
+		return []indexRange{{valueExclusive, "+inf"}}
+	case lessOrEqualOp:
+		return []indexRange{{"-inf", value}}
+	case greaterOrEqualOp:
+		return []indexRange{{value, "+inf"}}
+	}
+	return nil
+}
+
+// boolIndexRanges returns the ranges in a boolean index which contain exactly
+// the ids of the models that match the filter.
+func (f filter) boolIndexRanges() []indexRange {
 	var min, max interface{}
-	switch filter.op {
+	switch f.op {
 	case equalOp:
-		if filter.value.Bool() {
+		if f.value.Bool() {
 			min, max = 1, 1
 		} else {
 			min, max = 0, 0
 		}
 	case lessOp:
-		if filter.value.Bool() {
+		if f.value.Bool() {
 			// Only false is less than true
 			min, max = 0, 0
 		} else {
@@ -473,7 +1006,7 @@ func intersectBoolFilter(q *query, tx *Transaction, filter filter, origKey strin
 			min, max = -1, -1
 		}
 	case greaterOp:
-		if filter.value.Bool() {
+		if f.value.Bool() {
 			// No models are greater than true,
 			// so we should eliminate all models
 			min, max = -1, -1
@@ -482,7 +1015,7 @@ func intersectBoolFilter(q *query, tx *Transaction, filter filter, origKey strin
 			min, max = 1, 1
 		}
 	case lessOrEqualOp:
-		if filter.value.Bool() {
+		if f.value.Bool() {
 			// All models are <= true
 			min, max = 0, 1
 		} else {
@@ -490,7 +1023,7 @@ func intersectBoolFilter(q *query, tx *Transaction, filter filter, origKey strin
 			min, max = 0, 0
 		}
 	case greaterOrEqualOp:
-		if filter.value.Bool() {
+		if f.value.Bool() {
 			// Only true is >= true
 			min, max = 1, 1
 		} else {
@@ -498,71 +1031,36 @@ func intersectBoolFilter(q *query, tx *Transaction, filter filter, origKey strin
 			min, max = 0, 1
 		}
 	case notEqualOp:
-		if filter.value.Bool() {
+		if f.value.Bool() {
 			min, max = 0, 0
 		} else {
 			min, max = 1, 1
 		}
 	}
-	// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-	filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-	tx.ExtractIDsFromFieldIndex(fieldIndexKey, filterKey, min, max)
-	// Intersect filterKey with origKey and store result in destKey
-	tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-	// Delete the temporary key
-	tx.Command("DEL", redis.Args{filterKey}, nil)
-	return nil
+	return []indexRange{{min, max}}
 }
 
-// intersectStringFilter adds commands to the query transaction which, when run, will
-// create a temporary set which contains all the ids of models which match the given
-// string filter criteria, then intersect those ids with origKey and store the result
-// in destKey.
-func intersectStringFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
-	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
-	if err != nil {
-		return err
-	}
-	valString := filter.value.String()
-	if filter.op == notEqualOp {
-		// Special case for not equal. We need to use two separate commands
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-		// ZADD all ids greater than filter.value
-		min := "(" + valString + nullString + delString
-		tx.ExtractIDsFromStringIndex(fieldIndexKey, filterKey, min, "+")
-		// ZADD all ids less than filter.value
-		max := "(" + valString
-		tx.ExtractIDsFromStringIndex(fieldIndexKey, filterKey, "-", max)
-		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
-	} else {
-		var min, max string
-		switch filter.op {
-		case equalOp:
-			min = "[" + valString
-			max = "(" + valString + nullString + delString
-		case lessOp:
-			min = "-"
-			max = "(" + valString
-		case greaterOp:
-			min = "(" + valString + nullString + delString
-			max = "+"
-		case lessOrEqualOp:
-			min = "-"
-			max = "(" + valString + nullString + delString
-		case greaterOrEqualOp:
-			min = "[" + valString
-			max = "+"
-		}
-		// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-		tx.ExtractIDsFromStringIndex(fieldIndexKey, filterKey, min, max)
-		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
+// lexIndexRanges returns the ranges in a string or integer index which contain
+// exactly the ids of the models that match a filter with the given operator
+// and value. Each member of a string or integer index consists of the value
+// (which is encoded for integer indexes), followed by a NULL character,
+// followed by the id.
+func lexIndexRanges(op filterOp, valString string) []indexRange {
+	switch op {
+	case equalOp:
+		return []indexRange{{"[" + valString, "(" + valString + nullString + delString}}
+	case notEqualOp:
+		// Special case for not equal. We need to use two separate ranges, one for
+		// all ids greater than the value and one for all ids less than the value.
+		return []indexRange{{"(" + valString + nullString + delString, "+"}, {"-", "(" + valString}}
+	case lessOp:
+		return []indexRange{{"-", "(" + valString}}
+	case greaterOp:
+		return []indexRange{{"(" + valString + nullString + delString, "+"}}
+	case lessOrEqualOp:
+		return []indexRange{{"-", "(" + valString + nullString + delString}}
+	case greaterOrEqualOp:
+		return []indexRange{{"[" + valString, "+"}}
 	}
 	return nil
 }
@@ -612,6 +1110,25 @@ func (q *query) hasFilters() bool {
 	return len(q.filters) > 0
 }
 
+// sortByField returns the fieldSpec for the order of the query if the field
+// is not indexed, in which case the ids are sorted by the values in the main
+// hash of each model with the SORT command (see modelSpec.sortArgs). It returns
+// nil if the query does not have an order or the field is indexed.
+func (q *query) sortByField() *fieldSpec {
+	if !q.hasOrder() {
+		return nil
+	}
+	fs := q.collection.spec.fieldsByName[q.order.fieldName]
+	if fs.indexKind != noIndex {
+		return nil
+	}
+	return fs
+}
+
+func (q *query) hasSetRestrictions() bool {
+	return len(q.withinKeys) > 0 || len(q.excludedKeys) > 0
+}
+
 func (q *query) hasOrder() bool {
 	return q.order.fieldName != ""
 }
@@ -636,6 +1153,25 @@ func (q *query) hasError() bool {
 	return q.err != nil
 }
 
+// tmpKey returns a new, randomly generated key for a temporary set or sorted
+// set that is used while running the query. Temporary keys always start with
+// "tmp:" followed by the name of the collection and purpose.
+func (q *query) tmpKey(purpose string) string {
+	return generateRandomKey("tmp:" + q.collection.Name() + ":" + purpose)
+}
+
+// expireTmpKey adds a command to tx which sets the expiration of the temporary
+// key identified by key to the TemporaryKeyTTL for the pool (if any). It should
+// be called whenever a temporary key is created or overwritten, so that the key
+// is eventually deleted even if the query is interrupted.
+func (q *query) expireTmpKey(tx *Transaction, key string) {
+	ttl := q.pool.options.TemporaryKeyTTL
+	if ttl <= 0 {
+		return
+	}
+	tx.Command("PEXPIRE", redis.Args{key, int64(ttl / time.Millisecond)}, nil)
+}
+
 // generateRandomKey generates a random string that is more or less
 // guaranteed to be unique and then prepends the given prefix. It is
 // used to generate keys for temporary sorted sets in queries.
@@ -0,0 +1,272 @@
+// File leaderboard.go contains code for leaderboard queries, which rank models
+// by the value of a numeric field using the field index.
+
+package kvmodel
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// leaderboardField returns the fieldSpec for the field identified by
+// fieldName, which may have a "-" prefix to rank models with higher values
+// first, and whether or not the prefix was present. It returns an error if the
+// field does not exist or does not have a numeric or integer index.
+func (c *Collection) leaderboardField(methodName string, fieldName string) (fs *fieldSpec, reverse bool, err error) {
+	if strings.HasPrefix(fieldName, "-") {
+		reverse = true
+		fieldName = fieldName[1:]
+	}
+	fs, found := c.spec.fieldsByName[fieldName]
+	if !found {
+		return nil, false, fmt.Errorf("zoom: error in %s: could not find field %s in type %s", methodName, fieldName, c.spec.typ.String())
+	}
+	if fs.indexKind != numericIndex && fs.indexKind != integerIndex {
+		return nil, false, fmt.Errorf("zoom: error in %s: %s.%s is not an indexed numeric field", methodName, c.spec.typ.String(), fieldName)
+	}
+	return fs, reverse, nil
+}
+
+// leaderboardArgs returns the first arguments for the leaderboard script, which
+// are the same for all operations.
+func (c *Collection) leaderboardArgs(operation string, fs *fieldSpec, reverse bool) redis.Args {
+	indexKind := "score"
+	if fs.indexKind == integerIndex {
+		indexKind = "integer"
+	}
+	fieldIndexKey, _ := c.spec.fieldIndexKey(fs.name)
+	return redis.Args{operation, c.Name(), fieldIndexKey, indexKind, fs.redisName, convertBoolToInt(reverse)}
+}
+
+// newLeaderboardNotFoundError returns a ModelNotFoundError for a model which
+// is not in the field index, either because it does not exist or because the
+// field is nil.
+func newLeaderboardNotFoundError(c *Collection, id string, fs *fieldSpec) error {
+	return ModelNotFoundError{
+		Collection: c,
+		Msg:        fmt.Sprintf("Could not find %s with id = %s and a value for %s", c.Name(), id, fs.name),
+	}
+}
+
+// Rank returns the rank of the model with the given id when the models are
+// ordered by the field identified by fieldName, starting at 0. The field must
+// be an indexed numeric field. Like Query.Order, fieldName may be prefixed
+// with "-" to rank the models in descending order, i.e. so that the model with
+// the highest value has rank 0, which is usually what you want for a
+// leaderboard. Models with the same value are ranked by id. Rank returns a
+// ModelNotFoundError if the model does not exist or if the value of the field
+// is nil.
+func (c *Collection) Rank(id string, fieldName string) (int, error) {
+	t := c.pool.NewTransaction()
+	rank := 0
+	t.Rank(c, id, fieldName, &rank)
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	return rank, nil
+}
+
+// Rank sets the value of rank to the rank of the model with the given id in an
+// existing transaction. See the documentation for Collection.Rank for more
+// information. Any errors encountered will be added to the transaction and
+// returned as an error when the transaction is executed.
+func (t *Transaction) Rank(c *Collection, id string, fieldName string, rank *int) {
+	if c == nil {
+		t.setError(newNilCollectionError("Rank"))
+		return
+	}
+	fs, reverse, err := c.leaderboardField("Rank", fieldName)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	args := append(c.leaderboardArgs("rank", fs, reverse), id)
+	t.leaderboard(args, func(reply interface{}) error {
+		if reply == nil {
+			return newLeaderboardNotFoundError(c, id, fs)
+		}
+		return NewScanIntHandler(rank)(reply)
+	})
+}
+
+// Top scans the first n models ordered by the field identified by fieldName
+// into models, which must be a pointer to a slice of models of the registered
+// type. The field must be an indexed numeric field, and fieldName may be
+// prefixed with "-" to get the models with the highest values first. It is
+// equivalent to c.NewQuery().Order(fieldName).Limit(n).Run(models).
+func (c *Collection) Top(fieldName string, n uint, models interface{}) error {
+	t := c.pool.NewTransaction()
+	t.Top(c, fieldName, n, models)
+	return t.Exec()
+}
+
+// Top scans the first n models ordered by the field identified by fieldName
+// into models in an existing transaction. See the documentation for
+// Collection.Top for more information. Any errors encountered will be added to
+// the transaction and returned as an error when the transaction is executed.
+func (t *Transaction) Top(c *Collection, fieldName string, n uint, models interface{}) {
+	if c == nil {
+		t.setError(newNilCollectionError("Top"))
+		return
+	}
+	if _, _, err := c.leaderboardField("Top", fieldName); err != nil {
+		t.setError(err)
+		return
+	}
+	if n == 0 {
+		// A limit of 0 would mean no limit, so there is nothing to query
+		if err := c.checkModelsType(models); err != nil {
+			t.setError(fmt.Errorf("zoom: error in Top: %s", err.Error()))
+			return
+		}
+		reflect.ValueOf(models).Elem().SetLen(0)
+		return
+	}
+	t.Query(c).Order(fieldName).Limit(n).Run(models)
+}
+
+// Around scans the model with the given id and the k models ranked directly
+// before and after it (i.e. up to 2k+1 models) into models, which must be a
+// pointer to a slice of models of the registered type. The models are ordered
+// by the field identified by fieldName in the same way as Rank, and fieldName
+// may likewise be prefixed with "-". The rank of the model and the models
+// around it are read atomically. Around returns a ModelNotFoundError if the
+// model does not exist or if the value of the field is nil.
+func (c *Collection) Around(id string, fieldName string, k uint, models interface{}) error {
+	t := c.pool.NewTransaction()
+	t.Around(c, id, fieldName, k, models)
+	return t.Exec()
+}
+
+// Around scans the models ranked around the model with the given id into
+// models in an existing transaction. See the documentation for
+// Collection.Around for more information. Any errors encountered will be added
+// to the transaction and returned as an error when the transaction is
+// executed.
+func (t *Transaction) Around(c *Collection, id string, fieldName string, k uint, models interface{}) {
+	if c == nil {
+		t.setError(newNilCollectionError("Around"))
+		return
+	}
+	fs, reverse, err := c.leaderboardField("Around", fieldName)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	if err := c.checkModelsType(models); err != nil {
+		t.setError(fmt.Errorf("zoom: error in Around: %s", err.Error()))
+		return
+	}
+	redisFieldNames := c.spec.fieldRedisNames()
+	args := append(c.leaderboardArgs("around", fs, reverse), id, k, len(redisFieldNames))
+	args = args.AddFlat(redisFieldNames)
+	handler := newScanModelsHandler(c.spec, append(c.spec.fieldNames(), "-"), models)
+	t.leaderboard(args, func(reply interface{}) error {
+		if reply == nil {
+			return newLeaderboardNotFoundError(c, id, fs)
+		}
+		return handler(reply)
+	})
+}
+
+// Percentile returns the value of the field identified by fieldName at the
+// given percentile p, which must be between 0 and 1, using the nearest rank
+// method. I.e., it returns the smallest value such that the value for at least
+// p of the models is less than or equal to it. For example, p = 0.5 returns the
+// median and p = 1 returns the maximum. The field must be an indexed numeric
+// field. Models for which the field is nil are ignored. Percentile returns a
+// ModelNotFoundError if there are no such models.
+func (c *Collection) Percentile(fieldName string, p float64) (float64, error) {
+	t := c.pool.NewTransaction()
+	value := 0.0
+	t.Percentile(c, fieldName, p, &value)
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	return value, nil
+}
+
+// Percentile sets the value of value to the value of the field identified by
+// fieldName at the given percentile in an existing transaction. See the
+// documentation for Collection.Percentile for more information. Any errors
+// encountered will be added to the transaction and returned as an error when
+// the transaction is executed.
+func (t *Transaction) Percentile(c *Collection, fieldName string, p float64, value *float64) {
+	if c == nil {
+		t.setError(newNilCollectionError("Percentile"))
+		return
+	}
+	if strings.HasPrefix(fieldName, "-") {
+		t.setError(fmt.Errorf("zoom: error in Percentile: fieldName cannot have a \"-\" prefix"))
+		return
+	}
+	if p < 0 || p > 1 {
+		t.setError(fmt.Errorf("zoom: error in Percentile: p must be between 0 and 1. Got: %g", p))
+		return
+	}
+	fs, _, err := c.leaderboardField("Percentile", fieldName)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	args := append(c.leaderboardArgs("percentile", fs, false), p)
+	t.leaderboard(args, func(reply interface{}) error {
+		if reply == nil {
+			return ModelNotFoundError{
+				Collection: c,
+				Msg:        fmt.Sprintf("Could not find any %s with a value for %s", c.Name(), fs.name),
+			}
+		}
+		return NewScanFloat64Handler(value)(reply)
+	})
+}
+
+// PercentileRank returns the fraction of models which are ranked below the
+// model with the given id when the models are ordered by the field identified
+// by fieldName, i.e. the number of models with a lower value divided by the
+// number of models. If fieldName has a "-" prefix, it returns the fraction of
+// models with a higher value instead. The field must be an indexed numeric
+// field. Models for which the field is nil are ignored. PercentileRank returns
+// a ModelNotFoundError if the model does not exist or if the value of the
+// field is nil.
+func (c *Collection) PercentileRank(id string, fieldName string) (float64, error) {
+	t := c.pool.NewTransaction()
+	percentileRank := 0.0
+	t.PercentileRank(c, id, fieldName, &percentileRank)
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	return percentileRank, nil
+}
+
+// PercentileRank sets the value of percentileRank to the fraction of models
+// which are ranked below the model with the given id in an existing
+// transaction. See the documentation for Collection.PercentileRank for more
+// information. Any errors encountered will be added to the transaction and
+// returned as an error when the transaction is executed.
+func (t *Transaction) PercentileRank(c *Collection, id string, fieldName string, percentileRank *float64) {
+	if c == nil {
+		t.setError(newNilCollectionError("PercentileRank"))
+		return
+	}
+	fs, reverse, err := c.leaderboardField("PercentileRank", fieldName)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	args := append(c.leaderboardArgs("percentileRank", fs, reverse), id)
+	t.leaderboard(args, func(reply interface{}) error {
+		if reply == nil {
+			return newLeaderboardNotFoundError(c, id, fs)
+		}
+		counts, err := redis.Ints(reply, nil)
+		if err != nil {
+			return err
+		}
+		(*percentileRank) = float64(counts[0]) / float64(counts[1])
+		return nil
+	})
+}
@@ -0,0 +1,150 @@
+// File leaderboard_test.go tests leaderboard queries (leaderboard.go)
+
+package kvmodel
+
+import (
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaderboard(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use some duplicate and negative values so that ties and the encoding of
+	// integer indexes are tested.
+	values := []int{-30, 5, 12, -7, 5, 100, 0, 12, 64, -1}
+	models := make([]*indexedPrimativesModel, len(values))
+	tx := testPool.NewTransaction()
+	for i, value := range values {
+		models[i] = createIndexedPrimativesModel()
+		models[i].Int = value
+		models[i].Float64 = float64(value) / 2
+		tx.Save(indexedPrimativesModels, models[i])
+	}
+	require.NoError(t, tx.Exec())
+
+	// Int has an integer index and Float64 has a numeric index
+	for _, fieldName := range []string{"Int", "-Int", "Float64", "-Float64"} {
+		reverse := fieldName[0] == '-'
+		expected := make([]*indexedPrimativesModel, len(models))
+		copy(expected, models)
+		sort.Slice(expected, func(i, j int) bool {
+			if expected[i].Int == expected[j].Int {
+				if reverse {
+					return expected[i].ModelID() > expected[j].ModelID()
+				}
+				return expected[i].ModelID() < expected[j].ModelID()
+			}
+			if reverse {
+				return expected[i].Int > expected[j].Int
+			}
+			return expected[i].Int < expected[j].Int
+		})
+
+		for i, model := range expected {
+			rank, err := indexedPrimativesModels.Rank(model.ModelID(), fieldName)
+			require.NoError(t, err)
+			assert.Equal(t, i, rank, "Wrong rank for %s ordered by %s", model.ModelID(), fieldName)
+
+			percentileRank, err := indexedPrimativesModels.PercentileRank(model.ModelID(), fieldName)
+			require.NoError(t, err)
+			below := 0
+			for _, other := range models {
+				if (!reverse && other.Int < model.Int) || (reverse && other.Int > model.Int) {
+					below++
+				}
+			}
+			assert.Equal(t, float64(below)/float64(len(models)), percentileRank, "Wrong percentile rank for %s ordered by %s", model.ModelID(), fieldName)
+		}
+
+		top := []*indexedPrimativesModel{}
+		require.NoError(t, indexedPrimativesModels.Top(fieldName, 3, &top))
+		assert.Equal(t, expected[:3], top, "Wrong top models ordered by %s", fieldName)
+		require.NoError(t, indexedPrimativesModels.Top(fieldName, 0, &top))
+		assert.Empty(t, top)
+
+		around := []*indexedPrimativesModel{}
+		require.NoError(t, indexedPrimativesModels.Around(expected[4].ModelID(), fieldName, 2, &around))
+		assert.Equal(t, expected[2:7], around, "Wrong models around %s ordered by %s", expected[4].ModelID(), fieldName)
+		// Near the start and end of the leaderboard there are fewer models on
+		// one side.
+		require.NoError(t, indexedPrimativesModels.Around(expected[0].ModelID(), fieldName, 2, &around))
+		assert.Equal(t, expected[:3], around, "Wrong models around %s ordered by %s", expected[0].ModelID(), fieldName)
+		last := len(expected) - 1
+		require.NoError(t, indexedPrimativesModels.Around(expected[last].ModelID(), fieldName, 1, &around))
+		assert.Equal(t, expected[last-1:], around, "Wrong models around %s ordered by %s", expected[last].ModelID(), fieldName)
+	}
+
+	sorted := append([]int{}, values...)
+	sort.Ints(sorted)
+	for _, p := range []float64{0, 0.1, 0.25, 0.5, 0.9, 1} {
+		i := int(math.Max(math.Ceil(p*float64(len(sorted)))-1, 0))
+		got, err := indexedPrimativesModels.Percentile("Int", p)
+		require.NoError(t, err)
+		assert.Equal(t, float64(sorted[i]), got, "Wrong percentile %g for Int", p)
+		got, err = indexedPrimativesModels.Percentile("Float64", p)
+		require.NoError(t, err)
+		assert.Equal(t, float64(sorted[i])/2, got, "Wrong percentile %g for Float64", p)
+	}
+}
+
+func TestLeaderboardInTransaction(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(5)
+	require.NoError(t, err)
+	tx := testPool.NewTransaction()
+	ranks := make([]int, len(models))
+	for i, model := range models {
+		tx.Rank(indexedTestModels, model.ModelID(), "-Int", &ranks[i])
+	}
+	median := 0.0
+	tx.Percentile(indexedTestModels, "Int", 0.5, &median)
+	require.NoError(t, tx.Exec())
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Int > models[j].Int
+	})
+	sortedRanks := append([]int{}, ranks...)
+	sort.Ints(sortedRanks)
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, sortedRanks)
+	assert.Equal(t, float64(models[2].Int), median)
+}
+
+func TestLeaderboardErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(1)
+	require.NoError(t, err)
+
+	// Models which do not exist
+	_, err = indexedTestModels.Rank("invalid", "Int")
+	assert.IsType(t, ModelNotFoundError{}, err)
+	_, err = indexedTestModels.PercentileRank("invalid", "Int")
+	assert.IsType(t, ModelNotFoundError{}, err)
+	err = indexedTestModels.Around("invalid", "Int", 1, &[]*indexedTestModel{})
+	assert.IsType(t, ModelNotFoundError{}, err)
+	_, err = indexedPrimativesModels.Percentile("Int", 0.5)
+	assert.IsType(t, ModelNotFoundError{}, err)
+
+	// Invalid arguments
+	id := models[0].ModelID()
+	_, err = indexedTestModels.Rank(id, "String")
+	assert.Error(t, err, "Expected an error for a string field")
+	_, err = indexedTestModels.Rank(id, "Invalid")
+	assert.Error(t, err, "Expected an error for a field that does not exist")
+	_, err = testModels.Rank(id, "Int")
+	assert.Error(t, err, "Expected an error for an unindexed field")
+	_, err = indexedTestModels.Percentile("Int", 1.5)
+	assert.Error(t, err, "Expected an error for a percentile greater than 1")
+	_, err = indexedTestModels.Percentile("-Int", 0.5)
+	assert.Error(t, err, "Expected an error for a \"-\" prefix")
+	err = indexedTestModels.Around(id, "Int", 1, &[]*testModel{})
+	assert.Error(t, err, "Expected an error for the wrong type of models")
+}
@@ -0,0 +1,215 @@
+// File lock.go contains code related to locks, which can be used to
+// coordinate access to specific models between processes.
+
+package kvmodel
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// minLockRetryInterval and maxLockRetryInterval are the minimum and maximum
+	// amounts of time that LockWithTimeout waits between attempts to acquire a
+	// lock.
+	minLockRetryInterval = 5 * time.Millisecond
+	maxLockRetryInterval = 100 * time.Millisecond
+)
+
+// Lock is a distributed lock on the model with a specific id, which is stored
+// in Redis. Each lock has a random token which identifies the holder, so that
+// only the holder can release or extend the lock. Locks expire after a time to
+// live, so a lock is not held forever if its holder crashes. Use
+// Collection.Lock or Collection.LockWithTimeout to acquire a lock.
+//
+// Locks are advisory. Holding a lock does not prevent other processes from
+// changing the model, unless they also acquire the lock or use
+// Transaction.RequireLock.
+type Lock struct {
+	collection *Collection
+	id         string
+	key        string
+	token      string
+}
+
+// ID returns the id of the model that the lock is for.
+func (l *Lock) ID() string {
+	return l.id
+}
+
+// Key returns the key in Redis where the lock is stored.
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// Token returns the random token which identifies the holder of the lock.
+func (l *Lock) Token() string {
+	return l.token
+}
+
+// LockKey returns the key in Redis where the lock for the model with the given
+// id is stored.
+func (c *Collection) LockKey(id string) string {
+	return c.Name() + ":locks:" + id
+}
+
+// Lock tries to acquire the lock for the model with the given id, which will
+// expire after ttl unless it is extended with Lock.Extend or released with
+// Lock.Unlock. The model does not need to exist. Lock does not wait for the
+// lock to be released. If the lock is currently held by someone else, it
+// returns a LockError. ttl must be at least one millisecond.
+func (c *Collection) Lock(id string, ttl time.Duration) (*Lock, error) {
+	if c == nil {
+		return nil, newNilCollectionError("Lock")
+	}
+	if ttl < time.Millisecond {
+		return nil, fmt.Errorf("zoom: error in Lock: ttl must be at least one millisecond. Got: %s", ttl)
+	}
+	lock := &Lock{
+		collection: c,
+		id:         id,
+		key:        c.LockKey(id),
+		token:      generateRandomID(),
+	}
+	conn := c.pool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	if _, err := redis.String(conn.Do("SET", lock.key, lock.token, "NX", "PX", durationToMilliseconds(ttl))); err != nil {
+		if err == redis.ErrNil {
+			return nil, newLockError(c, id, "lock is held by someone else")
+		}
+		return nil, err
+	}
+	return lock, nil
+}
+
+// LockWithTimeout works like Lock, but if the lock is currently held by
+// someone else, it keeps trying to acquire the lock until it succeeds or
+// timeout has elapsed. If the lock could not be acquired in time, it returns
+// a LockError.
+func (c *Collection) LockWithTimeout(id string, ttl time.Duration, timeout time.Duration) (*Lock, error) {
+	deadline := time.Now().Add(timeout)
+	interval := minLockRetryInterval
+	for {
+		lock, err := c.Lock(id, ttl)
+		if _, ok := err.(LockError); !ok {
+			return lock, err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, newLockError(c, id, fmt.Sprintf("could not acquire lock within %s", timeout))
+		}
+		if interval > remaining {
+			interval = remaining
+		}
+		time.Sleep(interval)
+		interval *= 2
+		if interval > maxLockRetryInterval {
+			interval = maxLockRetryInterval
+		}
+	}
+}
+
+// Unlock releases the lock. It returns a LockError if the lock is no longer
+// held, i.e. if it has already been released or it expired (in which case it
+// may have been acquired by someone else).
+func (l *Lock) Unlock() error {
+	t := l.collection.pool.NewTransaction()
+	t.unlock(l.key, l.token, l.newHeldHandler("unlock"))
+	return t.Exec()
+}
+
+// Extend sets the time to live of the lock to ttl, starting now. It returns a
+// LockError if the lock is no longer held, i.e. if it has already been
+// released or it expired (in which case it may have been acquired by someone
+// else). ttl must be at least one millisecond.
+func (l *Lock) Extend(ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return fmt.Errorf("zoom: error in Extend: ttl must be at least one millisecond. Got: %s", ttl)
+	}
+	t := l.collection.pool.NewTransaction()
+	t.extendLock(l.key, l.token, durationToMilliseconds(ttl), l.newHeldHandler("extend"))
+	return t.Exec()
+}
+
+// newHeldHandler returns a ReplyHandler for the unlock and extend_lock scripts
+// which returns a LockError if the reply indicates that the lock is no longer
+// held. action describes what was attempted.
+func (l *Lock) newHeldHandler(action string) ReplyHandler {
+	return func(reply interface{}) error {
+		held, err := redis.Bool(reply, nil)
+		if err != nil {
+			return err
+		}
+		if !held {
+			return newLockError(l.collection, l.id, fmt.Sprintf("could not %s lock because it is no longer held", action))
+		}
+		return nil
+	}
+}
+
+// RequireLock causes the transaction to only be executed if lock is still
+// held. When the transaction is executed, Exec watches the key for the lock
+// and checks its token before sending any of the actions. If the lock is no
+// longer held, Exec returns a LockError without executing the transaction. If
+// the lock is released, expires, or is acquired by someone else after it was
+// checked but before the transaction is executed, Exec returns a WatchError.
+// (Note that expiration only causes a WatchError in Redis 6.0.9 and later.)
+// Unlike Watch, RequireLock can be called at any point before Exec.
+func (t *Transaction) RequireLock(lock *Lock) {
+	if lock == nil {
+		t.setError(fmt.Errorf("zoom: error in RequireLock: lock cannot be nil"))
+		return
+	}
+	t.locks = append(t.locks, lock)
+}
+
+// SaveWithLock works like Save, but the model is only saved if lock, which
+// must be the lock for the model, is still held. It returns a LockError or a
+// WatchError if the lock is not held. See Transaction.RequireLock for more
+// information.
+func (c *Collection) SaveWithLock(model Model, lock *Lock) error {
+	t := c.pool.NewTransaction()
+	t.SaveWithLock(c, model, lock)
+	return t.Exec()
+}
+
+// SaveWithLock works like Transaction.Save, but the model is only saved if
+// lock, which must be the lock for the model, is still held when the
+// transaction is executed. The entire transaction will fail if the lock is not
+// held. See RequireLock for more information.
+func (t *Transaction) SaveWithLock(c *Collection, model Model, lock *Lock) {
+	if lock != nil && model != nil && (lock.collection != c || lock.id != model.ModelID()) {
+		t.setError(fmt.Errorf("zoom: error in SaveWithLock: lock %s is not for the given model", lock.key))
+		return
+	}
+	t.RequireLock(lock)
+	t.Save(c, model)
+}
+
+// checkLocks watches the keys for all the locks required by the transaction
+// and checks that each of them is still held.
+func (t *Transaction) checkLocks() error {
+	for _, lock := range t.locks {
+		if _, err := t.conn.Do("WATCH", lock.key); err != nil {
+			return err
+		}
+		t.watching = append(t.watching, lock.key)
+		token, err := redis.String(t.conn.Do("GET", lock.key))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		if token != lock.token {
+			return newLockError(lock.collection, lock.id, "lock is no longer held")
+		}
+	}
+	return nil
+}
+
+// durationToMilliseconds converts d to a whole number of milliseconds.
+func durationToMilliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
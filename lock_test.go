@@ -0,0 +1,113 @@
+// File lock_test.go tests locks (lock.go)
+
+package kvmodel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	lock, err := testModels.Lock("id", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "id", lock.ID())
+	assert.Equal(t, testModels.LockKey("id"), lock.Key())
+	// The lock is already held, so it cannot be acquired again
+	_, err = testModels.Lock("id", time.Minute)
+	assert.IsType(t, LockError{}, err)
+	start := time.Now()
+	_, err = testModels.LockWithTimeout("id", time.Minute, 20*time.Millisecond)
+	assert.IsType(t, LockError{}, err)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond, "Expected LockWithTimeout to wait for the timeout")
+	// Locks for other ids are independent
+	other, err := testModels.Lock("other", time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, other.Unlock())
+
+	require.NoError(t, lock.Extend(time.Hour))
+	require.NoError(t, lock.Unlock())
+	// Once the lock is released, the old lock can no longer be used
+	assert.IsType(t, LockError{}, lock.Unlock())
+	assert.IsType(t, LockError{}, lock.Extend(time.Minute))
+	newLock, err := testModels.Lock("id", time.Minute)
+	require.NoError(t, err)
+	// The old lock cannot release a lock which was acquired by someone else
+	assert.IsType(t, LockError{}, lock.Unlock())
+	require.NoError(t, newLock.Unlock())
+}
+
+// expectLockTTL checks that the time to live of lock is greater than 0 and at
+// most ttl.
+func expectLockTTL(t *testing.T, lock *Lock, ttl time.Duration) {
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	pttl, err := redis.Int64(conn.Do("PTTL", lock.Key()))
+	require.NoError(t, err)
+	assert.True(t, pttl > 0 && pttl <= durationToMilliseconds(ttl), "Expected ttl for lock to be at most %s but got %dms", ttl, pttl)
+}
+
+func TestLockWithTimeout(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	lock, err := testModels.Lock("id", time.Minute)
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = lock.Unlock()
+	}()
+	newLock, err := testModels.LockWithTimeout("id", time.Minute, time.Second)
+	require.NoError(t, err)
+	assert.NotEqual(t, lock.Token(), newLock.Token())
+	require.NoError(t, newLock.Unlock())
+
+	// Locks expire after their ttl
+	expiringLock, err := testModels.Lock("expiring", time.Minute)
+	require.NoError(t, err)
+	expectLockTTL(t, expiringLock, time.Minute)
+	require.NoError(t, expiringLock.Extend(time.Hour))
+	expectLockTTL(t, expiringLock, time.Hour)
+}
+
+func TestSaveWithLock(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveTestModels(2)
+	require.NoError(t, err)
+	model := models[0]
+	lock, err := testModels.Lock(model.ModelID(), time.Minute)
+	require.NoError(t, err)
+	model.Int++
+	require.NoError(t, testModels.SaveWithLock(model, lock))
+	expectModelExists(t, testModels, model)
+
+	// The lock must be for the given model
+	assert.Error(t, testModels.SaveWithLock(models[1], lock))
+
+	// If the lock is no longer held, the transaction should not be executed
+	require.NoError(t, lock.Unlock())
+	original := *model
+	model.Int++
+	tx := testPool.NewTransaction()
+	tx.SaveWithLock(testModels, model, lock)
+	tx.Save(testModels, models[1])
+	assert.IsType(t, LockError{}, tx.Exec())
+	got := &testModel{}
+	require.NoError(t, testModels.Find(model.ModelID(), got))
+	assert.Equal(t, &original, got)
+
+	// A pipeline cannot require locks
+	p := testPool.NewPipeline()
+	p.SaveWithLock(testModels, model, lock)
+	assert.Error(t, p.Exec())
+}
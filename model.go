@@ -72,7 +72,7 @@ const (
 )
 
 // indexKind is the kind of an index, and is either noIndex, numericIndex,
-// stringIndex, or booleanIndex.
+// stringIndex, booleanIndex, geoIndex, or integerIndex.
 type indexKind int
 
 const (
@@ -80,6 +80,8 @@ const (
 	numericIndex
 	stringIndex
 	booleanIndex
+	geoIndex
+	integerIndex
 )
 
 // compilesModelSpec examines typ using reflection, parses its fields,
@@ -159,10 +161,18 @@ func compileModelSpec(typ reflect.Type) (*modelSpec, error) {
 			}
 		} else {
 			// All other types are considered inconvertible
+			fs.kind = inconvertibleField
 			if shouldIndex {
-				return nil, fmt.Errorf("zoom: Requested index on unsupported type %s", field.Type)
+				if !typeIsGeoPoint(field.Type) {
+					return nil, fmt.Errorf("zoom: Requested index on unsupported type %s", field.Type)
+				}
+				// GeoPoints are stored with the fallback marshaler, but they are
+				// indexed in a geo index.
+				if ms.geoFieldSpec() != nil {
+					return nil, fmt.Errorf("zoom: Requested geo index on %s but type %s already has a geo index (only one is allowed)", field.Name, elem.Name())
+				}
+				fs.indexKind = geoIndex
 			}
-			fs.kind = inconvertibleField
 		}
 	}
 	return ms, nil
@@ -184,6 +194,8 @@ func getDefaultModelSpecName(typ reflect.Type) string {
 // setIndexKind sets the indexKind field of fs based on fieldType.
 func setIndexKind(fs *fieldSpec, fieldType reflect.Type) error {
 	switch {
+	case typeIsLargeInteger(fieldType):
+		fs.indexKind = integerIndex
 	case typeIsNumeric(fieldType):
 		fs.indexKind = numericIndex
 	case typeIsString(fieldType):
@@ -260,16 +272,81 @@ func (ms *modelSpec) fieldIndexKey(fieldName string) (string, error) {
 	return ms.name + ":" + fs.redisName, nil
 }
 
+// fieldNullSetKey returns the key for the set which contains the ids of all
+// the models for which the field identified by fieldName is nil. It returns an
+// error if fieldName does not identify a field in the spec or if the field it
+// identifies is not an indexed field. Null sets are only maintained for indexed
+// pointer fields (see fieldSpec.hasNullSet).
+func (ms *modelSpec) fieldNullSetKey(fieldName string) (string, error) {
+	indexKey, err := ms.fieldIndexKey(fieldName)
+	if err != nil {
+		return "", err
+	}
+	return indexKey + ":null", nil
+}
+
+// hasLexIndex returns true iff the field index is a sorted set where all the
+// scores are 0 and each member consists of a value, followed by a NULL
+// character, followed by an id. This is the case for string and integer
+// indexes, which are queried with ZRANGEBYLEX.
+func (fs *fieldSpec) hasLexIndex() bool {
+	return fs.indexKind == stringIndex || fs.indexKind == integerIndex
+}
+
+// hasNullSet returns true iff a null set is maintained for the field, which is
+// the case for all indexed fields with a pointer type.
+func (fs *fieldSpec) hasNullSet() bool {
+	return fs.indexKind != noIndex && fs.typ.Kind() == reflect.Ptr
+}
+
+// canSortBy returns true iff the field can be used to sort models with the SORT
+// command, i.e. if it is a string, bool, or numeric field which is not a
+// pointer. (Nil pointers are stored as NULL, which cannot be sorted
+// numerically.)
+func (fs *fieldSpec) canSortBy() bool {
+	return fs.kind == primativeField && typeIsPrimative(fs.typ)
+}
+
+// indexKindArgs returns arguments that describe all the indexed fields for
+// the given modelSpec. The arguments consist of pairs of the Redis name of each
+// indexed field and either "string" for string indexes, "integer" for integer
+// indexes, or "score" for numeric, boolean, and geo indexes (geo indexes are
+// also sorted sets of ids). They are used by Lua scripts which need to maintain
+// the field indexes.
+func (ms *modelSpec) indexKindArgs() redis.Args {
+	args := redis.Args{}
+	for _, fs := range ms.fields {
+		switch fs.indexKind {
+		case noIndex:
+			continue
+		case stringIndex:
+			args = append(args, fs.redisName, "string")
+		case integerIndex:
+			args = append(args, fs.redisName, "integer")
+		default:
+			args = append(args, fs.redisName, "score")
+		}
+	}
+	return args
+}
+
 // sortArgs returns arguments that can be used to get all the fields in includeFields
 // for all the models which have corresponding ids in setKey. Any fields not in
 // includeFields will not be included in the arguments and will not be retrieved from
 // redis when the command is eventually run. If limit or offset are not 0, the LIMIT
 // option will be added to the arguments with the given limit and offset. setKey must
-// be the key of a set or a sorted set which consists of model ids. The arguments
-// use they "BY nosort" option, so if a specific order is required, the setKey should be
-// a sorted set.
-func (ms *modelSpec) sortArgs(idsKey string, redisFieldNames []string, limit int, offset uint, reverse bool) redis.Args {
+// be the key of a set or a sorted set which consists of model ids. If sortBy is nil,
+// the arguments use they "BY nosort" option, so if a specific order is required, the
+// setKey should be a sorted set. Otherwise the ids are sorted by the value of the
+// sortBy field in the main hash of each model (with the ALPHA option for strings).
+func (ms *modelSpec) sortArgs(idsKey string, sortBy *fieldSpec, redisFieldNames []string, limit int, offset uint, reverse bool) redis.Args {
 	args := redis.Args{idsKey, "BY", "nosort"}
+	if sortBy != nil {
+		args = redis.Args{idsKey, "BY", ms.name + ":*->" + sortBy.redisName}
+		if typeIsString(sortBy.typ) {
+			args = append(args, "ALPHA")
+		}
+	}
 	for _, fieldName := range redisFieldNames {
 		args = append(args, "GET", ms.name+":*->"+fieldName)
 	}
@@ -314,6 +391,12 @@ func (ms *modelSpec) checkModelsType(models interface{}) error {
 	return nil
 }
 
+// newModelsSlice returns a pointer to a new, empty slice of models of the
+// registered type that corresponds to modelSpec.
+func (ms *modelSpec) newModelsSlice() interface{} {
+	return reflect.New(reflect.SliceOf(ms.typ)).Interface()
+}
+
 // modelRef represents a reference to a particular model. It consists of the model object
 // itself and a pointer to the corresponding spec. This allows us to avoid constant lookups
 // in the modelTypeToSpec map.
@@ -0,0 +1,741 @@
+// File parse.go contains code for parsing queries from strings and printing
+// queries in the same textual format.
+
+package kvmodel
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ParseQuery parses s and returns the corresponding Query for the collection.
+// s consists of zero or more conditions separated by AND, followed by zero or
+// more clauses. Each condition is one of the following:
+//
+//	Field op value            (op is one of =, !=, <>, <, >, <=, or >=)
+//	Field IN (value, ...)
+//	Field IS NULL
+//	Field IS NOT NULL
+//	NEAR(lat, lon, radius, 'unit')
+//	WITHIN BOX(lat, lon, width, height, 'unit')
+//	WITHIN SET 'key'          (see Query.Within)
+//	NOT WITHIN SET 'key'      (see Query.Excluding)
+//
+// and each clause is one of the following:
+//
+//	ORDER BY Field            (or -Field, Field ASC, or Field DESC)
+//	LIMIT n
+//	OFFSET n
+//	INCLUDE Field, ...
+//	EXCLUDE Field, ...
+//	ALLOW SCAN
+//	SINGLE SCRIPT
+//
+// Keywords are case-insensitive. Values may be numbers, strings in single or
+// double quotes (the quote character can be escaped by doubling it), true,
+// false, or NULL, and are converted to the type of the corresponding field. For
+// example:
+//
+//	Age >= 21 AND Status IN ('a', 'b') ORDER BY -CreatedAt LIMIT 20 OFFSET 40
+//
+// Each condition and clause is applied with the corresponding query modifier
+// (e.g. Filter or Order), so the same validation rules apply. If s is invalid,
+// ParseQuery returns a ParseError which includes the position of the error.
+// Query.String returns a string in the same format, which can be parsed again
+// to get an equivalent query.
+func (c *Collection) ParseQuery(s string) (*Query, error) {
+	tokens, err := lexQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{
+		input:  s,
+		tokens: tokens,
+		query:  c.NewQuery(),
+	}
+	if p.query.hasError() {
+		return nil, p.query.err
+	}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p.query, nil
+}
+
+// String satisfies fmt.Stringer and prints out the query in the format that is
+// accepted by Collection.ParseQuery, e.g. "Age >= 21 ORDER BY -CreatedAt".
+// The result can be parsed again to get an equivalent query. The string for a
+// query without any modifiers is empty.
+func (q *Query) String() string {
+	conditions := []string{}
+	for _, f := range q.filters {
+		conditions = append(conditions, f.text())
+	}
+	if q.hasGeoSearch() {
+		conditions = append(conditions, q.geoSearch.text())
+	}
+	for _, setKey := range q.withinKeys {
+		conditions = append(conditions, "WITHIN SET "+quoteLiteral(setKey))
+	}
+	for _, setKey := range q.excludedKeys {
+		conditions = append(conditions, "NOT WITHIN SET "+quoteLiteral(setKey))
+	}
+	parts := []string{}
+	if len(conditions) > 0 {
+		parts = append(parts, strings.Join(conditions, " AND "))
+	}
+	if q.hasOrder() {
+		prefix := ""
+		if q.order.kind == descendingOrder {
+			prefix = "-"
+		}
+		parts = append(parts, "ORDER BY "+prefix+q.order.fieldName)
+	}
+	if q.hasLimit() {
+		parts = append(parts, fmt.Sprintf("LIMIT %d", q.limit))
+	}
+	if q.hasOffset() {
+		parts = append(parts, fmt.Sprintf("OFFSET %d", q.offset))
+	}
+	if q.hasIncludes() {
+		parts = append(parts, "INCLUDE "+strings.Join(q.includes, ", "))
+	} else if q.hasExcludes() {
+		parts = append(parts, "EXCLUDE "+strings.Join(q.excludes, ", "))
+	}
+	if q.allowScan {
+		parts = append(parts, "ALLOW SCAN")
+	}
+	if q.singleScript {
+		parts = append(parts, "SINGLE SCRIPT")
+	}
+	return strings.Join(parts, " ")
+}
+
+// text returns the filter in the format accepted by Collection.ParseQuery.
+func (f filter) text() string {
+	switch f.op {
+	case isNullOp:
+		return f.fieldSpec.name + " IS NULL"
+	case isNotNullOp:
+		return f.fieldSpec.name + " IS NOT NULL"
+	case inOp:
+		values := make([]string, f.value.Len())
+		for i := range values {
+			values[i] = literalText(f.value.Index(i))
+		}
+		return fmt.Sprintf("%s IN (%s)", f.fieldSpec.name, strings.Join(values, ", "))
+	}
+	return fmt.Sprintf("%s %s %s", f.fieldSpec.name, f.op, literalText(f.value))
+}
+
+// text returns the geo search in the format accepted by Collection.ParseQuery.
+func (gs geoSearch) text() string {
+	if gs.shape == radiusShape {
+		return fmt.Sprintf("NEAR(%s, %s, %s, %s)", formatFloat(gs.lat), formatFloat(gs.lon), formatFloat(gs.radius), quoteLiteral(gs.unit))
+	}
+	return fmt.Sprintf("WITHIN BOX(%s, %s, %s, %s, %s)", formatFloat(gs.lat), formatFloat(gs.lon), formatFloat(gs.width), formatFloat(gs.height), quoteLiteral(gs.unit))
+}
+
+// literalText returns val, which should be a primitive or a pointer to a
+// primitive, as a literal value in the format accepted by
+// Collection.ParseQuery.
+func literalText(val reflect.Value) string {
+	val = reflect.Indirect(val)
+	switch val.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(val.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(val.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(val.Uint(), 10)
+	case reflect.Float32:
+		return strconv.FormatFloat(val.Float(), 'g', -1, 32)
+	case reflect.Float64:
+		return formatFloat(val.Float())
+	default:
+		// String or slice or array of bytes
+		return quoteLiteral(stringValue(val))
+	}
+}
+
+// formatFloat formats f as a literal value in the format accepted by
+// Collection.ParseQuery.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// quoteLiteral surrounds s with single quotes, escaping any single quotes in s
+// by doubling them.
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// tokenKind is the kind of a token in a query string.
+type tokenKind int
+
+const (
+	identToken tokenKind = iota
+	numberToken
+	stringToken
+	opToken
+	minusToken
+	leftParenToken
+	rightParenToken
+	commaToken
+	eofToken
+)
+
+// token is a single token in a query string. For string tokens, text is the
+// value of the string without quotes or escape characters.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// describe returns a description of t which is used in error messages.
+func (t token) describe() string {
+	switch t.kind {
+	case eofToken:
+		return "end of query"
+	case stringToken:
+		return "string " + quoteLiteral(t.text)
+	}
+	return strconv.Quote(t.text)
+}
+
+// is returns true iff t is an identifier which matches the given keyword,
+// ignoring case.
+func (t token) is(keyword string) bool {
+	return t.kind == identToken && strings.EqualFold(t.text, keyword)
+}
+
+// lexQuery splits s into tokens. The last token is always an eofToken.
+func lexQuery(s string) ([]token, error) {
+	tokens := []token{}
+	i := 0
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '_' || unicode.IsLetter(r):
+			for i < len(s) {
+				r, size := utf8.DecodeRuneInString(s[i:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, token{kind: identToken, text: s[start:i], pos: start})
+		case isDigit(r), r == '.' && i+1 < len(s) && isDigit(rune(s[i+1])), r == '-' && i+1 < len(s) && (isDigit(rune(s[i+1])) || s[i+1] == '.'):
+			i = lexNumber(s, i)
+			tokens = append(tokens, token{kind: numberToken, text: s[start:i], pos: start})
+		case r == '\'' || r == '"':
+			text, end, ok := lexString(s, i)
+			if !ok {
+				return nil, newParseError(s, start, "unterminated string")
+			}
+			i = end
+			tokens = append(tokens, token{kind: stringToken, text: text, pos: start})
+		case r == '-':
+			i++
+			tokens = append(tokens, token{kind: minusToken, text: "-", pos: start})
+		case r == '(':
+			i++
+			tokens = append(tokens, token{kind: leftParenToken, text: "(", pos: start})
+		case r == ')':
+			i++
+			tokens = append(tokens, token{kind: rightParenToken, text: ")", pos: start})
+		case r == ',':
+			i++
+			tokens = append(tokens, token{kind: commaToken, text: ",", pos: start})
+		case strings.ContainsRune("=!<>", r):
+			op := ""
+			for _, candidate := range []string{"!=", "<>", "<=", ">=", "=", "<", ">"} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, newParseError(s, start, fmt.Sprintf("unexpected character %q", r))
+			}
+			i += len(op)
+			tokens = append(tokens, token{kind: opToken, text: op, pos: start})
+		default:
+			return nil, newParseError(s, start, fmt.Sprintf("unexpected character %q", r))
+		}
+	}
+	tokens = append(tokens, token{kind: eofToken, pos: len(s)})
+	return tokens, nil
+}
+
+// lexNumber returns the position of the end of the number which starts at
+// position start in s. The number may include a sign, a decimal point, and an
+// exponent.
+func lexNumber(s string, start int) int {
+	i := start
+	if s[i] == '-' {
+		i++
+	}
+	for i < len(s) && (isDigit(rune(s[i])) || s[i] == '.') {
+		i++
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(rune(s[j])) {
+			i = j
+			for i < len(s) && isDigit(rune(s[i])) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+// lexString reads the quoted string which starts at position start in s. It
+// returns the value of the string and the position of the end of the string.
+// ok is false if the string is not terminated.
+func lexString(s string, start int) (text string, end int, ok bool) {
+	quote := s[start]
+	value := []byte{}
+	for i := start + 1; i < len(s); i++ {
+		if s[i] != quote {
+			value = append(value, s[i])
+			continue
+		}
+		// A doubled quote character is an escaped quote
+		if i+1 < len(s) && s[i+1] == quote {
+			value = append(value, quote)
+			i++
+			continue
+		}
+		return string(value), i + 1, true
+	}
+	return "", 0, false
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// queryParser holds the state for parsing a query string.
+type queryParser struct {
+	input  string
+	tokens []token
+	pos    int
+	query  *Query
+}
+
+// peek returns the current token without consuming it.
+func (p *queryParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// peekAhead returns the token after the current token without consuming
+// anything.
+func (p *queryParser) peekAhead() token {
+	if p.pos+1 < len(p.tokens) {
+		return p.tokens[p.pos+1]
+	}
+	return p.tokens[len(p.tokens)-1]
+}
+
+// next consumes and returns the current token.
+func (p *queryParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != eofToken {
+		p.pos++
+	}
+	return t
+}
+
+// errorf returns a ParseError for the given token.
+func (p *queryParser) errorf(t token, format string, args ...interface{}) error {
+	return newParseError(p.input, t.pos, fmt.Sprintf(format, args...))
+}
+
+// expect consumes the current token and returns an error if it is not of the
+// given kind. what is a description of the expected token.
+func (p *queryParser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, p.errorf(t, "expected %s but got %s", what, t.describe())
+	}
+	return t, nil
+}
+
+// expectKeyword consumes the current token and returns an error if it is not
+// the given keyword.
+func (p *queryParser) expectKeyword(keyword string) error {
+	t := p.next()
+	if !t.is(keyword) {
+		return p.errorf(t, "expected %s but got %s", keyword, t.describe())
+	}
+	return nil
+}
+
+// checkQuery returns a ParseError for t if the query has an error, which is
+// the case if the modifier that was just applied to the query was invalid.
+func (p *queryParser) checkQuery(t token) error {
+	if p.query.hasError() {
+		return p.errorf(t, "%s", strings.TrimPrefix(p.query.err.Error(), "zoom: "))
+	}
+	return nil
+}
+
+// parse parses the entire query string.
+func (p *queryParser) parse() error {
+	if p.peek().is("WHERE") {
+		p.next()
+	}
+	if !p.atClause() && p.peek().kind != eofToken {
+		for {
+			if err := p.parseCondition(); err != nil {
+				return err
+			}
+			if !p.peek().is("AND") {
+				break
+			}
+			p.next()
+		}
+	}
+	seen := map[string]bool{}
+	for p.peek().kind != eofToken {
+		t := p.peek()
+		if !p.atClause() {
+			return p.errorf(t, "expected AND, ORDER BY, LIMIT, OFFSET, INCLUDE, EXCLUDE, ALLOW SCAN, SINGLE SCRIPT, or end of query but got %s", t.describe())
+		}
+		keyword := strings.ToUpper(t.text)
+		if seen[keyword] {
+			return p.errorf(t, "%s may only be specified once", keyword)
+		}
+		seen[keyword] = true
+		if err := p.parseClause(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// atClause returns true iff the current token is the start of a clause. Since
+// fields may have the same names as keywords, a keyword followed by an
+// operator is treated as a field.
+func (p *queryParser) atClause() bool {
+	t, ahead := p.peek(), p.peekAhead()
+	if ahead.kind == opToken || ahead.is("IN") || ahead.is("IS") {
+		return false
+	}
+	for _, keyword := range []string{"ORDER", "LIMIT", "OFFSET", "INCLUDE", "EXCLUDE", "ALLOW", "SINGLE"} {
+		if t.is(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCondition parses a single condition and applies it to the query.
+func (p *queryParser) parseCondition() error {
+	t := p.peek()
+	if t.is("NEAR") && p.peekAhead().kind == leftParenToken {
+		return p.parseGeoSearch()
+	}
+	if t.is("WITHIN") && p.peekAhead().is("BOX") {
+		return p.parseGeoSearch()
+	}
+	if (t.is("WITHIN") && p.peekAhead().is("SET")) || (t.is("NOT") && p.peekAhead().is("WITHIN")) {
+		return p.parseSetCondition()
+	}
+	fieldToken, err := p.expect(identToken, "a field name")
+	if err != nil {
+		return err
+	}
+	fieldName := fieldToken.text
+	fs, found := p.query.collection.spec.fieldsByName[fieldName]
+	if !found {
+		return p.errorf(fieldToken, "could not find field %s in type %s", fieldName, p.query.collection.spec.typ.String())
+	}
+	operator := p.next()
+	switch {
+	case operator.is("IS"):
+		if p.peek().is("NOT") {
+			p.next()
+			if err := p.expectKeyword("NULL"); err != nil {
+				return err
+			}
+			p.query.IsNotNull(fieldName)
+		} else {
+			if err := p.expectKeyword("NULL"); err != nil {
+				return err
+			}
+			p.query.IsNull(fieldName)
+		}
+	case operator.is("IN"):
+		values, err := p.parseValueList(fs)
+		if err != nil {
+			return err
+		}
+		p.query.Filter(fieldName+" in", values)
+	case operator.kind == opToken:
+		op := operator.text
+		if op == "<>" {
+			op = "!="
+		}
+		valueToken := p.next()
+		value, err := p.literalValue(fs, valueToken)
+		if err != nil {
+			return err
+		}
+		p.query.Filter(fieldName+" "+op, value)
+	default:
+		return p.errorf(operator, "expected an operator, IN, or IS but got %s", operator.describe())
+	}
+	return p.checkQuery(fieldToken)
+}
+
+// parseValueList parses a list of values in parentheses and returns them as a
+// slice of the type of the field identified by fs.
+func (p *queryParser) parseValueList(fs *fieldSpec) (interface{}, error) {
+	if _, err := p.expect(leftParenToken, "("); err != nil {
+		return nil, err
+	}
+	values := reflect.MakeSlice(reflect.SliceOf(baseFieldType(fs)), 0, 0)
+	for {
+		valueToken := p.next()
+		value, err := p.literalValue(fs, valueToken)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			return nil, p.errorf(valueToken, "NULL is not allowed with IN")
+		}
+		values = reflect.Append(values, reflect.ValueOf(value))
+		t := p.next()
+		if t.kind == rightParenToken {
+			break
+		}
+		if t.kind != commaToken {
+			return nil, p.errorf(t, "expected , or ) but got %s", t.describe())
+		}
+	}
+	return values.Interface(), nil
+}
+
+// parseGeoSearch parses a NEAR or WITHIN BOX condition and applies it to the
+// query.
+func (p *queryParser) parseGeoSearch() error {
+	start := p.next()
+	numArgs := 4
+	if start.is("WITHIN") {
+		// Skip the BOX keyword
+		p.next()
+		numArgs = 5
+	}
+	if _, err := p.expect(leftParenToken, "("); err != nil {
+		return err
+	}
+	args := []float64{}
+	for i := 0; i < numArgs-1; i++ {
+		t, err := p.expect(numberToken, "a number")
+		if err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return p.errorf(t, "invalid number %s", t.text)
+		}
+		args = append(args, f)
+		if _, err := p.expect(commaToken, ","); err != nil {
+			return err
+		}
+	}
+	unit, err := p.expect(stringToken, "a unit")
+	if err != nil {
+		return err
+	}
+	if _, err := p.expect(rightParenToken, ")"); err != nil {
+		return err
+	}
+	if numArgs == 4 {
+		p.query.Near(args[0], args[1], args[2], unit.text)
+	} else {
+		p.query.WithinBox(args[0], args[1], args[2], args[3], unit.text)
+	}
+	return p.checkQuery(start)
+}
+
+// parseSetCondition parses a WITHIN SET or NOT WITHIN SET condition and
+// applies it to the query.
+func (p *queryParser) parseSetCondition() error {
+	start := p.next()
+	excluding := start.is("NOT")
+	if excluding {
+		// Skip the WITHIN keyword
+		p.next()
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return err
+	}
+	setKey, err := p.expect(stringToken, "a set key")
+	if err != nil {
+		return err
+	}
+	if excluding {
+		p.query.Excluding(setKey.text)
+	} else {
+		p.query.Within(setKey.text)
+	}
+	return p.checkQuery(start)
+}
+
+// parseClause parses a single clause and applies it to the query.
+func (p *queryParser) parseClause() error {
+	t := p.next()
+	switch strings.ToUpper(t.text) {
+	case "ORDER":
+		if err := p.expectKeyword("BY"); err != nil {
+			return err
+		}
+		prefix := ""
+		if p.peek().kind == minusToken {
+			p.next()
+			prefix = "-"
+		}
+		fieldToken, err := p.expect(identToken, "a field name")
+		if err != nil {
+			return err
+		}
+		if p.peek().is("DESC") || p.peek().is("ASC") {
+			direction := p.next()
+			if prefix != "" {
+				return p.errorf(direction, "cannot use %s with -", strings.ToUpper(direction.text))
+			}
+			if direction.is("DESC") {
+				prefix = "-"
+			}
+		}
+		p.query.Order(prefix + fieldToken.text)
+		return p.checkQuery(fieldToken)
+	case "LIMIT", "OFFSET":
+		numToken, err := p.expect(numberToken, "a number")
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseUint(numToken.text, 10, 0)
+		if err != nil {
+			return p.errorf(numToken, "expected a non-negative integer but got %s", numToken.text)
+		}
+		if t.is("LIMIT") {
+			p.query.Limit(uint(n))
+		} else {
+			p.query.Offset(uint(n))
+		}
+	case "INCLUDE", "EXCLUDE":
+		fields := []string{}
+		for {
+			fieldToken, err := p.expect(identToken, "a field name")
+			if err != nil {
+				return err
+			}
+			if _, found := p.query.collection.spec.fieldsByName[fieldToken.text]; !found {
+				return p.errorf(fieldToken, "could not find field %s in type %s", fieldToken.text, p.query.collection.spec.typ.String())
+			}
+			fields = append(fields, fieldToken.text)
+			if p.peek().kind != commaToken {
+				break
+			}
+			p.next()
+		}
+		if t.is("INCLUDE") {
+			p.query.Include(fields...)
+		} else {
+			p.query.Exclude(fields...)
+		}
+		return p.checkQuery(t)
+	case "ALLOW":
+		if err := p.expectKeyword("SCAN"); err != nil {
+			return err
+		}
+		p.query.AllowScan()
+	case "SINGLE":
+		if err := p.expectKeyword("SCRIPT"); err != nil {
+			return err
+		}
+		p.query.SingleScript()
+	}
+	return nil
+}
+
+// literalValue converts the literal value in t to the type of the field
+// identified by fs (dereferencing pointer types). It returns nil if t is the
+// NULL keyword.
+func (p *queryParser) literalValue(fs *fieldSpec, t token) (interface{}, error) {
+	if t.is("NULL") {
+		return nil, nil
+	}
+	typ := baseFieldType(fs)
+	switch {
+	case typeIsBool(typ):
+		if !t.is("true") && !t.is("false") {
+			return nil, p.errorf(t, "expected true or false for field %s but got %s", fs.name, t.describe())
+		}
+		return reflect.ValueOf(t.is("true")).Convert(typ).Interface(), nil
+	case typeIsNumeric(typ):
+		if t.kind != numberToken {
+			return nil, p.errorf(t, "expected a number for field %s but got %s", fs.name, t.describe())
+		}
+		val := reflect.New(typ).Elem()
+		var err error
+		switch typ.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			var n int64
+			n, err = strconv.ParseInt(t.text, 10, typ.Bits())
+			val.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			var n uint64
+			n, err = strconv.ParseUint(t.text, 10, typ.Bits())
+			val.SetUint(n)
+		default:
+			var f float64
+			f, err = strconv.ParseFloat(t.text, typ.Bits())
+			val.SetFloat(f)
+		}
+		if err != nil {
+			return nil, p.errorf(t, "invalid value %s for field %s of type %s", t.text, fs.name, typ.String())
+		}
+		return val.Interface(), nil
+	case typeIsString(typ):
+		if t.kind != stringToken {
+			return nil, p.errorf(t, "expected a string for field %s but got %s", fs.name, t.describe())
+		}
+		if typ.Kind() == reflect.Array {
+			if len(t.text) > typ.Len() {
+				return nil, p.errorf(t, "string is too long for field %s of type %s", fs.name, typ.String())
+			}
+			val := reflect.New(typ).Elem()
+			reflect.Copy(val, reflect.ValueOf([]byte(t.text)))
+			return val.Interface(), nil
+		}
+		return reflect.ValueOf(t.text).Convert(typ).Interface(), nil
+	}
+	return nil, p.errorf(t, "values are not allowed for field %s of type %s", fs.name, fs.typ.String())
+}
+
+// baseFieldType returns the type of the field identified by fs, dereferencing
+// pointer types.
+func baseFieldType(fs *fieldSpec) reflect.Type {
+	typ := fs.typ
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
@@ -0,0 +1,226 @@
+// File parse_test.go tests the query parser and the textual format returned by
+// Query.String (parse.go)
+
+package kvmodel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuery(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	testCases := []struct {
+		input    string
+		expected *Query
+		text     string
+	}{
+		{
+			input:    "",
+			expected: indexedTestModels.NewQuery(),
+			text:     "",
+		},
+		{
+			input:    "Int >= 21 AND String IN ('a','b') ORDER BY -Int LIMIT 20 OFFSET 40",
+			expected: indexedTestModels.NewQuery().Filter("Int >=", 21).Filter("String in", []string{"a", "b"}).Order("-Int").Limit(20).Offset(40),
+			text:     "Int >= 21 AND String IN ('a', 'b') ORDER BY -Int LIMIT 20 OFFSET 40",
+		},
+		{
+			input:    "where int <> -3 and Bool = TRUE order by String desc",
+			expected: nil,
+		},
+		{
+			input:    "WHERE Int <> -3 AND Bool = TRUE ORDER BY String DESC",
+			expected: indexedTestModels.NewQuery().Filter("Int !=", -3).Filter("Bool =", true).Order("-String"),
+			text:     "Int != -3 AND Bool = true ORDER BY -String",
+		},
+		{
+			input:    `String = "it's" AND String != 'it''s not' INCLUDE Int, String`,
+			expected: indexedTestModels.NewQuery().Filter("String =", "it's").Filter("String !=", "it's not").Include("Int", "String"),
+			text:     "String = 'it''s' AND String != 'it''s not' INCLUDE Int, String",
+		},
+		{
+			input:    "order by Int asc exclude Bool",
+			expected: indexedTestModels.NewQuery().Order("Int").Exclude("Bool"),
+			text:     "ORDER BY Int EXCLUDE Bool",
+		},
+	}
+	for _, tc := range testCases {
+		got, err := indexedTestModels.ParseQuery(tc.input)
+		if tc.expected == nil {
+			assert.Error(t, err, "Expected an error for %q", tc.input)
+			continue
+		}
+		require.NoError(t, err, "Unexpected error for %q", tc.input)
+		assert.Equal(t, tc.expected.query.String(), got.query.String(), "Wrong query for %q", tc.input)
+		assert.Equal(t, tc.text, got.String())
+		// Parsing the string again should result in an equivalent query.
+		reparsed, err := indexedTestModels.ParseQuery(got.String())
+		require.NoError(t, err, "Unexpected error for %q", got.String())
+		assert.Equal(t, got.query.String(), reparsed.query.String())
+	}
+}
+
+func TestParseQueryRoundTrip(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	testCases := []struct {
+		collection *Collection
+		query      *Query
+	}{
+		{
+			collection: indexedPrimativesModels,
+			query: indexedPrimativesModels.NewQuery().Filter("Uint8 >", uint8(3)).Filter("Int64 <", int64(-10)).
+				Filter("Float32 =", float32(1.1)).Filter("Float64 <=", 1e-20).Filter("Byte >", byte('a')).
+				Filter("Rune =", 'x').Filter("String =", "café").Filter("Bool !=", false),
+		},
+		{
+			collection: indexedPointersModels,
+			query: indexedPointersModels.NewQuery().IsNull("Int").IsNotNull("String").
+				Filter("Uint in", []uint{1, 2, 3}).Filter("Float64 >", 0.5),
+		},
+		{
+			collection: testModels,
+			query:      testModels.NewQuery().AllowScan().Filter("Int >", 2).Filter("String <=", "z").Offset(3),
+		},
+		{
+			collection: geoTestModels,
+			query:      geoTestModels.NewQuery().Near(37.7749, -122.4194, 20, "km").Filter("Name in", []string{"a"}).Order("Location"),
+		},
+		{
+			collection: geoTestModels,
+			query:      geoTestModels.NewQuery().WithinBox(-33.5, 151.25, 10, 2.5, "mi").Limit(1),
+		},
+		{
+			collection: indexedTestModels,
+			query:      indexedTestModels.NewQuery().Filter("Int <", 5).Order("String").SingleScript(),
+		},
+		{
+			collection: indexedTestModels,
+			query:      indexedTestModels.NewQuery().Filter("Bool =", true).Within("favorites:'a'").Excluding("hidden").Order("Int"),
+		},
+	}
+	for _, tc := range testCases {
+		require.NoError(t, tc.query.err)
+		got, err := tc.collection.ParseQuery(tc.query.String())
+		require.NoError(t, err, "Unexpected error for %q", tc.query.String())
+		assert.Equal(t, tc.query.query.String(), got.query.String())
+		assert.Equal(t, tc.query.String(), got.String())
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	testCases := []struct {
+		input string
+		pos   int
+	}{
+		{"Foo = 3", 0},
+		{"Int = 'a'", 6},
+		{"Int = 3.5", 6},
+		{"Int = 3 AND String", 18},
+		{"Int = 3 OR String = 'a'", 8},
+		{"Int = 3 ORDER Int", 14},
+		{"String = 'abc", 9},
+		{"Int = 3 LIMIT -1", 14},
+		{"Int IN (1, 2", 12},
+		{"Int IN (1, NULL)", 11},
+		{"Int > NULL", 0},
+		{"Int # 3", 4},
+		{"Bool = 1", 7},
+		{"ORDER BY Int LIMIT 1 LIMIT 2", 21},
+		{"ORDER BY -Int DESC", 14},
+		{"ORDER BY Foo", 9},
+		{"INCLUDE Int EXCLUDE Bool", 12},
+		{"NEAR(1, 2, 3, 'km')", 0},
+		{"WITHIN SET favorites", 11},
+		{"NOT WITHIN 'favorites'", 11},
+	}
+	for _, tc := range testCases {
+		_, err := indexedTestModels.ParseQuery(tc.input)
+		if !assert.Error(t, err, "Expected an error for %q", tc.input) {
+			continue
+		}
+		parseErr, ok := err.(ParseError)
+		if assert.True(t, ok, "Expected a ParseError for %q but got %T: %s", tc.input, err, err) {
+			assert.Equal(t, tc.pos, parseErr.Pos, "Wrong position for %q: %s", tc.input, err)
+		}
+	}
+}
+
+func TestParseQueryOrderUnindexed(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Unindexed primitive fields can be ordered by, just like with Query.Order
+	testCases := []struct {
+		input    string
+		expected *Query
+		text     string
+	}{
+		{
+			input:    "ORDER BY Int",
+			expected: testModels.NewQuery().Order("Int"),
+			text:     "ORDER BY Int",
+		},
+		{
+			input:    "ORDER BY String DESC",
+			expected: testModels.NewQuery().Order("-String"),
+			text:     "ORDER BY -String",
+		},
+		{
+			input:    "Int > 3 ORDER BY -Int ALLOW SCAN",
+			expected: testModels.NewQuery().Filter("Int >", 3).Order("-Int").AllowScan(),
+			text:     "Int > 3 ORDER BY -Int ALLOW SCAN",
+		},
+	}
+	for _, tc := range testCases {
+		got, err := testModels.ParseQuery(tc.input)
+		require.NoError(t, err, "Unexpected error for %q", tc.input)
+		assert.Equal(t, tc.expected.query.String(), got.query.String(), "Wrong query for %q", tc.input)
+		assert.Equal(t, tc.text, got.String())
+	}
+
+	// The parsed query should run and return the models in order
+	models, err := createAndSaveTestModels(5)
+	require.NoError(t, err)
+	q, err := testModels.ParseQuery("ORDER BY Int DESC")
+	require.NoError(t, err)
+	got := []*testModel{}
+	require.NoError(t, q.Run(&got))
+	require.Len(t, got, len(models))
+	for i := 1; i < len(got); i++ {
+		assert.True(t, got[i-1].Int >= got[i].Int, "Models are not in descending order: %v", got)
+	}
+}
+
+func TestParseQueryRun(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	require.NoError(t, err)
+	for i, model := range models {
+		model.Int = i
+		model.String = string(rune('a' + i))
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	require.NoError(t, tx.Exec())
+
+	q, err := indexedTestModels.ParseQuery("Int >= 2 AND String IN ('a', 'c', 'e', 'f', 'z') ORDER BY -Int LIMIT 2 OFFSET 1")
+	require.NoError(t, err)
+	ids, err := q.IDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{models[4].ModelID(), models[2].ModelID()}, ids)
+	checkForLeakedTmpKeys(t, q.query)
+}
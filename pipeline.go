@@ -0,0 +1,167 @@
+// File pipeline.go contains code related to pipelines, which are like
+// transactions but do not use MULTI/EXEC.
+
+package kvmodel
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Pipeline is like a Transaction, but its actions are not executed atomically.
+// Instead of wrapping the actions in MULTI/EXEC, Exec sends them to Redis in
+// chunks and calls the handler for each action as soon as its reply is read.
+// This is useful for high-throughput writes (e.g. bulk loading) where
+// atomicity is not needed. Pipeline has all the same methods as Transaction
+// (e.g. Save, Find, Command, Script, and Query), except that it cannot watch
+// keys.
+type Pipeline struct {
+	*Transaction
+	chunkSize int
+}
+
+// NewPipeline instantiates and returns a new pipeline. The number of actions
+// which are sent to Redis at once is determined by the PipelineChunkSize
+// property of the PoolOptions.
+func (p *Pool) NewPipeline() *Pipeline {
+	return &Pipeline{
+		Transaction: p.NewTransaction(),
+		chunkSize:   p.options.PipelineChunkSize,
+	}
+}
+
+// Watch always returns an error, because pipelines cannot watch keys.
+func (p *Pipeline) Watch(model Model) error {
+	return fmt.Errorf("zoom: Cannot call Watch on a pipeline. Use a transaction instead")
+}
+
+// WatchKey always returns an error, because pipelines cannot watch keys.
+func (p *Pipeline) WatchKey(key string) error {
+	return fmt.Errorf("zoom: Cannot call WatchKey on a pipeline. Use a transaction instead")
+}
+
+// RequireLock adds an error to the pipeline, because pipelines are not atomic
+// and therefore cannot require locks.
+func (p *Pipeline) RequireLock(lock *Lock) {
+	p.setError(fmt.Errorf("zoom: Cannot call RequireLock on a pipeline. Use a transaction instead"))
+}
+
+// SaveWithLock adds an error to the pipeline, because pipelines are not atomic
+// and therefore cannot require locks.
+func (p *Pipeline) SaveWithLock(c *Collection, model Model, lock *Lock) {
+	p.RequireLock(lock)
+}
+
+// Exec executes the pipeline, sending the actions in chunks and calling the
+// handler for each action with its reply. Unlike Transaction.Exec, Exec does
+// not stop at the first error. If the reply for an action was an error or its
+// handler returned an error, the remaining actions are still executed and Exec
+// returns a BatchError which maps the index of each action that failed (in the
+// order the actions were added) to its error. Actions which were executed
+// before a failed action are not rolled back. If there is a problem with the
+// connection, Exec stops and the error is reported for each action whose reply
+// was not read. If any of the methods used to add actions to the pipeline
+// encountered an error, Exec returns that error without executing anything.
+//
+// The functions registered with OnCommit are called if all the actions were
+// executed, even if some of them failed. The functions registered with
+// OnRollback are called if Exec stopped before all the actions were executed.
+// Since pipelines are not atomic, some of the actions may have been executed
+// in that case.
+func (p *Pipeline) Exec() error {
+	committed, err := p.exec()
+	p.runCallbacks(committed, err)
+	return err
+}
+
+// exec does the work for Exec. committed is true iff all the actions were
+// executed.
+func (p *Pipeline) exec() (committed bool, err error) {
+	// Return the connection to the pool when we are done
+	defer func() {
+		if p.conn != nil {
+			_ = p.conn.Close()
+		}
+	}()
+
+	// If the pipeline had an error from a previous command, return it
+	// and don't continue
+	if p.err != nil {
+		return false, p.err
+	}
+
+	if p.options.DryRun {
+		p.record(false)
+		return false, nil
+	}
+
+	if err := p.loadMissingScripts(); err != nil {
+		return false, err
+	}
+	committed = true
+	errs := map[int]error{}
+	p.replies = make([]interface{}, len(p.actions))
+	chunkSize := p.chunkSize
+	if chunkSize <= 0 {
+		chunkSize = len(p.actions)
+	}
+	for start := 0; start < len(p.actions); start += chunkSize {
+		stop := start + chunkSize
+		if stop > len(p.actions) {
+			stop = len(p.actions)
+		}
+		if err := p.execChunk(start, stop, errs); err != nil {
+			// The connection is broken, so none of the remaining replies can
+			// be read
+			for i := start; i < len(p.actions); i++ {
+				if _, found := errs[i]; !found {
+					errs[i] = err
+				}
+			}
+			committed = false
+			break
+		}
+	}
+	if len(errs) > 0 {
+		return committed, BatchError{
+			Method: "Pipeline.Exec",
+			Errors: errs,
+		}
+	}
+	return committed, nil
+}
+
+// execChunk sends the actions with indexes from start up to (but not
+// including) stop, then reads the reply for each of them and calls the
+// corresponding handler. Errors for individual actions are added to errs. It
+// returns an error if there was a problem with the connection.
+func (p *Pipeline) execChunk(start, stop int, errs map[int]error) error {
+	for _, a := range p.actions[start:stop] {
+		if err := p.sendAction(a); err != nil {
+			return err
+		}
+	}
+	if err := p.conn.Flush(); err != nil {
+		return err
+	}
+	for i := start; i < stop; i++ {
+		reply, err := p.conn.Receive()
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				return err
+			}
+			// The reply for this action was an error
+			p.replies[i] = err
+			errs[i] = err
+			continue
+		}
+		p.replies[i] = reply
+		if a := p.actions[i]; a.handler != nil {
+			if err := a.handler(reply); err != nil {
+				errs[i] = err
+			}
+		}
+	}
+	return nil
+}
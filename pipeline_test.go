@@ -0,0 +1,102 @@
+// File pipeline_test.go tests pipelines (pipeline.go)
+
+package kvmodel
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withPipelineChunkSize sets the PipelineChunkSize option of testPool to size
+// and returns a function which restores the original value.
+func withPipelineChunkSize(size int) func() {
+	original := testPool.options.PipelineChunkSize
+	testPool.options.PipelineChunkSize = size
+	return func() {
+		testPool.options.PipelineChunkSize = original
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	// Use a small chunk size so that the actions are sent in several chunks
+	defer withPipelineChunkSize(4)()
+
+	models := createIndexedTestModels(10)
+	p := testPool.NewPipeline()
+	for _, model := range models {
+		p.Save(indexedTestModels, model)
+	}
+	require.NoError(t, p.Exec())
+	for _, model := range models {
+		expectModelExists(t, indexedTestModels, model)
+	}
+
+	p = testPool.NewPipeline()
+	found := make([]*indexedTestModel, len(models))
+	for i, model := range models {
+		found[i] = &indexedTestModel{}
+		p.Find(indexedTestModels, model.ModelID(), found[i])
+	}
+	count := 0
+	p.Count(indexedTestModels, &count)
+	ordered := []*indexedTestModel{}
+	p.Query(indexedTestModels).Order("Int").Run(&ordered)
+	require.NoError(t, p.Exec())
+	assert.Equal(t, models, found)
+	assert.Equal(t, len(models), count)
+	expected := []*indexedTestModel{}
+	require.NoError(t, indexedTestModels.NewQuery().Order("Int").Run(&expected))
+	assert.Equal(t, expected, ordered)
+}
+
+func TestPipelinePartialFailure(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	defer withPipelineChunkSize(2)()
+
+	models, err := createAndSaveTestModels(1)
+	require.NoError(t, err)
+	handlerErr := errors.New("handler error")
+	p := testPool.NewPipeline()
+	p.Command("SET", redis.Args{"pipelineKey", "1"}, nil)
+	// INCR on a hash is an error
+	p.Command("INCR", redis.Args{testModels.ModelKey(models[0].ModelID())}, nil)
+	p.Command("INCR", redis.Args{"pipelineKey"}, nil)
+	p.Command("GET", redis.Args{"pipelineKey"}, func(interface{}) error {
+		return handlerErr
+	})
+	value := 0
+	p.Command("INCR", redis.Args{"pipelineKey"}, NewScanIntHandler(&value))
+	err = p.Exec()
+	require.IsType(t, BatchError{}, err)
+	batchErr := err.(BatchError)
+	assert.Len(t, batchErr.Errors, 2)
+	assert.IsType(t, redis.Error(""), batchErr.Errors[1])
+	assert.Equal(t, handlerErr, batchErr.Errors[3])
+	// The actions after the failures should still have been executed
+	assert.Equal(t, 3, value)
+}
+
+func TestPipelineErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	p := testPool.NewPipeline()
+	assert.Error(t, p.WatchKey("key"))
+	p.Save(indexedTestModels, &testModel{})
+	p.Command("SET", redis.Args{"pipelineKey", "1"}, nil)
+	assert.Error(t, p.Exec(), "Expected an error from Save")
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	exists, err := redis.Bool(conn.Do("EXISTS", "pipelineKey"))
+	require.NoError(t, err)
+	assert.False(t, exists, "Expected no actions to be executed")
+}
@@ -5,7 +5,11 @@
 package kvmodel
 
 import (
+	"fmt"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -23,6 +27,16 @@ type Pool struct {
 	modelTypeToSpec map[reflect.Type]*modelSpec
 	// modelNameToSpec maps a registered model name to a modelSpec
 	modelNameToSpec map[string]*modelSpec
+	// scripts maps the name of a user-defined Lua script to the script
+	scripts      map[string]*redis.Script
+	scriptsMutex sync.RWMutex
+	// loadedScripts is the number of registered scripts which have been loaded
+	// into the script cache by LoadScripts. Scripts cannot be unregistered, so
+	// all of them have been loaded if it is equal to len(scripts).
+	loadedScripts int
+	// recordings holds the recordings for transactions if options.DryRun is
+	// true
+	recordings recordings
 }
 
 // DefaultPoolOptions is the default set of options for a Pool.
@@ -35,6 +49,11 @@ var DefaultPoolOptions = PoolOptions{
 	Network:     "tcp",
 	Password:    "",
 	Wait:        true,
+
+	TemporaryKeyTTL: 60 * time.Second,
+	BatchSize:       1000,
+
+	PipelineChunkSize: 1000,
 }
 
 // PoolOptions contains various options for a pool.
@@ -63,6 +82,28 @@ type PoolOptions struct {
 	// MaxActive limit is reached, Zoom will return an error indicating that the
 	// pool is exhausted.
 	Wait bool
+	// TemporaryKeyTTL is the amount of time after which the temporary keys
+	// created by queries expire. Temporary keys are normally deleted as soon as
+	// the query is finished, so the expiration only matters if something goes
+	// wrong before then, e.g. if the connection is lost partway through a query
+	// that is not run inside a MULTI/EXEC transaction. It should be longer than
+	// the longest query you expect to run. A value of 0 means temporary keys
+	// never expire.
+	TemporaryKeyTTL time.Duration
+	// BatchSize is the maximum number of models that the batch methods (e.g.
+	// Collection.SaveMany) send to Redis in a single transaction. Larger batches
+	// are split into chunks of this size, each of which is sent in its own
+	// transaction. A value of 0 means there is no limit.
+	BatchSize int
+	// PipelineChunkSize is the maximum number of actions that Pipeline.Exec
+	// sends to Redis before reading the replies. A value of 0 means all the
+	// actions are sent at once.
+	PipelineChunkSize int
+	// DryRun causes all the transactions and pipelines for the pool to record
+	// their actions instead of sending them to Redis. The recordings can be
+	// retrieved with Pool.Recordings. See TransactionOptions.DryRun for more
+	// information.
+	DryRun bool
 }
 
 // WithAddress returns a new copy of the options with the Address property set
@@ -121,6 +162,36 @@ func (options PoolOptions) WithWait(wait bool) PoolOptions {
 	return options
 }
 
+// WithTemporaryKeyTTL returns a new copy of the options with the
+// TemporaryKeyTTL property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithTemporaryKeyTTL(ttl time.Duration) PoolOptions {
+	options.TemporaryKeyTTL = ttl
+	return options
+}
+
+// WithBatchSize returns a new copy of the options with the BatchSize property
+// set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithBatchSize(size int) PoolOptions {
+	options.BatchSize = size
+	return options
+}
+
+// WithPipelineChunkSize returns a new copy of the options with the
+// PipelineChunkSize property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithPipelineChunkSize(size int) PoolOptions {
+	options.PipelineChunkSize = size
+	return options
+}
+
+// WithDryRun returns a new copy of the options with the DryRun property set to
+// the given value. It does not mutate the original options.
+func (options PoolOptions) WithDryRun(dryRun bool) PoolOptions {
+	options.DryRun = dryRun
+	return options
+}
+
 // NewPool creates and returns a new pool using the given address to connect to
 // Redis. All the other options will be set to their default values, which can
 // be found in DefaultPoolOptions.
@@ -178,3 +249,81 @@ func (p *Pool) NewConn() redis.Conn {
 func (p *Pool) Close() error {
 	return p.redisPool.Close()
 }
+
+// CleanupTemporaryKeys deletes temporary keys which were created by queries
+// but never deleted, e.g. because the connection was lost partway through a
+// query. It only looks at the keys which queries create for the collections
+// registered with the pool, i.e. keys which start with "tmp:" followed by the
+// name of one of the collections and a colon. It uses SCAN to find them, so it
+// does not block the database for long periods of time, and only deletes keys
+// which do not have an expiration. Since all the temporary keys created by
+// queries have an expiration when TemporaryKeyTTL is greater than 0, the keys
+// without one were left behind by a process which ran with TemporaryKeyTTL set
+// to 0. CleanupTemporaryKeys returns an error without deleting anything if
+// TemporaryKeyTTL is 0 for the pool, because then it cannot tell the keys
+// which were left behind from the keys of queries which are still running.
+// It returns the number of keys that were deleted.
+func (p *Pool) CleanupTemporaryKeys() (int, error) {
+	if p.options.TemporaryKeyTTL <= 0 {
+		return 0, fmt.Errorf("zoom: error in CleanupTemporaryKeys: cannot safely delete temporary keys when TemporaryKeyTTL is 0")
+	}
+	names := make([]string, 0, len(p.modelNameToSpec))
+	for name := range p.modelNameToSpec {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	conn := p.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	count := 0
+	for _, name := range names {
+		n, err := cleanupTemporaryKeysMatching(conn, "tmp:"+escapeGlobPattern(name)+":*")
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// cleanupTemporaryKeysMatching deletes the keys which match pattern and do not
+// have an expiration, and returns the number of keys that were deleted.
+func cleanupTemporaryKeysMatching(conn redis.Conn, pattern string) (int, error) {
+	count := 0
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return count, err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return count, err
+		}
+		if len(keys) > 0 {
+			n, err := redis.Int(deleteKeysWithoutTtlScript.Do(conn, redis.Args{}.AddFlat(keys)...))
+			if err != nil {
+				return count, err
+			}
+			count += n
+		}
+		if cursor == 0 {
+			return count, nil
+		}
+	}
+}
+
+// escapeGlobPattern escapes the characters in s which have a special meaning in
+// the patterns used by SCAN MATCH.
+func escapeGlobPattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,90 @@
+// File pool_test.go tests the options for a pool and the cleanup of
+// temporary keys (pool.go)
+
+package kvmodel
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemporaryKeyTTL(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	q := indexedTestModels.NewQuery().Filter("Int >", 3).Order("-String")
+	steps, err := q.Explain()
+	require.NoError(t, err)
+	// Every temporary key that is written should be given an expiration, and
+	// should be namespaced by the collection name.
+	expired := map[string]bool{}
+	for _, step := range steps {
+		if step.Name == "PEXPIRE" {
+			require.Len(t, step.Args, 2)
+			assert.Equal(t, "60000", step.Args[1])
+			expired[step.Args[0]] = true
+		}
+	}
+	assert.Len(t, expired, 3)
+	for key := range expired {
+		assert.True(t, strings.HasPrefix(key, "tmp:indexedTestModel:"), "Temporary key was not namespaced: %s", key)
+	}
+
+	// When TemporaryKeyTTL is 0, temporary keys should not expire.
+	originalTTL := testPool.options.TemporaryKeyTTL
+	testPool.options.TemporaryKeyTTL = 0
+	defer func() {
+		testPool.options.TemporaryKeyTTL = originalTTL
+	}()
+	steps, err = q.Explain()
+	require.NoError(t, err)
+	for _, step := range steps {
+		assert.NotEqual(t, "PEXPIRE", step.Name)
+	}
+}
+
+func TestCleanupTemporaryKeys(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, err := conn.Do("ZADD", "tmp:indexedTestModel:filter:leaked", 0, "a")
+	require.NoError(t, err)
+	_, err = conn.Do("SET", "tmp:indexedTestModel:filter:inUse", "a", "PX", time.Minute.Nanoseconds()/int64(time.Millisecond))
+	require.NoError(t, err)
+	_, err = conn.Do("SET", "notTemporary", "a")
+	require.NoError(t, err)
+	// Keys under tmp: which were not created for a registered collection
+	// belong to the application and should not be deleted
+	_, err = conn.Do("SET", "tmp:applicationData", "a")
+	require.NoError(t, err)
+
+	count, err := testPool.CleanupTemporaryKeys()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	keys, err := redis.Strings(conn.Do("KEYS", "*"))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"tmp:indexedTestModel:filter:inUse", "notTemporary", "tmp:applicationData"}, keys)
+
+	// CleanupTemporaryKeys should refuse to run if temporary keys do not
+	// expire, since it cannot tell which ones are still in use
+	original := testPool.options.TemporaryKeyTTL
+	testPool.options.TemporaryKeyTTL = 0
+	defer func() {
+		testPool.options.TemporaryKeyTTL = original
+	}()
+	_, err = testPool.CleanupTemporaryKeys()
+	assert.Error(t, err)
+}
+
+func TestEscapeGlobPattern(t *testing.T) {
+	assert.Equal(t, `a\*b\?c\[d\]e\\\\f`, escapeGlobPattern(`a*b?c[d]e\\f`))
+}
@@ -24,13 +24,21 @@ func (collection *Collection) NewQuery() *Query {
 // field in the struct type corresponding to the Collection used in the query
 // constructor. By default, the records are sorted by ascending order by the
 // given field. To sort by descending order, put a negative sign before the
-// field name. Zoom can only sort by fields which have been indexed, i.e. those
-// which have the `zoom:"index"` struct tag. Only one order may be specified per
-// Order will set an error on the query if the fieldName is invalid, if another
-// order has already been applied to the query, or if the fieldName specified
-// does not correspond to an indexed field. The error, same as any other error
-// that occurs during the lifetime of the query, is not returned until the query
-// is executed.
+// field name. Ordering by a field which has been indexed (i.e. one which has
+// the `zoom:"index"` struct tag) is fast. Ordering by a geo indexed field sorts
+// the models by their distance from the location given to Near or WithinBox,
+// and is only allowed if one of those is used. Fields which have not been
+// indexed can also be used if they have a string, bool, or numeric type (but
+// not a pointer type). In that case the models are sorted with the SORT
+// command, which reads the value of the field from the main hash of each
+// model, so this is slower and best suited to occasional queries. Numbers are
+// compared as float64s and strings are compared byte by byte. Only one order
+// may be specified per query. Order will set an error on the query if the
+// fieldName is invalid, if another order has already been applied to the
+// query, or if the fieldName specified corresponds to an unindexed field which
+// does not have a string, bool, or numeric type (e.g. a pointer, slice, or
+// struct). The error, same as any other error that occurs during the lifetime
+// of the query, is not returned until the query is executed.
 func (q *Query) Order(fieldName string) *Query {
 	q.query.Order(fieldName)
 	return q
@@ -82,19 +90,125 @@ func (q *Query) Exclude(fields ...string) *Query {
 // be an expression which includes a fieldName, a space, and an operator in that
 // order. For example: Filter("Age >=", 30) would only return models which have
 // an Age value greater than or equal to 30. Operators must be one of "=", "!=",
-// ">", "<", ">=", or "<=". You can only use Filter on fields which are indexed,
-// i.e. those which have the `zoom:"index"` struct tag. If multiple filters are
-// applied to the same query, the query will only return models which have
-// matches for *all* of the filters. Filter will set an error on the query if
-// the arguments are improperly formated, if the field you are attempting to
-// filter is not indexed, or if the type of value does not match the type of the
-// field. The error, same as any other error that occurs during the lifetime of
-// the query, is not returned until the query is executed.
+// ">", "<", ">=", or "<=". If value is nil, the operator must be one of "is",
+// "=", "is not", or "!=", and the filter works exactly like IsNull (for "is" or
+// "=") or IsNotNull (for "is not" or "!="). For example: Filter("DeletedAt is",
+// nil) would only return models for which DeletedAt is nil. You can only use
+// Filter on fields which are indexed, i.e. those which have the `zoom:"index"`
+// struct tag, unless the query also uses AllowScan (see the documentation for
+// AllowScan). If multiple filters are applied to the same query, the query will
+// only return models which have matches for *all* of the filters. Filter will
+// set an error on the query if the arguments are improperly formated, if the
+// field you are attempting to filter is not indexed, or if the type of value
+// does not match the type of the field. The error, same as any other error that
+// occurs during the lifetime of the query, is not returned until the query is
+// executed.
 func (q *Query) Filter(filterString string, value interface{}) *Query {
 	q.query.Filter(filterString, value)
 	return q
 }
 
+// Near restricts the query to models whose geo indexed field (a field of type
+// GeoPoint or *GeoPoint with the `zoom:"index"` struct tag) is within radius of
+// the location identified by lat and lon. unit must be one of "m", "km", "mi",
+// or "ft". Near can be combined with Filter, in which case the query will only
+// return models which are within the radius *and* match all the filters. To
+// sort the models by their distance from the location, use Order with the
+// name of the geo indexed field. Near will set an error on the query if the
+// model type does not have a geo index, if the radius is negative, if the unit
+// is invalid, or if Near or WithinBox has already been used on the query. The
+// error, same as any other error that occurs during the lifetime of the query,
+// is not returned until the query is executed. Near requires Redis 6.2 or
+// later, since it uses the GEOSEARCH command.
+func (q *Query) Near(lat, lon, radius float64, unit string) *Query {
+	q.query.Near(lat, lon, radius, unit)
+	return q
+}
+
+// WithinBox works like Near, but restricts the query to models within a box
+// which is centered on the location identified by lat and lon. width and height
+// are the dimensions of the box in the given unit, which must be one of "m",
+// "km", "mi", or "ft". See the documentation for Near for more information.
+func (q *Query) WithinBox(lat, lon, width, height float64, unit string) *Query {
+	q.query.WithinBox(lat, lon, width, height, unit)
+	return q
+}
+
+// IsNull applies a filter to the query, which will cause the query to only
+// return models for which the value of the field identified by fieldName is
+// nil. It is only allowed on indexed pointer fields, i.e. fields with a pointer
+// type which have the `zoom:"index"` struct tag. Zoom keeps track of the models
+// for which such fields are nil in a separate set whenever the models are
+// saved, so models which were saved with an older version of Zoom need to be
+// saved again before IsNull will return them. IsNull will set an error on the
+// query if the field is not an indexed pointer field. The error, same as any
+// other error that occurs during the lifetime of the query, is not returned
+// until the query is executed.
+func (q *Query) IsNull(fieldName string) *Query {
+	q.query.IsNull(fieldName)
+	return q
+}
+
+// IsNotNull works like IsNull, but causes the query to only return models for
+// which the value of the field identified by fieldName is not nil. See the
+// documentation for IsNull for more information.
+func (q *Query) IsNotNull(fieldName string) *Query {
+	q.query.IsNotNull(fieldName)
+	return q
+}
+
+// Within restricts the query to models whose ids are in the set or sorted set
+// identified by setKey, e.g. a set of the ids of the models that a user has
+// marked as favorites. Ids in the set which do not correspond to a model in the
+// collection are ignored. Within can be combined with any other query
+// modifiers, including Filter and Order, and may be used more than once, in
+// which case the query will only return models whose ids are in all of the
+// sets. The set is read when the query is executed, so it may change between
+// executions.
+func (q *Query) Within(setKey string) *Query {
+	q.query.Within(setKey)
+	return q
+}
+
+// Excluding causes the query to skip models whose ids are in the set or
+// sorted set identified by setKey, e.g. a set of the ids of the models that a
+// user has hidden. Excluding can be combined with any other query modifiers,
+// including Within, and may be used more than once. Excluding requires Redis
+// 6.2 or later, since it uses the ZDIFFSTORE command.
+func (q *Query) Excluding(setKey string) *Query {
+	q.query.Excluding(setKey)
+	return q
+}
+
+// AllowScan allows the query to use filters on primitive fields which are not
+// indexed. Such filters are evaluated inside of a Lua script by reading the
+// field value from the main hash of each model, which can be slow for large
+// collections. Filters on indexed fields are always applied first in order to
+// reduce the number of models that need to be read. Without AllowScan, using
+// Filter on an unindexed field will cause the query to return an error when it
+// is executed. Models whose value for a pointer field is nil never match a
+// scanned filter.
+func (q *Query) AllowScan() *Query {
+	q.query.AllowScan()
+	return q
+}
+
+// SingleScript causes the query to be run as a single Lua script when it is
+// finished with Run, RunOne, Count, or IDs. Normally each filter is applied by
+// extracting the matching ids into a temporary sorted set and intersecting it
+// with the others, which requires several commands and temporary keys for each
+// filter. In single script mode, the filters, order, limit, offset, and field
+// projection are all applied in memory by one script, which does not create any
+// temporary keys and stops reading models as soon as the limit is reached. This
+// is usually faster for queries with a limit or with filters that match a small
+// number of models, but the script blocks Redis for as long as it runs, so it
+// can be slower for queries that match a large part of a big collection. All
+// the other query finishers ignore SingleScript.
+func (q *Query) SingleScript() *Query {
+	q.query.SingleScript()
+	return q
+}
+
 // Run executes the query and scans the results into models. The type of models
 // should be a pointer to a slice of Models. If no models fit the criteria, Run
 // will set the length of models to 0 but will *not* return an error. Run will
@@ -151,3 +265,131 @@ func (q *Query) StoreIDs(destKey string) error {
 	newTransactionQuery(q.query, tx).StoreIDs(destKey)
 	return tx.Exec()
 }
+
+// Sum computes the sum of the values of the numeric field identified by
+// fieldName for all models that match the query criteria. The computation
+// happens inside of a Lua script, so only the result is sent over the network.
+// If fieldName is indexed, the values are read from the index. Otherwise they
+// are read from the main hash for each model. Models which do not have a value
+// for the field (e.g. because it is a nil pointer) are skipped. Sum will return
+// the first error that occurred during the lifetime of the query (if any), or
+// if fieldName does not identify a numeric field.
+func (q *Query) Sum(fieldName string) (float64, error) {
+	return q.aggregate(func(tq *TransactionQuery, result *float64) {
+		tq.Sum(fieldName, result)
+	})
+}
+
+// Avg computes the average of the values of the numeric field identified by
+// fieldName for all models that match the query criteria. If no models have a
+// value for the field, Avg returns 0. See the documentation for Query.Sum for
+// more information about how aggregates are computed.
+func (q *Query) Avg(fieldName string) (float64, error) {
+	return q.aggregate(func(tq *TransactionQuery, result *float64) {
+		tq.Avg(fieldName, result)
+	})
+}
+
+// Min finds the smallest value of the numeric field identified by fieldName
+// among all models that match the query criteria. If no models have a value
+// for the field, Min returns 0. See the documentation for Query.Sum for more
+// information about how aggregates are computed.
+func (q *Query) Min(fieldName string) (float64, error) {
+	return q.aggregate(func(tq *TransactionQuery, result *float64) {
+		tq.Min(fieldName, result)
+	})
+}
+
+// Max finds the largest value of the numeric field identified by fieldName
+// among all models that match the query criteria. If no models have a value
+// for the field, Max returns 0. See the documentation for Query.Sum for more
+// information about how aggregates are computed.
+func (q *Query) Max(fieldName string) (float64, error) {
+	return q.aggregate(func(tq *TransactionQuery, result *float64) {
+		tq.Max(fieldName, result)
+	})
+}
+
+// aggregate runs the aggregate added by f in a new transaction and returns the
+// result.
+func (q *Query) aggregate(f func(tq *TransactionQuery, result *float64)) (float64, error) {
+	tx := q.pool.NewTransaction()
+	var result float64
+	f(newTransactionQuery(q.query, tx), &result)
+	if err := tx.Exec(); err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// GroupCount counts the number of models that match the query criteria for
+// each distinct value of the indexed field identified by fieldName. The keys of
+// the returned map have the same type as the field (with any pointers
+// dereferenced). Fields which are slices or arrays of bytes use strings as
+// keys instead. Models which do not have a value for the field (e.g. because it
+// is a nil pointer) are not counted. The counting happens inside of a Lua
+// script, so only the counts are sent over the network. The script either looks
+// up the value of each matching model or walks the existing field index,
+// whichever is smaller, so the cost is proportional to the smaller of the
+// number of matching models and the number of models in the collection.
+// GroupCount will return the first error that occurred during the lifetime of
+// the query (if any), or if fieldName does not identify an indexed field.
+func (q *Query) GroupCount(fieldName string) (map[interface{}]int, error) {
+	tx := q.pool.NewTransaction()
+	counts := map[interface{}]int{}
+	newTransactionQuery(q.query, tx).GroupCount(fieldName, &counts)
+	if err := tx.Exec(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Facets works like GroupCount but computes the counts for each of the indexed
+// fields identified by fieldNames in a single round trip. The returned map is
+// keyed by field name, and each value is a map of counts like the one returned
+// by GroupCount.
+func (q *Query) Facets(fieldNames ...string) (map[string]map[interface{}]int, error) {
+	tx := q.pool.NewTransaction()
+	facets := map[string]map[interface{}]int{}
+	newTransactionQuery(q.query, tx).Facets(fieldNames, &facets)
+	if err := tx.Exec(); err != nil {
+		return nil, err
+	}
+	return facets, nil
+}
+
+// Delete deletes all the models that match the query criteria and returns the
+// number of models that were deleted. The main hash, the id in the set of all
+// ids, and any field indexes are removed for each model. Delete runs
+// atomically inside of a Lua script, so the ids never need to be sent over the
+// network. If the query has a limit or offset, only the models in the given
+// range are deleted. Delete will return the first error that occurred during
+// the lifetime of the query (if any).
+func (q *Query) Delete() (int, error) {
+	tx := q.pool.NewTransaction()
+	count := 0
+	newTransactionQuery(q.query, tx).Delete(&count)
+	if err := tx.Exec(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Update sets the given fields for all the models that match the query
+// criteria and returns the number of models that were updated. values should
+// be a map of field names to new values. As with Filter, you can pass in a
+// primitive for fields which have pointer values, or nil to set a pointer field
+// to nil. Any field indexes are updated accordingly. Update runs atomically
+// inside of a Lua script, so the ids never need to be sent over the network. If
+// the query has a limit or offset, only the models in the given range are
+// updated. Update will return the first error that occurred during the lifetime
+// of the query (if any), or if any of the field names or values are invalid.
+func (q *Query) Update(values map[string]interface{}) (int, error) {
+	tx := q.pool.NewTransaction()
+	count := 0
+	newTransactionQuery(q.query, tx).Update(values, &count)
+	if err := tx.Exec(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -270,6 +270,676 @@ func TestQueryRunOne(t *testing.T) {
 	}
 }
 
+func TestQueryAggregates(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Save models in a collection where Int is indexed and in one where it is
+	// not so we can test both ways of reading the values.
+	tx := testPool.NewTransaction()
+	for i := 1; i <= 5; i++ {
+		tx.Save(indexedTestModels, &indexedTestModel{Int: i})
+		tx.Save(testModels, &testModel{Int: i})
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	type aggregateTestCase struct {
+		query    *Query
+		method   func(q *Query) (float64, error)
+		expected float64
+	}
+	for _, collection := range []*Collection{indexedTestModels, testModels} {
+		testCases := []aggregateTestCase{
+			{
+				query:    collection.NewQuery(),
+				method:   func(q *Query) (float64, error) { return q.Sum("Int") },
+				expected: 15,
+			},
+			{
+				query:    collection.NewQuery(),
+				method:   func(q *Query) (float64, error) { return q.Avg("Int") },
+				expected: 3,
+			},
+			{
+				query:    collection.NewQuery(),
+				method:   func(q *Query) (float64, error) { return q.Min("Int") },
+				expected: 1,
+			},
+			{
+				query:    collection.NewQuery(),
+				method:   func(q *Query) (float64, error) { return q.Max("Int") },
+				expected: 5,
+			},
+		}
+		if collection == indexedTestModels {
+			// Filters and orders are only allowed on indexed fields.
+			testCases = append(testCases,
+				aggregateTestCase{
+					query:    collection.NewQuery().Filter("Int >", 3),
+					method:   func(q *Query) (float64, error) { return q.Avg("Int") },
+					expected: 4.5,
+				},
+				aggregateTestCase{
+					query:    collection.NewQuery().Order("-Int").Limit(2),
+					method:   func(q *Query) (float64, error) { return q.Sum("Int") },
+					expected: 9,
+				},
+			)
+		}
+		for i, tc := range testCases {
+			got, err := tc.method(tc.query)
+			if err != nil {
+				t.Errorf("Unexpected error in test case %d for query %s: %s", i, tc.query, err.Error())
+				continue
+			}
+			if got != tc.expected {
+				t.Errorf("Error in test case %d for query %s: Expected %v but got %v", i, tc.query, tc.expected, got)
+			}
+			checkForLeakedTmpKeys(t, tc.query.query)
+		}
+	}
+
+	// Aggregates on non-numeric fields should return an error.
+	if _, err := indexedTestModels.NewQuery().Sum("String"); err == nil {
+		t.Error("Expected an error when calling Sum on a string field but got none")
+	}
+}
+
+func TestQueryGroupCountAndFacets(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	tx := testPool.NewTransaction()
+	for i := 0; i < 6; i++ {
+		tx.Save(indexedTestModels, &indexedTestModel{
+			Int:    i % 3,
+			String: []string{"a", "b"}[i%2],
+			Bool:   i < 4,
+		})
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := indexedTestModels.NewQuery().GroupCount("Int")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedCounts := map[interface{}]int{0: 2, 1: 2, 2: 2}
+	if !reflect.DeepEqual(expectedCounts, counts) {
+		t.Errorf("GroupCount was incorrect.\nExpected: %v\nGot:  %v", expectedCounts, counts)
+	}
+
+	q := indexedTestModels.NewQuery().Filter("Bool =", true)
+	facets, err := q.Facets("String", "Bool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFacets := map[string]map[interface{}]int{
+		"String": {"a": 2, "b": 2},
+		"Bool":   {true: 4},
+	}
+	if !reflect.DeepEqual(expectedFacets, facets) {
+		t.Errorf("Facets was incorrect for query %s.\nExpected: %v\nGot:  %v", q, expectedFacets, facets)
+	}
+	checkForLeakedTmpKeys(t, q.query)
+
+	// GroupCount on unindexed fields should return an error.
+	if _, err := testModels.NewQuery().GroupCount("Int"); err == nil {
+		t.Error("Expected an error when calling GroupCount on an unindexed field but got none")
+	}
+}
+
+func TestQueryGroupCountFewIDs(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*indexedPointersModel{}
+	tx := testPool.NewTransaction()
+	for i := 0; i < 10; i++ {
+		model := createIndexedPointersModel()
+		int8Val := int8(i)
+		model.Int8 = &int8Val
+		switch {
+		case i%3 == 0:
+			model.String = nil
+		case i == 1:
+			// A string which looks like the value stored for nil pointers
+			null := "NULL"
+			model.String = &null
+		default:
+			str := []string{"a", "b"}[i%2]
+			model.String = &str
+		}
+		if i%4 == 0 {
+			model.Int64 = nil
+		} else {
+			int64Val := -int64(i%2) * (1<<60 + 1)
+			model.Int64 = &int64Val
+		}
+		float64Val := float64(i%3) - 1.5
+		model.Float64 = &float64Val
+		models = append(models, model)
+		tx.Save(indexedPointersModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	// When the query matches fewer models than there are in the field index,
+	// the values are looked up for each id instead of iterating through the
+	// field index. Both should give the same results.
+	for _, limit := range []int8{3, 10} {
+		q := indexedPointersModels.NewQuery().Filter("Int8 <", limit)
+		for _, fieldName := range []string{"String", "Int64", "Float64", "Int8"} {
+			expected := map[interface{}]int{}
+			for _, model := range models[:limit] {
+				fieldVal := reflect.ValueOf(model).Elem().FieldByName(fieldName)
+				if !fieldVal.IsNil() {
+					expected[fieldVal.Elem().Interface()]++
+				}
+			}
+			counts, err := q.GroupCount(fieldName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expected, counts) {
+				t.Errorf("Wrong counts for field %s and query %s.\nExpected: %v\nGot:      %v", fieldName, q, expected, counts)
+			}
+		}
+		checkForLeakedTmpKeys(t, q.query)
+	}
+}
+
+func TestQueryDelete(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*indexedTestModel{}
+	tx := testPool.NewTransaction()
+	for i := 0; i < 5; i++ {
+		model := &indexedTestModel{
+			Int:    i,
+			String: strconv.Itoa(i),
+			Bool:   true,
+		}
+		models = append(models, model)
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	q := indexedTestModels.NewQuery().Filter("Int >=", 3)
+	count, err := q.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected count to be 2 but got %d", count)
+	}
+	checkForLeakedTmpKeys(t, q.query)
+	for _, model := range models[3:] {
+		expectModelDoesNotExist(t, indexedTestModels, model)
+		for _, fieldName := range []string{"Int", "String", "Bool"} {
+			expectIndexDoesNotExist(t, indexedTestModels, model, fieldName)
+		}
+	}
+	for _, model := range models[:3] {
+		expectModelExists(t, indexedTestModels, model)
+		for _, fieldName := range []string{"Int", "String", "Bool"} {
+			expectIndexExists(t, indexedTestModels, model, fieldName)
+		}
+	}
+
+	// Delete should respect limit and order.
+	q = indexedTestModels.NewQuery().Order("-Int").Limit(1)
+	if count, err := q.Delete(); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Errorf("Expected count to be 1 but got %d", count)
+	}
+	expectModelDoesNotExist(t, indexedTestModels, models[2])
+	expectModelsExist(t, indexedTestModels, Models(models[:2]))
+}
+
+func TestQueryUpdate(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*indexedTestModel{}
+	tx := testPool.NewTransaction()
+	for i := 0; i < 5; i++ {
+		model := &indexedTestModel{
+			Int:    i,
+			String: strconv.Itoa(i),
+		}
+		models = append(models, model)
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	q := indexedTestModels.NewQuery().Filter("Int <", 2)
+	count, err := q.Update(map[string]interface{}{
+		"String": "updated",
+		"Bool":   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected count to be 2 but got %d", count)
+	}
+	checkForLeakedTmpKeys(t, q.query)
+	for i, model := range models {
+		if i < 2 {
+			model.String = "updated"
+			model.Bool = true
+		}
+		got := &indexedTestModel{}
+		if err := indexedTestModels.Find(model.ModelID(), got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(model, got) {
+			t.Errorf("Model was not updated correctly.\nExpected: %v\nGot:  %v", model, got)
+		}
+		for _, fieldName := range []string{"Int", "String", "Bool"} {
+			expectIndexExists(t, indexedTestModels, model, fieldName)
+		}
+	}
+	// The old string index should have been removed.
+	if ids, err := indexedTestModels.NewQuery().Filter("String =", "0").IDs(); err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 0 {
+		t.Errorf("Expected the old string index to be removed but got ids: %v", ids)
+	}
+
+	// Pointer fields can be set to nil, which removes the index.
+	model := createIndexedPointersModel()
+	if err := indexedPointersModels.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := indexedPointersModels.NewQuery().Update(map[string]interface{}{"Int": nil, "String": "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	got := &indexedPointersModel{}
+	if err := indexedPointersModels.Find(model.ModelID(), got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Int != nil {
+		t.Errorf("Expected Int to be nil but got %d", *got.Int)
+	}
+	if got.String == nil || *got.String != "foo" {
+		t.Errorf("Expected String to be foo but got %v", got.String)
+	}
+	if ids, err := indexedPointersModels.NewQuery().Filter("Int =", *model.Int).IDs(); err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 0 {
+		t.Errorf("Expected the numeric index to be removed but got ids: %v", ids)
+	}
+
+	// Invalid field names and values should return an error.
+	if _, err := indexedTestModels.NewQuery().Update(map[string]interface{}{"Foo": 1}); err == nil {
+		t.Error("Expected an error for an invalid field name but got none")
+	}
+	if _, err := indexedTestModels.NewQuery().Update(map[string]interface{}{"Int": "foo"}); err == nil {
+		t.Error("Expected an error for an invalid value but got none")
+	}
+}
+
+func TestQueryAllowScan(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*testModel{}
+	tx := testPool.NewTransaction()
+	for i := 0; i < 6; i++ {
+		model := &testModel{
+			Int:    i,
+			String: strconv.Itoa(i),
+			Bool:   i%2 == 0,
+		}
+		models = append(models, model)
+		tx.Save(testModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without AllowScan, filters on unindexed fields should return an error.
+	if _, err := testModels.NewQuery().Filter("Int >", 2).IDs(); err == nil {
+		t.Error("Expected an error for a filter on an unindexed field but got none")
+	}
+
+	testCases := []struct {
+		query       *Query
+		expectedIDs []string
+	}{
+		{
+			query:       testModels.NewQuery().Filter("Int >", 2).AllowScan(),
+			expectedIDs: modelIDs(Models(models[3:])),
+		},
+		{
+			query:       testModels.NewQuery().AllowScan().Filter("String <=", "1").Filter("Bool =", true),
+			expectedIDs: modelIDs(Models(models[0:1])),
+		},
+		{
+			query:       testModels.NewQuery().AllowScan().Filter("Int !=", 0).Filter("Bool =", false),
+			expectedIDs: []string{models[1].ModelID(), models[3].ModelID(), models[5].ModelID()},
+		},
+	}
+	for i, tc := range testCases {
+		gotIDs, err := tc.query.IDs()
+		if err != nil {
+			t.Errorf("Unexpected error in test case %d for query %s: %s", i, tc.query, err.Error())
+			continue
+		}
+		if equal, msg := compareAsStringSet(tc.expectedIDs, gotIDs); !equal {
+			t.Errorf("Error in test case %d for query %s: %s\nExpected: %v\nGot:  %v", i, tc.query, msg, tc.expectedIDs, gotIDs)
+		}
+		if count, err := tc.query.Count(); err != nil {
+			t.Error(err)
+		} else if count != len(tc.expectedIDs) {
+			t.Errorf("Error in test case %d for query %s: Expected count to be %d but got %d", i, tc.query, len(tc.expectedIDs), count)
+		}
+		checkForLeakedTmpKeys(t, tc.query.query)
+	}
+}
+
+func TestQueryOrderUnindexed(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Save the models in a random order with distinct values for each field,
+	// where the order of the strings is different from the order of the ints.
+	models := make([]*testModel, 6)
+	tx := testPool.NewTransaction()
+	for _, j := range rand.Perm(len(models)) {
+		models[j] = &testModel{
+			Int:    j*10 - 20,
+			String: strconv.Itoa(j * 10),
+			Bool:   j%2 == 0,
+		}
+		tx.Save(testModels, models[j])
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	byString := []*testModel{models[0], models[1], models[2], models[3], models[4], models[5]}
+	sort.Slice(byString, func(i, j int) bool {
+		return byString[i].String < byString[j].String
+	})
+
+	testCases := []struct {
+		query       *Query
+		expectedIDs []string
+	}{
+		{
+			query:       testModels.NewQuery().Order("Int"),
+			expectedIDs: modelIDs(Models(models)),
+		},
+		{
+			query:       testModels.NewQuery().Order("-Int").Offset(1).Limit(2),
+			expectedIDs: []string{models[4].ModelID(), models[3].ModelID()},
+		},
+		{
+			query:       testModels.NewQuery().Order("String"),
+			expectedIDs: modelIDs(Models(byString)),
+		},
+		{
+			query:       testModels.NewQuery().AllowScan().Filter("Bool =", true).Order("-Int"),
+			expectedIDs: []string{models[4].ModelID(), models[2].ModelID(), models[0].ModelID()},
+		},
+	}
+	for i, tc := range testCases {
+		for _, q := range []*Query{tc.query, singleScriptQuery(tc.query)} {
+			gotIDs, err := q.IDs()
+			if err != nil {
+				t.Errorf("Unexpected error in test case %d for query %s: %s", i, q, err.Error())
+				continue
+			}
+			if !reflect.DeepEqual(tc.expectedIDs, gotIDs) {
+				t.Errorf("Error in test case %d for query %s\nExpected: %v\nGot:  %v", i, q, tc.expectedIDs, gotIDs)
+			}
+			checkForLeakedTmpKeys(t, q.query)
+		}
+		got := []*testModel{}
+		if err := tc.query.Run(&got); err != nil {
+			t.Errorf("Unexpected error in test case %d for query %s: %s", i, tc.query, err.Error())
+			continue
+		}
+		if gotIDs := modelIDs(Models(got)); !reflect.DeepEqual(tc.expectedIDs, gotIDs) {
+			t.Errorf("Error in test case %d for query %s.Run\nExpected: %v\nGot:  %v", i, tc.query, tc.expectedIDs, gotIDs)
+		}
+	}
+
+	// RunOne and aggregates with a limit should also use the order.
+	one := &testModel{}
+	if err := testModels.NewQuery().Order("-String").RunOne(one); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(byString[len(byString)-1], one) {
+		t.Errorf("Expected RunOne to return %#v but got %#v", byString[len(byString)-1], one)
+	}
+	sum, err := testModels.NewQuery().Order("Int").Limit(2).Sum("Int")
+	if err != nil {
+		t.Error(err)
+	} else if expected := float64(models[0].Int + models[1].Int); sum != expected {
+		t.Errorf("Expected sum to be %f but got %f", expected, sum)
+	}
+}
+
+func TestQueryFilterIn(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*indexedTestModel{}
+	tx := testPool.NewTransaction()
+	for i := 0; i < 6; i++ {
+		model := &indexedTestModel{
+			Int:    i,
+			String: strconv.Itoa(i),
+			Bool:   i%2 == 0,
+		}
+		models = append(models, model)
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		query       *Query
+		expectedIDs []string
+	}{
+		{
+			query:       indexedTestModels.NewQuery().Filter("Int in", []int{1, 3, 42}),
+			expectedIDs: []string{models[1].ModelID(), models[3].ModelID()},
+		},
+		{
+			query:       indexedTestModels.NewQuery().Filter("String in", [2]string{"0", "5"}),
+			expectedIDs: []string{models[0].ModelID(), models[5].ModelID()},
+		},
+		{
+			query:       indexedTestModels.NewQuery().Filter("Bool in", []bool{false}).Filter("Int in", []int{0, 1, 2, 3}),
+			expectedIDs: []string{models[1].ModelID(), models[3].ModelID()},
+		},
+		{
+			query:       indexedTestModels.NewQuery().Filter("Int in", []int{}),
+			expectedIDs: []string{},
+		},
+	}
+	for i, tc := range testCases {
+		gotIDs, err := tc.query.IDs()
+		if err != nil {
+			t.Errorf("Unexpected error in test case %d for query %s: %s", i, tc.query, err.Error())
+			continue
+		}
+		if equal, msg := compareAsStringSet(tc.expectedIDs, gotIDs); !equal {
+			t.Errorf("Error in test case %d for query %s: %s\nExpected: %v\nGot:  %v", i, tc.query, msg, tc.expectedIDs, gotIDs)
+		}
+		checkForLeakedTmpKeys(t, tc.query.query)
+	}
+
+	// The value should be a slice or array of the field type, and the field
+	// should be indexed.
+	if _, err := indexedTestModels.NewQuery().Filter("Int in", 1).IDs(); err == nil {
+		t.Error("Expected an error for a non-slice value but got none")
+	}
+	if _, err := indexedTestModels.NewQuery().Filter("Int in", []string{"1"}).IDs(); err == nil {
+		t.Error("Expected an error for a slice of the wrong type but got none")
+	}
+	if _, err := testModels.NewQuery().AllowScan().Filter("Int in", []int{1}).IDs(); err == nil {
+		t.Error("Expected an error for an unindexed field but got none")
+	}
+}
+
+func TestQueryNullFilters(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// models[i] has a nil Int if i is even and a nil String if i is divisible
+	// by 3.
+	models := []*indexedPointersModel{}
+	tx := testPool.NewTransaction()
+	for i := 0; i < 6; i++ {
+		model := createIndexedPointersModel()
+		if i%2 == 0 {
+			model.Int = nil
+		}
+		if i%3 == 0 {
+			model.String = nil
+		}
+		models = append(models, model)
+		tx.Save(indexedPointersModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	nilInts := []string{models[0].ModelID(), models[2].ModelID(), models[4].ModelID()}
+	nonNilInts := []string{models[1].ModelID(), models[3].ModelID(), models[5].ModelID()}
+	testCases := []struct {
+		query       *Query
+		expectedIDs []string
+	}{
+		{
+			query:       indexedPointersModels.NewQuery().IsNull("Int"),
+			expectedIDs: nilInts,
+		},
+		{
+			query:       indexedPointersModels.NewQuery().Filter("Int is", nil),
+			expectedIDs: nilInts,
+		},
+		{
+			query:       indexedPointersModels.NewQuery().Filter("Int =", nil),
+			expectedIDs: nilInts,
+		},
+		{
+			query:       indexedPointersModels.NewQuery().IsNotNull("Int"),
+			expectedIDs: nonNilInts,
+		},
+		{
+			query:       indexedPointersModels.NewQuery().Filter("Int is not", nil),
+			expectedIDs: nonNilInts,
+		},
+		{
+			query:       indexedPointersModels.NewQuery().Filter("Int !=", nil).Order("Int"),
+			expectedIDs: nonNilInts,
+		},
+		{
+			query:       indexedPointersModels.NewQuery().IsNull("String").IsNull("Int"),
+			expectedIDs: []string{models[0].ModelID()},
+		},
+		{
+			query:       indexedPointersModels.NewQuery().IsNotNull("String").IsNull("Int"),
+			expectedIDs: []string{models[2].ModelID(), models[4].ModelID()},
+		},
+	}
+	for i, tc := range testCases {
+		gotIDs, err := tc.query.IDs()
+		if err != nil {
+			t.Errorf("Unexpected error in test case %d for query %s: %s", i, tc.query, err.Error())
+			continue
+		}
+		if equal, msg := compareAsStringSet(tc.expectedIDs, gotIDs); !equal {
+			t.Errorf("Error in test case %d for query %s: %s\nExpected: %v\nGot:  %v", i, tc.query, msg, tc.expectedIDs, gotIDs)
+		}
+		if count, err := tc.query.Count(); err != nil {
+			t.Error(err)
+		} else if count != len(tc.expectedIDs) {
+			t.Errorf("Error in test case %d for query %s: Expected count to be %d but got %d", i, tc.query, len(tc.expectedIDs), count)
+		}
+		checkForLeakedTmpKeys(t, tc.query.query)
+	}
+
+	// Null filters should only be allowed on indexed pointer fields.
+	if _, err := indexedTestModels.NewQuery().IsNull("Int").IDs(); err == nil {
+		t.Error("Expected an error for IsNull on a non-pointer field but got none")
+	}
+	if _, err := indexedPointersModels.NewQuery().Filter("Int >", nil).IDs(); err == nil {
+		t.Error("Expected an error for Filter with a nil value and an invalid operator but got none")
+	}
+
+	// Saving a model should keep the null set and the index consistent.
+	models[1].Int = nil
+	if err := indexedPointersModels.Save(models[1]); err != nil {
+		t.Fatal(err)
+	}
+	Int := 42
+	models[0].Int = &Int
+	if err := indexedPointersModels.Save(models[0]); err != nil {
+		t.Fatal(err)
+	}
+	expectNullSets := func(nullIDs []string, nonNullIDs []string) {
+		if gotIDs, err := indexedPointersModels.NewQuery().IsNull("Int").IDs(); err != nil {
+			t.Error(err)
+		} else if equal, msg := compareAsStringSet(nullIDs, gotIDs); !equal {
+			t.Errorf("Wrong ids for IsNull: %s\nExpected: %v\nGot:  %v", msg, nullIDs, gotIDs)
+		}
+		if gotIDs, err := indexedPointersModels.NewQuery().IsNotNull("Int").IDs(); err != nil {
+			t.Error(err)
+		} else if equal, msg := compareAsStringSet(nonNullIDs, gotIDs); !equal {
+			t.Errorf("Wrong ids for IsNotNull: %s\nExpected: %v\nGot:  %v", msg, nonNullIDs, gotIDs)
+		}
+	}
+	expectNullSets(
+		[]string{models[1].ModelID(), models[2].ModelID(), models[4].ModelID()},
+		[]string{models[0].ModelID(), models[3].ModelID(), models[5].ModelID()},
+	)
+
+	// So should Delete and the bulk Update and Delete methods.
+	if _, err := indexedPointersModels.Delete(models[2].ModelID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := indexedPointersModels.NewQuery().Filter("Int =", 42).Update(map[string]interface{}{"Int": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := indexedPointersModels.NewQuery().Filter("String =", *models[4].String).Delete(); err != nil {
+		t.Fatal(err)
+	}
+	expectNullSets(
+		[]string{models[0].ModelID(), models[1].ModelID()},
+		[]string{models[3].ModelID(), models[5].ModelID()},
+	)
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	nullSetKey, err := indexedPointersModels.spec.fieldNullSetKey("Int")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := redis.Int(conn.Do("SCARD", nullSetKey)); err != nil {
+		t.Error(err)
+	} else if n != 2 {
+		t.Errorf("Expected the null set to contain 2 ids but got %d", n)
+	}
+}
+
 // There's a huge amount of test cases to cover above. Below is some code that
 // makes it easier, but needs to be tested itself. Testing for correctness using
 // a brute force approach (obviously slow compared to what Zoom is actually
@@ -292,6 +962,13 @@ func testQuery(t *testing.T, q *Query, models []*indexedTestModel) {
 	testQueryCount(t, q, expected)
 	testQueryStoreIDs(t, q, expected)
 	checkForLeakedTmpKeys(t, q.query)
+	// The results should be the same when the query is run as a single script.
+	scriptQuery := *q.query
+	scriptQuery.singleScript = true
+	sq := &Query{query: &scriptQuery}
+	testQueryRun(t, sq, expected)
+	testQueryIDs(t, sq, expected)
+	testQueryCount(t, sq, expected)
 }
 
 func testQueryRun(t *testing.T, q *Query, expected []*indexedTestModel) {
@@ -6,12 +6,323 @@
 
 package kvmodel
 
-import (
-	"github.com/garyburd/redigo/redis"
-)
-
 var (
-	deleteModelsBySetIdsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+	addChangeEventsScript = newScript("add_change_events", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- add_change_events is a lua script that takes the following arguments:
+-- 	1) streamKey: The key of the change stream for a collection, or an empty
+--			string if events should not be added to a stream
+--		2) channel: The channel to publish events to, or an empty string if
+--			events should not be published
+--		3) collectionName: The name of the collection
+--		4) maxLen: The approximate maximum length of the stream, or 0 if the
+--			length of the stream should not be limited
+--		5) op: The operation for the events, either "save" or "delete"
+--		6) message: The JSON encoded event which is published for each model,
+--			without the id of the model
+--		7) idsKey: The key of a set, sorted set, or list of model ids, or an
+--			empty string
+--		8) numEntryArgs: The number of arguments which follow for the entries in
+--			the stream
+--		9...) numEntryArgs arguments, consisting of pairs of names and values
+--			which are added to each entry in the stream after the collection, id,
+--			and op, e.g. "fields" followed by the names of the fields separated by
+--			commas
+--		Followed by any number of ids: The ids of the models if idsKey is empty
+-- The script adds a change event to the stream and/or publishes a change event
+-- for each of the models whose ids are in idsKey (or given as arguments) and
+-- which currently exist. Delete events must be added before the models are
+-- deleted. It returns the number of models for which events were added.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local streamKey = ARGV[1]
+local channel = ARGV[2]
+local collectionName = ARGV[3]
+local maxLen = tonumber(ARGV[4])
+local op = ARGV[5]
+local message = ARGV[6]
+local idsKey = ARGV[7]
+local numEntryArgs = tonumber(ARGV[8])
+local entryArgs = {}
+for i = 9, 8 + numEntryArgs do
+	table.insert(entryArgs, ARGV[i])
+end
+-- Get all the ids, depending on the type of idsKey
+local ids = {}
+if idsKey ~= '' then
+	local idsType = redis.call('TYPE', idsKey)['ok']
+	if idsType == 'zset' then
+		ids = redis.call('ZRANGE', idsKey, 0, -1)
+	elseif idsType == 'set' then
+		ids = redis.call('SMEMBERS', idsKey)
+	elseif idsType == 'list' then
+		ids = redis.call('LRANGE', idsKey, 0, -1)
+	end
+else
+	for i = 9 + numEntryArgs, #ARGV do
+		table.insert(ids, ARGV[i])
+	end
+end
+local decodedMessage = {}
+if channel ~= '' then
+	decodedMessage = cjson.decode(message)
+end
+local count = 0
+for i, id in ipairs(ids) do
+	if redis.call('EXISTS', collectionName .. ':' .. id) == 1 then
+		if streamKey ~= '' then
+			if maxLen > 0 then
+				redis.call('XADD', streamKey, 'MAXLEN', '~', maxLen, '*', 'collection', collectionName, 'id', id, 'op', op, unpack(entryArgs))
+			else
+				redis.call('XADD', streamKey, '*', 'collection', collectionName, 'id', id, 'op', op, unpack(entryArgs))
+			end
+		end
+		if channel ~= '' then
+			decodedMessage['id'] = id
+			redis.call('PUBLISH', channel, cjson.encode(decodedMessage))
+		end
+		count = count + 1
+	end
+end
+return count
+`)
+	aggregateFieldScript = newScript("aggregate_field", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- aggregate_field is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a set, sorted set, or list of model ids
+--		2) collectionName: The name of a registered model
+-- 	3) fieldName: The name of a numeric field as it is stored in Redis
+-- 	4) fieldIndexKey: The key of a numeric field index for the field, or an
+--			empty string if the field is not indexed
+-- 	5) aggregate: One of "sum", "avg", "min", or "max"
+-- The script then reads the value of the field for each model id in idsKey,
+-- using the score from the field index if there is one and the value in the
+-- main hash otherwise, and computes the given aggregate over the values. Models
+-- without a numeric value for the field are skipped. It returns the result as a
+-- string, or "0" if no models had a value for the field.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local collectionName = ARGV[2]
+local fieldName = ARGV[3]
+local fieldIndexKey = ARGV[4]
+local aggregate = ARGV[5]
+-- Get all the ids, depending on the type of idsKey
+local ids = {}
+local idsType = redis.call('TYPE', idsKey)['ok']
+if idsType == 'zset' then
+	ids = redis.call('ZRANGE', idsKey, 0, -1)
+elseif idsType == 'set' then
+	ids = redis.call('SMEMBERS', idsKey)
+elseif idsType == 'list' then
+	ids = redis.call('LRANGE', idsKey, 0, -1)
+end
+local count = 0
+local sum = 0
+local min = nil
+local max = nil
+for i, id in ipairs(ids) do
+	local value
+	if fieldIndexKey ~= '' then
+		value = redis.call('ZSCORE', fieldIndexKey, id)
+	else
+		value = redis.call('HGET', collectionName .. ':' .. id, fieldName)
+	end
+	-- tonumber returns nil for missing values and for pointer fields that were
+	-- saved as NULL
+	value = tonumber(value)
+	if value ~= nil then
+		count = count + 1
+		sum = sum + value
+		if min == nil or value < min then
+			min = value
+		end
+		if max == nil or value > max then
+			max = value
+		end
+	end
+end
+if count == 0 then
+	return '0'
+end
+-- Return strings instead of numbers, because Redis would otherwise truncate
+-- the result to an integer
+local result = sum
+if aggregate == 'avg' then
+	result = sum / count
+elseif aggregate == 'min' then
+	result = min
+elseif aggregate == 'max' then
+	result = max
+end
+return string.format('%.17g', result)
+`)
+	deleteIntegerIndexScript = newScript("delete_integer_index", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_integer_index is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The id of the model to be deleted from the index
+--		3) The name of the indexed integer field
+-- The script then checks if there is a value for the given field name stored in the
+-- model hash, and if there is, removes the model from the index on the given field.
+-- NOTE: This script *must* be called before the main hash for the model is updated/deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local modelID = ARGV[2]
+local fieldName = ARGV[3]
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- ../integer_index.go for a description of the encoding.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- Get the old value from the existing model hash (if any)
+local modelKey = collectionName .. ":" .. modelID
+local oldValue = redis.call("HGET", modelKey, fieldName)
+local indexKey = collectionName .. ":" .. fieldName
+-- Nil pointers are stored as NULL and are not in the index
+if oldValue ~= false and string.match(oldValue, '^%-?%d+$') then
+	-- Remove the model from the field index
+	local oldMember = encodeInteger(oldValue) .. "\0" .. modelID
+	redis.call("ZREM", indexKey, oldMember)
+end
+`)
+	deleteKeysWithoutTtlScript = newScript("delete_keys_without_ttl", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_keys_without_ttl is a lua script that takes the following arguments:
+-- 	1...) Any number of keys
+-- The script then deletes each of the given keys which exists and does not have
+-- an expiration. Keys which have an expiration are left alone. It returns the
+-- number of keys that were deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+local count = 0
+for i, key in ipairs(ARGV) do
+	-- PTTL returns -1 if the key exists but has no expiration
+	if redis.call('PTTL', key) == -1 then
+		count = count + redis.call('DEL', key)
+	end
+end
+return count
+`)
+	deleteModelsByIdsScript = newScript("delete_models_by_ids", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_models_by_ids is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a set, sorted set, or list of model ids
+--		2) collectionName: The name of a registered model
+--		3) viewsKey: The key of the hash which stores the filters for each view
+--			(see update_views.lua), or '' if the collection does not have views
+-- 	4...) Any number of pairs of arguments, one for each indexed field, where
+--			the first argument is the name of the field as it is stored in Redis
+--			and the second argument is the kind of the index: either "string" for
+--			string indexes, "integer" for integer indexes, or "score" for numeric,
+--			boolean, and geo indexes.
+-- The script then deletes all the models corresponding to the ids in idsKey,
+-- including the main hash, the id in the set of all ids, any field indexes
+-- and null sets, and any views.
+-- It returns the number of models that were deleted. It does not delete idsKey.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local collectionName = ARGV[2]
+local viewsKey = ARGV[3]
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- ../integer_index.go for a description of the encoding.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- Get all the ids, depending on the type of idsKey. We need to read all of them
+-- first, because idsKey might be modified as we delete the models.
+local ids = {}
+local idsType = redis.call('TYPE', idsKey)['ok']
+if idsType == 'zset' then
+	ids = redis.call('ZRANGE', idsKey, 0, -1)
+elseif idsType == 'set' then
+	ids = redis.call('SMEMBERS', idsKey)
+elseif idsType == 'list' then
+	ids = redis.call('LRANGE', idsKey, 0, -1)
+end
+-- Get the keys of the sorted sets for all the views
+local viewKeys = {}
+if viewsKey ~= '' then
+	for _, definition in ipairs(redis.call('HVALS', viewsKey)) do
+		table.insert(viewKeys, cjson.decode(definition).key)
+	end
+end
+local count = 0
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	-- Remove the model from all the field indexes. This must happen before the
+	-- main hash is deleted, because string indexes rely on the old value.
+	for j = 4, #ARGV, 2 do
+		local fieldName = ARGV[j]
+		local indexKind = ARGV[j+1]
+		local indexKey = collectionName .. ':' .. fieldName
+		if indexKind == 'string' then
+			local oldValue = redis.call('HGET', modelKey, fieldName)
+			if oldValue ~= false then
+				redis.call('ZREM', indexKey, oldValue .. '\0' .. id)
+			end
+		elseif indexKind == 'integer' then
+			local oldValue = redis.call('HGET', modelKey, fieldName)
+			-- Nil pointers are stored as NULL and are not in the index
+			if oldValue ~= false and string.match(oldValue, '^%-?%d+$') then
+				redis.call('ZREM', indexKey, encodeInteger(oldValue) .. '\0' .. id)
+			end
+		else
+			redis.call('ZREM', indexKey, id)
+		end
+		-- Remove the id from the null set for the field (if any)
+		redis.call('SREM', indexKey .. ':null', id)
+	end
+	-- Remove the id from all the views
+	for _, viewKey in ipairs(viewKeys) do
+		redis.call('ZREM', viewKey, id)
+	end
+	-- Delete the main hash and remove the id from the set of all ids
+	count = count + redis.call('DEL', modelKey)
+	redis.call('SREM', collectionName .. ':all', id)
+end
+return count
+`)
+	deleteModelsBySetIdsScript = newScript("delete_models_by_set_ids", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
 -- license, which can be found in the LICENSE file.
 
@@ -45,7 +356,7 @@ if #ids > 0 then
 end
 return count
 `)
-	deleteStringIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+	deleteStringIndexScript = newScript("delete_string_index", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
 -- license, which can be found in the LICENSE file.
 
@@ -73,7 +384,31 @@ if oldValue ~= false then
 	redis.call("ZREM", indexKey, oldMember)
 end
 `)
-	extractIdsFromFieldIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+	extendLockScript = newScript("extend_lock", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- extend_lock is a lua script that takes the following arguments:
+-- 	1) lockKey: The key of a lock
+--		2) token: The token which was stored in the lock key when the lock was
+--			acquired
+--		3) ttl: The new time to live for the lock in milliseconds
+-- The script then sets the time to live of the lock key to ttl iff its value is
+-- still the given token, i.e. iff the lock has not expired and been acquired
+-- by someone else. It returns 1 if the time to live was set and 0 otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local lockKey = ARGV[1]
+local token = ARGV[2]
+local ttl = ARGV[3]
+if redis.call('GET', lockKey) == token then
+	return redis.call('PEXPIRE', lockKey, ttl)
+end
+return 0
+`)
+	extractIdsFromFieldIndexScript = newScript("extract_ids_from_field_index", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
 -- license, which can be found in the LICENSE file.
 
@@ -85,7 +420,7 @@ end
 -- The script then calls ZRANGEBYSCORE on setKey with the given min and max arguments,
 -- and then stores the resulting set in destKey. It does not preserve the existing
 -- scores, and instead just replaces scores with sequential numbers to keep the members
--- in the same order.
+-- in the same order. It returns the number of ids that were extracted.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
@@ -100,8 +435,45 @@ local members = redis.call('ZRANGEBYSCORE', setKey, min, max)
 for i, member in ipairs(members) do
 	redis.call('ZADD', destKey, i, member)
 end
+return #members
 `)
-	extractIdsFromStringIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+	extractIdsFromGeoIndexScript = newScript("extract_ids_from_geo_index", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- extract_ids_from_geo_index is a lua script that takes the following arguments:
+-- 	1) setKey: The key of a sorted set for a geo index
+-- 	2) destKey: The key of a sorted set where the resulting ids will be stored
+--		3) lon: The longitude of the center of the search area
+--		4) lat: The latitude of the center of the search area
+--		5...) The shape of the search area, which is either:
+--			a) "BYRADIUS", the radius, and the unit, or
+--			b) "BYBOX", the width, the height, and the unit
+-- The script then calls GEOSEARCH on setKey with the given arguments and stores
+-- the resulting ids in destKey. It does not preserve the existing scores, and
+-- instead uses the distance from the center of the search area as the score
+-- for each id. It returns the number of ids that were extracted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local setKey = ARGV[1]
+local destKey = ARGV[2]
+local lon = ARGV[3]
+local lat = ARGV[4]
+local searchArgs = {'GEOSEARCH', setKey, 'FROMLONLAT', lon, lat}
+for i = 5, #ARGV do
+	table.insert(searchArgs, ARGV[i])
+end
+table.insert(searchArgs, 'WITHDIST')
+-- Each result is a pair of the id and the distance
+local results = redis.call(unpack(searchArgs))
+for i, result in ipairs(results) do
+	redis.call('ZADD', destKey, result[2], result[1])
+end
+return #results
+`)
+	extractIdsFromStringIndexScript = newScript("extract_ids_from_string_index", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
 -- license, which can be found in the LICENSE file.
 
@@ -114,6 +486,7 @@ end
 -- 	4) max: The max argument for the ZRANGEBYLEX command
 -- The script then extracts the ids from setKey using the given min and max arguments,
 -- and then stores them destKey with the appropriate scores in ascending order.
+-- It returns the number of ids that were extracted.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
@@ -134,5 +507,1166 @@ if #members > 0 then
 		redis.call('ZADD', destKey, i, id)
 	end
 end
+return #members
+`)
+	filterIdsByFieldValuesScript = newScript("filter_ids_by_field_values", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- filter_ids_by_field_values is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a set or sorted set of model ids
+--		2) destKey: The key of a sorted set where the resulting ids will be stored
+-- 	3) collectionName: The name of a registered model
+-- 	4...) Any number of groups of 5 arguments, one for each filter:
+--			a) The name of the field as it is stored in Redis
+--			b) The filter operator: one of =, !=, >, <, >=, or <=
+--			c) The kind of comparison: either "number" or "string"
+--			d) The value to compare against
+--			e) "1" if the field is a pointer, in which case the value NULL means the
+--				field is nil and never matches, or "0" otherwise
+-- The script then reads the values of the fields from the main hash of each
+-- model in idsKey and stores the ids of the models which match all of the
+-- filters in destKey. If idsKey is a sorted set, the scores are preserved so
+-- that the order stays the same. idsKey and destKey may be the same key.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local destKey = ARGV[2]
+local collectionName = ARGV[3]
+-- Get all the ids (and scores, if any) from idsKey
+local ids = {}
+local scores = {}
+local idsType = redis.call('TYPE', idsKey)['ok']
+if idsType == 'zset' then
+	local idsAndScores = redis.call('ZRANGE', idsKey, 0, -1, 'WITHSCORES')
+	for i = 1, #idsAndScores, 2 do
+		table.insert(ids, idsAndScores[i])
+		table.insert(scores, idsAndScores[i+1])
+	end
+elseif idsType == 'set' then
+	ids = redis.call('SMEMBERS', idsKey)
+end
+-- compareStrings compares two strings byte by byte, which is the same way
+-- Redis compares strings in string indexes. It returns -1, 0, or 1.
+local function compareStrings(a, b)
+	if a == b then
+		return 0
+	end
+	local n = math.min(#a, #b)
+	for i = 1, n do
+		local ca = string.byte(a, i)
+		local cb = string.byte(b, i)
+		if ca ~= cb then
+			if ca < cb then
+				return -1
+			end
+			return 1
+		end
+	end
+	if #a < #b then
+		return -1
+	end
+	return 1
+end
+-- matches returns true iff value matches the filter with the given operator,
+-- kind, and filterValue
+local function matches(value, op, kind, filterValue)
+	local cmp
+	if kind == 'number' then
+		value = tonumber(value)
+		if value == nil then
+			return false
+		end
+		filterValue = tonumber(filterValue)
+		if value < filterValue then
+			cmp = -1
+		elseif value > filterValue then
+			cmp = 1
+		else
+			cmp = 0
+		end
+	else
+		cmp = compareStrings(value, filterValue)
+	end
+	if op == '=' then
+		return cmp == 0
+	elseif op == '!=' then
+		return cmp ~= 0
+	elseif op == '>' then
+		return cmp > 0
+	elseif op == '<' then
+		return cmp < 0
+	elseif op == '>=' then
+		return cmp >= 0
+	elseif op == '<=' then
+		return cmp <= 0
+	end
+	return false
+end
+-- Find the ids which match all the filters
+local matchingIDs = {}
+local matchingScores = {}
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	local isMatch = true
+	for j = 4, #ARGV, 5 do
+		local value = redis.call('HGET', modelKey, ARGV[j])
+		if value == false or (ARGV[j+4] == '1' and value == 'NULL') or not matches(value, ARGV[j+1], ARGV[j+2], ARGV[j+3]) then
+			isMatch = false
+			break
+		end
+	end
+	if isMatch then
+		table.insert(matchingIDs, id)
+		table.insert(matchingScores, scores[i] or 0)
+	end
+end
+-- Replace the contents of destKey with the matching ids
+redis.call('DEL', destKey)
+for i, id in ipairs(matchingIDs) do
+	redis.call('ZADD', destKey, matchingScores[i], id)
+end
+return #matchingIDs
+`)
+	groupCountScript = newScript("group_count", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- group_count is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a set, sorted set, or list of model ids
+--		2) fieldIndexKey: The key of a sorted set for a field index
+-- 	3) indexKind: Either "string" for string indexes, where each member is of
+--			the form: value + NULL + id, "integer" for integer indexes, where each
+--			member is of the form: encoded value + NULL + id, or "score" for
+--			numeric and boolean indexes, where the members are ids and the scores
+--			are values.
+--		4) collectionName: The name of the collection
+--		5) fieldName: The name of the field as it is stored in Redis
+--		6) nullSetKey: The key of the null set for the field, or an empty string
+--			if the field does not have a null set
+-- The script then counts the number of models in idsKey for each distinct value
+-- in the field index. It returns an array of the form value1, count1, value2,
+-- count2, etc. with the values in ascending order. Values which do not
+-- correspond to any model in idsKey are omitted. If there are fewer ids in
+-- idsKey than members in the field index, the script looks up the value for
+-- each id (with ZSCORE for score indexes or HGET for string and integer
+-- indexes) instead of iterating through the entire field index, so the cost is
+-- proportional to the smaller of the two.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local fieldIndexKey = ARGV[2]
+local indexKind = ARGV[3]
+local collectionName = ARGV[4]
+local fieldName = ARGV[5]
+local nullSetKey = ARGV[6]
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- ../integer_index.go for a description of the encoding.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- Get all the ids, depending on the type of idsKey
+local ids = {}
+local idsType = redis.call('TYPE', idsKey)['ok']
+if idsType == 'zset' then
+	ids = redis.call('ZRANGE', idsKey, 0, -1)
+elseif idsType == 'set' then
+	ids = redis.call('SMEMBERS', idsKey)
+elseif idsType == 'list' then
+	ids = redis.call('LRANGE', idsKey, 0, -1)
+end
+local values = {}
+local counts = {}
+local function count(value)
+	if counts[value] == nil then
+		table.insert(values, value)
+		counts[value] = 0
+	end
+	counts[value] = counts[value] + 1
+end
+if #ids < redis.call('ZCARD', fieldIndexKey) then
+	-- Look up the value for each id
+	for i, id in ipairs(ids) do
+		if indexKind == 'score' then
+			local score = redis.call('ZSCORE', fieldIndexKey, id)
+			if score ~= false then
+				count(score)
+			end
+		elseif nullSetKey == '' or redis.call('SISMEMBER', nullSetKey, id) == 0 then
+			local value = redis.call('HGET', collectionName .. ':' .. id, fieldName)
+			if value ~= false then
+				if indexKind == 'integer' then
+					-- Nil pointers are stored as NULL and are not in the index
+					if string.match(value, '^%-?%d+$') then
+						count(encodeInteger(value))
+					end
+				else
+					count(value)
+				end
+			end
+		end
+	end
+	-- Sort the values in the same order as the field index
+	if indexKind == 'score' then
+		local function toNumber(value)
+			if value == 'inf' then
+				return math.huge
+			elseif value == '-inf' then
+				return -math.huge
+			end
+			return tonumber(value)
+		end
+		table.sort(values, function(a, b)
+			return toNumber(a) < toNumber(b)
+		end)
+	else
+		table.sort(values)
+	end
+else
+	-- Iterate through the field index and count the ids for each value. Store
+	-- the ids in a table for fast lookups.
+	local isMember = {}
+	for i, id in ipairs(ids) do
+		isMember[id] = true
+	end
+	if indexKind == 'score' then
+		local membersAndScores = redis.call('ZRANGE', fieldIndexKey, 0, -1, 'WITHSCORES')
+		for i = 1, #membersAndScores, 2 do
+			if isMember[membersAndScores[i]] then
+				count(membersAndScores[i+1])
+			end
+		end
+	else
+		local members = redis.call('ZRANGE', fieldIndexKey, 0, -1)
+		for i, member in ipairs(members) do
+			-- The id is everything after the last NULL character
+			local idStart = string.find(member, '%z[^%z]*$')
+			if isMember[string.sub(member, idStart+1)] then
+				count(string.sub(member, 1, idStart-1))
+			end
+		end
+	end
+end
+local result = {}
+for i, value in ipairs(values) do
+	table.insert(result, value)
+	table.insert(result, counts[value])
+end
+return result
+`)
+	leaderboardScript = newScript("leaderboard", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- leaderboard is a lua script that takes the following arguments:
+-- 	1) operation: The operation to perform, which is one of:
+--			a) "rank" for the rank of a model,
+--			b) "around" for the models ranked around a model,
+--			c) "percentile" for the field value at a percentile, or
+--			d) "percentileRank" for the fraction of models ranked below a model
+--		2) collectionName: The name of a registered model
+--		3) fieldIndexKey: The key of the field index
+--		4) indexKind: Either "score" for a numeric index or "integer" for an
+--			integer index
+--		5) fieldName: The name of the field as it is stored in Redis
+--		6) reverse: "1" if models with higher values should be ranked first, or
+--			"0" otherwise
+--		Then the arguments for the operation:
+--			rank: The id of the model
+--			around: The id of the model, the number of models to include on either
+--				side of it, the number of field names which follow, and the names of
+--				the fields to return for each model as they are stored in Redis
+--			percentile: The percentile as a number between 0 and 1
+--			percentileRank: The id of the model
+-- The script returns nil if the model identified by id is not in the field
+-- index (or if the index is empty for the percentile operation). Otherwise:
+--		rank: returns the rank of the model, starting at 0.
+--		around: returns an array which consists of the values of the given fields
+--			followed by the id for each model ranked within the given number of
+--			positions of the model, which is the same format as the SORT command
+--			with one GET argument for each field and a final GET #.
+--		percentile: returns the value of the field for the model at the given
+--			percentile (using the nearest rank method) as a string.
+--		percentileRank: returns an array of the number of models with a lower
+--			value (or a higher value if reverse is "1") and the number of models
+--			in the index.
+-- For integer indexes, models with the same value are ranked by id. For numeric
+-- indexes, they are ranked in the same way as ZRANK.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local operation = ARGV[1]
+local collectionName = ARGV[2]
+local fieldIndexKey = ARGV[3]
+local indexKind = ARGV[4]
+local fieldName = ARGV[5]
+local reverse = ARGV[6] == '1'
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- integer_index.go.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- decodeInteger is the inverse of encodeInteger.
+local function decodeInteger(encoded)
+	local digits = string.sub(encoded, 4)
+	if string.sub(encoded, 1, 1) == 'p' then
+		return digits
+	end
+	local complement = string.gsub(digits, '%d', function(d)
+		return tostring(9 - tonumber(d))
+	end)
+	return '-' .. complement
+end
+-- member returns the member of the field index for the model with the given id,
+-- or nil if the model is not in the index.
+local function member(id)
+	if indexKind == 'score' then
+		if redis.call('ZSCORE', fieldIndexKey, id) == false then
+			return nil
+		end
+		return id
+	end
+	local value = redis.call('HGET', collectionName .. ':' .. id, fieldName)
+	if value == false or not string.match(value, '^%-?%d+$') then
+		return nil
+	end
+	local m = encodeInteger(value) .. '\0' .. id
+	if redis.call('ZSCORE', fieldIndexKey, m) == false then
+		return nil
+	end
+	return m
+end
+-- rank returns the rank of the given member of the field index.
+local function rank(m)
+	if reverse then
+		return redis.call('ZREVRANK', fieldIndexKey, m)
+	end
+	return redis.call('ZRANK', fieldIndexKey, m)
+end
+-- rangeByRank returns the members of the field index with ranks between start
+-- and stop (inclusive).
+local function rangeByRank(start, stop)
+	if reverse then
+		return redis.call('ZREVRANGE', fieldIndexKey, start, stop)
+	end
+	return redis.call('ZRANGE', fieldIndexKey, start, stop)
+end
+-- idFromMember returns the id for a member of the field index.
+local function idFromMember(m)
+	if indexKind == 'score' then
+		return m
+	end
+	local idStart = string.find(m, '%z[^%z]*$')
+	return string.sub(m, idStart+1)
+end
+
+if operation == 'rank' then
+	local m = member(ARGV[7])
+	if m == nil then
+		return nil
+	end
+	return rank(m)
+elseif operation == 'around' then
+	local m = member(ARGV[7])
+	if m == nil then
+		return nil
+	end
+	local k = tonumber(ARGV[8])
+	local numFields = tonumber(ARGV[9])
+	local fields = {}
+	for i = 1, numFields do
+		fields[i] = ARGV[9+i]
+	end
+	local r = rank(m)
+	local start = math.max(r - k, 0)
+	local results = {}
+	for _, other in ipairs(rangeByRank(start, r + k)) do
+		local id = idFromMember(other)
+		if numFields > 0 then
+			local values = redis.call('HMGET', collectionName .. ':' .. id, unpack(fields))
+			for j = 1, numFields do
+				results[#results+1] = values[j]
+			end
+		end
+		results[#results+1] = id
+	end
+	return results
+elseif operation == 'percentile' then
+	local p = tonumber(ARGV[7])
+	local count = redis.call('ZCARD', fieldIndexKey)
+	if count == 0 then
+		return nil
+	end
+	-- Use the nearest rank method, i.e. the smallest value such that at least
+	-- p of the values are less than or equal to it.
+	local r = math.max(math.ceil(p * count) - 1, 0)
+	local members = rangeByRank(r, r)
+	if indexKind == 'score' then
+		return redis.call('ZSCORE', fieldIndexKey, members[1])
+	end
+	local m = members[1]
+	return decodeInteger(string.sub(m, 1, string.find(m, '%z') - 1))
+elseif operation == 'percentileRank' then
+	local m = member(ARGV[7])
+	if m == nil then
+		return nil
+	end
+	local count = redis.call('ZCARD', fieldIndexKey)
+	local below
+	if indexKind == 'score' then
+		local score = redis.call('ZSCORE', fieldIndexKey, m)
+		if reverse then
+			below = redis.call('ZCOUNT', fieldIndexKey, '(' .. score, '+inf')
+		else
+			below = redis.call('ZCOUNT', fieldIndexKey, '-inf', '(' .. score)
+		end
+	else
+		local prefix = string.sub(m, 1, string.find(m, '%z'))
+		if reverse then
+			-- All the members with the same value start with prefix, and \255 is
+			-- greater than any character in an id
+			below = redis.call('ZLEXCOUNT', fieldIndexKey, '(' .. prefix .. '\255', '+')
+		else
+			below = redis.call('ZLEXCOUNT', fieldIndexKey, '-', '(' .. prefix)
+		end
+	end
+	return {below, count}
+end
+return redis.error_reply('unknown leaderboard operation: ' .. operation)
+`)
+	runQueryScript = newScript("run_query", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- run_query is a lua script that takes the following arguments:
+-- 	1) collectionName: The name of a registered model
+--		2) indexKey: The key of the set of all ids for the collection
+--		3) orderKind: The kind of index used for ordering, which is one of:
+--			a) "score" for a numeric or boolean index,
+--			b) "lex" for a string index,
+--			c) "geo" for ordering by the distance from the center of the geo search,
+--			d) "field" for ordering numerically by the values of an unindexed field,
+--			e) "alpha" for ordering lexicographically by the values of an unindexed
+--				field, or
+--			f) "" if the query does not have an order
+--		4) orderKey: The key of the field index used for ordering if orderKind is
+--			"score" or "lex", or the name of the field as it is stored in Redis if
+--			orderKind is "field" or "alpha"
+--		5) reverse: "1" if the order is descending, or "0" otherwise
+--		6) offset: The number of matching models to skip
+--		7) limit: The maximum number of models to return, or 0 for no limit
+--		8) countOnly: "1" if the script should only return the number of matching
+--			models, or "0" otherwise
+--		9) numFields: The number of field names which follow
+--		10...) The names of the fields to return for each model as they are stored
+--			in Redis
+--		Then the number of geo search arguments which follow (0 if the query does
+--			not have a geo search), followed by the key of the geo index, the
+--			longitude, the latitude, and the shape of the search area, which is
+--			either "BYRADIUS", the radius, and the unit, or "BYBOX", the width, the
+--			height, and the unit
+--		Then the number of indexed filters, followed by a group of arguments for
+--			each indexed filter:
+--			a) The kind of index: "score" for a numeric or boolean index, "lex" for
+--				a string index, "set" for a set of ids, "zset" for a sorted set of
+--				ids, "within" for a set or sorted set of ids which must contain the id,
+--				or "excluding" for a set or sorted set of ids which must not contain
+--				the id
+--			b) The key of the index
+--			c) The number of ranges which follow (0 unless the kind is "score" or
+--				"lex")
+--			d...) The min and max arguments for ZRANGEBYSCORE or ZRANGEBYLEX for
+--				each range
+--		Then any number of groups of 5 arguments, one for each filter which can
+--			only be applied by reading the main hash of each model:
+--			a) The name of the field as it is stored in Redis
+--			b) The filter operator: one of =, !=, >, <, >=, or <=
+--			c) The kind of comparison: either "number" or "string"
+--			d) The value to compare against
+--			e) "1" if the field is a pointer, in which case the value NULL means the
+--				field is nil and never matches, or "0" otherwise
+-- The script then finds the ids of the models which match all of the filters in
+-- memory, without creating any temporary keys, and applies the order, offset,
+-- and limit. If countOnly is "1", it returns the number of matching models.
+-- Otherwise it returns an array which consists of the values of the given fields
+-- followed by the id for each matching model, which is the same format as the
+-- SORT command with one GET argument for each field and a final GET #.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local indexKey = ARGV[2]
+local orderKind = ARGV[3]
+local orderKey = ARGV[4]
+local reverse = ARGV[5] == '1'
+local offset = tonumber(ARGV[6])
+local limit = tonumber(ARGV[7])
+local countOnly = ARGV[8] == '1'
+local numFields = tonumber(ARGV[9])
+local fields = {}
+for i = 1, numFields do
+	fields[i] = ARGV[9+i]
+end
+local pos = 10 + numFields
+-- idFromMember returns the id for a member of a string index, which is
+-- everything after the last NULL character
+local function idFromMember(member)
+	local idStart = string.find(member, '%z[^%z]*$')
+	return string.sub(member, idStart+1)
+end
+-- Get the ids within the geo search area (if any) ordered by their distance
+-- from the center, which is the same order as a sorted set scored by distance
+local geoIDs = nil
+local geoSet = nil
+local numGeoArgs = tonumber(ARGV[pos])
+pos = pos + 1
+if numGeoArgs > 0 then
+	local searchArgs = {'GEOSEARCH', ARGV[pos], 'FROMLONLAT', ARGV[pos+1], ARGV[pos+2]}
+	for i = pos+3, pos+numGeoArgs-1 do
+		table.insert(searchArgs, ARGV[i])
+	end
+	table.insert(searchArgs, 'WITHDIST')
+	-- Each result is a pair of the id and the distance
+	local results = redis.call(unpack(searchArgs))
+	table.sort(results, function(a, b)
+		local distA = tonumber(a[2])
+		local distB = tonumber(b[2])
+		if distA ~= distB then
+			return distA < distB
+		end
+		return a[1] < b[1]
+	end)
+	geoIDs = {}
+	geoSet = {}
+	for i, result in ipairs(results) do
+		geoIDs[i] = result[1]
+		geoSet[result[1]] = true
+	end
+	pos = pos + numGeoArgs
+end
+-- Get the ids which match each indexed filter. For "excluding" filters, the
+-- set contains the ids which do not match.
+local filterSets = {}
+local excludedSets = {}
+local firstFilterIDs = nil
+local numFilters = tonumber(ARGV[pos])
+pos = pos + 1
+for i = 1, numFilters do
+	local kind = ARGV[pos]
+	local key = ARGV[pos+1]
+	local numRanges = tonumber(ARGV[pos+2])
+	pos = pos + 3
+	local ids = {}
+	if kind == 'set' then
+		ids = redis.call('SMEMBERS', key)
+	elseif kind == 'zset' then
+		ids = redis.call('ZRANGE', key, 0, -1)
+	elseif kind == 'within' or kind == 'excluding' then
+		local keyType = redis.call('TYPE', key)['ok']
+		if keyType == 'zset' then
+			ids = redis.call('ZRANGE', key, 0, -1)
+		elseif keyType == 'set' then
+			ids = redis.call('SMEMBERS', key)
+		end
+	end
+	for j = 1, numRanges do
+		local min = ARGV[pos]
+		local max = ARGV[pos+1]
+		pos = pos + 2
+		if kind == 'lex' then
+			local members = redis.call('ZRANGEBYLEX', key, min, max)
+			for _, member in ipairs(members) do
+				table.insert(ids, idFromMember(member))
+			end
+		else
+			local members = redis.call('ZRANGEBYSCORE', key, min, max)
+			for _, member in ipairs(members) do
+				table.insert(ids, member)
+			end
+		end
+	end
+	local set = {}
+	for _, id in ipairs(ids) do
+		set[id] = true
+	end
+	if kind == 'excluding' then
+		table.insert(excludedSets, set)
+	else
+		table.insert(filterSets, set)
+		-- Sets from Within may contain ids which are not in the collection, so
+		-- they cannot be used as the candidates
+		if firstFilterIDs == nil and kind ~= 'within' then
+			firstFilterIDs = ids
+		end
+	end
+end
+-- The remaining arguments are filters which need to be applied by reading the
+-- main hash of each model
+local scanFiltersStart = pos
+-- Get the candidate ids in order
+local candidates = {}
+if orderKind == 'score' then
+	if reverse then
+		candidates = redis.call('ZREVRANGE', orderKey, 0, -1)
+	else
+		candidates = redis.call('ZRANGE', orderKey, 0, -1)
+	end
+elseif orderKind == 'lex' then
+	local members = redis.call('ZRANGEBYLEX', orderKey, '-', '+')
+	for i, member in ipairs(members) do
+		candidates[i] = idFromMember(member)
+	end
+elseif orderKind == 'geo' then
+	candidates = geoIDs
+else
+	-- Without an order, start with the smallest set of ids that we already have
+	if geoIDs ~= nil then
+		candidates = geoIDs
+	else
+		if firstFilterIDs ~= nil then
+			candidates = firstFilterIDs
+		else
+			candidates = redis.call('SMEMBERS', indexKey)
+		end
+		table.sort(candidates)
+	end
+	if orderKind == 'field' or orderKind == 'alpha' then
+		-- Sort by the values in the main hash in the same way as SORT BY, which
+		-- treats missing numeric values as 0 and compares ids if the values are
+		-- equal
+		local values = {}
+		for _, id in ipairs(candidates) do
+			local value = redis.call('HGET', collectionName .. ':' .. id, orderKey)
+			if orderKind == 'field' then
+				value = tonumber(value) or 0
+			elseif value == false then
+				value = ''
+			end
+			values[id] = value
+		end
+		table.sort(candidates, function(a, b)
+			if values[a] ~= values[b] then
+				return values[a] < values[b]
+			end
+			return a < b
+		end)
+	end
+end
+if reverse and orderKind ~= 'score' then
+	local reversed = {}
+	for i = #candidates, 1, -1 do
+		table.insert(reversed, candidates[i])
+	end
+	candidates = reversed
+end
+-- compareStrings compares two strings byte by byte, which is the same way
+-- Redis compares strings in string indexes. It returns -1, 0, or 1.
+local function compareStrings(a, b)
+	if a == b then
+		return 0
+	end
+	local n = math.min(#a, #b)
+	for i = 1, n do
+		local ca = string.byte(a, i)
+		local cb = string.byte(b, i)
+		if ca ~= cb then
+			if ca < cb then
+				return -1
+			end
+			return 1
+		end
+	end
+	if #a < #b then
+		return -1
+	end
+	return 1
+end
+-- matches returns true iff value matches the filter with the given operator,
+-- kind, and filterValue
+local function matches(value, op, kind, filterValue)
+	local cmp
+	if kind == 'number' then
+		value = tonumber(value)
+		if value == nil then
+			return false
+		end
+		filterValue = tonumber(filterValue)
+		if value < filterValue then
+			cmp = -1
+		elseif value > filterValue then
+			cmp = 1
+		else
+			cmp = 0
+		end
+	else
+		cmp = compareStrings(value, filterValue)
+	end
+	if op == '=' then
+		return cmp == 0
+	elseif op == '!=' then
+		return cmp ~= 0
+	elseif op == '>' then
+		return cmp > 0
+	elseif op == '<' then
+		return cmp < 0
+	elseif op == '>=' then
+		return cmp >= 0
+	elseif op == '<=' then
+		return cmp <= 0
+	end
+	return false
+end
+-- isMatch returns true iff the model with the given id matches the geo search
+-- and all of the filters
+local function isMatch(id)
+	if geoSet ~= nil and not geoSet[id] then
+		return false
+	end
+	for _, set in ipairs(filterSets) do
+		if not set[id] then
+			return false
+		end
+	end
+	for _, set in ipairs(excludedSets) do
+		if set[id] then
+			return false
+		end
+	end
+	local modelKey = collectionName .. ':' .. id
+	for j = scanFiltersStart, #ARGV, 5 do
+		local value = redis.call('HGET', modelKey, ARGV[j])
+		if value == false or (ARGV[j+4] == '1' and value == 'NULL') or not matches(value, ARGV[j+1], ARGV[j+2], ARGV[j+3]) then
+			return false
+		end
+	end
+	return true
+end
+-- Iterate over the candidates in order, skipping the first offset matches and
+-- stopping as soon as we reach the limit
+local results = {}
+local count = 0
+local skipped = 0
+local seen = {}
+for _, id in ipairs(candidates) do
+	if limit > 0 and count >= limit then
+		break
+	end
+	if not seen[id] then
+		seen[id] = true
+		if isMatch(id) then
+			if skipped < offset then
+				skipped = skipped + 1
+			else
+				count = count + 1
+				if not countOnly then
+					if numFields > 0 then
+						local values = redis.call('HMGET', collectionName .. ':' .. id, unpack(fields))
+						for j = 1, numFields do
+							results[#results+1] = values[j]
+						end
+					end
+					results[#results+1] = id
+				end
+			end
+		end
+	end
+end
+if countOnly then
+	return count
+end
+return results
+`)
+	unlockScript = newScript("unlock", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- unlock is a lua script that takes the following arguments:
+-- 	1) lockKey: The key of a lock
+--		2) token: The token which was stored in the lock key when the lock was
+--			acquired
+-- The script then deletes the lock key iff its value is still the given token,
+-- i.e. iff the lock has not expired and been acquired by someone else. It
+-- returns 1 if the lock key was deleted and 0 otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local lockKey = ARGV[1]
+local token = ARGV[2]
+if redis.call('GET', lockKey) == token then
+	return redis.call('DEL', lockKey)
+end
+return 0
+`)
+	updateModelsByIdsScript = newScript("update_models_by_ids", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- update_models_by_ids is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a set, sorted set, or list of model ids
+--		2) collectionName: The name of a registered model
+-- 	3...) Any number of groups of 5 arguments, one for each field to update:
+--			a) The name of the field as it is stored in Redis
+--			b) The new value to store in the main hash
+--			c) The kind of the index: either "string" for string indexes, "integer"
+--				for integer indexes, "score" for numeric and boolean indexes, "geo"
+--				for geo indexes, or an empty string if the field is not indexed
+--			d) The new value for the index: the score for numeric and boolean
+--				indexes, the string value for string indexes, the encoded value for
+--				integer indexes, or the longitude and latitude separated by a space
+--				for geo indexes
+--			e) "1" if the new value is nil, in which case the model is removed from
+--				the index and added to the null set for the field, or "0" otherwise
+-- The script then sets the given fields for each existing model corresponding
+-- to the ids in idsKey and updates the field indexes and null sets. Ids which
+-- do not correspond to an existing model are skipped. It returns the number of
+-- models that were updated.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local collectionName = ARGV[2]
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- ../integer_index.go for a description of the encoding.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- Get all the ids, depending on the type of idsKey. We need to read all of them
+-- first, because idsKey might be modified as we update the indexes.
+local ids = {}
+local idsType = redis.call('TYPE', idsKey)['ok']
+if idsType == 'zset' then
+	ids = redis.call('ZRANGE', idsKey, 0, -1)
+elseif idsType == 'set' then
+	ids = redis.call('SMEMBERS', idsKey)
+elseif idsType == 'list' then
+	ids = redis.call('LRANGE', idsKey, 0, -1)
+end
+local count = 0
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	if redis.call('EXISTS', modelKey) == 1 then
+		for j = 3, #ARGV, 5 do
+			local fieldName = ARGV[j]
+			local hashValue = ARGV[j+1]
+			local indexKind = ARGV[j+2]
+			local indexValue = ARGV[j+3]
+			local isNull = ARGV[j+4] == '1'
+			local indexKey = collectionName .. ':' .. fieldName
+			-- Update the field index (if any). This must happen before the main hash
+			-- is updated, because string and integer indexes rely on the old value.
+			if indexKind == 'string' then
+				local oldValue = redis.call('HGET', modelKey, fieldName)
+				if oldValue ~= false then
+					redis.call('ZREM', indexKey, oldValue .. '\0' .. id)
+				end
+				if not isNull then
+					redis.call('ZADD', indexKey, 0, indexValue .. '\0' .. id)
+				end
+			elseif indexKind == 'integer' then
+				local oldValue = redis.call('HGET', modelKey, fieldName)
+				-- Nil pointers are stored as NULL and are not in the index
+				if oldValue ~= false and string.match(oldValue, '^%-?%d+$') then
+					redis.call('ZREM', indexKey, encodeInteger(oldValue) .. '\0' .. id)
+				end
+				if not isNull then
+					redis.call('ZADD', indexKey, 0, indexValue .. '\0' .. id)
+				end
+			elseif indexKind == 'score' then
+				if isNull then
+					redis.call('ZREM', indexKey, id)
+				else
+					redis.call('ZADD', indexKey, indexValue, id)
+				end
+			elseif indexKind == 'geo' then
+				if isNull then
+					redis.call('ZREM', indexKey, id)
+				else
+					local lon, lat = string.match(indexValue, '^(%S+) (%S+)$')
+					redis.call('GEOADD', indexKey, lon, lat, id)
+				end
+			end
+			-- Update the null set for the field (if any)
+			if indexKind ~= '' then
+				if isNull then
+					redis.call('SADD', indexKey .. ':null', id)
+				else
+					redis.call('SREM', indexKey .. ':null', id)
+				end
+			end
+			redis.call('HSET', modelKey, fieldName, hashValue)
+		end
+		count = count + 1
+	end
+end
+return count
+`)
+	updateViewsScript = newScript("update_views", 0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- update_views is a lua script that takes the following arguments:
+-- 	1) collectionName: The name of a registered model
+--		2) viewsKey: The key of a hash which stores the filters for each view. The
+--			fields of the hash are the names of the views, and the values are JSON
+--			objects of the form {"key": ..., "filters": [...]}, where key is the
+--			key of the sorted set for the view and each filter is an object with
+--			the following fields:
+--				field: The name of the field as it is stored in Redis
+--				op: The filter operator: one of =, !=, >, <, >=, <=, in, is (for
+--					IsNull), or is not (for IsNotNull)
+--				kind: The kind of comparison: "number", "string", or "integer"
+--				pointer: true if the field is a pointer, in which case the value
+--					NULL means the field is nil
+--				values: The values to compare against (empty for is and is not).
+--					Values for "integer" comparisons must already be encoded (see
+--					encodeIntegerString in integer_index.go).
+--		3) viewName: The name of the only view to update, or '' to update all the
+--			views
+--		4) op: Either "update" to add the models to or remove them from each view
+--			depending on whether or not they match the filters, "delete" to
+--			remove the models from each view, or "clear" to delete the sorted sets
+--			for the views
+--		5) idsKind: Either "id" if the next argument is a single model id, or "key"
+--			if the next argument is the key of a set, sorted set, or list of ids
+--		6) ids: The id or the key of the ids, depending on idsKind
+--		7...) For the "update" operation, the names of the fields which changed as
+--			they are stored in Redis. Only views which have no filters or which
+--			filter on any of these fields are updated. Ignored if viewName is not
+--			empty.
+-- For the "update" operation, the script reads the field values from the main
+-- hash of each model and adds the id to the sorted set for each view if the
+-- model matches all of the filters for the view, or removes it otherwise.
+-- Models which no longer exist are removed from all the views. Ids are added
+-- with a score of 0, so the ids in a view are in lexicographical order. Since
+-- the views are read from viewsKey whenever the script runs, views which were
+-- defined by other processes are always kept up to date.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local viewsKey = ARGV[2]
+local viewName = ARGV[3]
+local op = ARGV[4]
+local idsKind = ARGV[5]
+local idsArg = ARGV[6]
+local changedFields = {}
+for i = 7, #ARGV do
+	changedFields[ARGV[i]] = true
+end
+-- dependsOnChangedFields returns true iff whether or not a model is in view may
+-- change when the changed fields change.
+local function dependsOnChangedFields(view)
+	if #view.filters == 0 then
+		return true
+	end
+	for _, filter in ipairs(view.filters) do
+		if changedFields[filter.field] then
+			return true
+		end
+	end
+	return false
+end
+-- Get the views to update
+local views = {}
+local definitions = {}
+if viewName == '' then
+	definitions = redis.call('HVALS', viewsKey)
+else
+	local definition = redis.call('HGET', viewsKey, viewName)
+	if definition then
+		definitions = {definition}
+	end
+end
+for _, definition in ipairs(definitions) do
+	local view = cjson.decode(definition)
+	if op ~= 'update' or viewName ~= '' or dependsOnChangedFields(view) then
+		table.insert(views, view)
+	end
+end
+if #views == 0 then
+	return 0
+end
+if op == 'clear' then
+	for _, view in ipairs(views) do
+		redis.call('DEL', view.key)
+	end
+	return 0
+end
+-- Get the ids of the models to update
+local ids = {}
+if idsKind == 'id' then
+	ids = {idsArg}
+else
+	local idsType = redis.call('TYPE', idsArg)['ok']
+	if idsType == 'zset' then
+		ids = redis.call('ZRANGE', idsArg, 0, -1)
+	elseif idsType == 'set' then
+		ids = redis.call('SMEMBERS', idsArg)
+	elseif idsType == 'list' then
+		ids = redis.call('LRANGE', idsArg, 0, -1)
+	end
+end
+if op == 'delete' then
+	for _, id in ipairs(ids) do
+		for _, view in ipairs(views) do
+			redis.call('ZREM', view.key, id)
+		end
+	end
+	return #ids
+end
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- integer_index.go.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- compareStrings compares two strings byte by byte, which is the same way
+-- Redis compares strings in string indexes. It returns -1, 0, or 1.
+local function compareStrings(a, b)
+	if a == b then
+		return 0
+	end
+	local n = math.min(#a, #b)
+	for i = 1, n do
+		local ca = string.byte(a, i)
+		local cb = string.byte(b, i)
+		if ca ~= cb then
+			if ca < cb then
+				return -1
+			end
+			return 1
+		end
+	end
+	if #a < #b then
+		return -1
+	end
+	return 1
+end
+-- compare compares value to filterValue using the given kind of comparison. It
+-- returns -1, 0, or 1, or nil if value cannot be compared.
+local function compare(value, kind, filterValue)
+	if kind == 'number' then
+		value = tonumber(value)
+		if value == nil then
+			return nil
+		end
+		filterValue = tonumber(filterValue)
+		if value < filterValue then
+			return -1
+		elseif value > filterValue then
+			return 1
+		end
+		return 0
+	elseif kind == 'integer' then
+		if not string.match(value, '^%-?%d+$') then
+			return nil
+		end
+		return compareStrings(encodeInteger(value), filterValue)
+	end
+	return compareStrings(value, filterValue)
+end
+-- matches returns true iff value, which is the value of the field in the main
+-- hash (or false if the field does not exist), matches the filter
+local function matches(value, filter)
+	if filter.op == 'is' then
+		return value == 'NULL'
+	end
+	if value == false or (filter.pointer and value == 'NULL') then
+		return false
+	end
+	if filter.op == 'is not' then
+		return true
+	elseif filter.op == 'in' then
+		for _, filterValue in ipairs(filter.values) do
+			if compare(value, filter.kind, filterValue) == 0 then
+				return true
+			end
+		end
+		return false
+	end
+	local cmp = compare(value, filter.kind, filter.values[1])
+	if cmp == nil then
+		return false
+	end
+	if filter.op == '=' then
+		return cmp == 0
+	elseif filter.op == '!=' then
+		return cmp ~= 0
+	elseif filter.op == '>' then
+		return cmp > 0
+	elseif filter.op == '<' then
+		return cmp < 0
+	elseif filter.op == '>=' then
+		return cmp >= 0
+	elseif filter.op == '<=' then
+		return cmp <= 0
+	end
+	return false
+end
+for _, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	local exists = redis.call('EXISTS', modelKey) == 1
+	for _, view in ipairs(views) do
+		local isMatch = exists
+		if isMatch then
+			for _, filter in ipairs(view.filters) do
+				if not matches(redis.call('HGET', modelKey, filter.field), filter) then
+					isMatch = false
+					break
+				end
+			end
+		end
+		if isMatch then
+			redis.call('ZADD', view.key, 0, id)
+		else
+			redis.call('ZREM', view.key, id)
+		end
+	end
+end
+return #ids
 `)
 )
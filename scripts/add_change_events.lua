@@ -0,0 +1,82 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- add_change_events is a lua script that takes the following arguments:
+-- 	1) streamKey: The key of the change stream for a collection, or an empty
+--			string if events should not be added to a stream
+--		2) channel: The channel to publish events to, or an empty string if
+--			events should not be published
+--		3) collectionName: The name of the collection
+--		4) maxLen: The approximate maximum length of the stream, or 0 if the
+--			length of the stream should not be limited
+--		5) op: The operation for the events, either "save" or "delete"
+--		6) message: The JSON encoded event which is published for each model,
+--			without the id of the model
+--		7) idsKey: The key of a set, sorted set, or list of model ids, or an
+--			empty string
+--		8) numEntryArgs: The number of arguments which follow for the entries in
+--			the stream
+--		9...) numEntryArgs arguments, consisting of pairs of names and values
+--			which are added to each entry in the stream after the collection, id,
+--			and op, e.g. "fields" followed by the names of the fields separated by
+--			commas
+--		Followed by any number of ids: The ids of the models if idsKey is empty
+-- The script adds a change event to the stream and/or publishes a change event
+-- for each of the models whose ids are in idsKey (or given as arguments) and
+-- which currently exist. Delete events must be added before the models are
+-- deleted. It returns the number of models for which events were added.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local streamKey = ARGV[1]
+local channel = ARGV[2]
+local collectionName = ARGV[3]
+local maxLen = tonumber(ARGV[4])
+local op = ARGV[5]
+local message = ARGV[6]
+local idsKey = ARGV[7]
+local numEntryArgs = tonumber(ARGV[8])
+local entryArgs = {}
+for i = 9, 8 + numEntryArgs do
+	table.insert(entryArgs, ARGV[i])
+end
+-- Get all the ids, depending on the type of idsKey
+local ids = {}
+if idsKey ~= '' then
+	local idsType = redis.call('TYPE', idsKey)['ok']
+	if idsType == 'zset' then
+		ids = redis.call('ZRANGE', idsKey, 0, -1)
+	elseif idsType == 'set' then
+		ids = redis.call('SMEMBERS', idsKey)
+	elseif idsType == 'list' then
+		ids = redis.call('LRANGE', idsKey, 0, -1)
+	end
+else
+	for i = 9 + numEntryArgs, #ARGV do
+		table.insert(ids, ARGV[i])
+	end
+end
+local decodedMessage = {}
+if channel ~= '' then
+	decodedMessage = cjson.decode(message)
+end
+local count = 0
+for i, id in ipairs(ids) do
+	if redis.call('EXISTS', collectionName .. ':' .. id) == 1 then
+		if streamKey ~= '' then
+			if maxLen > 0 then
+				redis.call('XADD', streamKey, 'MAXLEN', '~', maxLen, '*', 'collection', collectionName, 'id', id, 'op', op, unpack(entryArgs))
+			else
+				redis.call('XADD', streamKey, '*', 'collection', collectionName, 'id', id, 'op', op, unpack(entryArgs))
+			end
+		end
+		if channel ~= '' then
+			decodedMessage['id'] = id
+			redis.call('PUBLISH', channel, cjson.encode(decodedMessage))
+		end
+		count = count + 1
+	end
+end
+return count
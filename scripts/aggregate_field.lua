@@ -0,0 +1,74 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- aggregate_field is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a set, sorted set, or list of model ids
+--		2) collectionName: The name of a registered model
+-- 	3) fieldName: The name of a numeric field as it is stored in Redis
+-- 	4) fieldIndexKey: The key of a numeric field index for the field, or an
+--			empty string if the field is not indexed
+-- 	5) aggregate: One of "sum", "avg", "min", or "max"
+-- The script then reads the value of the field for each model id in idsKey,
+-- using the score from the field index if there is one and the value in the
+-- main hash otherwise, and computes the given aggregate over the values. Models
+-- without a numeric value for the field are skipped. It returns the result as a
+-- string, or "0" if no models had a value for the field.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local collectionName = ARGV[2]
+local fieldName = ARGV[3]
+local fieldIndexKey = ARGV[4]
+local aggregate = ARGV[5]
+-- Get all the ids, depending on the type of idsKey
+local ids = {}
+local idsType = redis.call('TYPE', idsKey)['ok']
+if idsType == 'zset' then
+	ids = redis.call('ZRANGE', idsKey, 0, -1)
+elseif idsType == 'set' then
+	ids = redis.call('SMEMBERS', idsKey)
+elseif idsType == 'list' then
+	ids = redis.call('LRANGE', idsKey, 0, -1)
+end
+local count = 0
+local sum = 0
+local min = nil
+local max = nil
+for i, id in ipairs(ids) do
+	local value
+	if fieldIndexKey ~= '' then
+		value = redis.call('ZSCORE', fieldIndexKey, id)
+	else
+		value = redis.call('HGET', collectionName .. ':' .. id, fieldName)
+	end
+	-- tonumber returns nil for missing values and for pointer fields that were
+	-- saved as NULL
+	value = tonumber(value)
+	if value ~= nil then
+		count = count + 1
+		sum = sum + value
+		if min == nil or value < min then
+			min = value
+		end
+		if max == nil or value > max then
+			max = value
+		end
+	end
+end
+if count == 0 then
+	return '0'
+end
+-- Return strings instead of numbers, because Redis would otherwise truncate
+-- the result to an integer
+local result = sum
+if aggregate == 'avg' then
+	result = sum / count
+elseif aggregate == 'min' then
+	result = min
+elseif aggregate == 'max' then
+	result = max
+end
+return string.format('%.17g', result)
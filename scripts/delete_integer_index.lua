@@ -0,0 +1,42 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_integer_index is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The id of the model to be deleted from the index
+--		3) The name of the indexed integer field
+-- The script then checks if there is a value for the given field name stored in the
+-- model hash, and if there is, removes the model from the index on the given field.
+-- NOTE: This script *must* be called before the main hash for the model is updated/deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local modelID = ARGV[2]
+local fieldName = ARGV[3]
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- ../integer_index.go for a description of the encoding.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- Get the old value from the existing model hash (if any)
+local modelKey = collectionName .. ":" .. modelID
+local oldValue = redis.call("HGET", modelKey, fieldName)
+local indexKey = collectionName .. ":" .. fieldName
+-- Nil pointers are stored as NULL and are not in the index
+if oldValue ~= false and string.match(oldValue, '^%-?%d+$') then
+	-- Remove the model from the field index
+	local oldMember = encodeInteger(oldValue) .. "\0" .. modelID
+	redis.call("ZREM", indexKey, oldMember)
+end
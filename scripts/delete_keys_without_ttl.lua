@@ -0,0 +1,20 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_keys_without_ttl is a lua script that takes the following arguments:
+-- 	1...) Any number of keys
+-- The script then deletes each of the given keys which exists and does not have
+-- an expiration. Keys which have an expiration are left alone. It returns the
+-- number of keys that were deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+local count = 0
+for i, key in ipairs(ARGV) do
+	-- PTTL returns -1 if the key exists but has no expiration
+	if redis.call('PTTL', key) == -1 then
+		count = count + redis.call('DEL', key)
+	end
+end
+return count
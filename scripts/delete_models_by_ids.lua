@@ -0,0 +1,92 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_models_by_ids is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a set, sorted set, or list of model ids
+--		2) collectionName: The name of a registered model
+--		3) viewsKey: The key of the hash which stores the filters for each view
+--			(see update_views.lua), or '' if the collection does not have views
+-- 	4...) Any number of pairs of arguments, one for each indexed field, where
+--			the first argument is the name of the field as it is stored in Redis
+--			and the second argument is the kind of the index: either "string" for
+--			string indexes, "integer" for integer indexes, or "score" for numeric,
+--			boolean, and geo indexes.
+-- The script then deletes all the models corresponding to the ids in idsKey,
+-- including the main hash, the id in the set of all ids, any field indexes
+-- and null sets, and any views.
+-- It returns the number of models that were deleted. It does not delete idsKey.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local collectionName = ARGV[2]
+local viewsKey = ARGV[3]
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- ../integer_index.go for a description of the encoding.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- Get all the ids, depending on the type of idsKey. We need to read all of them
+-- first, because idsKey might be modified as we delete the models.
+local ids = {}
+local idsType = redis.call('TYPE', idsKey)['ok']
+if idsType == 'zset' then
+	ids = redis.call('ZRANGE', idsKey, 0, -1)
+elseif idsType == 'set' then
+	ids = redis.call('SMEMBERS', idsKey)
+elseif idsType == 'list' then
+	ids = redis.call('LRANGE', idsKey, 0, -1)
+end
+-- Get the keys of the sorted sets for all the views
+local viewKeys = {}
+if viewsKey ~= '' then
+	for _, definition in ipairs(redis.call('HVALS', viewsKey)) do
+		table.insert(viewKeys, cjson.decode(definition).key)
+	end
+end
+local count = 0
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	-- Remove the model from all the field indexes. This must happen before the
+	-- main hash is deleted, because string indexes rely on the old value.
+	for j = 4, #ARGV, 2 do
+		local fieldName = ARGV[j]
+		local indexKind = ARGV[j+1]
+		local indexKey = collectionName .. ':' .. fieldName
+		if indexKind == 'string' then
+			local oldValue = redis.call('HGET', modelKey, fieldName)
+			if oldValue ~= false then
+				redis.call('ZREM', indexKey, oldValue .. '\0' .. id)
+			end
+		elseif indexKind == 'integer' then
+			local oldValue = redis.call('HGET', modelKey, fieldName)
+			-- Nil pointers are stored as NULL and are not in the index
+			if oldValue ~= false and string.match(oldValue, '^%-?%d+$') then
+				redis.call('ZREM', indexKey, encodeInteger(oldValue) .. '\0' .. id)
+			end
+		else
+			redis.call('ZREM', indexKey, id)
+		end
+		-- Remove the id from the null set for the field (if any)
+		redis.call('SREM', indexKey .. ':null', id)
+	end
+	-- Remove the id from all the views
+	for _, viewKey in ipairs(viewKeys) do
+		redis.call('ZREM', viewKey, id)
+	end
+	-- Delete the main hash and remove the id from the set of all ids
+	count = count + redis.call('DEL', modelKey)
+	redis.call('SREM', collectionName .. ':all', id)
+end
+return count
@@ -10,7 +10,7 @@
 -- The script then calls ZRANGEBYSCORE on setKey with the given min and max arguments,
 -- and then stores the resulting set in destKey. It does not preserve the existing
 -- scores, and instead just replaces scores with sequential numbers to keep the members
--- in the same order.
+-- in the same order. It returns the number of ids that were extracted.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
@@ -25,3 +25,4 @@ local members = redis.call('ZRANGEBYSCORE', setKey, min, max)
 for i, member in ipairs(members) do
 	redis.call('ZADD', destKey, i, member)
 end
+return #members
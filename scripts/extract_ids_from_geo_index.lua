@@ -0,0 +1,35 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- extract_ids_from_geo_index is a lua script that takes the following arguments:
+-- 	1) setKey: The key of a sorted set for a geo index
+-- 	2) destKey: The key of a sorted set where the resulting ids will be stored
+--		3) lon: The longitude of the center of the search area
+--		4) lat: The latitude of the center of the search area
+--		5...) The shape of the search area, which is either:
+--			a) "BYRADIUS", the radius, and the unit, or
+--			b) "BYBOX", the width, the height, and the unit
+-- The script then calls GEOSEARCH on setKey with the given arguments and stores
+-- the resulting ids in destKey. It does not preserve the existing scores, and
+-- instead uses the distance from the center of the search area as the score
+-- for each id. It returns the number of ids that were extracted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local setKey = ARGV[1]
+local destKey = ARGV[2]
+local lon = ARGV[3]
+local lat = ARGV[4]
+local searchArgs = {'GEOSEARCH', setKey, 'FROMLONLAT', lon, lat}
+for i = 5, #ARGV do
+	table.insert(searchArgs, ARGV[i])
+end
+table.insert(searchArgs, 'WITHDIST')
+-- Each result is a pair of the id and the distance
+local results = redis.call(unpack(searchArgs))
+for i, result in ipairs(results) do
+	redis.call('ZADD', destKey, result[2], result[1])
+end
+return #results
@@ -11,6 +11,7 @@
 -- 	4) max: The max argument for the ZRANGEBYLEX command
 -- The script then extracts the ids from setKey using the given min and max arguments,
 -- and then stores them destKey with the appropriate scores in ascending order.
+-- It returns the number of ids that were extracted.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
@@ -31,3 +32,4 @@ if #members > 0 then
 		redis.call('ZADD', destKey, i, id)
 	end
 end
+return #members
@@ -0,0 +1,120 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- filter_ids_by_field_values is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a set or sorted set of model ids
+--		2) destKey: The key of a sorted set where the resulting ids will be stored
+-- 	3) collectionName: The name of a registered model
+-- 	4...) Any number of groups of 5 arguments, one for each filter:
+--			a) The name of the field as it is stored in Redis
+--			b) The filter operator: one of =, !=, >, <, >=, or <=
+--			c) The kind of comparison: either "number" or "string"
+--			d) The value to compare against
+--			e) "1" if the field is a pointer, in which case the value NULL means the
+--				field is nil and never matches, or "0" otherwise
+-- The script then reads the values of the fields from the main hash of each
+-- model in idsKey and stores the ids of the models which match all of the
+-- filters in destKey. If idsKey is a sorted set, the scores are preserved so
+-- that the order stays the same. idsKey and destKey may be the same key.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local destKey = ARGV[2]
+local collectionName = ARGV[3]
+-- Get all the ids (and scores, if any) from idsKey
+local ids = {}
+local scores = {}
+local idsType = redis.call('TYPE', idsKey)['ok']
+if idsType == 'zset' then
+	local idsAndScores = redis.call('ZRANGE', idsKey, 0, -1, 'WITHSCORES')
+	for i = 1, #idsAndScores, 2 do
+		table.insert(ids, idsAndScores[i])
+		table.insert(scores, idsAndScores[i+1])
+	end
+elseif idsType == 'set' then
+	ids = redis.call('SMEMBERS', idsKey)
+end
+-- compareStrings compares two strings byte by byte, which is the same way
+-- Redis compares strings in string indexes. It returns -1, 0, or 1.
+local function compareStrings(a, b)
+	if a == b then
+		return 0
+	end
+	local n = math.min(#a, #b)
+	for i = 1, n do
+		local ca = string.byte(a, i)
+		local cb = string.byte(b, i)
+		if ca ~= cb then
+			if ca < cb then
+				return -1
+			end
+			return 1
+		end
+	end
+	if #a < #b then
+		return -1
+	end
+	return 1
+end
+-- matches returns true iff value matches the filter with the given operator,
+-- kind, and filterValue
+local function matches(value, op, kind, filterValue)
+	local cmp
+	if kind == 'number' then
+		value = tonumber(value)
+		if value == nil then
+			return false
+		end
+		filterValue = tonumber(filterValue)
+		if value < filterValue then
+			cmp = -1
+		elseif value > filterValue then
+			cmp = 1
+		else
+			cmp = 0
+		end
+	else
+		cmp = compareStrings(value, filterValue)
+	end
+	if op == '=' then
+		return cmp == 0
+	elseif op == '!=' then
+		return cmp ~= 0
+	elseif op == '>' then
+		return cmp > 0
+	elseif op == '<' then
+		return cmp < 0
+	elseif op == '>=' then
+		return cmp >= 0
+	elseif op == '<=' then
+		return cmp <= 0
+	end
+	return false
+end
+-- Find the ids which match all the filters
+local matchingIDs = {}
+local matchingScores = {}
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	local isMatch = true
+	for j = 4, #ARGV, 5 do
+		local value = redis.call('HGET', modelKey, ARGV[j])
+		if value == false or (ARGV[j+4] == '1' and value == 'NULL') or not matches(value, ARGV[j+1], ARGV[j+2], ARGV[j+3]) then
+			isMatch = false
+			break
+		end
+	end
+	if isMatch then
+		table.insert(matchingIDs, id)
+		table.insert(matchingScores, scores[i] or 0)
+	end
+end
+-- Replace the contents of destKey with the matching ids
+redis.call('DEL', destKey)
+for i, id in ipairs(matchingIDs) do
+	redis.call('ZADD', destKey, matchingScores[i], id)
+end
+return #matchingIDs
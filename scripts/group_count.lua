@@ -0,0 +1,136 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- group_count is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a set, sorted set, or list of model ids
+--		2) fieldIndexKey: The key of a sorted set for a field index
+-- 	3) indexKind: Either "string" for string indexes, where each member is of
+--			the form: value + NULL + id, "integer" for integer indexes, where each
+--			member is of the form: encoded value + NULL + id, or "score" for
+--			numeric and boolean indexes, where the members are ids and the scores
+--			are values.
+--		4) collectionName: The name of the collection
+--		5) fieldName: The name of the field as it is stored in Redis
+--		6) nullSetKey: The key of the null set for the field, or an empty string
+--			if the field does not have a null set
+-- The script then counts the number of models in idsKey for each distinct value
+-- in the field index. It returns an array of the form value1, count1, value2,
+-- count2, etc. with the values in ascending order. Values which do not
+-- correspond to any model in idsKey are omitted. If there are fewer ids in
+-- idsKey than members in the field index, the script looks up the value for
+-- each id (with ZSCORE for score indexes or HGET for string and integer
+-- indexes) instead of iterating through the entire field index, so the cost is
+-- proportional to the smaller of the two.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local fieldIndexKey = ARGV[2]
+local indexKind = ARGV[3]
+local collectionName = ARGV[4]
+local fieldName = ARGV[5]
+local nullSetKey = ARGV[6]
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- ../integer_index.go for a description of the encoding.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- Get all the ids, depending on the type of idsKey
+local ids = {}
+local idsType = redis.call('TYPE', idsKey)['ok']
+if idsType == 'zset' then
+	ids = redis.call('ZRANGE', idsKey, 0, -1)
+elseif idsType == 'set' then
+	ids = redis.call('SMEMBERS', idsKey)
+elseif idsType == 'list' then
+	ids = redis.call('LRANGE', idsKey, 0, -1)
+end
+local values = {}
+local counts = {}
+local function count(value)
+	if counts[value] == nil then
+		table.insert(values, value)
+		counts[value] = 0
+	end
+	counts[value] = counts[value] + 1
+end
+if #ids < redis.call('ZCARD', fieldIndexKey) then
+	-- Look up the value for each id
+	for i, id in ipairs(ids) do
+		if indexKind == 'score' then
+			local score = redis.call('ZSCORE', fieldIndexKey, id)
+			if score ~= false then
+				count(score)
+			end
+		elseif nullSetKey == '' or redis.call('SISMEMBER', nullSetKey, id) == 0 then
+			local value = redis.call('HGET', collectionName .. ':' .. id, fieldName)
+			if value ~= false then
+				if indexKind == 'integer' then
+					-- Nil pointers are stored as NULL and are not in the index
+					if string.match(value, '^%-?%d+$') then
+						count(encodeInteger(value))
+					end
+				else
+					count(value)
+				end
+			end
+		end
+	end
+	-- Sort the values in the same order as the field index
+	if indexKind == 'score' then
+		local function toNumber(value)
+			if value == 'inf' then
+				return math.huge
+			elseif value == '-inf' then
+				return -math.huge
+			end
+			return tonumber(value)
+		end
+		table.sort(values, function(a, b)
+			return toNumber(a) < toNumber(b)
+		end)
+	else
+		table.sort(values)
+	end
+else
+	-- Iterate through the field index and count the ids for each value. Store
+	-- the ids in a table for fast lookups.
+	local isMember = {}
+	for i, id in ipairs(ids) do
+		isMember[id] = true
+	end
+	if indexKind == 'score' then
+		local membersAndScores = redis.call('ZRANGE', fieldIndexKey, 0, -1, 'WITHSCORES')
+		for i = 1, #membersAndScores, 2 do
+			if isMember[membersAndScores[i]] then
+				count(membersAndScores[i+1])
+			end
+		end
+	else
+		local members = redis.call('ZRANGE', fieldIndexKey, 0, -1)
+		for i, member in ipairs(members) do
+			-- The id is everything after the last NULL character
+			local idStart = string.find(member, '%z[^%z]*$')
+			if isMember[string.sub(member, idStart+1)] then
+				count(string.sub(member, 1, idStart-1))
+			end
+		end
+	end
+end
+local result = {}
+for i, value in ipairs(values) do
+	table.insert(result, value)
+	table.insert(result, counts[value])
+end
+return result
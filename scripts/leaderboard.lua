@@ -0,0 +1,189 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- leaderboard is a lua script that takes the following arguments:
+-- 	1) operation: The operation to perform, which is one of:
+--			a) "rank" for the rank of a model,
+--			b) "around" for the models ranked around a model,
+--			c) "percentile" for the field value at a percentile, or
+--			d) "percentileRank" for the fraction of models ranked below a model
+--		2) collectionName: The name of a registered model
+--		3) fieldIndexKey: The key of the field index
+--		4) indexKind: Either "score" for a numeric index or "integer" for an
+--			integer index
+--		5) fieldName: The name of the field as it is stored in Redis
+--		6) reverse: "1" if models with higher values should be ranked first, or
+--			"0" otherwise
+--		Then the arguments for the operation:
+--			rank: The id of the model
+--			around: The id of the model, the number of models to include on either
+--				side of it, the number of field names which follow, and the names of
+--				the fields to return for each model as they are stored in Redis
+--			percentile: The percentile as a number between 0 and 1
+--			percentileRank: The id of the model
+-- The script returns nil if the model identified by id is not in the field
+-- index (or if the index is empty for the percentile operation). Otherwise:
+--		rank: returns the rank of the model, starting at 0.
+--		around: returns an array which consists of the values of the given fields
+--			followed by the id for each model ranked within the given number of
+--			positions of the model, which is the same format as the SORT command
+--			with one GET argument for each field and a final GET #.
+--		percentile: returns the value of the field for the model at the given
+--			percentile (using the nearest rank method) as a string.
+--		percentileRank: returns an array of the number of models with a lower
+--			value (or a higher value if reverse is "1") and the number of models
+--			in the index.
+-- For integer indexes, models with the same value are ranked by id. For numeric
+-- indexes, they are ranked in the same way as ZRANK.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local operation = ARGV[1]
+local collectionName = ARGV[2]
+local fieldIndexKey = ARGV[3]
+local indexKind = ARGV[4]
+local fieldName = ARGV[5]
+local reverse = ARGV[6] == '1'
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- integer_index.go.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- decodeInteger is the inverse of encodeInteger.
+local function decodeInteger(encoded)
+	local digits = string.sub(encoded, 4)
+	if string.sub(encoded, 1, 1) == 'p' then
+		return digits
+	end
+	local complement = string.gsub(digits, '%d', function(d)
+		return tostring(9 - tonumber(d))
+	end)
+	return '-' .. complement
+end
+-- member returns the member of the field index for the model with the given id,
+-- or nil if the model is not in the index.
+local function member(id)
+	if indexKind == 'score' then
+		if redis.call('ZSCORE', fieldIndexKey, id) == false then
+			return nil
+		end
+		return id
+	end
+	local value = redis.call('HGET', collectionName .. ':' .. id, fieldName)
+	if value == false or not string.match(value, '^%-?%d+$') then
+		return nil
+	end
+	local m = encodeInteger(value) .. '\0' .. id
+	if redis.call('ZSCORE', fieldIndexKey, m) == false then
+		return nil
+	end
+	return m
+end
+-- rank returns the rank of the given member of the field index.
+local function rank(m)
+	if reverse then
+		return redis.call('ZREVRANK', fieldIndexKey, m)
+	end
+	return redis.call('ZRANK', fieldIndexKey, m)
+end
+-- rangeByRank returns the members of the field index with ranks between start
+-- and stop (inclusive).
+local function rangeByRank(start, stop)
+	if reverse then
+		return redis.call('ZREVRANGE', fieldIndexKey, start, stop)
+	end
+	return redis.call('ZRANGE', fieldIndexKey, start, stop)
+end
+-- idFromMember returns the id for a member of the field index.
+local function idFromMember(m)
+	if indexKind == 'score' then
+		return m
+	end
+	local idStart = string.find(m, '%z[^%z]*$')
+	return string.sub(m, idStart+1)
+end
+
+if operation == 'rank' then
+	local m = member(ARGV[7])
+	if m == nil then
+		return nil
+	end
+	return rank(m)
+elseif operation == 'around' then
+	local m = member(ARGV[7])
+	if m == nil then
+		return nil
+	end
+	local k = tonumber(ARGV[8])
+	local numFields = tonumber(ARGV[9])
+	local fields = {}
+	for i = 1, numFields do
+		fields[i] = ARGV[9+i]
+	end
+	local r = rank(m)
+	local start = math.max(r - k, 0)
+	local results = {}
+	for _, other in ipairs(rangeByRank(start, r + k)) do
+		local id = idFromMember(other)
+		if numFields > 0 then
+			local values = redis.call('HMGET', collectionName .. ':' .. id, unpack(fields))
+			for j = 1, numFields do
+				results[#results+1] = values[j]
+			end
+		end
+		results[#results+1] = id
+	end
+	return results
+elseif operation == 'percentile' then
+	local p = tonumber(ARGV[7])
+	local count = redis.call('ZCARD', fieldIndexKey)
+	if count == 0 then
+		return nil
+	end
+	-- Use the nearest rank method, i.e. the smallest value such that at least
+	-- p of the values are less than or equal to it.
+	local r = math.max(math.ceil(p * count) - 1, 0)
+	local members = rangeByRank(r, r)
+	if indexKind == 'score' then
+		return redis.call('ZSCORE', fieldIndexKey, members[1])
+	end
+	local m = members[1]
+	return decodeInteger(string.sub(m, 1, string.find(m, '%z') - 1))
+elseif operation == 'percentileRank' then
+	local m = member(ARGV[7])
+	if m == nil then
+		return nil
+	end
+	local count = redis.call('ZCARD', fieldIndexKey)
+	local below
+	if indexKind == 'score' then
+		local score = redis.call('ZSCORE', fieldIndexKey, m)
+		if reverse then
+			below = redis.call('ZCOUNT', fieldIndexKey, '(' .. score, '+inf')
+		else
+			below = redis.call('ZCOUNT', fieldIndexKey, '-inf', '(' .. score)
+		end
+	else
+		local prefix = string.sub(m, 1, string.find(m, '%z'))
+		if reverse then
+			-- All the members with the same value start with prefix, and \255 is
+			-- greater than any character in an id
+			below = redis.call('ZLEXCOUNT', fieldIndexKey, '(' .. prefix .. '\255', '+')
+		else
+			below = redis.call('ZLEXCOUNT', fieldIndexKey, '-', '(' .. prefix)
+		end
+	end
+	return {below, count}
+end
+return redis.error_reply('unknown leaderboard operation: ' .. operation)
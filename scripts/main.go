@@ -7,7 +7,6 @@
 package main
 
 import (
-	"go/build"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -28,21 +27,24 @@ var (
 type script struct {
 	// VarName is the variable name that the script will be assigned to in the generated go code.
 	VarName string
+	// Name is the name of the original .lua file without the extension.
+	Name string
 	// Src is the contents of the original .lua file.
 	Src string
 }
 
 func init() {
-	// Use build to find the directory where this file lives. This always works as
-	// long as you have go installed, even if you have multiple GOPATHs or are using
-	// dependency management tools.
-	pkg, err := build.Import("github.com/albrow/zoom", "", build.FindOnly)
+	// go generate runs commands in the directory of the package which contains
+	// the go:generate comment, so the scripts directory is relative to the
+	// working directory. This works no matter where the package is located or
+	// what its import path is.
+	wd, err := os.Getwd()
 	if err != nil {
 		panic(err)
 	}
 	// Configure the required paths
-	scriptsPath = filepath.Join(pkg.Dir, "scripts")
-	destPath = filepath.Clean(filepath.Join(scriptsPath, "..", "scripts.go"))
+	scriptsPath = filepath.Join(wd, "scripts")
+	destPath = filepath.Join(wd, "scripts.go")
 	tmplPath = filepath.Join(scriptsPath, "scripts.go.tmpl")
 }
 
@@ -66,8 +68,10 @@ func findScripts(path string) ([]script, error) {
 	}
 	scripts := []script{}
 	for _, filename := range filenames {
+		name := strings.TrimSuffix(filepath.Base(filename), ".lua")
 		script := script{
-			VarName: convertUnderscoresToCamelCase(strings.TrimSuffix(filepath.Base(filename), ".lua")) + "Script",
+			VarName: convertUnderscoresToCamelCase(name) + "Script",
+			Name:    name,
 		}
 		src, err := ioutil.ReadFile(filename)
 		if err != nil {
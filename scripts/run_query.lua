@@ -0,0 +1,342 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- run_query is a lua script that takes the following arguments:
+-- 	1) collectionName: The name of a registered model
+--		2) indexKey: The key of the set of all ids for the collection
+--		3) orderKind: The kind of index used for ordering, which is one of:
+--			a) "score" for a numeric or boolean index,
+--			b) "lex" for a string index,
+--			c) "geo" for ordering by the distance from the center of the geo search,
+--			d) "field" for ordering numerically by the values of an unindexed field,
+--			e) "alpha" for ordering lexicographically by the values of an unindexed
+--				field, or
+--			f) "" if the query does not have an order
+--		4) orderKey: The key of the field index used for ordering if orderKind is
+--			"score" or "lex", or the name of the field as it is stored in Redis if
+--			orderKind is "field" or "alpha"
+--		5) reverse: "1" if the order is descending, or "0" otherwise
+--		6) offset: The number of matching models to skip
+--		7) limit: The maximum number of models to return, or 0 for no limit
+--		8) countOnly: "1" if the script should only return the number of matching
+--			models, or "0" otherwise
+--		9) numFields: The number of field names which follow
+--		10...) The names of the fields to return for each model as they are stored
+--			in Redis
+--		Then the number of geo search arguments which follow (0 if the query does
+--			not have a geo search), followed by the key of the geo index, the
+--			longitude, the latitude, and the shape of the search area, which is
+--			either "BYRADIUS", the radius, and the unit, or "BYBOX", the width, the
+--			height, and the unit
+--		Then the number of indexed filters, followed by a group of arguments for
+--			each indexed filter:
+--			a) The kind of index: "score" for a numeric or boolean index, "lex" for
+--				a string index, "set" for a set of ids, "zset" for a sorted set of
+--				ids, "within" for a set or sorted set of ids which must contain the id,
+--				or "excluding" for a set or sorted set of ids which must not contain
+--				the id
+--			b) The key of the index
+--			c) The number of ranges which follow (0 unless the kind is "score" or
+--				"lex")
+--			d...) The min and max arguments for ZRANGEBYSCORE or ZRANGEBYLEX for
+--				each range
+--		Then any number of groups of 5 arguments, one for each filter which can
+--			only be applied by reading the main hash of each model:
+--			a) The name of the field as it is stored in Redis
+--			b) The filter operator: one of =, !=, >, <, >=, or <=
+--			c) The kind of comparison: either "number" or "string"
+--			d) The value to compare against
+--			e) "1" if the field is a pointer, in which case the value NULL means the
+--				field is nil and never matches, or "0" otherwise
+-- The script then finds the ids of the models which match all of the filters in
+-- memory, without creating any temporary keys, and applies the order, offset,
+-- and limit. If countOnly is "1", it returns the number of matching models.
+-- Otherwise it returns an array which consists of the values of the given fields
+-- followed by the id for each matching model, which is the same format as the
+-- SORT command with one GET argument for each field and a final GET #.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local indexKey = ARGV[2]
+local orderKind = ARGV[3]
+local orderKey = ARGV[4]
+local reverse = ARGV[5] == '1'
+local offset = tonumber(ARGV[6])
+local limit = tonumber(ARGV[7])
+local countOnly = ARGV[8] == '1'
+local numFields = tonumber(ARGV[9])
+local fields = {}
+for i = 1, numFields do
+	fields[i] = ARGV[9+i]
+end
+local pos = 10 + numFields
+-- idFromMember returns the id for a member of a string index, which is
+-- everything after the last NULL character
+local function idFromMember(member)
+	local idStart = string.find(member, '%z[^%z]*$')
+	return string.sub(member, idStart+1)
+end
+-- Get the ids within the geo search area (if any) ordered by their distance
+-- from the center, which is the same order as a sorted set scored by distance
+local geoIDs = nil
+local geoSet = nil
+local numGeoArgs = tonumber(ARGV[pos])
+pos = pos + 1
+if numGeoArgs > 0 then
+	local searchArgs = {'GEOSEARCH', ARGV[pos], 'FROMLONLAT', ARGV[pos+1], ARGV[pos+2]}
+	for i = pos+3, pos+numGeoArgs-1 do
+		table.insert(searchArgs, ARGV[i])
+	end
+	table.insert(searchArgs, 'WITHDIST')
+	-- Each result is a pair of the id and the distance
+	local results = redis.call(unpack(searchArgs))
+	table.sort(results, function(a, b)
+		local distA = tonumber(a[2])
+		local distB = tonumber(b[2])
+		if distA ~= distB then
+			return distA < distB
+		end
+		return a[1] < b[1]
+	end)
+	geoIDs = {}
+	geoSet = {}
+	for i, result in ipairs(results) do
+		geoIDs[i] = result[1]
+		geoSet[result[1]] = true
+	end
+	pos = pos + numGeoArgs
+end
+-- Get the ids which match each indexed filter. For "excluding" filters, the
+-- set contains the ids which do not match.
+local filterSets = {}
+local excludedSets = {}
+local firstFilterIDs = nil
+local numFilters = tonumber(ARGV[pos])
+pos = pos + 1
+for i = 1, numFilters do
+	local kind = ARGV[pos]
+	local key = ARGV[pos+1]
+	local numRanges = tonumber(ARGV[pos+2])
+	pos = pos + 3
+	local ids = {}
+	if kind == 'set' then
+		ids = redis.call('SMEMBERS', key)
+	elseif kind == 'zset' then
+		ids = redis.call('ZRANGE', key, 0, -1)
+	elseif kind == 'within' or kind == 'excluding' then
+		local keyType = redis.call('TYPE', key)['ok']
+		if keyType == 'zset' then
+			ids = redis.call('ZRANGE', key, 0, -1)
+		elseif keyType == 'set' then
+			ids = redis.call('SMEMBERS', key)
+		end
+	end
+	for j = 1, numRanges do
+		local min = ARGV[pos]
+		local max = ARGV[pos+1]
+		pos = pos + 2
+		if kind == 'lex' then
+			local members = redis.call('ZRANGEBYLEX', key, min, max)
+			for _, member in ipairs(members) do
+				table.insert(ids, idFromMember(member))
+			end
+		else
+			local members = redis.call('ZRANGEBYSCORE', key, min, max)
+			for _, member in ipairs(members) do
+				table.insert(ids, member)
+			end
+		end
+	end
+	local set = {}
+	for _, id in ipairs(ids) do
+		set[id] = true
+	end
+	if kind == 'excluding' then
+		table.insert(excludedSets, set)
+	else
+		table.insert(filterSets, set)
+		-- Sets from Within may contain ids which are not in the collection, so
+		-- they cannot be used as the candidates
+		if firstFilterIDs == nil and kind ~= 'within' then
+			firstFilterIDs = ids
+		end
+	end
+end
+-- The remaining arguments are filters which need to be applied by reading the
+-- main hash of each model
+local scanFiltersStart = pos
+-- Get the candidate ids in order
+local candidates = {}
+if orderKind == 'score' then
+	if reverse then
+		candidates = redis.call('ZREVRANGE', orderKey, 0, -1)
+	else
+		candidates = redis.call('ZRANGE', orderKey, 0, -1)
+	end
+elseif orderKind == 'lex' then
+	local members = redis.call('ZRANGEBYLEX', orderKey, '-', '+')
+	for i, member in ipairs(members) do
+		candidates[i] = idFromMember(member)
+	end
+elseif orderKind == 'geo' then
+	candidates = geoIDs
+else
+	-- Without an order, start with the smallest set of ids that we already have
+	if geoIDs ~= nil then
+		candidates = geoIDs
+	else
+		if firstFilterIDs ~= nil then
+			candidates = firstFilterIDs
+		else
+			candidates = redis.call('SMEMBERS', indexKey)
+		end
+		table.sort(candidates)
+	end
+	if orderKind == 'field' or orderKind == 'alpha' then
+		-- Sort by the values in the main hash in the same way as SORT BY, which
+		-- treats missing numeric values as 0 and compares ids if the values are
+		-- equal
+		local values = {}
+		for _, id in ipairs(candidates) do
+			local value = redis.call('HGET', collectionName .. ':' .. id, orderKey)
+			if orderKind == 'field' then
+				value = tonumber(value) or 0
+			elseif value == false then
+				value = ''
+			end
+			values[id] = value
+		end
+		table.sort(candidates, function(a, b)
+			if values[a] ~= values[b] then
+				return values[a] < values[b]
+			end
+			return a < b
+		end)
+	end
+end
+if reverse and orderKind ~= 'score' then
+	local reversed = {}
+	for i = #candidates, 1, -1 do
+		table.insert(reversed, candidates[i])
+	end
+	candidates = reversed
+end
+-- compareStrings compares two strings byte by byte, which is the same way
+-- Redis compares strings in string indexes. It returns -1, 0, or 1.
+local function compareStrings(a, b)
+	if a == b then
+		return 0
+	end
+	local n = math.min(#a, #b)
+	for i = 1, n do
+		local ca = string.byte(a, i)
+		local cb = string.byte(b, i)
+		if ca ~= cb then
+			if ca < cb then
+				return -1
+			end
+			return 1
+		end
+	end
+	if #a < #b then
+		return -1
+	end
+	return 1
+end
+-- matches returns true iff value matches the filter with the given operator,
+-- kind, and filterValue
+local function matches(value, op, kind, filterValue)
+	local cmp
+	if kind == 'number' then
+		value = tonumber(value)
+		if value == nil then
+			return false
+		end
+		filterValue = tonumber(filterValue)
+		if value < filterValue then
+			cmp = -1
+		elseif value > filterValue then
+			cmp = 1
+		else
+			cmp = 0
+		end
+	else
+		cmp = compareStrings(value, filterValue)
+	end
+	if op == '=' then
+		return cmp == 0
+	elseif op == '!=' then
+		return cmp ~= 0
+	elseif op == '>' then
+		return cmp > 0
+	elseif op == '<' then
+		return cmp < 0
+	elseif op == '>=' then
+		return cmp >= 0
+	elseif op == '<=' then
+		return cmp <= 0
+	end
+	return false
+end
+-- isMatch returns true iff the model with the given id matches the geo search
+-- and all of the filters
+local function isMatch(id)
+	if geoSet ~= nil and not geoSet[id] then
+		return false
+	end
+	for _, set in ipairs(filterSets) do
+		if not set[id] then
+			return false
+		end
+	end
+	for _, set in ipairs(excludedSets) do
+		if set[id] then
+			return false
+		end
+	end
+	local modelKey = collectionName .. ':' .. id
+	for j = scanFiltersStart, #ARGV, 5 do
+		local value = redis.call('HGET', modelKey, ARGV[j])
+		if value == false or (ARGV[j+4] == '1' and value == 'NULL') or not matches(value, ARGV[j+1], ARGV[j+2], ARGV[j+3]) then
+			return false
+		end
+	end
+	return true
+end
+-- Iterate over the candidates in order, skipping the first offset matches and
+-- stopping as soon as we reach the limit
+local results = {}
+local count = 0
+local skipped = 0
+local seen = {}
+for _, id in ipairs(candidates) do
+	if limit > 0 and count >= limit then
+		break
+	end
+	if not seen[id] then
+		seen[id] = true
+		if isMatch(id) then
+			if skipped < offset then
+				skipped = skipped + 1
+			else
+				count = count + 1
+				if not countOnly then
+					if numFields > 0 then
+						local values = redis.call('HMGET', collectionName .. ':' .. id, unpack(fields))
+						for j = 1, numFields do
+							results[#results+1] = values[j]
+						end
+					end
+					results[#results+1] = id
+				end
+			end
+		end
+	end
+end
+if countOnly then
+	return count
+end
+return results
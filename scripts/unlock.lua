@@ -0,0 +1,21 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- unlock is a lua script that takes the following arguments:
+-- 	1) lockKey: The key of a lock
+--		2) token: The token which was stored in the lock key when the lock was
+--			acquired
+-- The script then deletes the lock key iff its value is still the given token,
+-- i.e. iff the lock has not expired and been acquired by someone else. It
+-- returns 1 if the lock key was deleted and 0 otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local lockKey = ARGV[1]
+local token = ARGV[2]
+if redis.call('GET', lockKey) == token then
+	return redis.call('DEL', lockKey)
+end
+return 0
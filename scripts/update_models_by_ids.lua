@@ -0,0 +1,112 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- update_models_by_ids is a lua script that takes the following arguments:
+-- 	1) idsKey: The key of a set, sorted set, or list of model ids
+--		2) collectionName: The name of a registered model
+-- 	3...) Any number of groups of 5 arguments, one for each field to update:
+--			a) The name of the field as it is stored in Redis
+--			b) The new value to store in the main hash
+--			c) The kind of the index: either "string" for string indexes, "integer"
+--				for integer indexes, "score" for numeric and boolean indexes, "geo"
+--				for geo indexes, or an empty string if the field is not indexed
+--			d) The new value for the index: the score for numeric and boolean
+--				indexes, the string value for string indexes, the encoded value for
+--				integer indexes, or the longitude and latitude separated by a space
+--				for geo indexes
+--			e) "1" if the new value is nil, in which case the model is removed from
+--				the index and added to the null set for the field, or "0" otherwise
+-- The script then sets the given fields for each existing model corresponding
+-- to the ids in idsKey and updates the field indexes and null sets. Ids which
+-- do not correspond to an existing model are skipped. It returns the number of
+-- models that were updated.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local idsKey = ARGV[1]
+local collectionName = ARGV[2]
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- ../integer_index.go for a description of the encoding.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- Get all the ids, depending on the type of idsKey. We need to read all of them
+-- first, because idsKey might be modified as we update the indexes.
+local ids = {}
+local idsType = redis.call('TYPE', idsKey)['ok']
+if idsType == 'zset' then
+	ids = redis.call('ZRANGE', idsKey, 0, -1)
+elseif idsType == 'set' then
+	ids = redis.call('SMEMBERS', idsKey)
+elseif idsType == 'list' then
+	ids = redis.call('LRANGE', idsKey, 0, -1)
+end
+local count = 0
+for i, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	if redis.call('EXISTS', modelKey) == 1 then
+		for j = 3, #ARGV, 5 do
+			local fieldName = ARGV[j]
+			local hashValue = ARGV[j+1]
+			local indexKind = ARGV[j+2]
+			local indexValue = ARGV[j+3]
+			local isNull = ARGV[j+4] == '1'
+			local indexKey = collectionName .. ':' .. fieldName
+			-- Update the field index (if any). This must happen before the main hash
+			-- is updated, because string and integer indexes rely on the old value.
+			if indexKind == 'string' then
+				local oldValue = redis.call('HGET', modelKey, fieldName)
+				if oldValue ~= false then
+					redis.call('ZREM', indexKey, oldValue .. '\0' .. id)
+				end
+				if not isNull then
+					redis.call('ZADD', indexKey, 0, indexValue .. '\0' .. id)
+				end
+			elseif indexKind == 'integer' then
+				local oldValue = redis.call('HGET', modelKey, fieldName)
+				-- Nil pointers are stored as NULL and are not in the index
+				if oldValue ~= false and string.match(oldValue, '^%-?%d+$') then
+					redis.call('ZREM', indexKey, encodeInteger(oldValue) .. '\0' .. id)
+				end
+				if not isNull then
+					redis.call('ZADD', indexKey, 0, indexValue .. '\0' .. id)
+				end
+			elseif indexKind == 'score' then
+				if isNull then
+					redis.call('ZREM', indexKey, id)
+				else
+					redis.call('ZADD', indexKey, indexValue, id)
+				end
+			elseif indexKind == 'geo' then
+				if isNull then
+					redis.call('ZREM', indexKey, id)
+				else
+					local lon, lat = string.match(indexValue, '^(%S+) (%S+)$')
+					redis.call('GEOADD', indexKey, lon, lat, id)
+				end
+			end
+			-- Update the null set for the field (if any)
+			if indexKind ~= '' then
+				if isNull then
+					redis.call('SADD', indexKey .. ':null', id)
+				else
+					redis.call('SREM', indexKey .. ':null', id)
+				end
+			end
+			redis.call('HSET', modelKey, fieldName, hashValue)
+		end
+		count = count + 1
+	end
+end
+return count
@@ -0,0 +1,233 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- update_views is a lua script that takes the following arguments:
+-- 	1) collectionName: The name of a registered model
+--		2) viewsKey: The key of a hash which stores the filters for each view. The
+--			fields of the hash are the names of the views, and the values are JSON
+--			objects of the form {"key": ..., "filters": [...]}, where key is the
+--			key of the sorted set for the view and each filter is an object with
+--			the following fields:
+--				field: The name of the field as it is stored in Redis
+--				op: The filter operator: one of =, !=, >, <, >=, <=, in, is (for
+--					IsNull), or is not (for IsNotNull)
+--				kind: The kind of comparison: "number", "string", or "integer"
+--				pointer: true if the field is a pointer, in which case the value
+--					NULL means the field is nil
+--				values: The values to compare against (empty for is and is not).
+--					Values for "integer" comparisons must already be encoded (see
+--					encodeIntegerString in integer_index.go).
+--		3) viewName: The name of the only view to update, or '' to update all the
+--			views
+--		4) op: Either "update" to add the models to or remove them from each view
+--			depending on whether or not they match the filters, "delete" to
+--			remove the models from each view, or "clear" to delete the sorted sets
+--			for the views
+--		5) idsKind: Either "id" if the next argument is a single model id, or "key"
+--			if the next argument is the key of a set, sorted set, or list of ids
+--		6) ids: The id or the key of the ids, depending on idsKind
+--		7...) For the "update" operation, the names of the fields which changed as
+--			they are stored in Redis. Only views which have no filters or which
+--			filter on any of these fields are updated. Ignored if viewName is not
+--			empty.
+-- For the "update" operation, the script reads the field values from the main
+-- hash of each model and adds the id to the sorted set for each view if the
+-- model matches all of the filters for the view, or removes it otherwise.
+-- Models which no longer exist are removed from all the views. Ids are added
+-- with a score of 0, so the ids in a view are in lexicographical order. Since
+-- the views are read from viewsKey whenever the script runs, views which were
+-- defined by other processes are always kept up to date.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local viewsKey = ARGV[2]
+local viewName = ARGV[3]
+local op = ARGV[4]
+local idsKind = ARGV[5]
+local idsArg = ARGV[6]
+local changedFields = {}
+for i = 7, #ARGV do
+	changedFields[ARGV[i]] = true
+end
+-- dependsOnChangedFields returns true iff whether or not a model is in view may
+-- change when the changed fields change.
+local function dependsOnChangedFields(view)
+	if #view.filters == 0 then
+		return true
+	end
+	for _, filter in ipairs(view.filters) do
+		if changedFields[filter.field] then
+			return true
+		end
+	end
+	return false
+end
+-- Get the views to update
+local views = {}
+local definitions = {}
+if viewName == '' then
+	definitions = redis.call('HVALS', viewsKey)
+else
+	local definition = redis.call('HGET', viewsKey, viewName)
+	if definition then
+		definitions = {definition}
+	end
+end
+for _, definition in ipairs(definitions) do
+	local view = cjson.decode(definition)
+	if op ~= 'update' or viewName ~= '' or dependsOnChangedFields(view) then
+		table.insert(views, view)
+	end
+end
+if #views == 0 then
+	return 0
+end
+if op == 'clear' then
+	for _, view in ipairs(views) do
+		redis.call('DEL', view.key)
+	end
+	return 0
+end
+-- Get the ids of the models to update
+local ids = {}
+if idsKind == 'id' then
+	ids = {idsArg}
+else
+	local idsType = redis.call('TYPE', idsArg)['ok']
+	if idsType == 'zset' then
+		ids = redis.call('ZRANGE', idsArg, 0, -1)
+	elseif idsType == 'set' then
+		ids = redis.call('SMEMBERS', idsArg)
+	elseif idsType == 'list' then
+		ids = redis.call('LRANGE', idsArg, 0, -1)
+	end
+end
+if op == 'delete' then
+	for _, id in ipairs(ids) do
+		for _, view in ipairs(views) do
+			redis.call('ZREM', view.key, id)
+		end
+	end
+	return #ids
+end
+-- encodeInteger converts the decimal representation of an integer into the
+-- form that is stored in integer indexes, which sorts lexicographically in the
+-- same order as the integers themselves. See encodeIntegerString in
+-- integer_index.go.
+local function encodeInteger(s)
+	if string.sub(s, 1, 1) == '-' then
+		local digits = string.sub(s, 2)
+		local complement = string.gsub(digits, '%d', function(d)
+			return tostring(9 - tonumber(d))
+		end)
+		return 'n' .. string.format('%02d', 99 - #digits) .. complement
+	end
+	return 'p' .. string.format('%02d', #s) .. s
+end
+-- compareStrings compares two strings byte by byte, which is the same way
+-- Redis compares strings in string indexes. It returns -1, 0, or 1.
+local function compareStrings(a, b)
+	if a == b then
+		return 0
+	end
+	local n = math.min(#a, #b)
+	for i = 1, n do
+		local ca = string.byte(a, i)
+		local cb = string.byte(b, i)
+		if ca ~= cb then
+			if ca < cb then
+				return -1
+			end
+			return 1
+		end
+	end
+	if #a < #b then
+		return -1
+	end
+	return 1
+end
+-- compare compares value to filterValue using the given kind of comparison. It
+-- returns -1, 0, or 1, or nil if value cannot be compared.
+local function compare(value, kind, filterValue)
+	if kind == 'number' then
+		value = tonumber(value)
+		if value == nil then
+			return nil
+		end
+		filterValue = tonumber(filterValue)
+		if value < filterValue then
+			return -1
+		elseif value > filterValue then
+			return 1
+		end
+		return 0
+	elseif kind == 'integer' then
+		if not string.match(value, '^%-?%d+$') then
+			return nil
+		end
+		return compareStrings(encodeInteger(value), filterValue)
+	end
+	return compareStrings(value, filterValue)
+end
+-- matches returns true iff value, which is the value of the field in the main
+-- hash (or false if the field does not exist), matches the filter
+local function matches(value, filter)
+	if filter.op == 'is' then
+		return value == 'NULL'
+	end
+	if value == false or (filter.pointer and value == 'NULL') then
+		return false
+	end
+	if filter.op == 'is not' then
+		return true
+	elseif filter.op == 'in' then
+		for _, filterValue in ipairs(filter.values) do
+			if compare(value, filter.kind, filterValue) == 0 then
+				return true
+			end
+		end
+		return false
+	end
+	local cmp = compare(value, filter.kind, filter.values[1])
+	if cmp == nil then
+		return false
+	end
+	if filter.op == '=' then
+		return cmp == 0
+	elseif filter.op == '!=' then
+		return cmp ~= 0
+	elseif filter.op == '>' then
+		return cmp > 0
+	elseif filter.op == '<' then
+		return cmp < 0
+	elseif filter.op == '>=' then
+		return cmp >= 0
+	elseif filter.op == '<=' then
+		return cmp <= 0
+	end
+	return false
+end
+for _, id in ipairs(ids) do
+	local modelKey = collectionName .. ':' .. id
+	local exists = redis.call('EXISTS', modelKey) == 1
+	for _, view in ipairs(views) do
+		local isMatch = exists
+		if isMatch then
+			for _, filter in ipairs(view.filters) do
+				if not matches(redis.call('HGET', modelKey, filter.field), filter) then
+					isMatch = false
+					break
+				end
+			end
+		end
+		if isMatch then
+			redis.call('ZADD', view.key, 0, id)
+		else
+			redis.call('ZREM', view.key, id)
+		end
+	end
+end
+return #ids
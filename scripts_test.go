@@ -127,12 +127,15 @@ func TestExtractIDsFromFieldIndexScript(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
 
-	// Create and save some test models with increasing Int values
-	models := createIndexedTestModels(5)
+	// Create and save some test models with increasing Int32 values. (Int is
+	// stored in an integer index, which is not a numeric index.)
+	models := []*indexedPrimativesModel{}
 	tx := testPool.NewTransaction()
-	for i, model := range models {
-		model.Int = i
-		tx.Save(indexedTestModels, model)
+	for i := 0; i < 5; i++ {
+		model := createIndexedPrimativesModel()
+		model.Int32 = int32(i)
+		models = append(models, model)
+		tx.Save(indexedPrimativesModels, model)
 	}
 	if err := tx.Exec(); err != nil {
 		t.Errorf("Unexpected error saving models in tx.Exec: %s", err.Error())
@@ -162,7 +165,7 @@ func TestExtractIDsFromFieldIndexScript(t *testing.T) {
 	}
 
 	// Run the script for each test case and check the result
-	fieldIndexKey, _ := indexedTestModels.FieldIndexKey("Int")
+	fieldIndexKey, _ := indexedPrimativesModels.FieldIndexKey("Int32")
 	for i, tc := range testCases {
 		gotIDs := []string{}
 		destKey := "TestExtractIDsFromFieldIndexScript:" + strconv.Itoa(i)
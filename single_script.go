@@ -0,0 +1,133 @@
+// File single_script.go contains code for running a query as a single Lua
+// script.
+
+package kvmodel
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// SingleScript causes the query to be run as a single Lua script. See the
+// documentation for Query.SingleScript for more information.
+func (q *query) SingleScript() {
+	q.singleScript = true
+}
+
+// runQueryArgs returns the arguments for the run_query script which will find
+// the models that match the query criteria and return the values for the
+// fields identified by redisFieldNames (followed by the id) for each of them.
+// limit overrides the limit for the query. If countOnly is true, the script
+// will only return the number of matching models.
+func (q *query) runQueryArgs(redisFieldNames []string, limit uint, countOnly bool) (redis.Args, error) {
+	indexedFilters, scanFilters := q.splitFilters()
+	if err := q.checkScanFilters(scanFilters); err != nil {
+		return nil, err
+	}
+	orderKind, orderKey := "", ""
+	if q.hasOrder() {
+		fieldSpec := q.collection.spec.fieldsByName[q.order.fieldName]
+		switch fieldSpec.indexKind {
+		case geoIndex:
+			if !q.hasGeoSearch() {
+				return nil, fmt.Errorf("zoom: error in Query.Order: ordering by the geo indexed field %s requires Query.Near or Query.WithinBox", q.order.fieldName)
+			}
+			orderKind = "geo"
+		case stringIndex, integerIndex:
+			orderKind = "lex"
+		case noIndex:
+			// Sort by the values in the main hash, like SORT BY does
+			orderKind = "field"
+			if typeIsString(fieldSpec.typ) {
+				orderKind = "alpha"
+			}
+			orderKey = fieldSpec.redisName
+		default:
+			orderKind = "score"
+		}
+		if orderKind == "score" || orderKind == "lex" {
+			fieldIndexKey, err := q.collection.spec.fieldIndexKey(q.order.fieldName)
+			if err != nil {
+				return nil, err
+			}
+			orderKey = fieldIndexKey
+		}
+	}
+	args := redis.Args{
+		q.collection.Name(),
+		q.collection.spec.indexKey(),
+		orderKind,
+		orderKey,
+		convertBoolToInt(q.order.kind == descendingOrder),
+		q.offset,
+		limit,
+		convertBoolToInt(countOnly),
+		len(redisFieldNames),
+	}
+	args = args.AddFlat(redisFieldNames)
+	if q.hasGeoSearch() {
+		gs := q.geoSearch
+		geoIndexKey, err := q.collection.spec.fieldIndexKey(gs.fieldSpec.name)
+		if err != nil {
+			return nil, err
+		}
+		geoArgs := append(redis.Args{geoIndexKey, gs.lon, gs.lat}, gs.shapeArgs()...)
+		args = append(args, len(geoArgs))
+		args = append(args, geoArgs...)
+	} else {
+		args = append(args, 0)
+	}
+	// The view and the sets from Within and Excluding are treated as indexed
+	// filters
+	setArgs := redis.Args{}
+	numSets := 0
+	if q.view != nil {
+		setArgs = append(setArgs, "zset", q.view.key, 0)
+		numSets++
+	}
+	for _, setKey := range q.withinKeys {
+		setArgs = append(setArgs, "within", setKey, 0)
+		numSets++
+	}
+	for _, setKey := range q.excludedKeys {
+		setArgs = append(setArgs, "excluding", setKey, 0)
+		numSets++
+	}
+	args = append(args, len(indexedFilters)+numSets)
+	args = append(args, setArgs...)
+	for _, filter := range indexedFilters {
+		filterArgs, err := q.indexedFilterArgs(filter)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, filterArgs...)
+	}
+	return append(args, scanFilterArgs(scanFilters)...), nil
+}
+
+// indexedFilterArgs converts filter, which should be a filter on an indexed
+// field, into the arguments expected by the run_query script.
+func (q *query) indexedFilterArgs(filter filter) (redis.Args, error) {
+	if filter.op == isNullOp {
+		nullSetKey, err := q.collection.spec.fieldNullSetKey(filter.fieldSpec.name)
+		if err != nil {
+			return nil, err
+		}
+		return redis.Args{"set", nullSetKey, 0}, nil
+	}
+	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
+	if err != nil {
+		return nil, err
+	}
+	kind := "score"
+	if filter.fieldSpec.hasLexIndex() {
+		kind = "lex"
+	}
+	ranges := filter.indexRanges()
+	args := redis.Args{kind, fieldIndexKey, len(ranges)}
+	for _, r := range ranges {
+		args = append(args, r.min, r.max)
+	}
+	return args, nil
+}
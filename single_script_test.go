@@ -0,0 +1,136 @@
+// File single_script_test.go tests running queries as a single Lua script
+// (single_script.go)
+
+package kvmodel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// singleScriptQuery returns a copy of q which is run as a single script.
+func singleScriptQuery(q *Query) *Query {
+	copy := *q.query
+	copy.singleScript = true
+	return &Query{query: &copy}
+}
+
+// expectSameResults runs q both normally and as a single script, and checks
+// that the ids and counts are the same. If ordered is true, the ids must also
+// be in the same order.
+func expectSameResults(t *testing.T, q *Query, ordered bool) {
+	expectedIDs, err := q.IDs()
+	require.NoError(t, err, "Unexpected error for query %s", q)
+	sq := singleScriptQuery(q)
+	gotIDs, err := sq.IDs()
+	require.NoError(t, err, "Unexpected error for query %s", sq)
+	if ordered {
+		assert.Equal(t, expectedIDs, gotIDs, "Wrong ids for query %s", sq)
+	} else {
+		assert.ElementsMatch(t, expectedIDs, gotIDs, "Wrong ids for query %s", sq)
+	}
+	expectedCount, err := q.Count()
+	require.NoError(t, err)
+	gotCount, err := sq.Count()
+	require.NoError(t, err)
+	assert.Equal(t, expectedCount, gotCount, "Wrong count for query %s", sq)
+	checkForLeakedTmpKeys(t, sq.query)
+}
+
+func TestSingleScriptPointers(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	tx := testPool.NewTransaction()
+	for i := 0; i < 12; i++ {
+		model := createIndexedPointersModel()
+		if i%2 == 0 {
+			model.Int = nil
+		}
+		if i%3 == 0 {
+			model.String = nil
+		}
+		tx.Save(indexedPointersModels, model)
+	}
+	require.NoError(t, tx.Exec())
+
+	queries := []*Query{
+		indexedPointersModels.NewQuery().IsNull("Int"),
+		indexedPointersModels.NewQuery().IsNotNull("String").Order("-Int"),
+		indexedPointersModels.NewQuery().IsNotNull("Int").Filter("Bool =", true).Order("String"),
+		indexedPointersModels.NewQuery().Filter("Uint8 in", []uint8{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}).Order("Uint8"),
+		indexedPointersModels.NewQuery().Filter("String !=", "a").Filter("Float64 >", 100.0).Order("-Float64").Offset(1).Limit(3),
+	}
+	for _, q := range queries {
+		expectSameResults(t, q, q.hasOrder())
+	}
+}
+
+func TestSingleScriptAllowScan(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	_, err := createAndSaveTestModels(10)
+	require.NoError(t, err)
+	queries := []*Query{
+		testModels.NewQuery().Filter("Int >", 50).AllowScan(),
+		testModels.NewQuery().AllowScan().Filter("Bool =", true).Filter("String <=", "m").Limit(2),
+	}
+	for _, q := range queries {
+		expectSameResults(t, q, false)
+	}
+	// Without AllowScan, filters on unindexed fields should return an error.
+	_, err = testModels.NewQuery().Filter("Int >", 50).SingleScript().IDs()
+	assert.Error(t, err)
+}
+
+func TestSingleScriptGeo(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createAndSaveGeoTestModels(t)
+	sf := models[0].Location
+	queries := []*Query{
+		geoTestModels.NewQuery().Near(sf.Lat, sf.Lon, 100, "km").Order("Location"),
+		geoTestModels.NewQuery().Near(sf.Lat, sf.Lon, 1000, "km").Order("-Location").Limit(2),
+		geoTestModels.NewQuery().WithinBox(sf.Lat, sf.Lon, 150, 150, "km").Filter("Name !=", "Oakland").Order("Name"),
+	}
+	for _, q := range queries {
+		expectSameResults(t, q, true)
+	}
+	got := []*geoTestModel{}
+	require.NoError(t, geoTestModels.NewQuery().Near(sf.Lat, sf.Lon, 100, "km").Order("Location").SingleScript().Run(&got))
+	assert.Equal(t, models[:3], got)
+	_, err := geoTestModels.NewQuery().Order("Location").SingleScript().IDs()
+	assert.Error(t, err)
+}
+
+func TestSingleScriptRun(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	require.NoError(t, err)
+
+	// Include should only read the given fields.
+	q := indexedTestModels.NewQuery().Filter("Int >", 0).Order("-Int").Include("Int").SingleScript()
+	expected := applyIncludes(expectedResultsForQuery(q.query, models), []string{"Int"})
+	got := []*indexedTestModel{}
+	require.NoError(t, q.Run(&got))
+	assert.Equal(t, expected, got)
+
+	// RunOne should return the first matching model.
+	one := &indexedTestModel{}
+	require.NoError(t, indexedTestModels.NewQuery().Order("Int").Offset(2).SingleScript().RunOne(one))
+	assert.Equal(t, expectedResultsForQuery(indexedTestModels.NewQuery().Order("Int").query, models)[2], one)
+	err = indexedTestModels.NewQuery().Filter("Int <", -1000).SingleScript().RunOne(one)
+	assert.IsType(t, ModelNotFoundError{}, err)
+
+	// The whole query should be a single step.
+	steps, err := q.Explain()
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	assert.Equal(t, runQueryScript.Hash(), steps[0].ScriptHash)
+}
@@ -0,0 +1,227 @@
+// File subscribe.go contains code related to subscriptions, which receive the
+// change events for a collection in near real time with Redis Pub/Sub.
+
+package kvmodel
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// minSubscribeRetryInterval and maxSubscribeRetryInterval are the minimum
+	// and maximum amounts of time that a subscription waits between attempts
+	// to reconnect.
+	minSubscribeRetryInterval = 10 * time.Millisecond
+	maxSubscribeRetryInterval = time.Second
+)
+
+// changeMessage is the format of the change events which are published with
+// PUBLISH. It is encoded as JSON. The events for Delete, DeleteAll,
+// Query.Delete, and Query.Update are published by the add_change_events
+// script, which sets the id in a copy of the encoded message for each model.
+type changeMessage struct {
+	Collection string            `json:"collection"`
+	ID         string            `json:"id"`
+	Operation  ChangeOperation   `json:"op"`
+	Fields     []string          `json:"fields,omitempty"`
+	Values     map[string][]byte `json:"values,omitempty"`
+}
+
+// ChangesChannel returns the name of the channel which the change events for
+// the collection are published to. It is only used if the PublishChanges
+// option was set for the collection.
+func (c *Collection) ChangesChannel() string {
+	return c.Name() + ":events"
+}
+
+// publishChangeEvent adds a command to the transaction which publishes ev to
+// the channel for the collection.
+func (t *Transaction) publishChangeEvent(c *Collection, ev ChangeEvent) {
+	data, err := json.Marshal(changeMessage{
+		Collection: ev.Collection,
+		ID:         ev.ID,
+		Operation:  ev.Operation,
+		Fields:     ev.Fields,
+		Values:     ev.Values,
+	})
+	if err != nil {
+		t.setError(fmt.Errorf("zoom: error publishing change event: %s", err.Error()))
+		return
+	}
+	t.Command("PUBLISH", redis.Args{c.ChangesChannel(), data}, nil)
+}
+
+// Subscription receives the change events which are published for a
+// collection. Use Collection.Subscribe to create one.
+type Subscription struct {
+	collection  *Collection
+	handler     func(ev ChangeEvent)
+	onReconnect func()
+	mutex       sync.Mutex
+	conn        redis.PubSubConn
+	closed      bool
+	closing     chan struct{}
+	done        chan struct{}
+}
+
+// Subscribe starts receiving the change events for the collection, which must
+// have the PublishChanges option set. handler is called for each event, one at
+// a time, on a goroutine which is owned by the subscription. Subscribe
+// returns once the subscription is active, so any change made after that will
+// be received.
+//
+// The subscription uses its own connection from the pool. If the connection
+// is lost, the subscription automatically reconnects with a new connection
+// from Pool.NewConn, retrying with a backoff until it succeeds or Close is
+// called. Since Pub/Sub does not store messages, any events which are
+// published while the subscription is reconnecting are lost. Use a change
+// stream (see CollectionOptions.ChangeStream) if every event must be
+// processed. Messages which cannot be decoded are ignored.
+func (c *Collection) Subscribe(handler func(ev ChangeEvent)) (*Subscription, error) {
+	if c == nil {
+		return nil, newNilCollectionError("Subscribe")
+	}
+	return c.subscribe(handler, nil)
+}
+
+// subscribe does the work for Subscribe. If onReconnect is not nil, it is
+// called each time the subscription reconnects.
+func (c *Collection) subscribe(handler func(ev ChangeEvent), onReconnect func()) (*Subscription, error) {
+	if !c.changeStream.publish {
+		return nil, fmt.Errorf("zoom: error in Subscribe: the PublishChanges option is not set for collection %s", c.Name())
+	}
+	s := &Subscription{
+		collection:  c,
+		handler:     handler,
+		onReconnect: onReconnect,
+		closing:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	psc, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	go s.run(psc)
+	return s, nil
+}
+
+// Close stops the subscription and returns its connection to the pool. It
+// waits until the handler has returned if it is currently running, so it must
+// not be called from inside the handler.
+func (s *Subscription) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.closing)
+	// Unsubscribing causes the goroutine for the subscription to stop once
+	// Redis confirms it. If the connection was lost, there is nothing to
+	// unsubscribe from, and the goroutine stops without reconnecting.
+	_ = s.conn.Unsubscribe()
+	s.mutex.Unlock()
+	<-s.done
+	return nil
+}
+
+// connect gets a new connection from the pool and subscribes to the channel
+// for the collection. It waits for Redis to confirm the subscription.
+func (s *Subscription) connect() (redis.PubSubConn, error) {
+	psc := redis.PubSubConn{Conn: s.collection.pool.NewConn()}
+	if err := psc.Subscribe(s.collection.ChangesChannel()); err != nil {
+		_ = psc.Close()
+		return psc, err
+	}
+	for confirmed := false; !confirmed; {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			confirmed = true
+		case error:
+			_ = psc.Close()
+			return psc, v
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		_ = psc.Close()
+		return psc, fmt.Errorf("zoom: subscription was closed")
+	}
+	s.conn = psc
+	return psc, nil
+}
+
+// run receives messages with psc until the connection is lost, then
+// reconnects, until the subscription is closed.
+func (s *Subscription) run(psc redis.PubSubConn) {
+	defer close(s.done)
+	for {
+		s.receive(psc)
+		interval := minSubscribeRetryInterval
+		for {
+			select {
+			case <-s.closing:
+				return
+			case <-time.After(interval):
+			}
+			var err error
+			if psc, err = s.connect(); err == nil {
+				if s.onReconnect != nil {
+					s.onReconnect()
+				}
+				break
+			}
+			interval *= 2
+			if interval > maxSubscribeRetryInterval {
+				interval = maxSubscribeRetryInterval
+			}
+		}
+	}
+}
+
+// receive calls the handler for each change event received with psc. It
+// returns when there is a problem with the connection or the subscription was
+// closed.
+func (s *Subscription) receive(psc redis.PubSubConn) {
+	defer func() {
+		// Closing the connection writes to it, so hold the mutex to prevent
+		// Close from writing to it at the same time
+		s.mutex.Lock()
+		_ = psc.Close()
+		s.mutex.Unlock()
+	}()
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			msg := changeMessage{}
+			if err := json.Unmarshal(v.Data, &msg); err != nil {
+				continue
+			}
+			ev := ChangeEvent{
+				Collection: msg.Collection,
+				ID:         msg.ID,
+				Operation:  msg.Operation,
+				Fields:     msg.Fields,
+				Values:     msg.Values,
+				collection: s.collection,
+			}
+			if ev.Fields == nil {
+				ev.Fields = []string{}
+			}
+			s.handler(ev)
+		case redis.Subscription:
+			if v.Count == 0 {
+				// Close was called
+				return
+			}
+		case error:
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// File subscribe_test.go tests subscriptions to collection changes
+// (subscribe.go)
+
+package kvmodel
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// subscribeTestModel is a model type that is used for testing subscriptions
+type subscribeTestModel struct {
+	Int    int
+	String string
+	RandomID
+}
+
+var (
+	subscribeTestModels     *Collection
+	subscribeTestModelsOnce sync.Once
+)
+
+// getSubscribeTestModels returns a collection of subscribeTestModels with the
+// PublishChanges and ChangeStreamValues options set.
+func getSubscribeTestModels(t *testing.T) *Collection {
+	subscribeTestModelsOnce.Do(func() {
+		options := DefaultCollectionOptions.WithIndex(true).WithPublishChanges(true).WithChangeStreamValues(true)
+		var err error
+		subscribeTestModels, err = testPool.NewCollectionWithOptions(&subscribeTestModel{}, options)
+		require.NoError(t, err)
+	})
+	return subscribeTestModels
+}
+
+// expectChangeEvent waits for an event to be received on events and returns
+// it, or fails the test if none is received within a second.
+func expectChangeEvent(t *testing.T, events chan ChangeEvent) ChangeEvent {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for change event")
+		return ChangeEvent{}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	collection := getSubscribeTestModels(t)
+
+	events := make(chan ChangeEvent, 10)
+	s, err := collection.Subscribe(func(ev ChangeEvent) {
+		events <- ev
+	})
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+
+	model := &subscribeTestModel{Int: 42, String: "foo"}
+	require.NoError(t, collection.Save(model))
+	ev := expectChangeEvent(t, events)
+	assert.Equal(t, collection.Name(), ev.Collection)
+	assert.Equal(t, model.ID, ev.ID)
+	assert.Equal(t, ChangeSave, ev.Operation)
+	assert.Equal(t, []string{"Int", "String"}, ev.Fields)
+	got := &subscribeTestModel{}
+	require.NoError(t, ev.Decode(got))
+	assert.Equal(t, model, got)
+
+	_, err = collection.Delete(model.ID)
+	require.NoError(t, err)
+	ev = expectChangeEvent(t, events)
+	assert.Equal(t, model.ID, ev.ID)
+	assert.Equal(t, ChangeDelete, ev.Operation)
+	assert.Empty(t, ev.Fields)
+
+	// Query.Update and Query.Delete should publish events in the same format
+	model.ID = ""
+	require.NoError(t, collection.Save(model))
+	expectChangeEvent(t, events)
+	_, err = collection.NewQuery().Update(map[string]interface{}{"String": "updated"})
+	require.NoError(t, err)
+	ev = expectChangeEvent(t, events)
+	assert.Equal(t, model.ID, ev.ID)
+	assert.Equal(t, ChangeSave, ev.Operation)
+	assert.Equal(t, []string{"String"}, ev.Fields)
+	got = &subscribeTestModel{}
+	require.NoError(t, ev.Decode(got))
+	assert.Equal(t, &subscribeTestModel{String: "updated", RandomID: model.RandomID}, got)
+	_, err = collection.NewQuery().Delete()
+	require.NoError(t, err)
+	ev = expectChangeEvent(t, events)
+	assert.Equal(t, model.ID, ev.ID)
+	assert.Equal(t, ChangeDelete, ev.Operation)
+
+	// Nothing should be published if the transaction fails
+	tx := testPool.NewTransaction()
+	tx.Save(collection, model)
+	tx.Save(collection, &testModel{})
+	require.Error(t, tx.Exec())
+	select {
+	case ev := <-events:
+		t.Errorf("Unexpected change event: %v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestSubscribeReconnect(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	collection := getSubscribeTestModels(t)
+
+	events := make(chan ChangeEvent, 100)
+	s, err := collection.Subscribe(func(ev ChangeEvent) {
+		events <- ev
+	})
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+
+	// Cause an error on the connection by sending a command which is not
+	// allowed while subscribed
+	s.mutex.Lock()
+	original := s.conn.Conn
+	require.NoError(t, s.conn.Conn.Send("GET", "foo"))
+	require.NoError(t, s.conn.Conn.Flush())
+	s.mutex.Unlock()
+	// Events which are published while reconnecting are lost, so keep saving
+	// the model until an event is received with a new connection. Events may
+	// still be received with the original connection before the error reply.
+	model := &subscribeTestModel{Int: 1}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		require.NoError(t, collection.Save(model))
+		select {
+		case ev := <-events:
+			assert.Equal(t, model.ID, ev.ID)
+			s.mutex.Lock()
+			reconnected := s.conn.Conn != original
+			s.mutex.Unlock()
+			if reconnected {
+				return
+			}
+		case <-time.After(20 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Subscription did not reconnect")
+		}
+	}
+}
+
+func TestSubscribeErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	_, err := testModels.Subscribe(func(ev ChangeEvent) {})
+	assert.Error(t, err)
+}
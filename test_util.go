@@ -230,11 +230,19 @@ func createIndexedPointersModel() *indexedPointersModel {
 	}
 }
 
+// geoTestModel is a model type with a geo index that is used for testing
+type geoTestModel struct {
+	Name     string    `zoom:"index"`
+	Location *GeoPoint `zoom:"index"`
+	RandomID
+}
+
 var (
 	testModels              *Collection
 	indexedTestModels       *Collection
 	indexedPrimativesModels *Collection
 	indexedPointersModels   *Collection
+	geoTestModels           *Collection
 )
 
 // registerTestingTypes registers the common types used for testing
@@ -264,6 +272,11 @@ func registerTestingTypes() {
 			model:      &indexedPointersModel{},
 			index:      true,
 		},
+		{
+			collection: &geoTestModels,
+			model:      &geoTestModel{},
+			index:      true,
+		},
 	}
 	for _, m := range testModelTypes {
 		options := DefaultCollectionOptions.WithIndex(true)
@@ -457,6 +470,8 @@ func indexExists(collection *Collection, model Model, fieldName string) (bool, e
 		typ = typ.Elem()
 	}
 	switch {
+	case fs.indexKind == integerIndex:
+		return integerIndexExists(collection, model, fieldName)
 	case typeIsNumeric(typ):
 		return numericIndexExists(collection, model, fieldName)
 	case typeIsString(typ):
@@ -537,6 +552,27 @@ func stringIndexExists(collection *Collection, model Model, fieldName string) (b
 	return reply != nil, nil
 }
 
+// integerIndexExists returns true iff an integer index on the given type and field exists.
+// It reads the current field value from model and if it is a pointer, dereferences it
+// until it reaches the underlying value.
+func integerIndexExists(collection *Collection, model Model, fieldName string) (bool, error) {
+	indexKey, err := collection.FieldIndexKey(fieldName)
+	if err != nil {
+		return false, err
+	}
+	fieldValue := reflect.ValueOf(model).Elem().FieldByName(fieldName)
+	memberKey := encodeInteger(fieldValue) + nullString + model.ModelID()
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	reply, err := conn.Do("ZRANK", indexKey, memberKey)
+	if err != nil {
+		return false, fmt.Errorf("Error in ZRANK: %s", err.Error())
+	}
+	return reply != nil, nil
+}
+
 // booleanIndexExists returns true iff a boolean index on the given type and field exists. It
 // reads the current field value from model and if it is a pointer, dereferences it until
 // it reaches the underlying value.
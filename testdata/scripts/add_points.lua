@@ -0,0 +1,3 @@
+-- add_points increments the number in the key KEYS[1] by ARGV[1] and returns
+-- the new value.
+return redis.call('INCRBY', KEYS[1], ARGV[1])
@@ -0,0 +1,2 @@
+-- get_points returns the number in the key KEYS[1], or 0 if it does not exist.
+return tonumber(redis.call('GET', KEYS[1]) or '0')
@@ -5,6 +5,8 @@ package kvmodel
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -14,10 +16,68 @@ import (
 // commands or lua scripts. Transactions feature delayed execution,
 // so nothing touches the database until you call Exec.
 type Transaction struct {
-	conn     redis.Conn
-	actions  []*Action
-	err      error
-	watching []string
+	conn       redis.Conn
+	actions    []*Action
+	err        error
+	watching   []string
+	locks      []*Lock
+	options    TransactionOptions
+	replies    []interface{}
+	pool       *Pool
+	recording  *Recording
+	onCommit   []func()
+	onRollback []func(err error)
+}
+
+// TransactionOptions contains various options for a transaction.
+type TransactionOptions struct {
+	// DetailedErrors causes Exec to wrap any error from a reply or a handler in
+	// a TransactionError, which identifies the action that caused it. Use
+	// errors.As or errors.Is to check for the underlying error (e.g. a
+	// ModelNotFoundError).
+	DetailedErrors bool
+	// CollectAllErrors causes Exec to call the handlers for all the actions,
+	// even after one of them has failed. If there were any errors, Exec returns
+	// TransactionErrors, which contains a TransactionError for each one.
+	CollectAllErrors bool
+	// DryRun causes Exec to record the actions in the transaction instead of
+	// sending them to Redis. Exec returns nil without executing anything, and
+	// the recording can be retrieved afterwards with Transaction.Recording.
+	// Transaction.ExecDryRun does the same for a single transaction and returns
+	// the recording directly. The transaction never touches the database, and
+	// none of the handlers are called, so e.g. Find does not scan any values
+	// into the model. Methods which send commands immediately instead of
+	// adding them to a transaction (e.g. Collection.Lock) are not affected.
+	DryRun bool
+}
+
+// DefaultTransactionOptions is the default set of options for a transaction.
+var DefaultTransactionOptions = TransactionOptions{
+	DetailedErrors:   false,
+	CollectAllErrors: false,
+	DryRun:           false,
+}
+
+// WithDetailedErrors returns a new copy of the options with the DetailedErrors
+// property set to the given value. It does not mutate the original options.
+func (options TransactionOptions) WithDetailedErrors(detailed bool) TransactionOptions {
+	options.DetailedErrors = detailed
+	return options
+}
+
+// WithCollectAllErrors returns a new copy of the options with the
+// CollectAllErrors property set to the given value. It does not mutate the
+// original options.
+func (options TransactionOptions) WithCollectAllErrors(collect bool) TransactionOptions {
+	options.CollectAllErrors = collect
+	return options
+}
+
+// WithDryRun returns a new copy of the options with the DryRun property set to
+// the given value. It does not mutate the original options.
+func (options TransactionOptions) WithDryRun(dryRun bool) TransactionOptions {
+	options.DryRun = dryRun
+	return options
 }
 
 // Action is a single step in a transaction and must be either a command
@@ -28,6 +88,9 @@ type Action struct {
 	script  *redis.Script
 	args    redis.Args
 	handler ReplyHandler
+	// useHash is true for scripts which should be sent with EVALSHA instead of
+	// EVAL, i.e. scripts which were registered with Pool.RegisterScript.
+	useHash bool
 }
 
 // actionKind is either a command or a script
@@ -40,8 +103,21 @@ const (
 
 // NewTransaction instantiates and returns a new transaction.
 func (p *Pool) NewTransaction() *Transaction {
+	return p.NewTransactionWithOptions(DefaultTransactionOptions)
+}
+
+// NewTransactionWithOptions instantiates and returns a new transaction with
+// the given options. If the DryRun option is set for the pool, it is also set
+// for the transaction.
+func (p *Pool) NewTransactionWithOptions(options TransactionOptions) *Transaction {
+	options.DryRun = options.DryRun || p.options.DryRun
 	t := &Transaction{
-		conn: p.NewConn(),
+		options: options,
+		pool:    p,
+	}
+	if !options.DryRun {
+		// A dry run never touches the database, so it doesn't need a connection
+		t.conn = p.NewConn()
 	}
 	return t
 }
@@ -83,6 +159,11 @@ func (t *Transaction) WatchKey(key string) error {
 	if len(t.actions) != 0 {
 		return fmt.Errorf("Cannot call WatchKey after other commands have been added to the transaction")
 	}
+	if t.options.DryRun {
+		// Only record the key
+		t.watching = append(t.watching, key)
+		return nil
+	}
 	if _, err := t.conn.Do("WATCH", key); err != nil {
 		return err
 	}
@@ -114,12 +195,90 @@ func (t *Transaction) Script(script *redis.Script, args redis.Args, handler Repl
 	})
 }
 
+// collectionName returns the name of the collection that a operates on. It is
+// determined by looking for an argument which is either the name of a
+// collection or a key which starts with the name of a collection (possibly
+// after the prefix for temporary keys) followed by a colon. It returns an empty
+// string if there is no such argument.
+func (a *Action) collectionName() string {
+	for _, arg := range a.args {
+		s, ok := arg.(string)
+		if !ok {
+			continue
+		}
+		s = strings.TrimPrefix(s, "tmp:")
+		found := ""
+		for e := collections.Front(); e != nil; e = e.Next() {
+			name := e.Value.(*Collection).Name()
+			if len(name) > len(found) && (s == name || strings.HasPrefix(s, name+":")) {
+				found = name
+			}
+		}
+		if found != "" {
+			return found
+		}
+	}
+	return ""
+}
+
+// scriptInfo contains information about a Lua script which was created with
+// newScript.
+type scriptInfo struct {
+	name     string
+	keyCount int
+	src      string
+}
+
+var (
+	// scriptInfos maps the hash of each script which was created with newScript
+	// to information about the script.
+	scriptInfos      = map[string]scriptInfo{}
+	scriptInfosMutex sync.RWMutex
+)
+
+// newScript creates and returns a new script with the given name, key count,
+// and source code, and records the information about the script so that it
+// can be identified in errors and recordings.
+func newScript(name string, keyCount int, src string) *redis.Script {
+	script := redis.NewScript(keyCount, src)
+	scriptInfosMutex.Lock()
+	scriptInfos[script.Hash()] = scriptInfo{
+		name:     name,
+		keyCount: keyCount,
+		src:      src,
+	}
+	scriptInfosMutex.Unlock()
+	return script
+}
+
+// getScriptInfo returns information about the script with the given hash and
+// true, or false if the script was not created with newScript.
+func getScriptInfo(hash string) (scriptInfo, bool) {
+	scriptInfosMutex.RLock()
+	defer scriptInfosMutex.RUnlock()
+	info, found := scriptInfos[hash]
+	return info, found
+}
+
+// scriptName returns the name of the given script, which is the name of the
+// .lua file it was read from for scripts which are part of Zoom, or "script"
+// for scripts which were not created with newScript.
+func scriptName(script *redis.Script) string {
+	if info, found := getScriptInfo(script.Hash()); found {
+		return info.name
+	}
+	return "script"
+}
+
 // sendAction writes a to a connection buffer using conn.Send()
 func (t *Transaction) sendAction(a *Action) error {
 	switch a.kind {
 	case commandAction:
 		return t.conn.Send(a.name, a.args...)
 	case scriptAction:
+		if a.useHash {
+			return a.script.SendHash(t.conn, a.args...)
+		}
 		return a.script.Send(t.conn, a.args...)
 	}
 	return nil
@@ -138,66 +297,130 @@ func (t *Transaction) doAction(a *Action) (interface{}, error) {
 }
 
 // Exec executes the transaction, sequentially sending each action and
-// calling all the action handlers with the corresponding replies.
+// calling all the action handlers with the corresponding replies. By default,
+// Exec stops at the first reply or handler which returns an error and returns
+// that error as is. See TransactionOptions for other ways of reporting errors.
+// If the DryRun option is set, Exec only records the actions and the recording
+// is returned by Recording. See also ExecDryRun.
+//
+// After the transaction has been executed, Exec calls the functions that were
+// registered with OnCommit or OnRollback. See OnCommit for more information.
 func (t *Transaction) Exec() error {
+	committed, err := t.exec()
+	t.runCallbacks(committed, err)
+	return err
+}
+
+// exec does the work for Exec. committed is true iff Redis executed the
+// actions in the transaction, even if some of the replies or handlers returned
+// errors.
+func (t *Transaction) exec() (committed bool, err error) {
 	// Return the connection to the pool when we are done
 	defer func() {
-		_ = t.conn.Close()
+		if t.conn != nil {
+			_ = t.conn.Close()
+		}
 	}()
 
 	// If the transaction had an error from a previous command, return it
 	// and don't continue
 	if t.err != nil {
-		return t.err
+		return false, t.err
+	}
+
+	if t.options.DryRun {
+		t.record(len(t.actions) != 1 || len(t.watching) > 0)
+		return false, nil
+	}
+
+	// Make sure any required locks are still held
+	if err := t.checkLocks(); err != nil {
+		return false, err
 	}
 
 	if len(t.actions) == 1 && len(t.watching) == 0 {
 		// If there is only one command and no keys being watched, no need to use
-		// MULTI/EXEC
-		a := t.actions[0]
-		reply, err := t.doAction(a)
-		if err != nil {
-			return err
+		// MULTI/EXEC. doAction falls back to EVAL if a script is missing from
+		// the script cache, but the registered scripts are still loaded the
+		// first time one of them is used.
+		if t.actions[0].useHash && !t.pool.allScriptsLoaded() {
+			if err := t.pool.loadScripts(t.conn); err != nil {
+				return false, err
+			}
 		}
-		if a.handler != nil {
-			if err := a.handler(reply); err != nil {
-				return err
+		reply, err := t.doAction(t.actions[0])
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				return false, err
 			}
+			// The reply itself was an error, which is handled the same way as
+			// an error reply inside of MULTI/EXEC
+			reply = err
 		}
+		t.replies = []interface{}{reply}
 	} else {
 		// Send all the commands and scripts at once using MULTI/EXEC
+		if err := t.loadMissingScripts(); err != nil {
+			return false, err
+		}
 		if err := t.conn.Send("MULTI"); err != nil {
-			return err
+			return false, err
 		}
 		for _, a := range t.actions {
 			if err := t.sendAction(a); err != nil {
-				return err
+				return false, err
 			}
 		}
 		// Invoke redis driver to execute the transaction
 		replies, err := redis.Values(t.conn.Do("EXEC"))
 		if err != nil {
 			if err == redis.ErrNil && len(t.watching) > 0 {
-				return WatchError{keys: t.watching}
+				return false, WatchError{keys: t.watching}
 			}
+			return false, err
+		}
+		t.replies = replies
+	}
+	return true, t.handleReplies()
+}
+
+// handleReplies iterates through the replies, calling the corresponding
+// handler functions, and returns any errors according to the options for the
+// transaction.
+func (t *Transaction) handleReplies() error {
+	errs := TransactionErrors{}
+	for i, reply := range t.replies {
+		a := t.actions[i]
+		err, isError := reply.(error)
+		if !isError && a.handler != nil {
+			err = a.handler(reply)
+		}
+		if err == nil {
+			continue
+		}
+		if !t.options.DetailedErrors && !t.options.CollectAllErrors {
 			return err
 		}
-		// Iterate through the replies, calling the corresponding handler functions
-		for i, reply := range replies {
-			a := t.actions[i]
-			if err, ok := reply.(error); ok {
-				return err
-			}
-			if a.handler != nil {
-				if err := a.handler(reply); err != nil {
-					return err
-				}
-			}
+		txErr := newTransactionError(i, a, err)
+		if !t.options.CollectAllErrors {
+			return txErr
 		}
+		errs = append(errs, txErr)
+	}
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
 
+// Replies returns the raw replies from Redis for each action in the
+// transaction, in the order the actions were added. It is intended for
+// debugging and is only set after Exec has received the replies. Error
+// replies are included as redis.Error values.
+func (t *Transaction) Replies() []interface{} {
+	return t.replies
+}
+
 //go:generate go run scripts/main.go
 
 // DeleteModelsBySetIDs is a small function wrapper around a Lua script. The
@@ -242,3 +465,119 @@ func (t *Transaction) ExtractIDsFromFieldIndex(setKey string, destKey string, mi
 func (t *Transaction) ExtractIDsFromStringIndex(setKey, destKey, min, max string) {
 	t.Script(extractIdsFromStringIndexScript, redis.Args{setKey, destKey, min, max}, nil)
 }
+
+// aggregateField is a small function wrapper around a Lua script. The script
+// will compute the given aggregate (one of "sum", "avg", "min", or "max") over
+// the values of the numeric field identified by fieldName for all the model ids
+// in the set, sorted set, or list identified by idsKey. If fieldIndexKey is not
+// empty, the values are read from the scores of the numeric index identified by
+// fieldIndexKey. Otherwise they are read from the main hash of each model.
+// fieldName should be the name as it is stored in Redis.
+func (t *Transaction) aggregateField(idsKey, collectionName, fieldName, fieldIndexKey, aggregate string, handler ReplyHandler) {
+	t.Script(aggregateFieldScript, redis.Args{idsKey, collectionName, fieldName, fieldIndexKey, aggregate}, handler)
+}
+
+// groupCount is a small function wrapper around a Lua script. The script will
+// count the number of model ids in the set, sorted set, or list identified by
+// idsKey for each distinct value in the field index identified by
+// fieldIndexKey. indexKind should be "string" if the field index is a string
+// index, "integer" if it is an integer index, and "score" if it is a numeric or
+// boolean index. fieldName is the name of the field as it is stored in Redis,
+// and nullSetKey is the key of the null set for the field, or an empty string
+// if it does not have one. The reply is an array of alternating values and
+// counts.
+func (t *Transaction) groupCount(idsKey, fieldIndexKey, indexKind, collectionName, fieldName, nullSetKey string, handler ReplyHandler) {
+	t.Script(groupCountScript, redis.Args{idsKey, fieldIndexKey, indexKind, collectionName, fieldName, nullSetKey}, handler)
+}
+
+// deleteModelsByIDs is a small function wrapper around a Lua script. The
+// script will atomically delete the models corresponding to the ids in the set,
+// sorted set, or list identified by idsKey, including any field indexes and
+// views. viewsKey is the key of the hash which stores the filters for the views
+// of the collection. indexArgs should consist of pairs of the Redis name of
+// each indexed field and either "string" or "score", depending on the kind of
+// the index. The reply is the number of models that were deleted.
+func (t *Transaction) deleteModelsByIDs(idsKey, collectionName, viewsKey string, indexArgs redis.Args, handler ReplyHandler) {
+	t.Script(deleteModelsByIdsScript, append(redis.Args{idsKey, collectionName, viewsKey}, indexArgs...), handler)
+}
+
+// updateModelsByIDs is a small function wrapper around a Lua script. The
+// script will atomically set the given fields for each of the models
+// corresponding to the ids in the set, sorted set, or list identified by
+// idsKey and update the field indexes. See scripts/update_models_by_ids.lua
+// for a description of fieldArgs. The reply is the number of models that were
+// updated.
+func (t *Transaction) updateModelsByIDs(idsKey, collectionName string, fieldArgs redis.Args, handler ReplyHandler) {
+	t.Script(updateModelsByIdsScript, append(redis.Args{idsKey, collectionName}, fieldArgs...), handler)
+}
+
+// filterIDsByFieldValues is a small function wrapper around a Lua script. The
+// script will read the field values from the main hash of each model in the
+// set or sorted set identified by idsKey and store the ids of the models which
+// match all the filters in a sorted set identified by destKey. See
+// scripts/filter_ids_by_field_values.lua for a description of filterArgs.
+func (t *Transaction) filterIDsByFieldValues(idsKey, destKey, collectionName string, filterArgs redis.Args) {
+	t.Script(filterIdsByFieldValuesScript, append(redis.Args{idsKey, destKey, collectionName}, filterArgs...), nil)
+}
+
+// updateViews is a small function wrapper around a Lua script. The script will
+// read the filters for the views from the hash identified by viewsKey and
+// apply op ("update", "delete", or "clear") to each of the models identified
+// by ids and the view identified by viewName (or all the views if viewName is
+// empty). idsKind should be "id" if ids is a single model id, or "key" if ids
+// is the key of a set, sorted set, or list of ids. fieldNames are the names of
+// the fields which changed as they are stored in Redis. See
+// scripts/update_views.lua for more details.
+func (t *Transaction) updateViews(collectionName, viewsKey, viewName, op, idsKind, ids string, fieldNames []string) {
+	args := redis.Args{collectionName, viewsKey, viewName, op, idsKind, ids}.AddFlat(fieldNames)
+	t.Script(updateViewsScript, args, nil)
+}
+
+// deleteIntegerIndex is a small function wrapper around a Lua script. The
+// script will remove the model with the given id from the integer index on the
+// field identified by fieldName, using the old value stored in the main hash.
+// fieldName should be the name as it is stored in Redis.
+func (t *Transaction) deleteIntegerIndex(collectionName, modelID, fieldName string) {
+	t.Script(deleteIntegerIndexScript, redis.Args{collectionName, modelID, fieldName}, nil)
+}
+
+// extractIDsFromGeoIndex is a small function wrapper around a Lua script. The
+// script will search the geo index identified by setKey with GEOSEARCH, using
+// the given center and shapeArgs (e.g. "BYRADIUS", 10, "km"), and then store
+// the resulting ids in a sorted set identified by destKey. The score of each
+// id is its distance from the center, in the unit given in shapeArgs.
+func (t *Transaction) extractIDsFromGeoIndex(setKey, destKey string, lon, lat float64, shapeArgs redis.Args) {
+	t.Script(extractIdsFromGeoIndexScript, append(redis.Args{setKey, destKey, lon, lat}, shapeArgs...), nil)
+}
+
+// runQuery is a small function wrapper around a Lua script. The script will
+// find the models which match a query in memory, without creating any
+// temporary keys, and return either the number of matching models or the
+// values of the requested fields followed by the id for each of them. See
+// scripts/run_query.lua for a description of args.
+func (t *Transaction) runQuery(args redis.Args, handler ReplyHandler) {
+	t.Script(runQueryScript, args, handler)
+}
+
+// leaderboard is a small function wrapper around a Lua script. The script will
+// perform a leaderboard operation (e.g. finding the rank of a model) using the
+// sorted set for a numeric or integer field index. See scripts/leaderboard.lua
+// for a description of args.
+func (t *Transaction) leaderboard(args redis.Args, handler ReplyHandler) {
+	t.Script(leaderboardScript, args, handler)
+}
+
+// unlock is a small function wrapper around a Lua script. The script will
+// delete the lock identified by lockKey iff it still has the given token. The
+// reply is 1 if the lock was deleted and 0 otherwise.
+func (t *Transaction) unlock(lockKey, token string, handler ReplyHandler) {
+	t.Script(unlockScript, redis.Args{lockKey, token}, handler)
+}
+
+// extendLock is a small function wrapper around a Lua script. The script will
+// set the time to live of the lock identified by lockKey to ttl milliseconds
+// iff it still has the given token. The reply is 1 if the time to live was set
+// and 0 otherwise.
+func (t *Transaction) extendLock(lockKey, token string, ttl int64, handler ReplyHandler) {
+	t.Script(extendLockScript, redis.Args{lockKey, token, ttl}, handler)
+}
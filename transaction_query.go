@@ -85,6 +85,62 @@ func (q *TransactionQuery) Filter(filterString string, value interface{}) *Trans
 	return q
 }
 
+// IsNull works exactly like Query.IsNull. See the documentation for
+// Query.IsNull for more information.
+func (q *TransactionQuery) IsNull(fieldName string) *TransactionQuery {
+	q.query.IsNull(fieldName)
+	return q
+}
+
+// IsNotNull works exactly like Query.IsNotNull. See the documentation for
+// Query.IsNotNull for more information.
+func (q *TransactionQuery) IsNotNull(fieldName string) *TransactionQuery {
+	q.query.IsNotNull(fieldName)
+	return q
+}
+
+// Near works exactly like Query.Near. See the documentation for Query.Near for
+// more information.
+func (q *TransactionQuery) Near(lat, lon, radius float64, unit string) *TransactionQuery {
+	q.query.Near(lat, lon, radius, unit)
+	return q
+}
+
+// WithinBox works exactly like Query.WithinBox. See the documentation for
+// Query.WithinBox for more information.
+func (q *TransactionQuery) WithinBox(lat, lon, width, height float64, unit string) *TransactionQuery {
+	q.query.WithinBox(lat, lon, width, height, unit)
+	return q
+}
+
+// Within works exactly like Query.Within. See the documentation for
+// Query.Within for a full description.
+func (q *TransactionQuery) Within(setKey string) *TransactionQuery {
+	q.query.Within(setKey)
+	return q
+}
+
+// Excluding works exactly like Query.Excluding. See the documentation for
+// Query.Excluding for a full description.
+func (q *TransactionQuery) Excluding(setKey string) *TransactionQuery {
+	q.query.Excluding(setKey)
+	return q
+}
+
+// AllowScan works exactly like Query.AllowScan. See the documentation for
+// Query.AllowScan for more information.
+func (q *TransactionQuery) AllowScan() *TransactionQuery {
+	q.query.AllowScan()
+	return q
+}
+
+// SingleScript works exactly like Query.SingleScript. See the documentation for
+// Query.SingleScript for more information.
+func (q *TransactionQuery) SingleScript() *TransactionQuery {
+	q.query.SingleScript()
+	return q
+}
+
 // Run will run the query and scan the results into models when the Transaction
 // is executed. It works very similarly to Query.Run, so you can check the
 // documentation for Query.Run for more information. The first error encountered
@@ -99,6 +155,15 @@ func (q *TransactionQuery) Run(models interface{}) {
 		q.tx.setError(err)
 		return
 	}
+	if q.singleScript {
+		args, err := q.runQueryArgs(q.redisFieldNames(), q.limit, false)
+		if err != nil {
+			q.tx.setError(err)
+			return
+		}
+		q.tx.runQuery(args, newScanModelsHandler(q.collection.spec, append(q.fieldNames(), "-"), models))
+		return
+	}
 	idsKey, tmpKeys, err := generateIDsSet(q.query, q.tx)
 	if err != nil {
 		q.tx.setError(err)
@@ -110,7 +175,7 @@ func (q *TransactionQuery) Run(models interface{}) {
 		// But in redis, -1 means unlimited
 		limit = -1
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, q.redisFieldNames(), limit, q.offset, q.order.kind == descendingOrder)
+	sortArgs := q.collection.spec.sortArgs(idsKey, q.sortByField(), q.redisFieldNames(), limit, q.offset, q.order.kind == descendingOrder)
 	q.tx.Command("SORT", sortArgs, newScanModelsHandler(q.collection.spec, append(q.fieldNames(), "-"), models))
 	if len(tmpKeys) > 0 {
 		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
@@ -133,12 +198,21 @@ func (q *TransactionQuery) RunOne(model Model) {
 		q.tx.setError(err)
 		return
 	}
+	if q.singleScript {
+		args, err := q.runQueryArgs(q.redisFieldNames(), 1, false)
+		if err != nil {
+			q.tx.setError(err)
+			return
+		}
+		q.tx.runQuery(args, newScanOneModelHandler(q.query, q.collection.spec, append(q.fieldNames(), "-"), model))
+		return
+	}
 	idsKey, tmpKeys, err := generateIDsSet(q.query, q.tx)
 	if err != nil {
 		q.tx.setError(err)
 		return
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, q.redisFieldNames(), 1, q.offset, q.order.kind == descendingOrder)
+	sortArgs := q.collection.spec.sortArgs(idsKey, q.sortByField(), q.redisFieldNames(), 1, q.offset, q.order.kind == descendingOrder)
 	q.tx.Command("SORT", sortArgs, newScanOneModelHandler(q.query, q.collection.spec, append(q.fieldNames(), "-"), model))
 	if len(tmpKeys) > 0 {
 		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
@@ -156,9 +230,14 @@ func (q *TransactionQuery) Count(count *int) {
 		q.tx.setError(q.err)
 		return
 	}
-	if !q.hasFilters() {
-		// Start by getting the number of models in the all index set
-		q.tx.Command("SCARD", redis.Args{q.collection.spec.indexKey()}, func(reply interface{}) error {
+	if !q.hasFilters() && !q.hasGeoSearch() && !q.hasSetRestrictions() {
+		// Start by getting the number of models in the all index set (or the
+		// view, if any)
+		command, key := "SCARD", q.collection.spec.indexKey()
+		if q.view != nil {
+			command, key = "ZCARD", q.view.key
+		}
+		q.tx.Command(command, redis.Args{key}, func(reply interface{}) error {
 			gotCount, err := redis.Int(reply, nil)
 			if err != nil {
 				return err
@@ -174,13 +253,22 @@ func (q *TransactionQuery) Count(count *int) {
 			(*count) = gotCount
 			return nil
 		})
+	} else if q.singleScript {
+		// The script counts the matching models without storing them anywhere.
+		args, err := q.runQueryArgs(nil, q.limit, true)
+		if err != nil {
+			q.tx.setError(err)
+			return
+		}
+		q.tx.runQuery(args, NewScanIntHandler(count))
 	} else {
 		// If the query has filters, it is difficult to do any optimizations.
 		// Instead we'll just count the number of ids that match the query
 		// criteria. To do in a single transaction, we use the StoreIDs method and
 		// then add a LLEN command.
-		destKey := generateRandomKey("tmp:countDestKey")
+		destKey := q.tmpKey("count")
 		q.StoreIDs(destKey)
+		q.expireTmpKey(q.tx, destKey)
 		q.tx.Command("LLEN", redis.Args{destKey}, NewScanIntHandler(count))
 		// Delete the temporary destKey when we're done.
 		q.tx.Command("DEL", redis.Args{destKey}, nil)
@@ -197,6 +285,15 @@ func (q *TransactionQuery) IDs(ids *[]string) {
 		q.tx.setError(q.err)
 		return
 	}
+	if q.singleScript {
+		args, err := q.runQueryArgs(nil, q.limit, false)
+		if err != nil {
+			q.tx.setError(err)
+			return
+		}
+		q.tx.runQuery(args, NewScanStringsHandler(ids))
+		return
+	}
 	idsKey, tmpKeys, err := generateIDsSet(q.query, q.tx)
 	if err != nil {
 		q.tx.setError(err)
@@ -207,7 +304,7 @@ func (q *TransactionQuery) IDs(ids *[]string) {
 		// But in redis, -1 means unlimited
 		limit = -1
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, nil, limit, q.offset, q.order.kind == descendingOrder)
+	sortArgs := q.collection.spec.sortArgs(idsKey, q.sortByField(), nil, limit, q.offset, q.order.kind == descendingOrder)
 	q.tx.Command("SORT", sortArgs, NewScanStringsHandler(ids))
 	if len(tmpKeys) > 0 {
 		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
@@ -235,7 +332,7 @@ func (q *TransactionQuery) StoreIDs(destKey string) {
 		// But in Redis, -1 means unlimited
 		limit = -1
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, nil, limit, q.offset, q.order.kind == descendingOrder)
+	sortArgs := q.collection.spec.sortArgs(idsKey, q.sortByField(), nil, limit, q.offset, q.order.kind == descendingOrder)
 	// Append the STORE argument to cause Redis to store the results in destKey.
 	sortAndStoreArgs := append(sortArgs, "STORE", destKey)
 	q.tx.Command("SORT", sortAndStoreArgs, nil)
@@ -243,3 +340,275 @@ func (q *TransactionQuery) StoreIDs(destKey string) {
 		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
 	}
 }
+
+// Sum will compute the sum of the values of the numeric field identified by
+// fieldName for all models that match the query criteria and set the value of
+// sum. It works very similarly to Query.Sum, so you can check the documentation
+// for Query.Sum for more information. The first error encountered will be saved
+// to the corresponding Transaction (if there is not already an error for the
+// Transaction) and returned when you call Transaction.Exec.
+func (q *TransactionQuery) Sum(fieldName string, sum *float64) {
+	q.aggregate("Sum", sumAggregate, fieldName, sum)
+}
+
+// Avg will compute the average of the values of the numeric field identified
+// by fieldName for all models that match the query criteria and set the value
+// of avg. It works very similarly to Query.Avg, so you can check the
+// documentation for Query.Avg for more information. The first error
+// encountered will be saved to the corresponding Transaction (if there is not
+// already an error for the Transaction) and returned when you call
+// Transaction.Exec.
+func (q *TransactionQuery) Avg(fieldName string, avg *float64) {
+	q.aggregate("Avg", avgAggregate, fieldName, avg)
+}
+
+// Min will find the smallest value of the numeric field identified by
+// fieldName among all models that match the query criteria and set the value
+// of min. It works very similarly to Query.Min, so you can check the
+// documentation for Query.Min for more information. The first error
+// encountered will be saved to the corresponding Transaction (if there is not
+// already an error for the Transaction) and returned when you call
+// Transaction.Exec.
+func (q *TransactionQuery) Min(fieldName string, min *float64) {
+	q.aggregate("Min", minAggregate, fieldName, min)
+}
+
+// Max will find the largest value of the numeric field identified by
+// fieldName among all models that match the query criteria and set the value
+// of max. It works very similarly to Query.Max, so you can check the
+// documentation for Query.Max for more information. The first error
+// encountered will be saved to the corresponding Transaction (if there is not
+// already an error for the Transaction) and returned when you call
+// Transaction.Exec.
+func (q *TransactionQuery) Max(fieldName string, max *float64) {
+	q.aggregate("Max", maxAggregate, fieldName, max)
+}
+
+// aggregate adds a script to the transaction which computes the given kind of
+// aggregate over the field identified by fieldName for all models that match
+// the query criteria. The value of result will be set when the transaction is
+// executed. methodName is used to make error messages more helpful.
+func (q *TransactionQuery) aggregate(methodName string, kind aggregateKind, fieldName string, result *float64) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	fs, err := q.aggregateFieldSpec(methodName, fieldName)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	idsKey, tmpKeys, err := q.generateRangedIDsSet()
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	// Use the scores from the numeric index if there is one. Otherwise the
+	// script will fall back to reading the values from the main hashes.
+	fieldIndexKey := ""
+	if fs.indexKind == numericIndex {
+		fieldIndexKey, err = q.collection.spec.fieldIndexKey(fs.name)
+		if err != nil {
+			q.tx.setError(err)
+			return
+		}
+	}
+	q.tx.aggregateField(idsKey, q.collection.Name(), fs.redisName, fieldIndexKey, kind.String(), NewScanFloat64Handler(result))
+	if len(tmpKeys) > 0 {
+		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+	}
+}
+
+// GroupCount will count the number of models that match the query criteria for
+// each distinct value of the indexed field identified by fieldName and set the
+// value of counts. It works very similarly to Query.GroupCount, so you can
+// check the documentation for Query.GroupCount for more information. The first
+// error encountered will be saved to the corresponding Transaction (if there is
+// not already an error for the Transaction) and returned when you call
+// Transaction.Exec.
+func (q *TransactionQuery) GroupCount(fieldName string, counts *map[interface{}]int) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	fs, err := q.groupFieldSpec("GroupCount", fieldName)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	idsKey, tmpKeys, err := q.generateRangedIDsSet()
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	q.groupCount(idsKey, fs, newScanGroupCountsHandler(fs, counts))
+	if len(tmpKeys) > 0 {
+		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+	}
+}
+
+// Facets will count the number of models that match the query criteria for
+// each distinct value of each of the indexed fields identified by fieldNames
+// and set the value of facets. It works very similarly to Query.Facets, so you
+// can check the documentation for Query.Facets for more information. The first
+// error encountered will be saved to the corresponding Transaction (if there is
+// not already an error for the Transaction) and returned when you call
+// Transaction.Exec.
+func (q *TransactionQuery) Facets(fieldNames []string, facets *map[string]map[interface{}]int) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	fieldSpecs := make([]*fieldSpec, len(fieldNames))
+	for i, fieldName := range fieldNames {
+		fs, err := q.groupFieldSpec("Facets", fieldName)
+		if err != nil {
+			q.tx.setError(err)
+			return
+		}
+		fieldSpecs[i] = fs
+	}
+	// All of the facets share the same set of ids, so we only need to generate
+	// it once.
+	idsKey, tmpKeys, err := q.generateRangedIDsSet()
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	results := make(map[string]map[interface{}]int, len(fieldSpecs))
+	for _, fs := range fieldSpecs {
+		fs := fs
+		counts := map[interface{}]int{}
+		scanCounts := newScanGroupCountsHandler(fs, &counts)
+		q.groupCount(idsKey, fs, func(reply interface{}) error {
+			if err := scanCounts(reply); err != nil {
+				return err
+			}
+			results[fs.name] = counts
+			(*facets) = results
+			return nil
+		})
+	}
+	if len(tmpKeys) > 0 {
+		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+	}
+}
+
+// groupCount adds a script to the transaction which counts the number of ids
+// in idsKey for each distinct value of the indexed field identified by fs.
+func (q *TransactionQuery) groupCount(idsKey string, fs *fieldSpec, handler ReplyHandler) {
+	fieldIndexKey, err := q.collection.spec.fieldIndexKey(fs.name)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	indexKind := "score"
+	switch fs.indexKind {
+	case stringIndex:
+		indexKind = "string"
+	case integerIndex:
+		indexKind = "integer"
+	}
+	nullSetKey := ""
+	if fs.hasNullSet() {
+		nullSetKey = fieldIndexKey + ":null"
+	}
+	q.tx.groupCount(idsKey, fieldIndexKey, indexKind, q.collection.Name(), fs.redisName, nullSetKey, handler)
+}
+
+// generateRangedIDsSet works like generateIDsSet, but also takes the limit and
+// offset of the query into account. If the query has a limit or offset, the
+// ids in the given range are stored in a temporary list and the key of the list
+// is returned instead. The returned key may identify a set, sorted set, or list.
+func (q *TransactionQuery) generateRangedIDsSet() (idsKey string, tmpKeys []interface{}, err error) {
+	idsKey, tmpKeys, err = generateIDsSet(q.query, q.tx)
+	if err != nil {
+		return "", tmpKeys, err
+	}
+	if q.hasLimit() || q.hasOffset() {
+		// Limit and offset depend on the order of the ids, so we use SORT to store
+		// only the ids in the given range in a temporary list.
+		limit := int(q.limit)
+		if limit == 0 {
+			// In our query syntax, a limit of 0 means unlimited
+			// But in Redis, -1 means unlimited
+			limit = -1
+		}
+		destKey := q.tmpKey("range")
+		sortArgs := q.collection.spec.sortArgs(idsKey, q.sortByField(), nil, limit, q.offset, q.order.kind == descendingOrder)
+		q.tx.Command("SORT", append(sortArgs, "STORE", destKey), nil)
+		q.expireTmpKey(q.tx, destKey)
+		tmpKeys = append(tmpKeys, destKey)
+		idsKey = destKey
+	}
+	return idsKey, tmpKeys, nil
+}
+
+// Delete will delete all the models that match the query criteria and set the
+// value of count to the number of models that were deleted. It works very
+// similarly to Query.Delete, so you can check the documentation for
+// Query.Delete for more information. The first error encountered will be saved
+// to the corresponding Transaction (if there is not already an error for the
+// Transaction) and returned when you call Transaction.Exec. You may pass in nil
+// for count if you do not care about the number of models that were deleted.
+func (q *TransactionQuery) Delete(count *int) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	idsKey, tmpKeys, err := q.generateRangedIDsSet()
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	var handler ReplyHandler
+	if count != nil {
+		handler = NewScanIntHandler(count)
+	}
+	q.tx.addDeleteEvents(q.collection, idsKey)
+	q.tx.deleteModelsByIDs(idsKey, q.collection.Name(), q.collection.viewFiltersKey(), q.collection.spec.indexKindArgs(), handler)
+	q.tx.clearCache(q.collection)
+	if len(tmpKeys) > 0 {
+		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+	}
+}
+
+// Update will set the given fields for all the models that match the query
+// criteria and set the value of count to the number of models that were
+// updated. It works very similarly to Query.Update, so you can check the
+// documentation for Query.Update for more information. The first error
+// encountered will be saved to the corresponding Transaction (if there is not
+// already an error for the Transaction) and returned when you call
+// Transaction.Exec. You may pass in nil for count if you do not care about the
+// number of models that were updated.
+func (q *TransactionQuery) Update(values map[string]interface{}, count *int) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	fieldArgs, err := q.updateArgs(values)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	idsKey, tmpKeys, err := q.generateRangedIDsSet()
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	var handler ReplyHandler
+	if count != nil {
+		handler = NewScanIntHandler(count)
+	}
+	q.tx.updateModelsByIDs(idsKey, q.collection.Name(), fieldArgs, handler)
+	q.tx.addUpdateEvents(q.collection, idsKey, fieldArgs)
+	q.tx.clearCache(q.collection)
+	redisNames := []string{}
+	for fieldName := range values {
+		redisNames = append(redisNames, q.collection.spec.fieldsByName[fieldName].redisName)
+	}
+	q.tx.updateViews(q.collection.Name(), q.collection.viewFiltersKey(), "", "update", "key", idsKey, redisNames)
+	if len(tmpKeys) > 0 {
+		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+	}
+}
@@ -1,6 +1,8 @@
 package kvmodel
 
 import (
+	"errors"
+
 	"github.com/garyburd/redigo/redis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -77,3 +79,85 @@ func TestWatchKey(t *testing.T) {
 	require.NoError(t, err)
 	require.Exactly(t, expectedVal, got)
 }
+
+func TestTransactionDetailedErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	models, err := createAndSaveTestModels(1)
+	require.NoError(t, err)
+	modelKey := testModels.ModelKey(models[0].ModelID())
+
+	// By default, errors are returned as is
+	tx := testPool.NewTransaction()
+	tx.Command("SET", redis.Args{"txKey", "1"}, nil)
+	tx.Find(testModels, "invalid", &testModel{})
+	err = tx.Exec()
+	assert.IsType(t, ModelNotFoundError{}, err)
+
+	// With DetailedErrors, the error identifies the action that failed
+	tx = testPool.NewTransactionWithOptions(DefaultTransactionOptions.WithDetailedErrors(true))
+	tx.Command("SET", redis.Args{"txKey", "1"}, nil)
+	tx.Find(testModels, "invalid", &testModel{})
+	err = tx.Exec()
+	require.IsType(t, TransactionError{}, err)
+	txErr := err.(TransactionError)
+	assert.Equal(t, 1, txErr.Index)
+	assert.Equal(t, "EXISTS", txErr.Name)
+	assert.False(t, txErr.IsScript)
+	assert.Equal(t, testModels.Name(), txErr.Collection)
+	notFoundErr := ModelNotFoundError{}
+	assert.True(t, errors.As(err, &notFoundErr))
+
+	// Errors from scripts and error replies
+	tx = testPool.NewTransactionWithOptions(DefaultTransactionOptions.WithDetailedErrors(true))
+	tx.Command("INCR", redis.Args{modelKey}, nil)
+	err = tx.Exec()
+	require.IsType(t, TransactionError{}, err)
+	assert.IsType(t, redis.Error(""), err.(TransactionError).Err)
+	tx = testPool.NewTransactionWithOptions(DefaultTransactionOptions.WithDetailedErrors(true))
+	tx.Command("SET", redis.Args{"txKey", "1"}, nil)
+	// An unknown leaderboard operation is an error
+	tx.leaderboard(redis.Args{"invalid", testModels.Name(), "", "score", "", 0}, nil)
+	err = tx.Exec()
+	require.IsType(t, TransactionError{}, err)
+	txErr = err.(TransactionError)
+	assert.Equal(t, 1, txErr.Index)
+	assert.Equal(t, "leaderboard", txErr.Name)
+	assert.True(t, txErr.IsScript)
+	assert.Equal(t, testModels.Name(), txErr.Collection)
+}
+
+func TestTransactionCollectAllErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	models, err := createAndSaveTestModels(1)
+	require.NoError(t, err)
+	modelKey := testModels.ModelKey(models[0].ModelID())
+
+	tx := testPool.NewTransactionWithOptions(DefaultTransactionOptions.WithCollectAllErrors(true))
+	tx.Find(testModels, "invalid", &testModel{})
+	tx.Command("INCR", redis.Args{modelKey}, nil)
+	found := &testModel{}
+	tx.Find(testModels, models[0].ModelID(), found)
+	value := 0
+	tx.Command("INCR", redis.Args{"txKey"}, NewScanIntHandler(&value))
+	err = tx.Exec()
+	require.IsType(t, TransactionErrors{}, err)
+	txErrs := err.(TransactionErrors)
+	require.Len(t, txErrs, 2)
+	assert.Equal(t, 0, txErrs[0].Index)
+	assert.IsType(t, ModelNotFoundError{}, txErrs[0].Err)
+	assert.Equal(t, 2, txErrs[1].Index)
+	assert.Equal(t, "INCR", txErrs[1].Name)
+	assert.True(t, errors.As(err, &ModelNotFoundError{}))
+	// The handlers after the failed actions should still have been called
+	assert.Equal(t, models[0], found)
+	assert.Equal(t, 1, value)
+
+	// Raw replies are available after Exec
+	replies := tx.Replies()
+	require.Len(t, replies, 6)
+	assert.Equal(t, int64(0), replies[0])
+	assert.IsType(t, redis.Error(""), replies[2])
+	assert.Equal(t, int64(1), replies[5])
+}
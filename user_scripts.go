@@ -0,0 +1,200 @@
+// File user_scripts.go contains code related to user-defined Lua scripts,
+// which applications can register with a pool and run inside transactions.
+
+package kvmodel
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// RegisterScript registers a Lua script with the given name and source code,
+// so that it can be run inside of transactions with Transaction.RunScript.
+// keyCount is the number of arguments which are passed to the script as KEYS
+// (the rest are passed as ARGV). If keyCount is negative, the number of keys
+// must be passed as the first argument each time the script is run.
+//
+// RegisterScript does not send the script to Redis. All the registered
+// scripts are loaded into the script cache with SCRIPT LOAD the first time a
+// transaction or pipeline which runs one of them is executed. You can also call
+// LoadScripts after registering all your scripts (e.g. on startup) to load them
+// ahead of time and detect any errors early. Registered scripts are run with
+// EVALSHA, and any scripts which are missing from the script cache (e.g.
+// because Redis was restarted) are loaded again automatically. RegisterScript
+// returns an error if a script with the same name was already registered.
+func (p *Pool) RegisterScript(name string, keyCount int, src string) error {
+	if name == "" {
+		return fmt.Errorf("zoom: error in RegisterScript: name cannot be empty")
+	}
+	p.scriptsMutex.Lock()
+	defer p.scriptsMutex.Unlock()
+	if _, found := p.scripts[name]; found {
+		return fmt.Errorf("zoom: error in RegisterScript: a script named %s is already registered", name)
+	}
+	if p.scripts == nil {
+		p.scripts = map[string]*redis.Script{}
+	}
+	p.scripts[name] = newScript(name, keyCount, src)
+	return nil
+}
+
+// RegisterScriptsFS registers each of the files in fsys which match pattern
+// (e.g. "scripts/*.lua") as a Lua script. fsys is typically an embed.FS. The
+// name of each script is the base name of the file without the extension,
+// e.g. "scripts/add_points.lua" is named "add_points". See RegisterScript for
+// more information, including the meaning of keyCount, which is the same for
+// all the scripts.
+func (p *Pool) RegisterScriptsFS(fsys fs.FS, pattern string, keyCount int) error {
+	filenames, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return fmt.Errorf("zoom: error in RegisterScriptsFS: %s", err.Error())
+	}
+	for _, filename := range filenames {
+		src, err := fs.ReadFile(fsys, filename)
+		if err != nil {
+			return fmt.Errorf("zoom: error in RegisterScriptsFS: %s", err.Error())
+		}
+		name := strings.TrimSuffix(path.Base(filename), path.Ext(filename))
+		if err := p.RegisterScript(name, keyCount, string(src)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScriptNames returns the names of all the registered scripts in alphabetical
+// order.
+func (p *Pool) ScriptNames() []string {
+	p.scriptsMutex.RLock()
+	defer p.scriptsMutex.RUnlock()
+	names := make([]string, 0, len(p.scripts))
+	for name := range p.scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadScripts loads all the registered scripts into the script cache with
+// SCRIPT LOAD. Registered scripts are loaded automatically the first time they
+// are used, so calling LoadScripts is optional. It is typically called once on
+// startup, after all the scripts have been registered, in order to detect any
+// errors (e.g. syntax errors in the scripts) before they are used.
+func (p *Pool) LoadScripts() error {
+	conn := p.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	return p.loadScripts(conn)
+}
+
+// loadScripts loads all the registered scripts into the script cache using
+// conn.
+func (p *Pool) loadScripts(conn redis.Conn) error {
+	names := p.ScriptNames()
+	for _, name := range names {
+		script, _ := p.getScript(name)
+		if err := script.Load(conn); err != nil {
+			return fmt.Errorf("zoom: error loading script %s: %s", name, err.Error())
+		}
+	}
+	p.scriptsMutex.Lock()
+	defer p.scriptsMutex.Unlock()
+	if len(names) > p.loadedScripts {
+		p.loadedScripts = len(names)
+	}
+	return nil
+}
+
+// allScriptsLoaded returns true if all the registered scripts have been
+// loaded by loadScripts.
+func (p *Pool) allScriptsLoaded() bool {
+	p.scriptsMutex.RLock()
+	defer p.scriptsMutex.RUnlock()
+	return p.loadedScripts == len(p.scripts)
+}
+
+// getScript returns the registered script with the given name and true, or
+// nil and false if there is no such script.
+func (p *Pool) getScript(name string) (*redis.Script, bool) {
+	p.scriptsMutex.RLock()
+	defer p.scriptsMutex.RUnlock()
+	script, found := p.scripts[name]
+	return script, found
+}
+
+// RunScript adds an action to the transaction which runs the registered script
+// with the given name and args. handler will be called with the reply from the
+// script when the transaction is executed. Use one of the NewScanXHandler
+// functions (e.g. NewScanIntHandler or NewScanStringsHandler) to convert the
+// reply to a specific type. If no script with the given name was registered,
+// RunScript adds an error to the transaction.
+func (t *Transaction) RunScript(name string, args redis.Args, handler ReplyHandler) {
+	if t.pool == nil {
+		t.setError(fmt.Errorf("zoom: error in RunScript: transaction was not created with a pool"))
+		return
+	}
+	script, found := t.pool.getScript(name)
+	if !found {
+		t.setError(fmt.Errorf("zoom: error in RunScript: no script named %s is registered", name))
+		return
+	}
+	t.actions = append(t.actions, &Action{
+		kind:    scriptAction,
+		name:    name,
+		script:  script,
+		args:    args,
+		handler: handler,
+		useHash: true,
+	})
+}
+
+// loadMissingScripts checks whether each of the scripts in the transaction
+// which are sent with EVALSHA is in the script cache, and loads any which are
+// missing. If the registered scripts have not been loaded yet, it loads all of
+// them instead. This prevents NOSCRIPT errors, which cannot be retried once the
+// actions have been sent in a MULTI/EXEC transaction.
+//
+// The check is not atomic with the transaction itself. If the script cache is
+// flushed (e.g. with SCRIPT FLUSH or because Redis was restarted) after the
+// check but before EXEC, the scripts in the transaction fail with a NOSCRIPT
+// error reply, and since the other commands in the transaction have already
+// been executed, loadMissingScripts does not retry them. In that case Exec
+// returns the error and it is up to the caller whether to retry.
+func (t *Transaction) loadMissingScripts() error {
+	scripts := []*redis.Script{}
+	args := redis.Args{"EXISTS"}
+	seen := map[*redis.Script]bool{}
+	for _, a := range t.actions {
+		if a.useHash && !seen[a.script] {
+			seen[a.script] = true
+			scripts = append(scripts, a.script)
+			args = append(args, a.script.Hash())
+		}
+	}
+	if len(scripts) == 0 {
+		return nil
+	}
+	if !t.pool.allScriptsLoaded() {
+		// Every script in the transaction was registered before it was added,
+		// so it is loaded by loadScripts.
+		return t.pool.loadScripts(t.conn)
+	}
+	exists, err := redis.Ints(t.conn.Do("SCRIPT", args...))
+	if err != nil {
+		return err
+	}
+	for i, script := range scripts {
+		if exists[i] == 0 {
+			if err := script.Load(t.conn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// File user_scripts_test.go tests user-defined Lua scripts (user_scripts.go)
+
+package kvmodel
+
+import (
+	"embed"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//go:embed testdata/scripts/*.lua
+var testScriptsFS embed.FS
+
+func TestUserScripts(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	pool := NewPoolWithOptions(testPool.options)
+	defer func() {
+		_ = pool.Close()
+	}()
+	require.NoError(t, pool.RegisterScript("concat", 0, "return ARGV[1] .. ARGV[2]"))
+	require.NoError(t, pool.RegisterScriptsFS(testScriptsFS, "testdata/scripts/*.lua", 1))
+	assert.Equal(t, []string{"add_points", "concat", "get_points"}, pool.ScriptNames())
+	require.NoError(t, pool.LoadScripts())
+	conn := pool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	exists, err := redis.Ints(conn.Do("SCRIPT", "EXISTS", redis.NewScript(0, "return ARGV[1] .. ARGV[2]").Hash()))
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, exists)
+
+	// A single script
+	tx := pool.NewTransaction()
+	concatenated := ""
+	tx.RunScript("concat", redis.Args{"foo", "bar"}, NewScanStringHandler(&concatenated))
+	require.NoError(t, tx.Exec())
+	assert.Equal(t, "foobar", concatenated)
+
+	// Scripts should be loaded again if the script cache was flushed, both
+	// inside of a MULTI/EXEC transaction and in a pipeline
+	_, err = conn.Do("SCRIPT", "FLUSH")
+	require.NoError(t, err)
+	tx = pool.NewTransaction()
+	points := int64(0)
+	tx.RunScript("add_points", redis.Args{"points", 5}, nil)
+	tx.Command("INCR", redis.Args{"points"}, nil)
+	tx.RunScript("get_points", redis.Args{"points"}, NewScanInt64Handler(&points))
+	require.NoError(t, tx.Exec())
+	assert.Equal(t, int64(6), points)
+	_, err = conn.Do("SCRIPT", "FLUSH")
+	require.NoError(t, err)
+	p := pool.NewPipeline()
+	p.RunScript("add_points", redis.Args{"points", 4}, NewScanInt64Handler(&points))
+	require.NoError(t, p.Exec())
+	assert.Equal(t, int64(10), points)
+}
+
+func TestUserScriptsLoadedOnFirstUse(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	pool := NewPoolWithOptions(testPool.options)
+	defer func() {
+		_ = pool.Close()
+	}()
+	require.NoError(t, pool.RegisterScriptsFS(testScriptsFS, "testdata/scripts/*.lua", 1))
+	conn := pool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, err := conn.Do("SCRIPT", "FLUSH")
+	require.NoError(t, err)
+
+	// Running one of the scripts without calling LoadScripts should load all of
+	// the registered scripts
+	tx := pool.NewTransaction()
+	tx.RunScript("add_points", redis.Args{"points", 3}, nil)
+	require.NoError(t, tx.Exec())
+	hashes := redis.Args{}
+	for _, name := range pool.ScriptNames() {
+		script, _ := pool.getScript(name)
+		hashes = append(hashes, script.Hash())
+	}
+	exists, err := redis.Ints(conn.Do("SCRIPT", append(redis.Args{"EXISTS"}, hashes...)...))
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 1}, exists)
+
+	// Scripts which are registered later should be loaded too
+	require.NoError(t, pool.RegisterScript("double", 1, "return redis.call('INCRBY', KEYS[1], redis.call('GET', KEYS[1]))"))
+	points := int64(0)
+	tx = pool.NewTransaction()
+	tx.RunScript("double", redis.Args{"points"}, NewScanInt64Handler(&points))
+	require.NoError(t, tx.Exec())
+	assert.Equal(t, int64(6), points)
+}
+
+func TestUserScriptErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	pool := NewPoolWithOptions(testPool.options)
+	defer func() {
+		_ = pool.Close()
+	}()
+	require.NoError(t, pool.RegisterScript("fail", 0, "return redis.error_reply('failed')"))
+	assert.Error(t, pool.RegisterScript("fail", 0, "return 1"), "Expected an error for a duplicate name")
+	assert.Error(t, pool.RegisterScript("", 0, "return 1"), "Expected an error for an empty name")
+
+	tx := pool.NewTransaction()
+	tx.RunScript("invalid", nil, nil)
+	assert.Error(t, tx.Exec(), "Expected an error for a script that was not registered")
+
+	// Errors should identify the script by name
+	tx = pool.NewTransactionWithOptions(DefaultTransactionOptions.WithDetailedErrors(true))
+	tx.Command("SET", redis.Args{"key", "value"}, nil)
+	tx.RunScript("fail", nil, nil)
+	err := tx.Exec()
+	require.IsType(t, TransactionError{}, err)
+	assert.Equal(t, "fail", err.(TransactionError).Name)
+	assert.True(t, err.(TransactionError).IsScript)
+}
@@ -0,0 +1,323 @@
+// File view.go contains code related to views, which are persistent sorted
+// sets of the ids of the models that match some filters.
+
+package kvmodel
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// view represents a view which was defined with Collection.DefineView.
+type view struct {
+	name string
+	key  string
+}
+
+// viewDefinition is the definition of a view in the format expected by the
+// update_views script. It is stored as JSON in the hash identified by
+// Collection.viewFiltersKey.
+type viewDefinition struct {
+	Key     string       `json:"key"`
+	Filters []viewFilter `json:"filters"`
+}
+
+// viewFilter is a single filter of a viewDefinition.
+type viewFilter struct {
+	Field   string   `json:"field"`
+	Op      string   `json:"op"`
+	Kind    string   `json:"kind"`
+	Pointer bool     `json:"pointer"`
+	Values  []string `json:"values"`
+}
+
+// DefineView defines a view with the given name for the collection. A view is
+// a sorted set in Redis which contains the ids of all the models that match
+// the filters of q. It is kept up to date whenever a model is saved or deleted
+// (including with Transaction.Save, Transaction.SaveFields,
+// Transaction.Delete, Query.Update, and Query.Delete), so a query on the view
+// does not need to recompute the intersection of the field indexes for each
+// filter. Use Collection.View to query a view.
+//
+// q must be a query for the collection which consists only of filters
+// (including IsNull and IsNotNull), i.e. it cannot have an order, limit,
+// offset, includes, excludes, or geo search. Since the filters are evaluated
+// by reading the main hash of each model, they may be on unindexed fields.
+// DefineView builds the view from all of the existing models, which may take
+// some time for large collections. If a view with the same name was already
+// defined, it is replaced.
+//
+// The definition of the view (i.e. the query in the format returned by
+// Query.String) is stored in Redis, in a hash whose key is exposed via the
+// ViewDefinitionsKey method. The filters are stored alongside it and are read
+// by the Lua scripts which update the views, so the view is maintained by
+// every process as soon as it is defined, not only by the one which defined
+// it.
+func (c *Collection) DefineView(name string, q *Query) error {
+	if name == "" {
+		return fmt.Errorf("zoom: error in DefineView: name cannot be empty")
+	}
+	if q == nil {
+		return fmt.Errorf("zoom: error in DefineView: query cannot be nil")
+	}
+	if q.hasError() {
+		return q.err
+	}
+	if q.collection != c {
+		return fmt.Errorf("zoom: error in DefineView: query is for collection %s, not %s", q.collection.Name(), c.Name())
+	}
+	if q.hasOrder() || q.hasLimit() || q.hasOffset() || q.hasIncludes() || q.hasExcludes() || q.hasGeoSearch() || q.view != nil {
+		return fmt.Errorf("zoom: error in DefineView: the query for a view can only have filters. Got: %s", q.query)
+	}
+	v := &view{
+		name: name,
+		key:  c.viewKey(name),
+	}
+	definition := viewDefinition{
+		Key:     v.key,
+		Filters: []viewFilter{},
+	}
+	for _, f := range q.filters {
+		definition.Filters = append(definition.Filters, newViewFilter(f))
+	}
+	data, err := json.Marshal(definition)
+	if err != nil {
+		return err
+	}
+	// The definition is saved in the same transaction which builds the view,
+	// so any models which are saved afterwards are also added to the view.
+	t := c.pool.NewTransaction()
+	t.Command("HSET", redis.Args{c.ViewDefinitionsKey(), name, q.String()}, nil)
+	t.Command("HSET", redis.Args{c.viewFiltersKey(), name, data}, nil)
+	t.Command("DEL", redis.Args{v.key}, nil)
+	t.updateViews(c.Name(), c.viewFiltersKey(), name, "update", "key", c.IndexKey(), nil)
+	if err := t.Exec(); err != nil {
+		return err
+	}
+	c.viewsMutex.Lock()
+	if c.views == nil {
+		c.views = map[string]*view{}
+	}
+	c.views[name] = v
+	c.viewsMutex.Unlock()
+	return nil
+}
+
+// DropView removes the view with the given name from the collection and
+// deletes its definition and sorted set. It returns an error if the view was
+// not defined.
+func (c *Collection) DropView(name string) error {
+	c.viewsMutex.Lock()
+	delete(c.views, name)
+	c.viewsMutex.Unlock()
+	var found bool
+	t := c.pool.NewTransaction()
+	t.Command("HDEL", redis.Args{c.ViewDefinitionsKey(), name}, NewScanBoolHandler(&found))
+	t.Command("HDEL", redis.Args{c.viewFiltersKey(), name}, nil)
+	t.Command("DEL", redis.Args{c.viewKey(name)}, nil)
+	if err := t.Exec(); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("zoom: error in DropView: collection %s does not have a view named %s", c.Name(), name)
+	}
+	return nil
+}
+
+// ViewDefinitionsKey returns the key of the hash in Redis which stores the
+// definitions of the views for the collection. The fields of the hash are the
+// names of the views, and the values are the queries for the views in the
+// format returned by Query.String.
+func (c *Collection) ViewDefinitionsKey() string {
+	return c.Name() + ":views"
+}
+
+// viewFiltersKey returns the key of the hash in Redis which stores the filters
+// for each view in the format expected by the update_views script.
+func (c *Collection) viewFiltersKey() string {
+	return c.Name() + ":viewFilters"
+}
+
+// ReloadViews loads the names of the views for the collection from Redis
+// again, replacing the names that were loaded before. Views which are not
+// loaded yet (e.g. because they were defined by other processes) are loaded
+// automatically the first time they are queried, so it is only needed to
+// forget views which were dropped by other processes.
+// Views are always maintained using the definitions stored in Redis, regardless
+// of which views were loaded.
+func (c *Collection) ReloadViews() error {
+	views, err := c.readViews()
+	if err != nil {
+		return err
+	}
+	c.viewsMutex.Lock()
+	c.views = views
+	c.viewsMutex.Unlock()
+	return nil
+}
+
+// readViews reads the names of the views for the collection from Redis.
+func (c *Collection) readViews() (map[string]*view, error) {
+	conn := c.pool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	names, err := redis.Strings(conn.Do("HKEYS", c.ViewDefinitionsKey()))
+	if err != nil {
+		return nil, err
+	}
+	views := map[string]*view{}
+	for _, name := range names {
+		views[name] = &view{
+			name: name,
+			key:  c.viewKey(name),
+		}
+	}
+	return views, nil
+}
+
+// findView returns the view with the given name. If the view was not loaded,
+// the views are loaded from Redis again in case it was defined by another
+// process. It returns an error if the view was not defined.
+func (c *Collection) findView(name string) (*view, error) {
+	if v, found := c.getView(name); found {
+		return v, nil
+	}
+	if err := c.ReloadViews(); err != nil {
+		return nil, err
+	}
+	if v, found := c.getView(name); found {
+		return v, nil
+	}
+	return nil, fmt.Errorf("collection %s does not have a view named %s", c.Name(), name)
+}
+
+// View returns a query which only matches the models in the view with the
+// given name, which must have been defined with DefineView. The query can be
+// chained together with query modifiers (e.g. Filter or Order) and executed
+// with any query finisher, just like a query returned by NewQuery. Without any
+// other filters, the ids are read directly from the view, so counting and
+// paging through the models in a view is fast. Without an order, the models
+// are sorted by id.
+func (c *Collection) View(name string) *Query {
+	q := &Query{
+		query: newQuery(c),
+	}
+	q.setView("View", name)
+	return q
+}
+
+// View is used to construct a query on the view with the given name in the
+// context of an existing Transaction. It works like Collection.View, but
+// returns a TransactionQuery.
+func (tx *Transaction) View(c *Collection, name string) *TransactionQuery {
+	q := tx.Query(c)
+	q.setView("Transaction.View", name)
+	return q
+}
+
+// setView restricts the query to the models in the view with the given name,
+// or adds an error to the query if there is no such view.
+func (q *query) setView(methodName string, name string) {
+	if q.hasError() {
+		return
+	}
+	v, err := q.collection.findView(name)
+	if err != nil {
+		q.setError(fmt.Errorf("zoom: error in %s: %s", methodName, err.Error()))
+		return
+	}
+	q.view = v
+}
+
+// ViewKey returns the key of the sorted set for the view with the given name.
+// It returns an error if the view was not defined.
+func (c *Collection) ViewKey(name string) (string, error) {
+	v, err := c.findView(name)
+	if err != nil {
+		return "", fmt.Errorf("zoom: %s", err.Error())
+	}
+	return v.key, nil
+}
+
+// viewKey returns the key of the sorted set for a view with the given name.
+func (c *Collection) viewKey(name string) string {
+	return c.Name() + ":views:" + name
+}
+
+// getView returns the view with the given name and true, or nil and false if
+// the view was not defined.
+func (c *Collection) getView(name string) (*view, bool) {
+	c.viewsMutex.RLock()
+	defer c.viewsMutex.RUnlock()
+	v, found := c.views[name]
+	return v, found
+}
+
+// updateViewsForModel adds a command to the transaction which adds the model
+// with the given id to or removes it from each view which depends on any of
+// the given fields. It must be called after the main hash has been saved.
+func (t *Transaction) updateViewsForModel(c *Collection, fieldNames []string, id string) {
+	redisNames, err := c.spec.redisNamesForFieldNames(fieldNames)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	t.updateViews(c.Name(), c.viewFiltersKey(), "", "update", "id", id, redisNames)
+}
+
+// newViewFilter converts f into the format expected by the update_views
+// script.
+func newViewFilter(f filter) viewFilter {
+	values := []reflect.Value{}
+	switch f.op {
+	case isNullOp, isNotNullOp:
+		// There is no value to compare against
+	case inOp:
+		for i := 0; i < f.value.Len(); i++ {
+			values = append(values, reflect.Indirect(f.value.Index(i)))
+		}
+	default:
+		values = append(values, reflect.Indirect(f.value))
+	}
+	typ := f.fieldSpec.typ
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	kind := "string"
+	switch {
+	case typ.Kind() == reflect.Bool:
+		kind = "number"
+	case typeIsLargeInteger(typ):
+		kind = "integer"
+	case typeIsNumeric(typ):
+		kind = "number"
+	}
+	vf := viewFilter{
+		Field:   f.fieldSpec.redisName,
+		Op:      f.op.String(),
+		Kind:    kind,
+		Pointer: f.fieldSpec.kind == pointerField,
+		Values:  []string{},
+	}
+	for _, value := range values {
+		switch kind {
+		case "integer":
+			vf.Values = append(vf.Values, encodeInteger(value))
+		case "number":
+			if value.Kind() == reflect.Bool {
+				// Booleans are stored as 1 or 0
+				vf.Values = append(vf.Values, strconv.Itoa(convertBoolToInt(value.Bool())))
+			} else {
+				vf.Values = append(vf.Values, strconv.FormatFloat(numericScore(value), 'g', -1, 64))
+			}
+		default:
+			vf.Values = append(vf.Values, stringValue(value))
+		}
+	}
+	return vf
+}
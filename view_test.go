@@ -0,0 +1,304 @@
+// File view_test.go tests views (view.go)
+
+package kvmodel
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expectViewMatches checks that the sorted set for the view with the given
+// name contains exactly the ids returned by q.
+func expectViewMatches(t *testing.T, c *Collection, name string, q *Query) {
+	expected, err := q.IDs()
+	require.NoError(t, err)
+	viewKey, err := c.ViewKey(name)
+	require.NoError(t, err)
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	got, err := redis.Strings(conn.Do("ZRANGE", viewKey, 0, -1))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expected, got, "View %s does not match query %s", name, q)
+}
+
+func TestDefineView(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	_, err := createAndSaveIndexedTestModels(20)
+	require.NoError(t, err)
+	viewQuery := indexedTestModels.NewQuery().Filter("Int >", 30).Filter("Bool =", true)
+	require.NoError(t, indexedTestModels.DefineView("big", viewQuery))
+	defer func() {
+		require.NoError(t, indexedTestModels.DropView("big"))
+	}()
+	expectViewMatches(t, indexedTestModels, "big", viewQuery)
+
+	// Queries on the view should return the same results as the equivalent
+	// queries without the view.
+	testCases := []struct {
+		view     *Query
+		expected *Query
+	}{
+		{
+			view:     indexedTestModels.View("big"),
+			expected: indexedTestModels.NewQuery().Filter("Int >", 30).Filter("Bool =", true),
+		},
+		{
+			view:     indexedTestModels.View("big").Order("-Int").Offset(1).Limit(3),
+			expected: indexedTestModels.NewQuery().Filter("Int >", 30).Filter("Bool =", true).Order("-Int").Offset(1).Limit(3),
+		},
+		{
+			view:     indexedTestModels.View("big").Filter("String >", "m").Order("String"),
+			expected: indexedTestModels.NewQuery().Filter("Int >", 30).Filter("Bool =", true).Filter("String >", "m").Order("String"),
+		},
+	}
+	for _, tc := range testCases {
+		expected := []*indexedTestModel{}
+		require.NoError(t, tc.expected.Run(&expected))
+		got := []*indexedTestModel{}
+		require.NoError(t, tc.view.Run(&got))
+		if tc.view.hasOrder() {
+			assert.Equal(t, expected, got, "Wrong results for query %s", tc.view)
+		} else {
+			assert.ElementsMatch(t, expected, got, "Wrong results for query %s", tc.view)
+		}
+		expectedCount, err := tc.expected.Count()
+		require.NoError(t, err)
+		gotCount, err := tc.view.Count()
+		require.NoError(t, err)
+		assert.Equal(t, expectedCount, gotCount, "Wrong count for query %s", tc.view)
+		expectSameResults(t, tc.view, tc.view.hasOrder())
+		checkForLeakedTmpKeys(t, tc.view.query)
+	}
+
+	// Without any other modifiers, the ids should be read directly from the
+	// view.
+	steps, err := indexedTestModels.View("big").Explain()
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	assert.Equal(t, "SORT", steps[0].Name)
+}
+
+func TestViewMaintenance(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*indexedPointersModel{}
+	for i := 0; i < 6; i++ {
+		model := createIndexedPointersModel()
+		if i%2 == 0 {
+			model.String = nil
+		}
+		models = append(models, model)
+	}
+	require.NoError(t, indexedPointersModels.Save(models[0]))
+	// Define the views before saving the rest of the models, so that both
+	// building and maintaining the views are tested.
+	viewQueries := map[string]*Query{
+		"nullString": indexedPointersModels.NewQuery().IsNull("String"),
+		"smallInt":   indexedPointersModels.NewQuery().IsNotNull("Int").Filter("Int <", 0),
+		"someUint8":  indexedPointersModels.NewQuery().Filter("Uint8 in", []uint8{1, 2, 3}),
+		"bigInt64":   indexedPointersModels.NewQuery().Filter("Int64 >=", int64(1<<60)),
+	}
+	for name, q := range viewQueries {
+		require.NoError(t, indexedPointersModels.DefineView(name, q))
+		defer func(name string) {
+			require.NoError(t, indexedPointersModels.DropView(name))
+		}(name)
+	}
+	expectViews := func() {
+		for name, q := range viewQueries {
+			expectViewMatches(t, indexedPointersModels, name, q)
+		}
+	}
+	expectViews()
+	tx := testPool.NewTransaction()
+	for _, model := range models[1:] {
+		tx.Save(indexedPointersModels, model)
+	}
+	require.NoError(t, tx.Exec())
+	expectViews()
+
+	// Save
+	negative := -1
+	models[1].Int = &negative
+	models[1].String = nil
+	big := int64(1<<60) + 1
+	models[2].Int64 = &big
+	require.NoError(t, indexedPointersModels.Save(models[1]))
+	require.NoError(t, indexedPointersModels.Save(models[2]))
+	expectViews()
+
+	// SaveFields
+	two := uint8(2)
+	models[3].Uint8 = &two
+	models[4].Int = &negative
+	require.NoError(t, indexedPointersModels.SaveFields([]string{"Uint8"}, models[3]))
+	require.NoError(t, indexedPointersModels.SaveFields([]string{"Int"}, models[4]))
+	expectViews()
+
+	// Delete
+	_, err := indexedPointersModels.Delete(models[1].ModelID())
+	require.NoError(t, err)
+	expectViews()
+
+	// Query.Update
+	_, err = indexedPointersModels.NewQuery().IsNull("String").Update(map[string]interface{}{
+		"Int":   &negative,
+		"Int64": &big,
+	})
+	require.NoError(t, err)
+	expectViews()
+
+	// Query.Delete, including a query on a view
+	_, err = indexedPointersModels.NewQuery().Filter("Int64 =", big).Limit(1).Delete()
+	require.NoError(t, err)
+	expectViews()
+	_, err = indexedPointersModels.View("smallInt").Delete()
+	require.NoError(t, err)
+	expectViews()
+	count, err := indexedPointersModels.View("smallInt").Count()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// DeleteAll
+	_, err = indexedPointersModels.DeleteAll()
+	require.NoError(t, err)
+	expectViews()
+}
+
+func TestViewUnindexedFields(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveTestModels(10)
+	require.NoError(t, err)
+	// Views on unindexed fields do not require AllowScan
+	require.NoError(t, testModels.DefineView("positive", testModels.NewQuery().Filter("Int >", 0)))
+	defer func() {
+		require.NoError(t, testModels.DropView("positive"))
+	}()
+	expectViewMatches(t, testModels, "positive", testModels.NewQuery().Filter("Int >", 0).AllowScan())
+	models[0].Int = -models[0].Int
+	require.NoError(t, testModels.Save(models[0]))
+	expectViewMatches(t, testModels, "positive", testModels.NewQuery().Filter("Int >", 0).AllowScan())
+}
+
+func TestViewErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	invalidQueries := []*Query{
+		nil,
+		indexedTestModels.NewQuery().Order("Int"),
+		indexedTestModels.NewQuery().Limit(1),
+		indexedTestModels.NewQuery().Include("Int"),
+		testModels.NewQuery().Filter("Int >", 0),
+	}
+	for _, q := range invalidQueries {
+		assert.Error(t, indexedTestModels.DefineView("invalid", q), "Expected an error for query %s", q)
+	}
+	_, err := indexedTestModels.View("invalid").IDs()
+	assert.Error(t, err)
+	assert.Error(t, indexedTestModels.DropView("invalid"))
+}
+
+// newOtherProcessCollection returns a collection of the given model type which
+// belongs to a new pool, as if it was created by another process. The new
+// pool is closed when the test finishes.
+func newOtherProcessCollection(t *testing.T, model Model, options CollectionOptions) *Collection {
+	pool := NewPoolWithOptions(testPool.options)
+	t.Cleanup(func() {
+		_ = pool.Close()
+	})
+	collection, err := pool.NewCollectionWithOptions(model, options)
+	require.NoError(t, err)
+	return collection
+}
+
+func TestViewDefinitionsArePersisted(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	require.NoError(t, err)
+	viewQuery := indexedTestModels.NewQuery().Filter("Int >", 30).Filter("String !=", "a b")
+	require.NoError(t, indexedTestModels.DefineView("big", viewQuery))
+	defer func() {
+		require.NoError(t, indexedTestModels.DropView("big"))
+	}()
+
+	// Another process which never called DefineView should still maintain the
+	// view and be able to query it
+	other := newOtherProcessCollection(t, &indexedTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	models[0].Int = 100
+	require.NoError(t, other.Save(models[0]))
+	models[1].Int = 0
+	require.NoError(t, other.SaveFields([]string{"Int"}, models[1]))
+	_, err = other.Delete(models[2].ID)
+	require.NoError(t, err)
+	expectViewMatches(t, indexedTestModels, "big", viewQuery)
+	ids, err := other.View("big").IDs()
+	require.NoError(t, err)
+	expected, err := viewQuery.IDs()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expected, ids)
+
+	// Views which are dropped by another process are removed by ReloadViews
+	require.NoError(t, other.DropView("big"))
+	require.NoError(t, indexedTestModels.ReloadViews())
+	_, err = indexedTestModels.ViewKey("big")
+	assert.Error(t, err)
+	require.NoError(t, indexedTestModels.DefineView("big", viewQuery))
+}
+
+func TestViewDefinedAfterOtherProcessSaved(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	require.NoError(t, err)
+	// The other process saves and queries before the view is defined, so it
+	// has already seen the views which existed at that time
+	other := newOtherProcessCollection(t, &indexedTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	require.NoError(t, other.Save(models[0]))
+	_, err = other.View("big").IDs()
+	assert.Error(t, err)
+
+	viewQuery := indexedTestModels.NewQuery().Filter("Int >", 30)
+	require.NoError(t, indexedTestModels.DefineView("big", viewQuery))
+	defer func() {
+		require.NoError(t, indexedTestModels.DropView("big"))
+	}()
+
+	// The view should be maintained by the other process without calling
+	// ReloadViews
+	models[0].Int = 100
+	models[1].Int = 0
+	require.NoError(t, other.SaveMany(models[:2]))
+	models[2].Int = 0
+	require.NoError(t, other.SaveFields([]string{"Int"}, models[2]))
+	_, err = other.NewQuery().Filter("Int =", models[3].Int).Update(map[string]interface{}{"Int": 200})
+	require.NoError(t, err)
+	_, err = other.NewQuery().Filter("Int =", models[4].Int).Delete()
+	require.NoError(t, err)
+	_, err = other.Delete(models[5].ID)
+	require.NoError(t, err)
+	expectViewMatches(t, indexedTestModels, "big", viewQuery)
+	ids, err := other.View("big").IDs()
+	require.NoError(t, err)
+	expected, err := viewQuery.IDs()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expected, ids)
+
+	// Deleting all the models should empty the view
+	_, err = other.DeleteAll()
+	require.NoError(t, err)
+	expectViewMatches(t, indexedTestModels, "big", viewQuery)
+}
@@ -0,0 +1,108 @@
+// File within_test.go tests restricting queries to the ids in a set with
+// Within and Excluding (internal_query.go)
+
+package kvmodel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithinAndExcluding(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	require.NoError(t, err)
+	conn := testPool.NewConn()
+	defer func() {
+		_ = conn.Close()
+	}()
+	// favorites is a set which includes an id that does not correspond to any
+	// model, and hidden is a sorted set.
+	favorites := []*indexedTestModel{models[0], models[2], models[4], models[6], models[8]}
+	favoritesArgs := []interface{}{"favorites", "missing"}
+	for _, model := range favorites {
+		favoritesArgs = append(favoritesArgs, model.ModelID())
+	}
+	_, err = conn.Do("SADD", favoritesArgs...)
+	require.NoError(t, err)
+	_, err = conn.Do("ZADD", "hidden", 1, models[2].ModelID(), 2, models[3].ModelID())
+	require.NoError(t, err)
+	defer func() {
+		_, _ = conn.Do("DEL", "favorites", "hidden")
+	}()
+
+	// contains returns true iff model is in models
+	contains := func(models []*indexedTestModel, model *indexedTestModel) bool {
+		for _, m := range models {
+			if m == model {
+				return true
+			}
+		}
+		return false
+	}
+	visibleFavorites := []*indexedTestModel{}
+	for _, model := range favorites {
+		if model != models[2] {
+			visibleFavorites = append(visibleFavorites, model)
+		}
+	}
+	testCases := []struct {
+		query    *Query
+		expected []*indexedTestModel
+	}{
+		{
+			query:    indexedTestModels.NewQuery().Within("favorites"),
+			expected: favorites,
+		},
+		{
+			query:    indexedTestModels.NewQuery().Within("favorites").Excluding("hidden"),
+			expected: visibleFavorites,
+		},
+		{
+			query:    indexedTestModels.NewQuery().Excluding("hidden").Excluding("favorites"),
+			expected: []*indexedTestModel{models[1], models[5], models[7], models[9]},
+		},
+		{
+			query:    indexedTestModels.NewQuery().Within("favorites").Within("hidden"),
+			expected: []*indexedTestModel{models[2]},
+		},
+		{
+			query:    indexedTestModels.NewQuery().Within("favorites").Within("empty"),
+			expected: []*indexedTestModel{},
+		},
+	}
+	for _, tc := range testCases {
+		got := []*indexedTestModel{}
+		require.NoError(t, tc.query.Run(&got))
+		assert.ElementsMatch(t, tc.expected, got, "Wrong results for query %s", tc.query)
+		count, err := tc.query.Count()
+		require.NoError(t, err)
+		assert.Equal(t, len(tc.expected), count, "Wrong count for query %s", tc.query)
+		expectSameResults(t, tc.query, false)
+		checkForLeakedTmpKeys(t, tc.query.query)
+	}
+
+	// Within and Excluding should be combinable with filters, order, limit, and
+	// includes.
+	q := indexedTestModels.NewQuery().Within("favorites").Excluding("hidden").Filter("Int >", 0).Order("-Int").Limit(2).Include("Int")
+	expected := []*indexedTestModel{}
+	for _, model := range expectedResultsForQuery(indexedTestModels.NewQuery().Filter("Int >", 0).Order("-Int").query, models) {
+		if contains(visibleFavorites, model) && len(expected) < 2 {
+			expected = append(expected, model)
+		}
+	}
+	got := []*indexedTestModel{}
+	require.NoError(t, q.Run(&got))
+	assert.Equal(t, applyIncludes(expected, []string{"Int"}), got)
+	expectSameResults(t, q, true)
+	checkForLeakedTmpKeys(t, q.query)
+
+	_, err = indexedTestModels.NewQuery().Within("").IDs()
+	assert.Error(t, err)
+	_, err = indexedTestModels.NewQuery().Excluding("").IDs()
+	assert.Error(t, err)
+}